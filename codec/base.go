@@ -1,6 +1,8 @@
 package codec
 
 import (
+	"github.com/NubeIO/nubeio-rubix-lib-models-go/model"
+
 	"encoding/hex"
 	"errors"
 	"strconv"
@@ -73,3 +75,26 @@ func DecodeSNR(data string) (float32, error) {
 	}
 	return f, nil
 }
+
+// MergeMetaTags sets values on the device's meta tags, updating existing keys
+// in place, and returns the full list.
+func MergeMetaTags(device *model.Device, values map[string]string) []*model.DeviceMetaTag {
+	for key, value := range values {
+		found := false
+		for _, metaTag := range device.MetaTags {
+			if metaTag.Key == key {
+				metaTag.Value = value
+				found = true
+				break
+			}
+		}
+		if !found {
+			device.MetaTags = append(device.MetaTags, &model.DeviceMetaTag{
+				DeviceUUID: device.UUID,
+				Key:        key,
+				Value:      value,
+			})
+		}
+	}
+	return device.MetaTags
+}
@@ -1,6 +1,7 @@
 package codec
 
 import (
+	"github.com/NubeIO/nubeio-rubix-lib-models-go/datatype"
 	"github.com/NubeIO/nubeio-rubix-lib-models-go/model"
 
 	"errors"
@@ -34,6 +35,22 @@ type DecodeResponseFunc func(
 ) error
 type EncodeRequestMessageFunc func(points []*model.Point) ([]byte, error)
 
+// PointConfig overrides the defaults of a point auto-created for a model.
+// Empty fields keep the module defaults. Unit is the display unit symbol
+// (e.g. "°C") and StateClass the Home Assistant state class (measurement,
+// total or total_increasing) for integrations; neither is stored on the
+// point.
+type PointConfig struct {
+	Name                string
+	Unit                string
+	StateClass          string
+	WriteMode           datatype.WriteMode
+	HistoryEnable       *bool
+	HistoryType         datatype.HistoryType
+	HistoryInterval     *int
+	HistoryCOVThreshold *float64
+}
+
 type LoRaDeviceDescription struct {
 	DeviceName           string
 	Model                string
@@ -52,6 +69,8 @@ type LoRaDeviceDescription struct {
 	// for models with genuine unencrypted deployments (e.g. ZipHydroTap), whose
 	// decoders apply their own strict structured length validation.
 	AllowUnencrypted bool
+	// GetPointConfig is optional; it returns nil for points without overrides.
+	GetPointConfig func(name string) *PointConfig
 }
 
 var NilLoRaDeviceDescription = LoRaDeviceDescription{
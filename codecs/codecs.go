@@ -1,6 +1,9 @@
 package codecs
 
 import (
+	"fmt"
+	"strings"
+
 	"github.com/NubeIO/module-core-loraraw/codec"
 	"github.com/NubeIO/module-core-loraraw/codecs/legacyDecoders"
 	"github.com/NubeIO/module-core-loraraw/codecs/rubixDataEncoding"
@@ -115,3 +118,42 @@ var LoRaDeviceDescriptions = []codec.LoRaDeviceDescription{
 		IsLoRaRAW:            true,
 	},
 }
+
+// builtInCount is the number of compiled-in models. Models loaded from codec
+// files are appended after them.
+var builtInCount = len(LoRaDeviceDescriptions)
+
+// SetFileDeviceDescriptions replaces the models loaded from codec files. A
+// model whose name is already taken (by a built-in or an earlier file) is
+// rejected.
+func SetFileDeviceDescriptions(descs []codec.LoRaDeviceDescription) []error {
+	all := LoRaDeviceDescriptions[:builtInCount:builtInCount]
+	var errs []error
+	for _, desc := range descs {
+		if modelExists(all, desc.Model) {
+			errs = append(errs, fmt.Errorf("model %s already exists", desc.Model))
+			continue
+		}
+		all = append(all, desc)
+	}
+	LoRaDeviceDescriptions = all
+	return errs
+}
+
+// FileModels returns the models loaded from codec files.
+func FileModels() []string {
+	var models []string
+	for _, desc := range LoRaDeviceDescriptions[builtInCount:] {
+		models = append(models, desc.Model)
+	}
+	return models
+}
+
+func modelExists(descs []codec.LoRaDeviceDescription, model string) bool {
+	for _, desc := range descs {
+		if strings.EqualFold(desc.Model, model) {
+			return true
+		}
+	}
+	return false
+}
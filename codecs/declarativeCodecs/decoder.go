@@ -0,0 +1,143 @@
+package declarativeCodecs
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/NubeIO/lib-utils-go/boolean"
+	"github.com/NubeIO/lib-utils-go/float"
+	"github.com/NubeIO/lib-utils-go/integer"
+	"github.com/NubeIO/module-core-loraraw/codec"
+	"github.com/NubeIO/nubeio-rubix-lib-models-go/datatype"
+	"github.com/NubeIO/nubeio-rubix-lib-models-go/model"
+)
+
+const (
+	legacyAddressLen = 4
+	legacyTrailerLen = 2 // rssi, snr
+)
+
+// DeviceDescription builds the codec of a definition.
+func (d *Definition) DeviceDescription() codec.LoRaDeviceDescription {
+	name := d.Name
+	if name == "" {
+		name = d.Model
+	}
+	desc := codec.LoRaDeviceDescription{
+		DeviceName:       name,
+		Model:            d.Model,
+		CheckLength:      d.checkLength,
+		DecodeUplink:     d.decodeUplink,
+		GetPointNames:    d.pointNames,
+		GetPointConfig:   d.pointConfig,
+		IsLoRaRAW:        d.LoRaRAW,
+		AllowUnencrypted: d.AllowUnencrypted,
+	}
+	if d.script != nil {
+		desc.DecodeUplink = d.decodeScriptUplink
+		if d.LoRaRAW {
+			desc.DecodeResponse = d.decodeScriptResponse
+			if d.script.canEncode {
+				desc.EncodeRequestMessage = d.encodeScriptRequest
+			}
+		}
+	}
+	return desc
+}
+
+// checkLength is only called for legacy frames, with the whole frame as hex.
+func (d *Definition) checkLength(data string) bool {
+	return d.acceptsLength(len(data)/2 - legacyAddressLen - legacyTrailerLen)
+}
+
+func (d *Definition) payload(payloadBytes []byte) []byte {
+	if d.LoRaRAW {
+		return payloadBytes
+	}
+	if len(payloadBytes) < legacyAddressLen+legacyTrailerLen {
+		return nil
+	}
+	return payloadBytes[legacyAddressLen : len(payloadBytes)-legacyTrailerLen]
+}
+
+func (d *Definition) decodeUplink(
+	_ string,
+	payloadBytes []byte,
+	devDesc *codec.LoRaDeviceDescription,
+	device *model.Device,
+	updatePointFn codec.UpdateDevicePointFunc,
+	_ codec.UpdateDevicePointErrorFunc,
+	_ codec.UpdateDeviceMetaTagsFunc,
+) error {
+	payload := d.payload(payloadBytes)
+	if !d.acceptsLength(len(payload)) {
+		return fmt.Errorf("%s: payload length %d not accepted", d.Model, len(payload))
+	}
+	for _, f := range d.Fields {
+		_ = updatePointFn(f.Name, f.decode(payload), device, devDesc)
+	}
+	return nil
+}
+
+func (f *Field) decode(payload []byte) float64 {
+	b := payload[f.Offset : f.Offset+f.Width]
+	var raw uint64
+	if f.Endian == EndianLittle {
+		for i := len(b) - 1; i >= 0; i-- {
+			raw = raw<<8 | uint64(b[i])
+		}
+	} else {
+		for _, v := range b {
+			raw = raw<<8 | uint64(v)
+		}
+	}
+
+	var value float64
+	switch {
+	case f.Float && f.Width == 4:
+		value = float64(math.Float32frombits(uint32(raw)))
+	case f.Float:
+		value = math.Float64frombits(raw)
+	case f.Signed:
+		shift := uint(64 - 8*f.Width)
+		value = float64(int64(raw<<shift) >> shift)
+	default:
+		value = float64(raw)
+	}
+	if f.Scale != nil {
+		value *= *f.Scale
+	}
+	return value + f.Add
+}
+
+func (d *Definition) pointNames() []string {
+	names := codec.GetCommonValueNames()
+	for _, p := range d.points() {
+		names = append(names, p.Name)
+	}
+	return names
+}
+
+func (d *Definition) pointConfig(name string) *codec.PointConfig {
+	for _, p := range d.points() {
+		if p.Name != name {
+			continue
+		}
+		config := &codec.PointConfig{Name: p.Title, Unit: p.Unit, StateClass: p.StateClass}
+		if p.Writable {
+			config.WriteMode = datatype.WriteAlways
+		}
+		if p.History != nil {
+			config.HistoryEnable = boolean.New(p.History.Enable)
+			config.HistoryType, _ = historyType(p.History.Type)
+			if p.History.Interval > 0 {
+				config.HistoryInterval = integer.New(p.History.Interval)
+			}
+			if p.History.COVThreshold > 0 {
+				config.HistoryCOVThreshold = float.New(p.History.COVThreshold)
+			}
+		}
+		return config
+	}
+	return nil
+}
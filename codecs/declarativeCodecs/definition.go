@@ -0,0 +1,218 @@
+package declarativeCodecs
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/NubeIO/module-core-loraraw/codec"
+	"github.com/NubeIO/nubeio-rubix-lib-models-go/datatype"
+	"github.com/go-yaml/yaml"
+)
+
+const (
+	EndianBig    = "big"
+	EndianLittle = "little"
+)
+
+// Definition is one device model described in a codec file. JSON files use
+// the same keys as YAML ones.
+type Definition struct {
+	Model string `yaml:"model"`
+	Name  string `yaml:"name"`
+	// LoRaRAW frames are decrypted and stripped to their inner payload before
+	// decoding; otherwise the frame is a legacy one: address, payload, rssi, snr.
+	LoRaRAW          bool `yaml:"lora_raw"`
+	AllowUnencrypted bool `yaml:"allow_unencrypted"`
+	// Lengths are the accepted payload lengths in bytes. Empty accepts any
+	// payload long enough for every field.
+	Lengths []int   `yaml:"lengths"`
+	Fields  []Field `yaml:"fields"`
+
+	// Script is a JavaScript payload formatter, relative to the codec file,
+	// used instead of fields. Points lists the points it produces. FPort is
+	// the fPort passed to the script (default 1); LoRaRAW has none.
+	Script string  `yaml:"script"`
+	FPort  int     `yaml:"f_port"`
+	Points []Point `yaml:"points"`
+
+	script *script
+}
+
+// Point is the config of a point created for the model.
+type Point struct {
+	Name       string   `yaml:"name"`
+	Title      string   `yaml:"title"`
+	Unit       string   `yaml:"unit"`
+	StateClass string   `yaml:"state_class"`
+	Writable   bool     `yaml:"writable"`
+	History    *History `yaml:"history"`
+}
+
+// Field is one value read out of the payload. Offset counts from the first
+// payload byte: after the address for legacy frames, after the LoRaRAW header
+// for LoRaRAW ones. The decoded value is raw * scale + add.
+type Field struct {
+	Point  `yaml:",inline"`
+	Offset int      `yaml:"offset"`
+	Width  int      `yaml:"width"`
+	Endian string   `yaml:"endian"`
+	Signed bool     `yaml:"signed"`
+	Float  bool     `yaml:"float"`
+	Scale  *float64 `yaml:"scale"`
+	Add    float64  `yaml:"add"`
+}
+
+// History is the history default of the point created for a field.
+type History struct {
+	Enable       bool    `yaml:"enable"`
+	Type         string  `yaml:"type"`
+	Interval     int     `yaml:"interval"`
+	COVThreshold float64 `yaml:"cov_threshold"`
+}
+
+// Parse reads and validates one codec definition.
+func Parse(data []byte) (*Definition, error) {
+	def := &Definition{}
+	if err := yaml.UnmarshalStrict(data, def); err != nil {
+		return nil, err
+	}
+	if err := def.Validate(); err != nil {
+		return nil, err
+	}
+	return def, nil
+}
+
+func (d *Definition) Validate() error {
+	if strings.TrimSpace(d.Model) == "" {
+		return errors.New("model is required")
+	}
+	if d.Script != "" {
+		if len(d.Fields) > 0 {
+			return fmt.Errorf("model %s: fields cannot be used with a script", d.Model)
+		}
+		if d.FPort < 0 || d.FPort > 255 {
+			return fmt.Errorf("model %s: f_port must be 1 to 255", d.Model)
+		}
+	} else {
+		if len(d.Fields) == 0 {
+			return fmt.Errorf("model %s: at least one field or a script is required", d.Model)
+		}
+		if len(d.Points) > 0 {
+			return fmt.Errorf("model %s: points are only used with a script", d.Model)
+		}
+	}
+	names := make(map[string]struct{}, len(d.Fields))
+	for _, p := range d.points() {
+		if _, ok := names[p.Name]; ok {
+			return fmt.Errorf("model %s: duplicate point %s", d.Model, p.Name)
+		}
+		names[p.Name] = struct{}{}
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("model %s: %v", d.Model, err)
+		}
+		if p.Writable && (d.Script == "" || !d.LoRaRAW) {
+			return fmt.Errorf("model %s: point %s: only LoRaRAW script codecs can write", d.Model, p.Name)
+		}
+	}
+	for _, f := range d.Fields {
+		if err := f.validate(); err != nil {
+			return fmt.Errorf("model %s: %v", d.Model, err)
+		}
+	}
+	minLength := d.minLength()
+	for _, l := range d.Lengths {
+		if l < minLength {
+			return fmt.Errorf("model %s: length %d is shorter than the fields (%d bytes)", d.Model, l, minLength)
+		}
+	}
+	return nil
+}
+
+func (p *Point) validate() error {
+	if p.Name == "" {
+		return errors.New("point name is required")
+	}
+	if p.Name == codec.RssiField || p.Name == codec.SnrField {
+		return fmt.Errorf("point %s: name is reserved", p.Name)
+	}
+	switch p.StateClass {
+	case "", "measurement", "total", "total_increasing":
+	default:
+		return fmt.Errorf("point %s: invalid state_class %q", p.Name, p.StateClass)
+	}
+	if p.History != nil {
+		if _, err := historyType(p.History.Type); err != nil {
+			return fmt.Errorf("point %s: %v", p.Name, err)
+		}
+		if p.History.Interval < 0 {
+			return fmt.Errorf("point %s: history interval must not be negative", p.Name)
+		}
+	}
+	return nil
+}
+
+// points returns the points of the model, from its fields or its point list.
+func (d *Definition) points() []Point {
+	if d.Script != "" {
+		return d.Points
+	}
+	points := make([]Point, 0, len(d.Fields))
+	for _, f := range d.Fields {
+		points = append(points, f.Point)
+	}
+	return points
+}
+
+func (f *Field) validate() error {
+	if f.Offset < 0 {
+		return fmt.Errorf("field %s: offset must not be negative", f.Name)
+	}
+	if f.Float {
+		if f.Width != 4 && f.Width != 8 {
+			return fmt.Errorf("field %s: float width must be 4 or 8", f.Name)
+		}
+	} else if f.Width < 1 || f.Width > 8 {
+		return fmt.Errorf("field %s: width must be 1 to 8 bytes", f.Name)
+	}
+	if f.Endian != "" && f.Endian != EndianBig && f.Endian != EndianLittle {
+		return fmt.Errorf("field %s: endian must be %s or %s", f.Name, EndianBig, EndianLittle)
+	}
+	return nil
+}
+
+// historyType maps cov, interval and cov_and_interval (any case) to the
+// point history type. Empty is interval.
+func historyType(t string) (datatype.HistoryType, error) {
+	if t == "" {
+		return datatype.HistoryTypeInterval, nil
+	}
+	ht := datatype.HistoryType(strings.ToUpper(t))
+	if _, ok := datatype.HistoryTypeMap[ht]; !ok {
+		return "", fmt.Errorf("unknown history type %s", t)
+	}
+	return ht, nil
+}
+
+// minLength is the payload length needed to read every field.
+func (d *Definition) minLength() int {
+	minLength := 0
+	for _, f := range d.Fields {
+		if end := f.Offset + f.Width; end > minLength {
+			minLength = end
+		}
+	}
+	return minLength
+}
+
+func (d *Definition) acceptsLength(l int) bool {
+	if len(d.Lengths) == 0 {
+		return l >= d.minLength()
+	}
+	for _, accepted := range d.Lengths {
+		if l == accepted {
+			return true
+		}
+	}
+	return false
+}
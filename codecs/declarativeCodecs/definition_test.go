@@ -0,0 +1,213 @@
+package declarativeCodecs
+
+import (
+	"encoding/hex"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/NubeIO/module-core-loraraw/codec"
+	"github.com/NubeIO/module-core-loraraw/codecs"
+	"github.com/NubeIO/nubeio-rubix-lib-models-go/datatype"
+	"github.com/NubeIO/nubeio-rubix-lib-models-go/model"
+)
+
+const acmeTempYAML = `
+model: AcmeTemp
+name: Acme temperature sensor
+lengths: [7, 9]
+fields:
+  - name: temperature
+    title: Temperature
+    offset: 0
+    width: 2
+    signed: true
+    scale: 0.1
+    history:
+      enable: true
+      type: cov_and_interval
+      interval: 15
+      cov_threshold: 0.5
+  - name: humidity
+    offset: 2
+    width: 1
+  - name: counter
+    state_class: total_increasing
+    offset: 3
+    width: 2
+    endian: little
+  - name: voltage
+    offset: 5
+    width: 2
+    scale: 0.001
+    add: 1.5
+`
+
+func decodeAll(t *testing.T, desc *codec.LoRaDeviceDescription, dataHex string, payload []byte) map[string]float64 {
+	got := map[string]float64{}
+	update := func(name string, value float64, _ *model.Device, devDesc *codec.LoRaDeviceDescription) error {
+		if devDesc != desc {
+			t.Fatalf("point %s updated without the device description", name)
+		}
+		got[name] = value
+		return nil
+	}
+	err := desc.DecodeUplink(dataHex, payload, desc, &model.Device{}, update, nil, nil)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	return got
+}
+
+func TestParse_DecodesLegacyFrame(t *testing.T) {
+	def, err := Parse([]byte(acmeTempYAML))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	desc := def.DeviceDescription()
+
+	// address | temperature -25.6 | humidity 55 | counter 0x0102 LE | voltage 1.5+0.7 | rssi snr
+	frame := []byte{0xAA, 0xBB, 0xCC, 0xDD, 0xFF, 0x00, 0x37, 0x02, 0x01, 0x02, 0xBC, 0xB0, 0x10}
+	dataHex := hex.EncodeToString(frame)
+	if !desc.CheckLength(dataHex) {
+		t.Fatalf("CheckLength rejected a %d byte payload", len(frame)-6)
+	}
+	if desc.CheckLength(dataHex + "00") {
+		t.Fatal("CheckLength accepted a payload length not listed")
+	}
+
+	got := decodeAll(t, &desc, dataHex, frame)
+	want := map[string]float64{"temperature": -25.6, "humidity": 55, "counter": 0x0102, "voltage": 2.2}
+	for name, value := range want {
+		if math.Abs(got[name]-value) > 1e-9 {
+			t.Errorf("%s = %v, want %v", name, got[name], value)
+		}
+	}
+}
+
+func TestParse_DecodesLoRaRAWPayloadFromJSON(t *testing.T) {
+	def, err := Parse([]byte(`{
+		"model": "AcmeFlow",
+		"lora_raw": true,
+		"fields": [
+			{"name": "flow", "offset": 1, "width": 4, "float": true},
+			{"name": "total", "offset": 5, "width": 4, "endian": "little", "signed": true}
+		]
+	}`))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	desc := def.DeviceDescription()
+	if !desc.IsLoRaRAW || desc.AllowUnencrypted {
+		t.Fatalf("IsLoRaRAW=%v AllowUnencrypted=%v", desc.IsLoRaRAW, desc.AllowUnencrypted)
+	}
+
+	// 12.5 as float32 = 0x41480000; -2 as int32 LE = FE FF FF FF
+	payload := []byte{0x01, 0x41, 0x48, 0x00, 0x00, 0xFE, 0xFF, 0xFF, 0xFF}
+	got := decodeAll(t, &desc, "", payload)
+	if got["flow"] != 12.5 || got["total"] != -2 {
+		t.Fatalf("got %v", got)
+	}
+
+	err = desc.DecodeUplink("", payload[:8], &desc, &model.Device{}, nil, nil, nil)
+	if err == nil {
+		t.Fatal("expected a short payload to be rejected")
+	}
+}
+
+func TestParse_PointConfig(t *testing.T) {
+	def, err := Parse([]byte(acmeTempYAML))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	desc := def.DeviceDescription()
+
+	names := desc.GetPointNames()
+	if len(names) != 6 || names[0] != codec.RssiField || names[2] != "temperature" {
+		t.Fatalf("point names %v", names)
+	}
+	config := desc.GetPointConfig("temperature")
+	if config == nil || config.Name != "Temperature" || !*config.HistoryEnable ||
+		config.HistoryType != datatype.HistoryTypeCovAndInterval ||
+		*config.HistoryInterval != 15 || *config.HistoryCOVThreshold != 0.5 {
+		t.Fatalf("temperature config %+v", config)
+	}
+	if config := desc.GetPointConfig("humidity"); config == nil || config.HistoryEnable != nil {
+		t.Fatalf("humidity config %+v", config)
+	}
+	if config := desc.GetPointConfig("counter"); config == nil || config.StateClass != "total_increasing" {
+		t.Fatalf("counter config %+v", config)
+	}
+	if desc.GetPointConfig(codec.RssiField) != nil {
+		t.Fatal("expected no config for rssi")
+	}
+}
+
+func TestParse_RejectsInvalidDefinitions(t *testing.T) {
+	cases := map[string]string{
+		"no model":        "fields: [{name: a, width: 1}]",
+		"no fields":       "model: X",
+		"bad width":       "model: X\nfields: [{name: a, width: 9}]",
+		"bad float":       "model: X\nfields: [{name: a, width: 2, float: true}]",
+		"bad endian":      "model: X\nfields: [{name: a, width: 2, endian: middle}]",
+		"duplicate":       "model: X\nfields: [{name: a, width: 1}, {name: a, offset: 1, width: 1}]",
+		"reserved name":   "model: X\nfields: [{name: rssi, width: 1}]",
+		"short length":    "model: X\nlengths: [1]\nfields: [{name: a, width: 2}]",
+		"bad history":     "model: X\nfields: [{name: a, width: 1, history: {type: daily}}]",
+		"unknown key":     "model: X\nfields: [{name: a, width: 1, sacle: 2}]",
+		"negative offset": "model: X\nfields: [{name: a, offset: -1, width: 1}]",
+		"bad state class": "model: X\nfields: [{name: a, width: 1, state_class: gauge}]",
+	}
+	for name, data := range cases {
+		if _, err := Parse([]byte(data)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestLoadDir_RegistersModels(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"acme.yaml":   acmeTempYAML,
+		"flow.json":   `{"model": "AcmeFlow", "fields": [{"name": "flow", "width": 2}]}`,
+		"broken.yml":  "model: Broken\n",
+		"shadow.yaml": "model: rubix\nfields: [{name: a, width: 1}]",
+		"README.md":   "not a codec",
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	descs, errs := LoadDir(dir, 0)
+	if len(errs) != 1 || len(descs) != 3 {
+		t.Fatalf("loaded %d models with errors %v", len(descs), errs)
+	}
+
+	builtIn := len(codecs.LoRaDeviceDescriptions)
+	defer codecs.SetFileDeviceDescriptions(nil)
+	errs = codecs.SetFileDeviceDescriptions(descs)
+	if len(errs) != 1 {
+		t.Fatalf("expected the model shadowing Rubix to be rejected, got %v", errs)
+	}
+	models := codecs.FileModels()
+	if len(models) != 2 || models[0] != "AcmeTemp" || models[1] != "AcmeFlow" {
+		t.Fatalf("file models %v", models)
+	}
+	desc := codec.GetDeviceDescription(&model.Device{CommonDevice: model.CommonDevice{Model: "acmetemp"}}, codecs.LoRaDeviceDescriptions)
+	if desc.DeviceName != "Acme temperature sensor" {
+		t.Fatalf("device description %q", desc.DeviceName)
+	}
+
+	// Reloading replaces the file models rather than adding to them.
+	codecs.SetFileDeviceDescriptions(descs[:1])
+	if len(codecs.LoRaDeviceDescriptions) != builtIn+1 {
+		t.Fatalf("%d models after reload", len(codecs.LoRaDeviceDescriptions))
+	}
+
+	if descs, errs := LoadDir(filepath.Join(dir, "missing"), 0); descs != nil || errs != nil {
+		t.Fatalf("missing dir: %v %v", descs, errs)
+	}
+}
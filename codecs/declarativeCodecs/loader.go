@@ -0,0 +1,56 @@
+package declarativeCodecs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/NubeIO/module-core-loraraw/codec"
+)
+
+// LoadDir parses every .yaml, .yml and .json file in dir, in name order. A
+// file that does not parse is reported and skipped; the others still load. A
+// missing dir loads nothing. Scripts are limited to scriptTimeout per call.
+func LoadDir(dir string, scriptTimeout time.Duration) ([]codec.LoRaDeviceDescription, []error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, []error{err}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	var descs []codec.LoRaDeviceDescription
+	var errs []error
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		switch strings.ToLower(filepath.Ext(entry.Name())) {
+		case ".yaml", ".yml", ".json":
+		default:
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		def, err := Parse(data)
+		if err == nil {
+			err = def.LoadScript(dir, scriptTimeout)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", path, err))
+			continue
+		}
+		descs = append(descs, def.DeviceDescription())
+	}
+	return descs, errs
+}
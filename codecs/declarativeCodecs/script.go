@@ -0,0 +1,366 @@
+package declarativeCodecs
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/NubeIO/module-core-loraraw/codec"
+	"github.com/NubeIO/nubeio-rubix-lib-models-go/model"
+	"github.com/dop251/goja"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultScriptTimeout = 100 * time.Millisecond
+	defaultFPort         = 1
+	// maxCallStackSize bounds recursion so a runaway script fails instead of
+	// growing the Go stack.
+	maxCallStackSize = 1024
+	// A LoRa frame is at most 255 bytes, so no script input is larger.
+	maxScriptInputBytes = 255
+	// maxScriptResultItems, maxScriptResultDepth and maxScriptStringLength
+	// bound what a call may return: a result is checked against them before
+	// any of it is copied out of the runtime.
+	maxScriptResultItems  = 512
+	maxScriptResultDepth  = 8
+	maxScriptStringLength = 1024
+)
+
+// script is a compiled TTN-style payload formatter. Every call runs in a new
+// runtime, so no state leaks between uplinks or devices, and is interrupted
+// once it has run for longer than timeout. The runtime has no I/O: no
+// require, no timers, no network, only console.log to the debug log.
+//
+// The interpreter has no memory limit, so a script can still allocate as
+// much as it likes within its timeout: codec files are trusted code, loaded
+// only from the gateway's codecs dir. The input and result size limits keep
+// a well-meaning but buggy script from flooding the module with points.
+type script struct {
+	name      string
+	program   *goja.Program
+	timeout   time.Duration
+	canEncode bool
+}
+
+// LoadScript compiles the definition's script, found relative to dir, and
+// checks it has a decodeUplink function.
+func (d *Definition) LoadScript(dir string, timeout time.Duration) error {
+	if d.Script == "" {
+		return nil
+	}
+	path := d.Script
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	s, err := compileScript(filepath.Base(path), string(src), timeout)
+	if err != nil {
+		return fmt.Errorf("model %s: %v", d.Model, err)
+	}
+	for _, p := range d.Points {
+		if p.Writable && !s.canEncode {
+			return fmt.Errorf("model %s: point %s is writable but the script has no encodeDownlink", d.Model, p.Name)
+		}
+	}
+	d.script = s
+	return nil
+}
+
+func compileScript(name, src string, timeout time.Duration) (*script, error) {
+	if timeout <= 0 {
+		timeout = DefaultScriptTimeout
+	}
+	program, err := goja.Compile(name, src, false)
+	if err != nil {
+		return nil, err
+	}
+	s := &script{name: name, program: program, timeout: timeout}
+
+	vm, stop, err := s.newRuntime()
+	if err != nil {
+		return nil, err
+	}
+	defer stop()
+	if _, ok := goja.AssertFunction(vm.Get("decodeUplink")); !ok {
+		return nil, errors.New("script has no decodeUplink function")
+	}
+	_, s.canEncode = goja.AssertFunction(vm.Get("encodeDownlink"))
+	return s, nil
+}
+
+// newRuntime runs the script's top level in a fresh runtime. stop must be
+// called once the runtime is done with; until then the timeout is running.
+func (s *script) newRuntime() (vm *goja.Runtime, stop func(), err error) {
+	vm = goja.New()
+	vm.SetMaxCallStackSize(maxCallStackSize)
+	console := vm.NewObject()
+	_ = console.Set("log", func(call goja.FunctionCall) goja.Value {
+		args := make([]string, 0, len(call.Arguments))
+		for _, arg := range call.Arguments {
+			args = append(args, arg.String())
+		}
+		log.Debugf("codec script %s: %s", s.name, strings.Join(args, " "))
+		return goja.Undefined()
+	})
+	_ = vm.Set("console", console)
+
+	timer := time.AfterFunc(s.timeout, func() {
+		vm.Interrupt(fmt.Sprintf("script ran for longer than %s", s.timeout))
+	})
+	if _, err = vm.RunProgram(s.program); err != nil {
+		timer.Stop()
+		return nil, nil, err
+	}
+	return vm, func() { timer.Stop() }, nil
+}
+
+// call runs fn(input) and returns the object it returns. The TTN errors
+// array fails the call; warnings are logged.
+func (s *script) call(fn string, input map[string]interface{}) (map[string]interface{}, error) {
+	vm, stop, err := s.newRuntime()
+	if err != nil {
+		return nil, err
+	}
+	defer stop()
+
+	f, ok := goja.AssertFunction(vm.Get(fn))
+	if !ok {
+		return nil, fmt.Errorf("script has no %s function", fn)
+	}
+	if bytes, ok := input["bytes"].([]byte); ok {
+		if len(bytes) > maxScriptInputBytes {
+			return nil, fmt.Errorf("%s input of %d bytes is larger than %d", fn, len(bytes), maxScriptInputBytes)
+		}
+		items := make([]interface{}, len(bytes))
+		for i, b := range bytes {
+			items[i] = int64(b)
+		}
+		input["bytes"] = vm.NewArray(items...)
+	}
+	value, err := f(goja.Undefined(), vm.ToValue(input))
+	if err != nil {
+		return nil, err
+	}
+	items := 0
+	if err := checkResultSize(value, 0, &items); err != nil {
+		return nil, fmt.Errorf("%s result %v", fn, err)
+	}
+	result, ok := value.Export().(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s must return an object", fn)
+	}
+	for _, warning := range toList(result["warnings"]) {
+		log.Warnf("codec script %s: %s: %v", s.name, fn, warning)
+	}
+	if errs := toList(result["errors"]); len(errs) > 0 {
+		messages := make([]string, 0, len(errs))
+		for _, e := range errs {
+			messages = append(messages, fmt.Sprint(e))
+		}
+		return nil, fmt.Errorf("%s: %s", fn, strings.Join(messages, "; "))
+	}
+	return result, nil
+}
+
+// checkResultSize walks a returned value and fails once it holds more than
+// maxScriptResultItems values, nests deeper than maxScriptResultDepth or has
+// a string longer than maxScriptStringLength. items counts the values seen.
+func checkResultSize(v goja.Value, depth int, items *int) error {
+	if *items++; *items > maxScriptResultItems {
+		return fmt.Errorf("has more than %d values", maxScriptResultItems)
+	}
+	switch value := v.(type) {
+	case goja.String:
+		if value.Length() > maxScriptStringLength {
+			return fmt.Errorf("has a string longer than %d", maxScriptStringLength)
+		}
+	case *goja.Object:
+		if depth >= maxScriptResultDepth {
+			return fmt.Errorf("is nested deeper than %d", maxScriptResultDepth)
+		}
+		if value.ClassName() == "Array" {
+			if n := value.Get("length").ToInteger(); n > maxScriptResultItems {
+				return fmt.Errorf("has more than %d values", maxScriptResultItems)
+			}
+		}
+		for _, key := range value.Keys() {
+			if err := checkResultSize(value.Get(key), depth+1, items); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func toList(v interface{}) []interface{} {
+	list, _ := v.([]interface{})
+	return list
+}
+
+func (d *Definition) fPort() int {
+	if d.FPort == 0 {
+		return defaultFPort
+	}
+	return d.FPort
+}
+
+// decodeScript runs decodeUplink and flattens its data into point values and
+// text values.
+func (d *Definition) decodeScript(payload []byte) (map[string]float64, map[string]string, error) {
+	result, err := d.script.call("decodeUplink", map[string]interface{}{
+		"bytes":    payload,
+		"fPort":    d.fPort(),
+		"recvTime": time.Now().UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	values := map[string]float64{}
+	texts := map[string]string{}
+	data, ok := result["data"].(map[string]interface{})
+	if !ok {
+		return nil, nil, errors.New("decodeUplink returned no data object")
+	}
+	flatten("", data, values, texts)
+	return values, texts, nil
+}
+
+// flatten turns decoded data into point names: nested objects are joined with
+// "_" (battery.voltage → battery_voltage) and arrays get a 1-based suffix
+// (temperatures[0] → temperatures_1). Numbers and booleans are point values,
+// strings are kept as text.
+func flatten(name string, v interface{}, values map[string]float64, texts map[string]string) {
+	join := func(key string) string {
+		if name == "" {
+			return key
+		}
+		return name + "_" + key
+	}
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for key, item := range value {
+			flatten(join(key), item, values, texts)
+		}
+	case []interface{}:
+		for i, item := range value {
+			flatten(join(fmt.Sprint(i+1)), item, values, texts)
+		}
+	case int64:
+		values[name] = float64(value)
+	case float64:
+		if !math.IsNaN(value) && !math.IsInf(value, 0) {
+			values[name] = value
+		}
+	case bool:
+		if value {
+			values[name] = 1
+		} else {
+			values[name] = 0
+		}
+	case string:
+		texts[name] = value
+	}
+}
+
+func sortedNames(values map[string]float64) []string {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (d *Definition) decodeScriptUplink(
+	_ string,
+	payloadBytes []byte,
+	devDesc *codec.LoRaDeviceDescription,
+	device *model.Device,
+	updatePointFn codec.UpdateDevicePointFunc,
+	_ codec.UpdateDevicePointErrorFunc,
+	updateDeviceMetaTagsFn codec.UpdateDeviceMetaTagsFunc,
+) error {
+	payload := d.payload(payloadBytes)
+	if payload == nil || !d.acceptsLength(len(payload)) {
+		return fmt.Errorf("%s: payload length %d not accepted", d.Model, len(payload))
+	}
+	values, texts, err := d.decodeScript(payload)
+	if err != nil {
+		return fmt.Errorf("%s: %v", d.Model, err)
+	}
+	for _, name := range sortedNames(values) {
+		_ = updatePointFn(name, values[name], device, devDesc)
+	}
+	if len(texts) > 0 && updateDeviceMetaTagsFn != nil && device != nil {
+		return updateDeviceMetaTagsFn(device.UUID, codec.MergeMetaTags(device, texts))
+	}
+	return nil
+}
+
+// decodeScriptResponse decodes a RESPONSE with decodeUplink; every value in
+// it acknowledges the written point of the same name.
+func (d *Definition) decodeScriptResponse(
+	_ string,
+	payloadBytes []byte,
+	msgId uint8,
+	_ *codec.LoRaDeviceDescription,
+	device *model.Device,
+	updateWrittenPointFn codec.UpdateDeviceWrittenPointFunc,
+	_ codec.UpdateDeviceWrittenPointErrorFunc,
+	_ codec.UpdateDeviceMetaTagsFunc,
+) error {
+	values, _, err := d.decodeScript(payloadBytes)
+	if err != nil {
+		return fmt.Errorf("%s: %v", d.Model, err)
+	}
+	for _, name := range sortedNames(values) {
+		_ = updateWrittenPointFn(name, values[name], msgId, device)
+	}
+	return nil
+}
+
+// encodeScriptRequest runs encodeDownlink with the points' write values keyed
+// by point name and returns the bytes it produces.
+func (d *Definition) encodeScriptRequest(points []*model.Point) ([]byte, error) {
+	data := make(map[string]interface{}, len(points))
+	for _, point := range points {
+		if point.WriteValue == nil {
+			return nil, errors.New("encoding failed for nil point")
+		}
+		data[point.IoNumber] = *point.WriteValue
+	}
+	result, err := d.script.call("encodeDownlink", map[string]interface{}{"data": data})
+	if err != nil {
+		return nil, err
+	}
+	items := toList(result["bytes"])
+	if len(items) == 0 {
+		return nil, errors.New("encodeDownlink returned no bytes")
+	}
+	payload := make([]byte, len(items))
+	for i, item := range items {
+		var b float64
+		switch v := item.(type) {
+		case int64:
+			b = float64(v)
+		case float64:
+			b = v
+		default:
+			return nil, fmt.Errorf("encodeDownlink byte %d is not a number", i)
+		}
+		if b < 0 || b > 255 || b != math.Trunc(b) {
+			return nil, fmt.Errorf("encodeDownlink byte %d out of range: %v", i, b)
+		}
+		payload[i] = byte(b)
+	}
+	return payload, nil
+}
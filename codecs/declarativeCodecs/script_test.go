@@ -0,0 +1,238 @@
+package declarativeCodecs
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/NubeIO/module-core-loraraw/codec"
+	"github.com/NubeIO/nubeio-rubix-lib-models-go/datatype"
+	"github.com/NubeIO/nubeio-rubix-lib-models-go/model"
+)
+
+const vendorScript = `
+function decodeUplink(input) {
+	if (input.bytes.length < 4) {
+		return { errors: ["payload too short"] };
+	}
+	var warnings = [];
+	if (input.bytes[3] === 0) {
+		warnings.push("valve closed");
+	}
+	return {
+		data: {
+			temperature: ((input.bytes[0] << 8 | input.bytes[1]) << 16 >> 16) / 10,
+			battery: { voltage: input.bytes[2] / 50 },
+			open: input.bytes[3] === 1,
+			channels: [input.fPort, input.bytes.slice(0, 2).length],
+			firmware: "v1.2"
+		},
+		warnings: warnings
+	};
+}
+
+function encodeDownlink(input) {
+	return { bytes: [0x01, input.data.setpoint * 2], fPort: 1 };
+}
+`
+
+const vendorCodecYAML = `
+model: AcmeValve
+lora_raw: true
+script: valve.js
+f_port: 5
+points:
+  - name: setpoint
+    title: Setpoint
+    writable: true
+  - name: temperature
+    history:
+      enable: true
+`
+
+func loadScriptCodec(t *testing.T, yaml, src string, timeout time.Duration) codec.LoRaDeviceDescription {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "valve.js"), []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	def, err := Parse([]byte(yaml))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if err := def.LoadScript(dir, timeout); err != nil {
+		t.Fatalf("load script: %v", err)
+	}
+	return def.DeviceDescription()
+}
+
+func TestScript_DecodeUplink(t *testing.T) {
+	desc := loadScriptCodec(t, vendorCodecYAML, vendorScript, 0)
+
+	got := map[string]float64{}
+	update := func(name string, value float64, _ *model.Device, _ *codec.LoRaDeviceDescription) error {
+		got[name] = value
+		return nil
+	}
+	var metaTags []*model.DeviceMetaTag
+	updateMetaTags := func(_ string, tags []*model.DeviceMetaTag) error {
+		metaTags = tags
+		return nil
+	}
+	device := &model.Device{}
+	err := desc.DecodeUplink("", []byte{0xFF, 0x9C, 150, 1}, &desc, device, update, nil, updateMetaTags)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	want := map[string]float64{"temperature": -10, "battery_voltage": 3, "open": 1, "channels_1": 5, "channels_2": 2}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for name, value := range want {
+		if got[name] != value {
+			t.Errorf("%s = %v, want %v", name, got[name], value)
+		}
+	}
+	if len(metaTags) != 1 || metaTags[0].Key != "firmware" || metaTags[0].Value != "v1.2" {
+		t.Fatalf("meta tags %+v", metaTags)
+	}
+
+	err = desc.DecodeUplink("", []byte{0x01}, &desc, device, update, nil, updateMetaTags)
+	if err == nil || !strings.Contains(err.Error(), "payload too short") {
+		t.Fatalf("expected the script error, got %v", err)
+	}
+}
+
+func TestScript_EncodeAndResponse(t *testing.T) {
+	desc := loadScriptCodec(t, vendorCodecYAML, vendorScript, 0)
+	if desc.EncodeRequestMessage == nil || desc.DecodeResponse == nil {
+		t.Fatal("expected a LoRaRAW script with encodeDownlink to support writes")
+	}
+
+	value := 21.0
+	payload, err := desc.EncodeRequestMessage([]*model.Point{{WriteValue: &value, IoNumber: "setpoint"}})
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if len(payload) != 2 || payload[0] != 0x01 || payload[1] != 42 {
+		t.Fatalf("payload % x", payload)
+	}
+	value = 200
+	if _, err := desc.EncodeRequestMessage([]*model.Point{{WriteValue: &value, IoNumber: "setpoint"}}); err == nil {
+		t.Fatal("expected a byte out of range to fail")
+	}
+
+	acked := map[string]float64{}
+	written := func(name string, value float64, msgId uint8, _ *model.Device) error {
+		if msgId != 7 {
+			t.Fatalf("msgId %d", msgId)
+		}
+		acked[name] = value
+		return nil
+	}
+	err = desc.DecodeResponse("", []byte{0x00, 0x64, 100, 0}, 7, &desc, &model.Device{}, written, nil, nil)
+	if err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if acked["temperature"] != 10 {
+		t.Fatalf("acked %v", acked)
+	}
+
+	config := desc.GetPointConfig("setpoint")
+	if config == nil || config.Name != "Setpoint" || config.WriteMode != datatype.WriteAlways {
+		t.Fatalf("setpoint config %+v", config)
+	}
+	names := desc.GetPointNames()
+	if len(names) != 4 || names[2] != "setpoint" {
+		t.Fatalf("point names %v", names)
+	}
+}
+
+func TestScript_IsInterruptedAfterTimeout(t *testing.T) {
+	desc := loadScriptCodec(t, "model: Loop\nscript: valve.js\n",
+		"function decodeUplink(input) { while (true) {} }", 50*time.Millisecond)
+
+	start := time.Now()
+	err := desc.DecodeUplink("", []byte{0, 0, 0, 0, 0, 0, 0}, &desc, &model.Device{}, nil, nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "longer than") {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("script ran for %s", elapsed)
+	}
+}
+
+func TestScript_RejectsOversizedInputAndResults(t *testing.T) {
+	results := map[string]string{
+		"too many values": "var d = {}; for (var i = 0; i < 1000; i++) { d['p' + i] = i; } return { data: d };",
+		"huge array":      "return { data: { a: new Array(100000).fill(1) } };",
+		"long string":     "return { data: { s: 'x'.repeat(5000) } };",
+		"deep nesting":    "var d = {}; var o = d; for (var i = 0; i < 20; i++) { o.n = {}; o = o.n; } return { data: d };",
+	}
+	for name, body := range results {
+		desc := loadScriptCodec(t, "model: Big\nscript: valve.js\n", "function decodeUplink(input) { "+body+" }", time.Second)
+		err := desc.DecodeUplink("", []byte{0, 0, 0, 0, 0, 0, 0}, &desc, &model.Device{}, nil, nil, nil)
+		if err == nil || !strings.Contains(err.Error(), "result") {
+			t.Errorf("%s: expected the result to be rejected, got %v", name, err)
+		}
+	}
+
+	s, err := compileScript("valve.js", "function decodeUplink(input) { return { data: {} }; }", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.call("decodeUplink", map[string]interface{}{"bytes": make([]byte, maxScriptInputBytes+1)}); err == nil {
+		t.Error("an input larger than a LoRa frame must be rejected")
+	}
+}
+
+func TestScript_IsSandboxed(t *testing.T) {
+	src := `function decodeUplink(input) {
+		return { data: { has_require: typeof require !== "undefined", has_timers: typeof setTimeout !== "undefined" } };
+	}`
+	desc := loadScriptCodec(t, "model: Sandbox\nscript: valve.js\n", src, 0)
+	got := map[string]float64{}
+	update := func(name string, value float64, _ *model.Device, _ *codec.LoRaDeviceDescription) error {
+		got[name] = value
+		return nil
+	}
+	if err := desc.DecodeUplink("", []byte{0, 0, 0, 0, 0, 0, 0}, &desc, &model.Device{}, update, nil, nil); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if got["has_require"] != 0 || got["has_timers"] != 0 {
+		t.Fatalf("script can reach %v", got)
+	}
+	if desc.EncodeRequestMessage != nil || desc.DecodeResponse != nil {
+		t.Fatal("a legacy script codec must not support writes")
+	}
+}
+
+func TestScript_RejectsInvalidScripts(t *testing.T) {
+	cases := map[string][2]string{
+		"syntax error":    {"model: X\nscript: valve.js\n", "function decodeUplink(input) {"},
+		"no decodeUplink": {"model: X\nscript: valve.js\n", "function decode(bytes) { return {}; }"},
+		"writable without encodeDownlink": {"model: X\nlora_raw: true\nscript: valve.js\npoints: [{name: a, writable: true}]\n",
+			"function decodeUplink(input) { return { data: {} }; }"},
+	}
+	for name, c := range cases {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, "valve.js"), []byte(c[1]), 0644); err != nil {
+			t.Fatal(err)
+		}
+		def, err := Parse([]byte(c[0]))
+		if err != nil {
+			t.Fatalf("%s: parse: %v", name, err)
+		}
+		if err := def.LoadScript(dir, 0); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	if _, err := Parse([]byte("model: X\nscript: valve.js\npoints: [{name: a, writable: true}]\n")); err == nil {
+		t.Error("expected writable points on a legacy script codec to be rejected")
+	}
+	if _, err := Parse([]byte("model: X\nscript: valve.js\nfields: [{name: a, width: 1}]\n")); err == nil {
+		t.Error("expected fields and a script together to be rejected")
+	}
+}
@@ -188,6 +188,12 @@ func decodeData(serialData *SerialData, metaDataKey MetaDataKey, data interface{
 			} else {
 				return fmt.Errorf("invalid type for MDK_FLOAT: %T", data)
 			}
+		case MDK_DOUBLE:
+			if v, ok := data.(*float64); ok {
+				*v = math.Float64frombits(uint64(dataBits))
+			} else {
+				return fmt.Errorf("invalid type for MDK_DOUBLE: %T", data)
+			}
 		case MDK_ERROR:
 			if v, ok := data.(*uint8); ok {
 				*v = uint8(dataBits)
@@ -197,12 +203,42 @@ func decodeData(serialData *SerialData, metaDataKey MetaDataKey, data interface{
 		default:
 			return fmt.Errorf("unsupported MetaDataKey: %v", metaDataKey)
 		}
+	case STRINGPOINT:
+		v, ok := data.(*string)
+		if !ok {
+			return fmt.Errorf("invalid type for %v: %T", metaDataKey, data)
+		}
+		bitCount = metaData.byteCount * 8
+		dataVector, shiftPos, bytesRequired = getVector(serialData, bitCount, serialData.ReadBitPos)
+		length := int(vectorToBits(dataVector, bitCount, shiftPos, bytesRequired))
+		if serialData.ReadBitPos+length*8 > len(serialData.Buffer)*8 {
+			// Nothing after a truncated string can be aligned, stop decoding here.
+			serialData.ReadBitPos = len(serialData.Buffer) * 8
+			return fmt.Errorf("string length %d exceeds remaining payload", length)
+		}
+		text := make([]byte, length)
+		for i := range text {
+			dataVector, shiftPos, bytesRequired = getVector(serialData, 8, serialData.ReadBitPos)
+			text[i] = byte(vectorToBits(dataVector, 8, shiftPos, bytesRequired))
+		}
+		*v = string(text)
 	default:
 		return fmt.Errorf("unsupported data type1: %v", metaData.dataType)
 	}
 	return nil
 }
 
+// IsGeneralField reports whether fieldName is a field generateFieldName names
+// for metaDataKey without positional data, e.g. "push-frequency-1".
+func IsGeneralField(fieldName string, metaDataKey MetaDataKey) bool {
+	id, ok := strings.CutPrefix(fieldName, metaDataKey.String()+"-")
+	if !ok {
+		return false
+	}
+	n, err := strconv.Atoi(id)
+	return err == nil && n > 0
+}
+
 func generateFieldName(metaDataKey MetaDataKey, pos PositionData) string {
 	id := pos.ID + 1
 	switch pos.Type {
@@ -293,9 +329,9 @@ func DecodeRubixUplink(
 	device *model.Device,
 	updatePointFn codec.UpdateDevicePointFunc,
 	updatePointErrFn codec.UpdateDevicePointErrorFunc,
-	_ codec.UpdateDeviceMetaTagsFunc,
+	updateDeviceMetaTagsFn codec.UpdateDeviceMetaTagsFunc,
 ) error {
-	return DecodeRubix(payloadBytes, device, devDesc, 0, updatePointFn, updatePointErrFn, nil, nil)
+	return DecodeRubix(payloadBytes, device, devDesc, 0, updatePointFn, updatePointErrFn, nil, nil, updateDeviceMetaTagsFn)
 }
 
 func DecodeRubixResponse(
@@ -306,11 +342,14 @@ func DecodeRubixResponse(
 	device *model.Device,
 	updateWrittenPointFn codec.UpdateDeviceWrittenPointFunc,
 	updateWrittenPointErrFn codec.UpdateDeviceWrittenPointErrorFunc,
-	_ codec.UpdateDeviceMetaTagsFunc,
+	updateDeviceMetaTagsFn codec.UpdateDeviceMetaTagsFunc,
 ) error {
-	return DecodeRubix(payloadBytes, device, devDesc, msgId, nil, nil, updateWrittenPointFn, updateWrittenPointErrFn)
+	return DecodeRubix(payloadBytes, device, devDesc, msgId, nil, nil, updateWrittenPointFn, updateWrittenPointErrFn, updateDeviceMetaTagsFn)
 }
 
+// DecodeRubix walks every field in the payload. Numeric fields go to the
+// point callbacks; string fields can't be a point value (float64) so they are
+// stored as device meta tags keyed by field name, e.g. "string-1" or "UVP-3".
 func DecodeRubix(
 	payloadBytes []byte,
 	device *model.Device,
@@ -320,6 +359,7 @@ func DecodeRubix(
 	updatePointErrFn codec.UpdateDevicePointErrorFunc,
 	updateWrittenPointFn codec.UpdateDeviceWrittenPointFunc,
 	updateWrittenPointErrFn codec.UpdateDeviceWrittenPointErrorFunc,
+	updateDeviceMetaTagsFn codec.UpdateDeviceMetaTagsFunc,
 ) error {
 	serialData := NewSerialDataWithBuffer(payloadBytes)
 
@@ -329,13 +369,16 @@ func DecodeRubix(
 		ID:   0,
 		Type: PositionDataType_GENERAL,
 	}
+	textValues := map[string]string{}
 	for canDecode(serialData) {
 		metaDataKey, positionDataNew := parseMetaData(serialData)
 		if hasPos {
 			positionData = positionDataNew
 		}
-		name, value, err := decodePointRubix(serialData, metaDataKey, hasPos, positionData, device, updatePointFn)
-		if updatePointFn != nil {
+		name, value, text, err := decodePointRubix(serialData, metaDataKey, hasPos, positionData, device, updatePointFn)
+		if err == nil && text != nil {
+			textValues[name] = *text
+		} else if updatePointFn != nil {
 			if err != nil {
 				updatePointErrFn(name, err, device, devDesc)
 			} else {
@@ -352,12 +395,17 @@ func DecodeRubix(
 		positionData.ID++ // might be overwritten anyway if hasPos is true
 	}
 
+	if len(textValues) > 0 && updateDeviceMetaTagsFn != nil && device != nil {
+		return updateDeviceMetaTagsFn(device.UUID, codec.MergeMetaTags(device, textValues))
+	}
 	return nil
 }
 
-func decodePointRubix(serialData *SerialData, metaDataKey MetaDataKey, hasPos bool, position PositionData, device *model.Device, updatePointFn codec.UpdateDevicePointFunc) (name string, value float64, err error) {
+func decodePointRubix(serialData *SerialData, metaDataKey MetaDataKey, hasPos bool, position PositionData, device *model.Device, updatePointFn codec.UpdateDevicePointFunc) (name string, value float64, text *string, err error) {
 	var (
 		f32  float32
+		f64  float64
+		str  string
 		u8   uint8
 		i8   int8
 		u16  uint16
@@ -434,29 +482,22 @@ func decodePointRubix(serialData *SerialData, metaDataKey MetaDataKey, hasPos bo
 	case MDK_FLOAT:
 		decodeData(serialData, metaDataKey, &f32)
 		value = float64(f32)
+	case MDK_DOUBLE:
+		decodeData(serialData, metaDataKey, &f64)
+		value = f64
+	case MDK_STRING:
+		if err = decodeData(serialData, metaDataKey, &str); err != nil {
+			return name, 0, nil, err
+		}
+		text = &str
 	case MDK_BOOL:
 		decodeData(serialData, metaDataKey, &f32)
 		value = float64(f32)
 	case MDK_ERROR:
 		var errCode uint8 = 0
 		decodeData(serialData, metaDataKey, &errCode)
-		switch errCode {
-		case ErrorCodeNone:
-			break
-		case ErrorCodeGeneral:
-			return name, 0, errors.New("unknown error")
-		case ErrorCodeNotAllowed:
-			return name, 0, errors.New("non-writable point")
-		case ErrorCodeWriteFailed:
-			return name, 0, errors.New("internal error")
-		case ErrorCodeInvalidPoint:
-			return name, 0, errors.New("invalid point ID")
-		case ErrorCodeInvalidType:
-			return name, 0, errors.New("data type mismatch")
-		case ErrorCodeInvalidValue:
-			return name, 0, errors.New("invalid value")
-		default:
-			return name, 0, errors.New("Unknown error" + strconv.Itoa(int(errCode)))
+		if errCode != ErrorCodeNone {
+			return name, 0, nil, &DeviceError{Code: errCode}
 		}
 		value = 0
 	case 0:
@@ -465,7 +506,7 @@ func decodePointRubix(serialData *SerialData, metaDataKey MetaDataKey, hasPos bo
 		log.Errorf("Unknown MetaDataKey: %d", metaDataKey)
 	}
 
-	return name, value, nil
+	return name, value, text, nil
 }
 
 func GetRubixPointNames() []string {
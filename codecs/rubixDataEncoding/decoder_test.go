@@ -3,6 +3,9 @@ package rubixDataEncoding
 import (
 	"reflect"
 	"testing"
+
+	"github.com/NubeIO/module-core-loraraw/codec"
+	"github.com/NubeIO/nubeio-rubix-lib-models-go/model"
 )
 
 func testHeader(t *testing.T, serialData *SerialData, expectedHeader MetaDataKey) {
@@ -251,3 +254,103 @@ func TestPositional(t *testing.T) {
 	testDecodeFloat(t, serialData, 0.7, MDK_ANALOG_IN)
 	requireFalse(t, canDecode(serialData), "Should not decode")
 }
+
+func TestDoubleAndStringRoundTrip(t *testing.T) {
+	serialData := NewSerialData()
+	Require(t, EncodeData(serialData, float64(123456789.123456), MDK_DOUBLE, 0))
+	Require(t, EncodeData(serialData, "SN-0042", MDK_STRING, 0))
+	Require(t, EncodeData(serialData, "", MDK_STRING, 0))
+	Require(t, EncodeData(serialData, float32(1.5), MDK_FLOAT, 0))
+
+	decoded := NewSerialDataWithBuffer(serialData.Buffer)
+
+	testHeader(t, decoded, MDK_DOUBLE)
+	var f64 float64
+	if err := decodeData(decoded, MDK_DOUBLE, &f64); err != nil || f64 != 123456789.123456 {
+		t.Fatalf("Expected double 123456789.123456, got %v (%v)", f64, err)
+	}
+	for _, expected := range []string{"SN-0042", ""} {
+		testHeader(t, decoded, MDK_STRING)
+		var str string
+		if err := decodeData(decoded, MDK_STRING, &str); err != nil || str != expected {
+			t.Fatalf("Expected string %q, got %q (%v)", expected, str, err)
+		}
+	}
+	// Fields after a double and strings must still be aligned
+	testDecodeFloat(t, decoded, 1.5, MDK_FLOAT)
+	requireFalse(t, canDecode(decoded), "Should not decode")
+}
+
+func TestStringTooLongForPrefix(t *testing.T) {
+	serialData := NewSerialData()
+	requireFalse(t, EncodeData(serialData, string(make([]byte, 256)), MDK_STRING, 0), "256 byte string must not encode")
+}
+
+func TestTruncatedStringStopsDecoding(t *testing.T) {
+	serialData := NewSerialData()
+	Require(t, EncodeData(serialData, "truncated", MDK_STRING, 0))
+	decoded := NewSerialDataWithBuffer(serialData.Buffer[:len(serialData.Buffer)-3])
+
+	testHeader(t, decoded, MDK_STRING)
+	var str string
+	if err := decodeData(decoded, MDK_STRING, &str); err == nil {
+		t.Fatalf("Expected an error for a truncated string")
+	}
+	requireFalse(t, canDecode(decoded), "Should not decode past a truncated string")
+}
+
+func TestDecodeRubixStringsToMetaTags(t *testing.T) {
+	serialData := NewSerialData()
+	setPositionalData(serialData, true)
+	uvp1, _ := getPosition("UVP-1")
+	uvp2, _ := getPosition("UVP-2")
+	Require(t, EncodeData(serialData, "SN-0042", MDK_STRING, uvp1))
+	Require(t, EncodeData(serialData, float64(98765.4321), MDK_DOUBLE, uvp2))
+
+	device := &model.Device{
+		CommonUUID: model.CommonUUID{UUID: "dev-1"},
+		MetaTags:   []*model.DeviceMetaTag{{DeviceUUID: "dev-1", Key: "UVP-1", Value: "old"}},
+	}
+	values := map[string]float64{}
+	var metaTags []*model.DeviceMetaTag
+	err := DecodeRubix(serialData.Buffer, device, nil, 0,
+		func(name string, value float64, _ *model.Device, _ *codec.LoRaDeviceDescription) error {
+			values[name] = value
+			return nil
+		},
+		func(name string, err error, _ *model.Device, _ *codec.LoRaDeviceDescription) error {
+			t.Fatalf("unexpected error for %s: %v", name, err)
+			return nil
+		},
+		nil, nil,
+		func(_ string, tags []*model.DeviceMetaTag) error {
+			metaTags = tags
+			return nil
+		},
+	)
+	if err != nil {
+		t.Fatalf("DecodeRubix: %v", err)
+	}
+	if len(values) != 1 || values["UVP-2"] != 98765.4321 {
+		t.Fatalf("Expected only the double as a point value, got %v", values)
+	}
+	if len(metaTags) != 1 || metaTags[0].Key != "UVP-1" || metaTags[0].Value != "SN-0042" {
+		t.Fatalf("Expected the string to update the UVP-1 meta tag, got %+v", metaTags)
+	}
+}
+
+func TestEncodeRequestMessageRejectsString(t *testing.T) {
+	value := 1.0
+	_, err := EncodeRequestMessage([]*model.Point{{IoNumber: "UVP-1", DataType: "42", WriteValue: &value}})
+	if err == nil {
+		t.Fatalf("Expected string point writes to be rejected")
+	}
+}
+
+func TestIsGeneralField(t *testing.T) {
+	name := generateFieldName(MDK_PUSH_FREQUENCY, PositionData{Type: PositionDataType_GENERAL})
+	requireFalse(t, !IsGeneralField(name, MDK_PUSH_FREQUENCY), "Expected "+name+" to be a push frequency field")
+	for _, other := range []string{PushFrequencyField, "push-frequency-x", "push-frequency-0", "temp-1", "UVP-1"} {
+		requireFalse(t, IsGeneralField(other, MDK_PUSH_FREQUENCY), "Expected "+other+" not to be a push frequency field")
+	}
+}
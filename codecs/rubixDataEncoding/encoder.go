@@ -157,6 +157,24 @@ func EncodeData[T any](serialData *SerialData, data T, header MetaDataKey, posit
 		// Convert uint64 to vector
 		bitsToVector(dataBits, bitCount, &dataVector)
 
+	case STRINGPOINT:
+		text, ok := any(data).(string)
+		if !ok {
+			log.Errorf("EncodeData: Unsupported type for STRINGPOINT: %T", data)
+			return false
+		}
+		bitCount = metaData.byteCount * 8
+		if len(text) >= 1<<bitCount {
+			log.Errorf("EncodeData: string of %d bytes does not fit a %d bit length prefix", len(text), bitCount)
+			return false
+		}
+		// Add header to buffer
+		addVectorToBuffer(serialData, headerVector, headerBitCount)
+		// Length prefix, then the raw bytes
+		bitsToVector(uint64(len(text)), bitCount, &dataVector)
+		dataVector = append(dataVector, text...)
+		bitCount += len(text) * 8
+
 	default:
 		return false
 	}
@@ -181,6 +199,9 @@ func EncodeRequestMessage(points []*model.Point) ([]byte, error) {
 		if err != nil {
 			return nil, err
 		}
+		if MetaDataKey(pointDataType) == MDK_STRING {
+			return nil, errors.New("string points cannot be written")
+		}
 
 		position, err := getPosition(point.IoNumber)
 		if err != nil {
@@ -1,5 +1,7 @@
 package rubixDataEncoding
 
+import "strconv"
+
 type SerialData struct {
 	Buffer      []byte
 	ReadBitPos  int
@@ -40,6 +42,30 @@ const (
 	ErrorCodeInvalidValue = 6
 )
 
+// DeviceError is the MDK_ERROR a device returns for a point in a RESPONSE.
+type DeviceError struct {
+	Code uint8
+}
+
+func (e *DeviceError) Error() string {
+	switch e.Code {
+	case ErrorCodeGeneral:
+		return "unknown error"
+	case ErrorCodeNotAllowed:
+		return "non-writable point"
+	case ErrorCodeWriteFailed:
+		return "internal error"
+	case ErrorCodeInvalidPoint:
+		return "invalid point ID"
+	case ErrorCodeInvalidType:
+		return "data type mismatch"
+	case ErrorCodeInvalidValue:
+		return "invalid value"
+	default:
+		return "Unknown error" + strconv.Itoa(int(e.Code))
+	}
+}
+
 func NewSerialData() *SerialData {
 	buffer := make([]byte, MinSize)
 	buffer[0] = DefaultSettings
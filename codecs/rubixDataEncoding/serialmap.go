@@ -47,8 +47,9 @@ const (
 )
 
 const (
-	FIXEDPOINT = 1
-	DATAPOINT  = 2
+	FIXEDPOINT  = 1
+	DATAPOINT   = 2
+	STRINGPOINT = 3 // byteCount is the size of the length prefix, not the data
 )
 
 var serialMap = map[MetaDataKey]MetaData{
@@ -79,6 +80,7 @@ var serialMap = map[MetaDataKey]MetaData{
 	MDK_CHAR:             {DATAPOINT, 0, 0, 0, 1},
 	MDK_FLOAT:            {DATAPOINT, 0, 0, 0, 4},
 	MDK_DOUBLE:           {DATAPOINT, 0, 0, 0, 8},
+	MDK_STRING:           {STRINGPOINT, 0, 0, 0, 1},
 	MDK_ERROR:            {DATAPOINT, 0, 0, 0, 1},
 }
 
@@ -110,6 +112,7 @@ const (
 	Int64Field          = "int_64"
 	FloatField          = "float"
 	DoubleField         = "double"
+	StringField         = "string"
 	ErrorField          = "error"
 )
 
@@ -173,6 +176,8 @@ func (m MetaDataKey) String() string {
 		return FloatField
 	case MDK_DOUBLE:
 		return DoubleField
+	case MDK_STRING:
+		return StringField
 	case MDK_ERROR:
 		return ErrorField
 	default:
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"fmt"
+	"os"
+
 	"github.com/NubeIO/lib-module-go/nmodule"
 	"github.com/NubeIO/module-core-loraraw/pkg"
 	"github.com/hashicorp/go-plugin"
@@ -17,5 +20,12 @@ func ServePlugin() {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		if err := pkg.ReplayCommand(os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 	ServePlugin()
 }
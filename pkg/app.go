@@ -31,23 +31,29 @@ func (m *Module) addNetwork(body *model.Network) (network *model.Network, err er
 	if err != nil {
 		return nil, err
 	}
-	for _, net := range nets {
-		if net != nil {
-			errMsg := fmt.Sprintf("only max one network is allowed with %s", m.moduleName)
-			log.Errorf(errMsg)
-			return nil, errors.New(errMsg)
+	if body.TransportType == "" {
+		body.TransportType = TransportSerial
+	}
+	if !validTransportType(body.TransportType) {
+		return nil, fmt.Errorf("unsupported transport type %q, must be one of %s", body.TransportType, strings.Join(transportTypes, ", "))
+	}
+	if body.TransportType == TransportSerial {
+		for _, net := range nets {
+			if net != nil && body.SerialPort != nil && net.SerialPort != nil && *net.SerialPort == *body.SerialPort {
+				errMsg := fmt.Sprintf("serial port %s is already used by network %s", *body.SerialPort, net.Name)
+				log.Errorf(errMsg)
+				return nil, errors.New(errMsg)
+			}
+		}
+		if integer.IsUnitNil(body.SerialBaudRate) {
+			body.SerialBaudRate = integer.NewUint(38400)
 		}
-	}
-	body.TransportType = "serial"
-	if integer.IsUnitNil(body.SerialBaudRate) {
-		body.SerialBaudRate = integer.NewUint(38400)
 	}
 	network, err = m.grpcMarshaller.CreateNetwork(body)
 	if err != nil {
 		return nil, err
 	}
-	m.networkUUID = network.UUID
-	go m.run()
+	m.startNetwork(network.UUID)
 	return network, nil
 }
 
@@ -137,36 +143,78 @@ func (m *Module) writePoint(pointUUID string, body *dto.PointWriter) (*model.Poi
 	return &pwResponse.Point, nil
 }
 
-func (m *Module) handleSerialPayload(dataHex string) {
-	log.Infof("handleSerialPayload: enter, networkUUID=%s, dataHex=%s", m.networkUUID, dataHex)
+func (m *Module) handleSerialPayload(networkUUID, dataHex string) {
+	log.Infof("handleSerialPayload: enter, networkUUID=%s, dataHex=%s", networkUUID, dataHex)
 
-	if m.networkUUID == "" {
+	if networkUUID == "" {
 		log.Infof("handleSerialPayload: exit, no networkUUID set")
 		return
 	}
+	if m.frameCapture != nil {
+		m.frameCapture.Write(networkUUID, dataHex)
+	}
 
-	// Collect every decoded point value so we can publish them as a single
-	// JSON payload over MQTT once decoding is complete.
+	// Only devices of the network whose radio heard the frame are considered:
+	// when two radios are in range of one device, the other radio's copy of
+	// the frame is ignored instead of being decoded (and acked) twice.
+	otherNetwork := false
+	getDevice := func(address string) *model.Device {
+		device := m.getDeviceByLoRaAddress(address)
+		if device != nil && device.NetworkUUID != networkUUID {
+			log.Debugf("handleSerialPayload: device %s belongs to network %s, ignoring", address, device.NetworkUUID)
+			otherNetwork = true
+			return nil
+		}
+		return device
+	}
+
+	// Collect every decoded point value (and point fault) so we can publish
+	// them as a single JSON payload over MQTT once decoding is complete.
+	received := time.Now().UTC()
 	collected := map[string]float64{}
+	faults := map[string]string{}
 	successFn := func(name string, value float64, dev *model.Device, dd *codec.LoRaDeviceDescription) error {
 		collected[name] = value
 		return m.updateDevicePointSuccess(name, value, dev, dd)
 	}
+	errorFn := func(name string, err error, dev *model.Device, dd *codec.LoRaDeviceDescription) error {
+		faults[name] = err.Error()
+		return m.updateDevicePointError(name, err, dev, dd)
+	}
 
-	res := m.dispatchFrame(dataHex, m.getDeviceByLoRaAddress, successFn, m.updateDevicePointError, m.updateDeviceMetaTags, m.updateDeviceWrittenPointSuccess, m.updateDeviceWrittenPointError)
+	res := m.dispatchFrame(dataHex, getDevice, successFn, errorFn, m.updateDeviceMetaTags, m.updateDeviceWrittenPointSuccess, m.updateDeviceWrittenPointError)
+	if res.Device != nil && m.modelDetector != nil {
+		frameHex := dataHex
+		if res.LegacyDevice {
+			frameHex = res.DataHex
+		}
+		m.modelDetector.Frame(res.Device.UUID, frameHex)
+		m.learnModel(res.Device)
+	}
 	if !res.OK {
+		if res.Unknown && !otherNetwork && m.discovery != nil {
+			encryption, models := m.guessDevice(res)
+			m.discovery.Seen(networkUUID, res, encryption, models)
+		}
+		if res.Device != nil && res.Dropped != "" && m.linkTracker != nil {
+			m.linkTracker.Dropped(res.Device.UUID, res.Dropped)
+		}
 		return
 	}
 
 	_ = successFn(codec.RssiField, float64(res.RSSI), res.Device, res.DevDesc)
 	_ = successFn(codec.SnrField, float64(res.SNR), res.Device, res.DevDesc)
+	m.updateLinkStats(res)
+	if m.offlineWatchdog != nil {
+		m.offlineWatchdog.Seen(res.Device.UUID)
+	}
 	m.updateDeviceFault(res.Device.Model, res.Device.UUID)
 	log.Infof("handleSerialPayload: done for address=%s model=%s", res.Address, res.Device.Model)
 
 	if m.mqttClient != nil {
 		m.mqttClient.PublishRaw(res.PublishRawHex)
-		if res.Device.AddressUUID != nil && len(collected) > 0 {
-			m.mqttClient.PublishValues(*res.Device.AddressUUID, res.Device.Name, collected)
+		if res.Device.AddressUUID != nil {
+			m.mqttClient.PublishValues(newValueMessage(res, networkUUID, received, collected, faults))
 		}
 	}
 }
@@ -184,6 +232,22 @@ type DispatchResult struct {
 	SNR           float32
 	LegacyDevice  bool
 	OK            bool
+	// Encryption is how the frame arrived: frameEncrypted,
+	// frameLegacyEncrypted or framePlaintext.
+	Encryption string
+	// Nonce is the nonce of a LoRaRAW uplink (HasNonce false for legacy
+	// frames and responses).
+	Nonce    uint8
+	HasNonce bool
+	// Dropped says why a frame from a known device was not decoded
+	// (linkDropCMAC, linkDropReplay); OK is false then.
+	Dropped string
+	// Unknown is set for a frame whose address matches no device, neither
+	// on the wire nor after legacy decryption; OK is false. Address and
+	// DataHex are the frame as received, LegacyAddress the address it
+	// decrypts to with the default key (if it does), RSSI and SNR are set.
+	Unknown       bool
+	LegacyAddress string
 }
 
 // dispatchFrame is the core wire-frame decoder shared by handleSerialPayload
@@ -239,6 +303,7 @@ func (m *Module) dispatchFrame(
 
 	// Auto-detect legacy-encrypted frame: unknown address on the wire, but
 	// after decrypting with the default key the address resolves differently.
+	wireAddress, wireHex := address, dataHex
 	if device == nil {
 		if res, ok := m.tryLegacyDecrypt(address, dataBytesOrig); ok {
 			address = res.address
@@ -264,7 +329,11 @@ func (m *Module) dispatchFrame(
 
 	if device == nil {
 		log.Infof("message from unknown sensor. ID: %s, RSSI: %d, SNR: %.2f", address, rssi, snr)
-		return DispatchResult{}
+		res := DispatchResult{Address: wireAddress, DataHex: wireHex, RSSI: rssi, SNR: snr, Unknown: true}
+		if legacyDevice {
+			res.LegacyAddress = address
+		}
+		return res
 	}
 	devDesc := codec.GetDeviceDescription(device, codecs.LoRaDeviceDescriptions)
 	if devDesc == &codec.NilLoRaDeviceDescription {
@@ -274,7 +343,11 @@ func (m *Module) dispatchFrame(
 	log.Infof("dispatchFrame: matched device model=%s uuid=%s isLoRaRAW=%v",
 		device.Model, device.UUID, devDesc.IsLoRaRAW)
 
+	var nonce uint8
+	hasNonce := false
+	encryption := framePlaintext
 	if legacyDevice {
+		encryption = frameLegacyEncrypted
 		log.Infof("dispatchFrame: taking legacy decrypted handler path for address=%s", address)
 		dataBytes, _ := hex.DecodeString(dataHex)
 		m.handleLegacyDevice(device, devDesc, dataHex, dataBytes, successFn, errorFn, metaFn)
@@ -298,16 +371,38 @@ func (m *Module) dispatchFrame(
 		//     is NOT shaped like a ciphertext (isEncryptionShaped): a frame
 		//     whose inner region is a whole number of AES blocks but fails CMAC
 		//     is a corrupted/forged ciphertext, not plaintext.
+		//
+		// A device being re-keyed may use its current or its next key (or,
+		// shortly after a rotation, its previous key); each is tried in turn.
 		dataBytes := dataBytesOrig
-		keyBytes, err := m.getEncryptionKey(device)
+		keys, err := m.uplinkKeys(device)
 		if err != nil {
 			log.Errorf("error decoding device key: %s", err)
 			return DispatchResult{}
 		}
+		var keyBytes, decodedDataBytes []byte
+		var derr error
+		keyLabel := keyCurrent
+		for _, k := range keys {
+			if decodedDataBytes, derr = tryDecryptLoRaRAWPkt(dataBytes, k.key); derr == nil {
+				keyBytes, keyLabel = k.key, k.label
+				break
+			}
+		}
 
-		if decodedDataBytes, derr := tryDecryptLoRaRAWPkt(dataBytes, keyBytes); derr == nil {
+		if derr == nil {
 			// 1. Decrypted and CMAC verified → genuinely encrypted frame.
 			log.Infof("dispatchFrame: LoRaRAW decrypt ok (CMAC valid) address=%s decodedLen=%d", address, len(decodedDataBytes))
+			if !m.acceptNonce(device, decodedDataBytes) {
+				log.Warnf("dispatchFrame: dropping replayed LoRaRAW frame (address=%s, nonce=%d)", address, getNonce(decodedDataBytes))
+				return DispatchResult{Address: address, Device: device, Dropped: linkDropReplay}
+			}
+			nonce, hasNonce = uplinkNonce(decodedDataBytes)
+			encryption = frameEncrypted
+			if keyLabel != keyCurrent {
+				log.Infof("dispatchFrame: address=%s verified with its %s key", address, keyLabel)
+			}
+			m.keyProved(device, keyLabel)
 			// Rebuild the frame as it would have appeared unencrypted on the
 			// wire so downstream MQTT consumers don't need the key.
 			if pub, ok := buildUnencryptedRawFrame(decodedDataBytes, dataBytes); ok {
@@ -321,6 +416,7 @@ func (m *Module) dispatchFrame(
 			//    genuinely unencrypted frame. Downstream model decoders (ZHT)
 			//    still apply their own length/structure validation.
 			log.Infof("dispatchFrame: genuine unencrypted LoRaRAW for address=%s", address)
+			nonce, hasNonce = uplinkNonce(dataBytes)
 			payload := utils.StripLoRaRAWPayload(dataBytes)
 			if err := devDesc.DecodeUplink(dataHex, payload, devDesc, device,
 				successFn, errorFn, metaFn); err != nil {
@@ -333,7 +429,7 @@ func (m *Module) dispatchFrame(
 			//    forged encrypted frame), or it is not a valid plaintext shape.
 			//    Drop rather than decode ciphertext into garbage points.
 			log.Errorf("dispatchFrame: LoRaRAW frame not decryptable and not accepted as plaintext (address=%s, allowUnencrypted=%v, encShaped=%v): %s", address, devDesc.AllowUnencrypted, isEncryptionShaped(dataBytes), derr)
-			return DispatchResult{}
+			return DispatchResult{Address: address, Device: device, Dropped: linkDropCMAC}
 		}
 	} else {
 		log.Infof("dispatchFrame: taking legacy plaintext handler path for address=%s", address)
@@ -350,6 +446,9 @@ func (m *Module) dispatchFrame(
 		SNR:           snr,
 		LegacyDevice:  legacyDevice,
 		OK:            true,
+		Encryption:    encryption,
+		Nonce:         nonce,
+		HasNonce:      hasNonce,
 	}
 }
 
@@ -365,7 +464,7 @@ type legacyDecryptResult struct {
 // (i.e. the bytes really were legacy-encrypted). It returns the rewritten
 // address, dataHex and publishRawHex on success.
 func (m *Module) tryLegacyDecrypt(address string, dataBytesOrig []byte) (legacyDecryptResult, bool) {
-	keyBytes, err := hex.DecodeString(m.config.DefaultKey)
+	keyBytes, err := hex.DecodeString(m.config.deviceDefaultKey())
 	if err != nil {
 		log.Errorf("tryLegacyDecrypt: error decoding default key: %s", err)
 		return legacyDecryptResult{}, false
@@ -471,15 +570,23 @@ func (m *Module) handleLoRaRAWDevice(device *model.Device, devDesc *codec.LoRaDe
 	opts := getOpts(dataBytes)
 	switch opts {
 	case utils.LORARAW_OPTS_UNCONFIRMED_UPLINK:
-		_ = devDesc.DecodeUplink(dataHex, payload, devDesc, device, successFn, errorFn, metaFn)
+		if err := devDesc.DecodeUplink(dataHex, payload, devDesc, device, successFn, errorFn, metaFn); err != nil {
+			log.Errorf("error decoding LoRaRAW uplink: %v", err)
+		}
 	case utils.LORARAW_OPTS_CONFIRMED_UPLINK:
-		m.handleConfirmedOpt(dataBytes, keyBytes)
-		_ = devDesc.DecodeUplink(dataHex, payload, devDesc, device, successFn, errorFn, metaFn)
+		m.handleConfirmedOpt(device, dataBytes, keyBytes)
+		if err := devDesc.DecodeUplink(dataHex, payload, devDesc, device, successFn, errorFn, metaFn); err != nil {
+			log.Errorf("error decoding LoRaRAW uplink: %v", err)
+		}
 	case utils.LORARAW_OPTS_RESPONSE:
 		if len(dataBytes) <= utils.LORARAW_NONCE_POSITION {
 			log.Errorf("dataBytes too short for response: length %d, need at least %d", len(dataBytes), utils.LORARAW_NONCE_POSITION+1)
 			return
 		}
+		if devDesc.DecodeResponse == nil {
+			log.Warnf("device model %s does not decode responses", device.Model)
+			return
+		}
 		msgId := dataBytes[utils.LORARAW_NONCE_POSITION]
 		_ = devDesc.DecodeResponse(dataHex, payload, msgId, devDesc, device, writtenSuccessFn, writtenErrorFn, metaFn)
 	default:
@@ -503,13 +610,40 @@ func getNonce(dataBytes []byte) int {
 	return int(dataBytes[utils.LORARAW_NONCE_POSITION])
 }
 
-func (m *Module) handleConfirmedOpt(dataBytes []byte, byteKey []byte) {
+// uplinkNonce returns the nonce of an uplink frame; other frames (responses)
+// have none worth tracking, as theirs echoes our request's message ID.
+func uplinkNonce(dataBytes []byte) (uint8, bool) {
+	if len(dataBytes) <= utils.LORARAW_NONCE_POSITION {
+		return 0, false
+	}
+	opts := getOpts(dataBytes)
+	if opts != utils.LORARAW_OPTS_UNCONFIRMED_UPLINK && opts != utils.LORARAW_OPTS_CONFIRMED_UPLINK {
+		return 0, false
+	}
+	return dataBytes[utils.LORARAW_NONCE_POSITION], true
+}
+
+// acceptNonce runs an authenticated uplink through the replay guard. Only
+// uplinks are checked: the nonce of a RESPONSE echoes our own request's
+// message ID, which is random and legitimately repeats.
+func (m *Module) acceptNonce(device *model.Device, dataBytes []byte) bool {
+	if m.replayGuard == nil || len(dataBytes) <= utils.LORARAW_NONCE_POSITION {
+		return true
+	}
+	opts := getOpts(dataBytes)
+	if opts != utils.LORARAW_OPTS_UNCONFIRMED_UPLINK && opts != utils.LORARAW_OPTS_CONFIRMED_UPLINK {
+		return true
+	}
+	return m.replayGuard.Check(device.UUID, dataBytes[utils.LORARAW_NONCE_POSITION])
+}
+
+func (m *Module) handleConfirmedOpt(device *model.Device, dataBytes []byte, byteKey []byte) {
 	if len(dataBytes) < utils.LORARAW_HEADER_LEN {
 		log.Errorf("dataBytes too short for confirmed opt: length %d, need at least %d", len(dataBytes), utils.LORARAW_HEADER_LEN)
 		return
 	}
 	ack := createAck(dataBytes[:utils.LORARAW_HEADER_LEN], byteKey, getNonce(dataBytes))
-	err := m.WriteToLoRaRaw(ack)
+	err := m.WriteToLoRaRaw(device.NetworkUUID, ack)
 	if err != nil {
 		log.Errorf("error sending acknowledgement: %s", err)
 	}
@@ -617,9 +751,11 @@ func (m *Module) addDevicePoints(deviceBody *model.Device) error {
 
 func (m *Module) addPointsFromName(deviceBody *model.Device, names ...string) {
 	var points []*model.Point
+	devDesc := codec.GetDeviceDescription(deviceBody, codecs.LoRaDeviceDescriptions)
 	for _, name := range names {
 		point := new(model.Point)
 		setNewPointFields(deviceBody, point, name)
+		setPointConfigFields(point, devDesc)
 		// For UART devices, ensure RSSI and SNR have history enabled by default.
 		if deviceBody.Model == schema.DeviceModelUART && (name == codec.RssiField || name == codec.SnrField) {
 			setUARTCommonHistory(point)
@@ -728,11 +864,15 @@ func (m *Module) getDevice(uuid string) (*model.Device, error) {
 	return device, nil
 }
 
+// getEncryptionKey returns the key downlinks to the device are encrypted
+// with: its current key, unless its last uplink proved it uses its next or
+// previous key (see keyRing).
 func (m *Module) getEncryptionKey(device *model.Device) ([]byte, error) {
-	hexKey := m.config.DefaultKey
-	if device.Manufacture != "" {
-		hexKey = device.Manufacture // Manufacture property from device model holds hex key
+	current, err := m.currentKey(device)
+	if err != nil {
+		return nil, err
 	}
+	hexKey := m.keyRing.downlinkKey(device.UUID, current)
 
 	key, err := hex.DecodeString(hexKey)
 	if err != nil {
@@ -741,72 +881,3 @@ func (m *Module) getEncryptionKey(device *model.Device) ([]byte, error) {
 
 	return key, nil
 }
-
-// initWriteQueue starts the serial drainer if it is not running. It is safe to
-// call after stopWriteQueue, so an Enable following a Disable gets a fresh queue.
-func (m *Module) initWriteQueue() {
-	m.writeQueueMutex.Lock()
-	defer m.writeQueueMutex.Unlock()
-
-	if m.writeQueue != nil {
-		return
-	}
-	m.writeQueue = make(chan []byte, 100)
-	m.writeQueueDone = make(chan struct{})
-
-	go m.processWriteQueue(m.writeQueue, m.writeQueueDone)
-}
-
-// stopWriteQueue stops the serial drainer. The send channel is never closed:
-// a concurrent WriteToLoRaRaw may still be holding it, and sending on a
-// closed channel panics. Dropping the reference is enough.
-func (m *Module) stopWriteQueue() {
-	m.writeQueueMutex.Lock()
-	defer m.writeQueueMutex.Unlock()
-
-	if m.writeQueue == nil {
-		return
-	}
-	close(m.writeQueueDone)
-	m.writeQueue = nil
-	m.writeQueueDone = nil
-}
-
-// getWriteQueue returns the current send channel, or nil when stopped.
-func (m *Module) getWriteQueue() chan []byte {
-	m.writeQueueMutex.Lock()
-	defer m.writeQueueMutex.Unlock()
-
-	return m.writeQueue
-}
-
-func (m *Module) processWriteQueue(queue <-chan []byte, done <-chan struct{}) {
-	defer func() {
-		if r := recover(); r != nil {
-			log.Errorf("Recovered panic in processWriteQueue: %v", r)
-			// Restart goroutine
-			go m.processWriteQueue(queue, done)
-		}
-	}()
-
-	for {
-		select {
-		case data := <-queue:
-			if Port == nil {
-				log.Error("Serial port not connected")
-				continue
-			}
-
-			_, err := Port.Write(data)
-			if err != nil {
-				log.Errorf("Error writing to serial port: %v", err)
-			}
-
-			// Wait a while after sending for the LoRa module to process
-			time.Sleep(50 * time.Millisecond)
-
-		case <-done:
-			return
-		}
-	}
-}
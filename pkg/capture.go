@@ -0,0 +1,404 @@
+package pkg
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NubeIO/lib-module-go/nmodule"
+	"github.com/NubeIO/module-core-loraraw/codec"
+	"github.com/NubeIO/nubeio-rubix-lib-models-go/model"
+	"github.com/NubeIO/nubeio-rubix-lib-models-go/nargs"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	capturesDirName = "captures"
+	captureFileName = "capture.jsonl"
+
+	// captureMaxLineSize bounds a line read back from a capture file; a
+	// frame is at most a few hundred hex characters.
+	captureMaxLineSize = 64 * 1024
+)
+
+// CapturedFrame is one line of a capture file: a raw uplink as the radio of
+// Network delivered it, before any decoding.
+type CapturedFrame struct {
+	Time    time.Time `json:"time"`
+	Network string    `json:"network"`
+	Line    string    `json:"line"`
+}
+
+// frameCapture appends every raw line to capture.jsonl in dir. Once the file
+// reaches maxSize it is rotated to capture.1.jsonl (the previous .1 becomes
+// .2 and so on); at most maxFiles rotated files are kept.
+type frameCapture struct {
+	dir      string
+	maxSize  int64
+	maxFiles int
+
+	file  *os.File
+	size  int64
+	mutex sync.Mutex
+}
+
+func newFrameCapture(dir string, maxSize int64, maxFiles int) (*frameCapture, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	c := &frameCapture{dir: dir, maxSize: maxSize, maxFiles: maxFiles}
+	if err := c.open(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *frameCapture) path(index int) string {
+	if index == 0 {
+		return filepath.Join(c.dir, captureFileName)
+	}
+	ext := filepath.Ext(captureFileName)
+	return filepath.Join(c.dir, fmt.Sprintf("%s.%d%s", strings.TrimSuffix(captureFileName, ext), index, ext))
+}
+
+func (c *frameCapture) open() error {
+	file, err := os.OpenFile(c.path(0), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	c.file = file
+	c.size = info.Size()
+	return nil
+}
+
+func (c *frameCapture) rotate() error {
+	_ = c.file.Close()
+	c.file = nil
+	_ = os.Remove(c.path(c.maxFiles))
+	for i := c.maxFiles - 1; i >= 0; i-- {
+		if err := os.Rename(c.path(i), c.path(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if c.maxFiles == 0 {
+		_ = os.Remove(c.path(1))
+	}
+	return c.open()
+}
+
+// Write appends a raw line received on the network. Errors are logged: a
+// full disk must not stop frames from being decoded.
+func (c *frameCapture) Write(networkUUID, line string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.file == nil {
+		return
+	}
+	data, err := json.Marshal(CapturedFrame{Time: time.Now().UTC(), Network: networkUUID, Line: line})
+	if err != nil {
+		return
+	}
+	data = append(data, '\n')
+	if c.size > 0 && c.size+int64(len(data)) > c.maxSize {
+		if err = c.rotate(); err != nil {
+			log.Errorf("frame capture: rotate: %s", err)
+			return
+		}
+	}
+	n, err := c.file.Write(data)
+	c.size += int64(n)
+	if err != nil {
+		log.Errorf("frame capture: %s", err)
+	}
+}
+
+func (c *frameCapture) Close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.file != nil {
+		_ = c.file.Close()
+		c.file = nil
+	}
+}
+
+func (m *Module) startFrameCapture() {
+	m.stopFrameCapture()
+	if !m.config.CaptureEnable {
+		return
+	}
+	dir := m.capturesDir()
+	if dir == "" {
+		log.Warn("frame capture: no module data dir, capture disabled")
+		return
+	}
+	c, err := newFrameCapture(dir, int64(m.config.CaptureMaxSizeMB)*1024*1024, m.config.CaptureMaxFiles)
+	if err != nil {
+		log.Errorf("frame capture: %s", err)
+		return
+	}
+	m.frameCapture = c
+	log.Infof("capturing raw frames to %s", c.path(0))
+}
+
+func (m *Module) stopFrameCapture() {
+	if m.frameCapture != nil {
+		m.frameCapture.Close()
+		m.frameCapture = nil
+	}
+}
+
+func (m *Module) capturesDir() string {
+	return m.statePath(capturesDirName)
+}
+
+// CaptureFile describes a capture file in the captures dir.
+type CaptureFile struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+func (m *Module) listCaptureFiles() ([]CaptureFile, error) {
+	dir := m.capturesDir()
+	files := []CaptureFile{}
+	if dir == "" {
+		return files, nil
+	}
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return files, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".jsonl" {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, CaptureFile{Name: entry.Name(), Size: info.Size(), Modified: info.ModTime()})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files, nil
+}
+
+// openCaptureFile opens a capture file by name; only plain names inside the
+// captures dir are accepted.
+func (m *Module) openCaptureFile(name string) (*os.File, error) {
+	dir := m.capturesDir()
+	if dir == "" {
+		return nil, fmt.Errorf("no module data dir")
+	}
+	if name == "" {
+		name = captureFileName
+	}
+	if name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return nil, fmt.Errorf("invalid capture file name %q", name)
+	}
+	return os.Open(filepath.Join(dir, name))
+}
+
+// ReplayedFrame is the outcome of one captured frame fed back through
+// dispatchFrame.
+type ReplayedFrame struct {
+	Time       *time.Time         `json:"time,omitempty"`
+	Network    string             `json:"network,omitempty"`
+	Line       string             `json:"line"`
+	Address    string             `json:"address,omitempty"`
+	DeviceUUID string             `json:"device_uuid,omitempty"`
+	DeviceName string             `json:"device_name,omitempty"`
+	Model      string             `json:"model,omitempty"`
+	OK         bool               `json:"ok"`
+	Dropped    string             `json:"dropped,omitempty"`
+	Points     map[string]float64 `json:"points,omitempty"`
+	Written    map[string]float64 `json:"written,omitempty"`
+	Errors     map[string]string  `json:"errors,omitempty"`
+	MetaTags   map[string]string  `json:"meta_tags,omitempty"`
+}
+
+// ReplayOptions selects how captured frames are replayed. Network, when set,
+// only replays the frames heard by that network's radio. ReplayProtection
+// runs the frames through a fresh in-memory replay window, so a capture that
+// contains re-transmitted frames shows them dropped.
+type ReplayOptions struct {
+	Network          string
+	ReplayProtection bool
+}
+
+// replayCapture decodes every frame of a capture against devices, matched by
+// address_uuid, and returns what each frame would have written. Lines may be
+// CapturedFrame JSON or bare hex, e.g. pasted from a log.
+//
+// Nothing leaves the process: the frames run on a scratch Module that only
+// shares the config, so there is no DB, no MQTT, no replay state and no
+// radio (a confirmed uplink's ACK fails to send and is logged).
+func replayCapture(r io.Reader, devices []*model.Device, config *Config, opts ReplayOptions) ([]ReplayedFrame, error) {
+	byAddress := map[string]*model.Device{}
+	for _, device := range devices {
+		if device.AddressUUID == nil || *device.AddressUUID == "" {
+			continue
+		}
+		d := *device
+		d.NetworkUUID = ""
+		byAddress[strings.ToUpper(*device.AddressUUID)] = &d
+	}
+	getDevice := func(address string) *model.Device {
+		return byAddress[strings.ToUpper(address)]
+	}
+
+	scratch := &Module{config: config}
+	if opts.ReplayProtection {
+		scratch.replayGuard = newReplayGuard("", config.ReplayWindowSize, config.ReplayResyncCount)
+	}
+
+	frames := []ReplayedFrame{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 4096), captureMaxLineSize)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		frame := ReplayedFrame{}
+		if strings.HasPrefix(text, "{") {
+			var captured CapturedFrame
+			if err := json.Unmarshal([]byte(text), &captured); err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNo, err)
+			}
+			if opts.Network != "" && captured.Network != opts.Network {
+				continue
+			}
+			frame.Time = &captured.Time
+			frame.Network = captured.Network
+			frame.Line = captured.Line
+		} else {
+			frame.Line = text
+		}
+		frames = append(frames, scratch.replayFrame(frame, getDevice))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return frames, nil
+}
+
+func (m *Module) replayFrame(frame ReplayedFrame, getDevice func(string) *model.Device) ReplayedFrame {
+	points := map[string]float64{}
+	written := map[string]float64{}
+	pointErrors := map[string]string{}
+	metaTags := map[string]string{}
+
+	res := m.dispatchFrame(frame.Line, getDevice,
+		func(name string, value float64, _ *model.Device, _ *codec.LoRaDeviceDescription) error {
+			points[name] = value
+			return nil
+		},
+		func(name string, err error, _ *model.Device, _ *codec.LoRaDeviceDescription) error {
+			pointErrors[name] = err.Error()
+			return nil
+		},
+		func(_ string, tags []*model.DeviceMetaTag) error {
+			for _, tag := range tags {
+				metaTags[tag.Key] = tag.Value
+			}
+			return nil
+		},
+		func(name string, value float64, _ uint8, _ *model.Device) error {
+			written[name] = value
+			return nil
+		},
+		func(name string, err error, _ uint8, _ *model.Device) error {
+			pointErrors[name] = err.Error()
+			return nil
+		},
+	)
+	if res.OK {
+		points[codec.RssiField] = float64(res.RSSI)
+		points[codec.SnrField] = float64(res.SNR)
+	}
+
+	frame.Address = res.Address
+	frame.OK = res.OK
+	frame.Dropped = res.Dropped
+	if res.Device != nil {
+		frame.DeviceUUID = res.Device.UUID
+		frame.DeviceName = res.Device.Name
+		frame.Model = res.Device.Model
+	}
+	if len(points) > 0 {
+		frame.Points = points
+	}
+	if len(written) > 0 {
+		frame.Written = written
+	}
+	if len(pointErrors) > 0 {
+		frame.Errors = pointErrors
+	}
+	if len(metaTags) > 0 {
+		frame.MetaTags = metaTags
+	}
+	return frame
+}
+
+// ReplayRequest is the body of POST /api/captures/replay. Frames come from
+// Lines, or else from the capture file File (default: the current one).
+// Devices are DeviceUUIDs read from the DB plus inline Devices; with neither,
+// every device of the module's networks is used.
+type ReplayRequest struct {
+	File             string          `json:"file"`
+	Lines            []string        `json:"lines"`
+	DeviceUUIDs      []string        `json:"device_uuids"`
+	Devices          []*model.Device `json:"devices"`
+	NetworkUUID      string          `json:"network_uuid"`
+	ReplayProtection bool            `json:"replay_protection"`
+}
+
+func (m *Module) replayCaptureRequest(req *ReplayRequest) ([]ReplayedFrame, error) {
+	devices := req.Devices
+	for _, uuid := range req.DeviceUUIDs {
+		device, err := m.getDevice(uuid)
+		if err != nil {
+			return nil, fmt.Errorf("device %s: %w", uuid, err)
+		}
+		devices = append(devices, device)
+	}
+	if len(req.Devices) == 0 && len(req.DeviceUUIDs) == 0 {
+		networks, err := m.grpcMarshaller.GetNetworksByPluginName(m.moduleName, &nmodule.Opts{Args: &nargs.Args{WithDevices: true}})
+		if err != nil {
+			return nil, err
+		}
+		for _, network := range networks {
+			devices = append(devices, network.Devices...)
+		}
+	}
+
+	var r io.Reader
+	if len(req.Lines) > 0 {
+		r = strings.NewReader(strings.Join(req.Lines, "\n"))
+	} else {
+		file, err := m.openCaptureFile(req.File)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		r = file
+	}
+	return replayCapture(r, devices, m.config, ReplayOptions{Network: req.NetworkUUID, ReplayProtection: req.ReplayProtection})
+}
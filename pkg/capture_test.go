@@ -0,0 +1,127 @@
+package pkg
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/NubeIO/module-core-loraraw/schema"
+	"github.com/NubeIO/nubeio-rubix-lib-models-go/model"
+)
+
+const testCaptureFrame = "65C0640DA98521CC47B800BF4F2E90E4014F5279F207180C56A29EE9604CE987A1BA825351BDEF154126"
+
+func TestFrameCapture_Rotates(t *testing.T) {
+	dir := t.TempDir()
+	c, err := newFrameCapture(dir, 200, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		c.Write("net-1", testCaptureFrame)
+	}
+	c.Close()
+
+	for _, name := range []string{"capture.jsonl", "capture.1.jsonl", "capture.2.jsonl"} {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(data) > 200 {
+			t.Fatalf("%s is %d bytes, over the limit", name, len(data))
+		}
+		scanner := bufio.NewScanner(strings.NewReader(string(data)))
+		for scanner.Scan() {
+			var frame CapturedFrame
+			if err := json.Unmarshal(scanner.Bytes(), &frame); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if frame.Network != "net-1" || frame.Line != testCaptureFrame || frame.Time.IsZero() {
+				t.Fatalf("%s: unexpected frame %+v", name, frame)
+			}
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "capture.3.jsonl")); !os.IsNotExist(err) {
+		t.Fatalf("expected at most 2 rotated files")
+	}
+}
+
+func TestReplayCapture_DecodesAgainstDevices(t *testing.T) {
+	addr := "65C0640D"
+	devices := []*model.Device{{
+		CommonUUID: model.CommonUUID{UUID: "dev-optical"},
+		Name:       "optical",
+		CommonDevice: model.CommonDevice{
+			Model:       schema.DeviceModelRubixEncrypted,
+			AddressUUID: &addr,
+		},
+		NetworkUUID: "net-1",
+	}}
+	capture := strings.Join([]string{
+		`{"time":"2026-10-01T10:00:00Z","network":"net-1","line":"` + testCaptureFrame + `"}`,
+		`{"time":"2026-10-01T10:00:05Z","network":"net-2","line":"` + testCaptureFrame + `"}`,
+		"",
+		strings.ToLower(testCaptureFrame), // bare hex, e.g. pasted from a log
+		"AABBCCDD" + testCaptureFrame[8:],
+	}, "\n")
+	config := &Config{DefaultKey: testDefaultKey, ReplayWindowSize: 32}
+
+	frames, err := replayCapture(strings.NewReader(capture), devices, config, ReplayOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 4 {
+		t.Fatalf("expected 4 frames, got %d", len(frames))
+	}
+	first := frames[0]
+	if !first.OK || first.DeviceUUID != "dev-optical" || first.Network != "net-1" || first.Time == nil {
+		t.Fatalf("first frame: %+v", first)
+	}
+	if _, ok := first.Points["rssi"]; !ok || len(first.Points) < 3 {
+		t.Fatalf("expected decoded points, got %v", first.Points)
+	}
+	if !frames[2].OK || frames[2].Time != nil {
+		t.Fatalf("bare hex frame: %+v", frames[2])
+	}
+	if frames[3].OK || frames[3].DeviceUUID != "" {
+		t.Fatalf("unknown address must not decode: %+v", frames[3])
+	}
+	if devices[0].NetworkUUID != "net-1" {
+		t.Fatalf("replay must not modify the devices passed in")
+	}
+
+	frames, err = replayCapture(strings.NewReader(capture), devices, config, ReplayOptions{Network: "net-1", ReplayProtection: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 3 || !frames[0].OK || frames[1].OK || frames[1].Dropped != linkDropReplay {
+		t.Fatalf("expected net-2 skipped and the repeated frame dropped: %+v", frames)
+	}
+}
+
+func TestReplayCommand(t *testing.T) {
+	dir := t.TempDir()
+	devicesFile := filepath.Join(dir, "devices.json")
+	captureFile := filepath.Join(dir, "capture.jsonl")
+	devices := `[{"uuid":"dev-optical","address_uuid":"65C0640D","model":"` + schema.DeviceModelRubixEncrypted + `"}]`
+	if err := os.WriteFile(devicesFile, []byte(devices), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(captureFile, []byte(testCaptureFrame+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var out strings.Builder
+	if err := ReplayCommand([]string{"-devices", devicesFile, captureFile}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out.String(), "65C0640D "+schema.DeviceModelRubixEncrypted+" ok ") || !strings.Contains(out.String(), " rssi=") {
+		t.Fatalf("unexpected output %q", out.String())
+	}
+	if err := ReplayCommand([]string{captureFile}, &out); err == nil {
+		t.Fatalf("expected an error without -devices")
+	}
+}
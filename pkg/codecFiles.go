@@ -0,0 +1,34 @@
+package pkg
+
+import (
+	"github.com/NubeIO/module-core-loraraw/codec"
+	"github.com/NubeIO/module-core-loraraw/codecs"
+	"github.com/NubeIO/module-core-loraraw/codecs/declarativeCodecs"
+	log "github.com/sirupsen/logrus"
+)
+
+const codecsDirName = "codecs"
+
+// loadCodecFiles (re)registers the models described by the codec files, so
+// an integrator can add a simple sensor by dropping a file in and re-enabling
+// the module.
+func (m *Module) loadCodecFiles() {
+	dir := m.config.CodecsDir
+	if dir == "" {
+		dir = m.statePath(codecsDirName)
+	}
+	var descs []codec.LoRaDeviceDescription
+	if dir != "" {
+		var errs []error
+		descs, errs = declarativeCodecs.LoadDir(dir, m.config.CodecScriptTimeout)
+		for _, err := range errs {
+			log.Errorf("codec file: %v", err)
+		}
+	}
+	for _, err := range codecs.SetFileDeviceDescriptions(descs) {
+		log.Errorf("codec file: %v", err)
+	}
+	if models := codecs.FileModels(); len(models) > 0 {
+		log.Infof("loaded codec file models: %v", models)
+	}
+}
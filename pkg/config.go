@@ -6,15 +6,24 @@ import (
 	"strings"
 	"time"
 
+	"github.com/NubeIO/module-core-loraraw/codecs/declarativeCodecs"
 	"github.com/NubeIO/module-core-loraraw/logger"
 	"github.com/go-yaml/yaml"
 	log "github.com/sirupsen/logrus"
 )
 
 type Config struct {
-	ReIterationTime      time.Duration `yaml:"re_iteration_time"`
-	LogLevel             string        `yaml:"log_level"`
-	DefaultKey           string        `yaml:"default_key" type:"secret"`
+	ReIterationTime time.Duration `yaml:"re_iteration_time"`
+	LogLevel        string        `yaml:"log_level"`
+	DefaultKey      string        `yaml:"default_key" type:"secret"`
+	// MasterKeyFile holds the hex AES key device keys are encrypted with at
+	// rest (LORARAW_MASTER_KEY overrides it). DefaultKeyFile holds the default
+	// key instead of DefaultKey (LORARAW_DEFAULT_KEY overrides both).
+	MasterKeyFile  string `yaml:"master_key_file"`
+	DefaultKeyFile string `yaml:"default_key_file"`
+	// KeyRotationWindow is how long a device's old key is still accepted
+	// after its next key was promoted (0 drops it at once).
+	KeyRotationWindow    time.Duration `yaml:"key_rotation_window"`
 	WriteQueueMaxRetries int           `yaml:"write_queue_max_retries"`
 	MQTTEnable           bool          `yaml:"mqtt_enable"`
 	MQTTBroker           string        `yaml:"mqtt_broker"`
@@ -22,26 +31,150 @@ type Config struct {
 	MQTTUsername         string        `yaml:"mqtt_username"`
 	MQTTPassword         string        `yaml:"mqtt_password" type:"secret"`
 	MQTTTopicPrefix      string        `yaml:"mqtt_topic_prefix"`
+	// MQTTPointTopic, when set, also publishes every decoded value on its own
+	// topic, e.g. "<prefix>/devices/<address>/<point>" (<device> is the device
+	// name). MQTTRetain retains those; MQTTQoS (0-2) applies to all data
+	// publishes.
+	MQTTPointTopic string `yaml:"mqtt_point_topic"`
+	MQTTRetain     bool   `yaml:"mqtt_retain"`
+	MQTTQoS        int    `yaml:"mqtt_qos"`
+	// MQTTValueSchema is the schema version of the <prefix>/value payload: 1
+	// is the original envelope, 2 adds the timestamp, network, device, signal
+	// metadata and per-point UUIDs, units and faults.
+	MQTTValueSchema int `yaml:"mqtt_value_schema"`
+	// The MQTT TLS settings apply to ssl://, tls://, mqtts:// and wss://
+	// brokers. MQTTCertFile and MQTTKeyFile are the client certificate for
+	// brokers that require mutual TLS. MQTTInsecureSkipVerify skips the
+	// broker certificate check, for lab brokers only.
+	MQTTCAFile             string `yaml:"mqtt_ca_file"`
+	MQTTCertFile           string `yaml:"mqtt_cert_file"`
+	MQTTKeyFile            string `yaml:"mqtt_key_file"`
+	MQTTInsecureSkipVerify bool   `yaml:"mqtt_insecure_skip_verify"`
+	// MQTTProtocolVersion is 3 (MQTT 3.1.1) or 5. MQTTUserProperties are
+	// added to every publish on MQTT 5.
+	MQTTProtocolVersion int               `yaml:"mqtt_protocol_version"`
+	MQTTUserProperties  map[string]string `yaml:"mqtt_user_properties"`
+	// MQTTBufferEnable keeps the raw and value publishes made while the broker
+	// is down in mqtt-buffer.jsonl in the module data dir and sends them in
+	// order on reconnect. The oldest are dropped past MQTTBufferMaxSizeMB of
+	// payload or once older than MQTTBufferMaxAge (0 is no limit).
+	MQTTBufferEnable    bool          `yaml:"mqtt_buffer_enable"`
+	MQTTBufferMaxSizeMB int           `yaml:"mqtt_buffer_max_size_mb"`
+	MQTTBufferMaxAge    time.Duration `yaml:"mqtt_buffer_max_age"`
+	// HADiscovery publishes Home Assistant MQTT discovery configs for every
+	// point under HADiscoveryPrefix. The sensors' state comes from the
+	// per-point topics, which are enabled with the default template if
+	// MQTTPointTopic is empty.
+	HADiscovery       bool   `yaml:"ha_discovery"`
+	HADiscoveryPrefix string `yaml:"ha_discovery_prefix"`
 	// WriteResponseTimeout is how long the radio is held idle after each write
 	// transmission waiting for the device's RESPONSE before the next frame goes.
 	WriteResponseTimeout time.Duration `yaml:"write_response_timeout"`
+	// A write that got no RESPONSE is retried after WriteRetryBackoff,
+	// doubled per attempt up to WriteRetryBackoffMax, with jitter (0 retries
+	// right away).
+	WriteRetryBackoff    time.Duration `yaml:"write_retry_backoff"`
+	WriteRetryBackoffMax time.Duration `yaml:"write_retry_backoff_max"`
+	// DutyCycleLimit is the share of DutyCycleWindow (percent) each radio may
+	// be on air, e.g. 1 for EU868 (0 disables the budget). Time on air is
+	// estimated from the frame length and the radios' LoRaSpreadingFactor,
+	// LoRaBandwidthKHz and LoRaCodingRate (5 to 8, for 4/5 to 4/8).
+	DutyCycleLimit      float64       `yaml:"duty_cycle_limit"`
+	DutyCycleWindow     time.Duration `yaml:"duty_cycle_window"`
+	LoRaSpreadingFactor int           `yaml:"lora_spreading_factor"`
+	LoRaBandwidthKHz    float64       `yaml:"lora_bandwidth_khz"`
+	LoRaCodingRate      int           `yaml:"lora_coding_rate"`
+	// ReplayProtection rejects encrypted uplinks whose nonce was already seen
+	// (or is older than ReplayWindowSize frames). ReplayResyncCount consecutive
+	// nonces behind the window re-sync it, so a rebooted device is not locked
+	// out; 0 (default) disables the re-sync, the window is then reset over
+	// the API.
+	ReplayProtection  bool `yaml:"replay_protection"`
+	ReplayWindowSize  int  `yaml:"replay_window_size"`
+	ReplayResyncCount int  `yaml:"replay_resync_count"`
+	// CodecsDir holds the declarative codec files loaded at Enable. Empty is
+	// the codecs dir in the module data dir.
+	CodecsDir string `yaml:"codecs_dir"`
+	// CodecScriptTimeout is how long a codec file's JavaScript formatter may
+	// run per uplink or downlink before it is interrupted.
+	CodecScriptTimeout time.Duration `yaml:"codec_script_timeout"`
+	// LinkStatsWindow is the number of recent frames the per-device RSSI/SNR
+	// min/avg/max cover. LinkStatsPoints also writes the averages and the
+	// estimated packet loss to rssi_avg, snr_avg and packet_loss points.
+	LinkStatsWindow int  `yaml:"link_stats_window"`
+	LinkStatsPoints bool `yaml:"link_stats_points"`
+	// ModelLearningFrames is how many frames a device learning its model is
+	// heard before its model is corrected (1 to 10).
+	ModelLearningFrames int `yaml:"model_learning_frames"`
+	// A device is faulted once it has been silent for OfflineMissedIntervals
+	// of its expected uplink interval (0 disables the check). The interval
+	// comes from the device's uplink_interval meta tag, its reported push
+	// frequency, OfflineModelIntervals, then OfflineDefaultInterval.
+	OfflineMissedIntervals int                      `yaml:"offline_missed_intervals"`
+	OfflineDefaultInterval time.Duration            `yaml:"offline_default_interval"`
+	OfflineModelIntervals  map[string]time.Duration `yaml:"offline_model_intervals"`
+	// CaptureEnable appends every raw line the radios deliver to
+	// captures/capture.jsonl in the module data dir, for replaying later. The
+	// file is rotated at CaptureMaxSizeMB, keeping CaptureMaxFiles old files.
+	CaptureEnable    bool `yaml:"capture_enable"`
+	CaptureMaxSizeMB int  `yaml:"capture_max_size_mb"`
+	CaptureMaxFiles  int  `yaml:"capture_max_files"`
+
+	sealer     *keySealer
+	defaultKey string
 }
 
 const DefaultDeviceKey = "0301021604050f07e6095a0b0c12630f"
 
 func (m *Module) DefaultConfig() *Config {
 	return &Config{
-		ReIterationTime:      5 * time.Second,
-		LogLevel:             "ERROR",
-		DefaultKey:           DefaultDeviceKey,
-		WriteQueueMaxRetries: 5,
-		MQTTEnable:           true,
-		MQTTBroker:           "tcp://127.0.0.1:1883",
-		MQTTClientID:         "module-core-loraraw",
-		MQTTUsername:         "",
-		MQTTPassword:         "",
-		MQTTTopicPrefix:      MQTTTopicPrefix,
-		WriteResponseTimeout: 5 * time.Second,
+		ReIterationTime:        5 * time.Second,
+		LogLevel:               "ERROR",
+		DefaultKey:             DefaultDeviceKey,
+		KeyRotationWindow:      24 * time.Hour,
+		WriteQueueMaxRetries:   5,
+		MQTTEnable:             true,
+		MQTTBroker:             "tcp://127.0.0.1:1883",
+		MQTTClientID:           "module-core-loraraw",
+		MQTTUsername:           "",
+		MQTTPassword:           "",
+		MQTTTopicPrefix:        MQTTTopicPrefix,
+		MQTTPointTopic:         "",
+		MQTTRetain:             false,
+		MQTTQoS:                0,
+		MQTTValueSchema:        ValueSchemaV1,
+		MQTTCAFile:             "",
+		MQTTCertFile:           "",
+		MQTTKeyFile:            "",
+		MQTTInsecureSkipVerify: false,
+		MQTTProtocolVersion:    MQTTProtocolV3,
+		MQTTUserProperties:     map[string]string{},
+		MQTTBufferEnable:       false,
+		MQTTBufferMaxSizeMB:    10,
+		MQTTBufferMaxAge:       24 * time.Hour,
+		HADiscovery:            false,
+		HADiscoveryPrefix:      HADiscoveryPrefix,
+		WriteResponseTimeout:   5 * time.Second,
+		WriteRetryBackoff:      5 * time.Second,
+		WriteRetryBackoffMax:   time.Minute,
+		DutyCycleLimit:         1,
+		DutyCycleWindow:        time.Hour,
+		LoRaSpreadingFactor:    7,
+		LoRaBandwidthKHz:       125,
+		LoRaCodingRate:         5,
+		ReplayProtection:       true,
+		ReplayWindowSize:       32,
+		ReplayResyncCount:      0,
+		CodecScriptTimeout:     declarativeCodecs.DefaultScriptTimeout,
+		LinkStatsWindow:        50,
+		ModelLearningFrames:    5,
+		LinkStatsPoints:        false,
+		OfflineMissedIntervals: 3,
+		OfflineDefaultInterval: 0,
+		OfflineModelIntervals:  map[string]time.Duration{},
+		CaptureEnable:          false,
+		CaptureMaxSizeMB:       10,
+		CaptureMaxFiles:        5,
 	}
 }
 
@@ -56,20 +189,90 @@ func (m *Module) ValidateAndSetConfig(config []byte) ([]byte, error) {
 	logger.SetLogger(logLevel)
 	newConfig.LogLevel = strings.ToUpper(logLevel.String())
 
+	if newConfig.KeyRotationWindow < 0 {
+		newConfig.KeyRotationWindow = 0
+	}
 	if newConfig.WriteResponseTimeout <= 0 {
 		newConfig.WriteResponseTimeout = 5 * time.Second
 	}
+	if newConfig.WriteRetryBackoff < 0 {
+		newConfig.WriteRetryBackoff = 0
+	}
+	if newConfig.WriteRetryBackoffMax < newConfig.WriteRetryBackoff {
+		newConfig.WriteRetryBackoffMax = newConfig.WriteRetryBackoff
+	}
+	if newConfig.DutyCycleLimit < 0 || newConfig.DutyCycleLimit > 100 {
+		newConfig.DutyCycleLimit = 1
+	}
+	if newConfig.DutyCycleWindow <= 0 {
+		newConfig.DutyCycleWindow = time.Hour
+	}
+	if newConfig.LoRaSpreadingFactor < 7 || newConfig.LoRaSpreadingFactor > 12 {
+		newConfig.LoRaSpreadingFactor = 7
+	}
+	if newConfig.LoRaBandwidthKHz <= 0 {
+		newConfig.LoRaBandwidthKHz = 125
+	}
+	if newConfig.LoRaCodingRate < 5 || newConfig.LoRaCodingRate > 8 {
+		newConfig.LoRaCodingRate = 5
+	}
+	if newConfig.MQTTQoS < 0 || newConfig.MQTTQoS > 2 {
+		newConfig.MQTTQoS = 0
+	}
+	if newConfig.MQTTValueSchema != ValueSchemaV2 {
+		newConfig.MQTTValueSchema = ValueSchemaV1
+	}
+	if newConfig.MQTTProtocolVersion != MQTTProtocolV5 {
+		newConfig.MQTTProtocolVersion = MQTTProtocolV3
+	}
+	if newConfig.MQTTBufferMaxSizeMB <= 0 {
+		newConfig.MQTTBufferMaxSizeMB = 10
+	}
+	if newConfig.MQTTBufferMaxAge < 0 {
+		newConfig.MQTTBufferMaxAge = 0
+	}
+	if newConfig.HADiscoveryPrefix == "" {
+		newConfig.HADiscoveryPrefix = HADiscoveryPrefix
+	}
 	if newConfig.WriteQueueMaxRetries <= 0 {
 		newConfig.WriteQueueMaxRetries = 1
 	}
+	if newConfig.ReplayWindowSize <= 0 || newConfig.ReplayWindowSize > replayWindowMaxSize {
+		newConfig.ReplayWindowSize = 32
+	}
+	if newConfig.CodecScriptTimeout <= 0 {
+		newConfig.CodecScriptTimeout = declarativeCodecs.DefaultScriptTimeout
+	}
+	if newConfig.OfflineMissedIntervals < 0 {
+		newConfig.OfflineMissedIntervals = 0
+	}
+	if newConfig.LinkStatsWindow <= 0 {
+		newConfig.LinkStatsWindow = 50
+	}
+	if newConfig.ModelLearningFrames <= 0 || newConfig.ModelLearningFrames > modelDetectionFrames {
+		newConfig.ModelLearningFrames = 5
+	}
+	if newConfig.CaptureMaxSizeMB <= 0 {
+		newConfig.CaptureMaxSizeMB = 10
+	}
+	if newConfig.CaptureMaxFiles < 0 {
+		newConfig.CaptureMaxFiles = 0
+	}
+	if newConfig.ReplayResyncCount < 0 {
+		newConfig.ReplayResyncCount = 0
+	}
 
-	keyBytes, err := hex.DecodeString(newConfig.DefaultKey)
+	if newConfig.DefaultKey == "" {
+		newConfig.DefaultKey = DefaultDeviceKey
+	}
+	if err = newConfig.resolveKeys(); err != nil {
+		return nil, err
+	}
+	keyBytes, err := hex.DecodeString(newConfig.deviceDefaultKey())
 	if err != nil {
 		return nil, err
 	}
-	if len(keyBytes) == 0 {
-		newConfig.DefaultKey = DefaultDeviceKey
-	} else if len(keyBytes) != 16 {
+	if len(keyBytes) != 16 {
 		return nil, errors.New("invalid default key: must be exactly 16 bytes")
 	}
 
@@ -117,6 +117,7 @@ func (m *Module) updateDevicePoint(pointIDStr string, value float64, err error,
 			return err
 		}
 		pnt = newPoint
+		m.refreshHADiscovery()
 	}
 	if err != nil {
 		err = m.updatePointValueError(pnt, err)
@@ -138,27 +139,35 @@ func (m *Module) updateDeviceWrittenPointError(pointIDStr string, err error, mes
 }
 
 func (m *Module) updateDeviceWrittenPoint(pointIDStr string, value float64, err error, messageId uint8, device *model.Device) error {
-	point := m.pointWriteQueueManager.DequeueUsingMessageId(device.UUID, messageId)
+	writeQueueManager := m.getWriteQueueManager(device)
+	if writeQueueManager == nil {
+		log.Errorf("network %s of device %s is not running", device.NetworkUUID, device.UUID)
+		return nil
+	}
+	point, correlationID := writeQueueManager.AckPoint(device.UUID, messageId, pointIDStr)
 	if point == nil {
-		log.Errorf("failed to find point with messageId: %d", messageId)
+		log.Errorf("failed to find point %s with messageId: %d", pointIDStr, messageId)
 		return nil
 	}
 	if err != nil {
 		_, _ = m.updateWrittenPointError(point, err)
+		m.finishWriteCommand(point, correlationID, writeStatusError, err)
 	} else {
 		_, _ = m.updateWrittenPointSuccess(point)
+		m.finishWriteCommand(point, correlationID, writeStatusAcked, nil)
 	}
 	return nil
 }
 
 // onWriteExhausted is called by the write scheduler once a point's write has
 // used up all its attempts without a device RESPONSE.
-func (m *Module) onWriteExhausted(point *model.Point) {
+func (m *Module) onWriteExhausted(point *model.Point, correlationID string) {
 	if point.UUID == "" { // synthetic points (e.g. UART ping) are not stored
 		return
 	}
 	err := fmt.Errorf("no response from device after %d write attempts", m.config.WriteQueueMaxRetries)
 	_, _ = m.updateWrittenPointError(point, err)
+	m.finishWriteCommand(point, correlationID, writeStatusExhausted, err)
 }
 
 func selectPointByIoNumber(ioNumber string, device *model.Device) *model.Point {
@@ -182,6 +191,7 @@ func (m *Module) addPointFromName(deviceBody *model.Device, pointIDStr string, d
 		setNewPointFieldsUART(deviceBody, point, pointIDStr)
 	} else {
 		setNewPointFields(deviceBody, point, pointIDStr)
+		setPointConfigFields(point, devDesc)
 	}
 	point.EnableWriteable = boolean.NewFalse()
 	pnt, err := m.savePoint(point)
@@ -245,6 +255,36 @@ func setNewPointFields(deviceBody *model.Device, pointBody *model.Point, pointID
 	pointBody.DataType, _ = rubixDataEncoding.GetMetaDataKey(pointIDStr)
 }
 
+// setPointConfigFields applies the overrides the model has for the point, if
+// any (e.g. names and history defaults from a codec file).
+func setPointConfigFields(pointBody *model.Point, devDesc *codec.LoRaDeviceDescription) {
+	if devDesc == nil || devDesc.GetPointConfig == nil {
+		return
+	}
+	config := devDesc.GetPointConfig(pointBody.IoNumber)
+	if config == nil {
+		return
+	}
+	if config.Name != "" {
+		pointBody.Name = config.Name
+	}
+	if config.WriteMode != "" {
+		pointBody.WriteMode = config.WriteMode
+	}
+	if config.HistoryEnable != nil {
+		pointBody.HistoryEnable = config.HistoryEnable
+	}
+	if config.HistoryType != "" {
+		pointBody.HistoryType = config.HistoryType
+	}
+	if config.HistoryInterval != nil {
+		pointBody.HistoryInterval = config.HistoryInterval
+	}
+	if config.HistoryCOVThreshold != nil {
+		pointBody.HistoryCOVThreshold = config.HistoryCOVThreshold
+	}
+}
+
 func (m *Module) savePoint(point *model.Point) (*model.Point, error) {
 	point.EnableWriteable = boolean.NewFalse()
 	pnt, err := m.addPoint(point)
@@ -311,6 +351,23 @@ func (m *Module) updateWrittenPointError(point *model.Point, err error) (*model.
 	return &pwResponse.Point, nil
 }
 
+// updateWrittenPointCancelled clears the pending write state of a point whose
+// write was cancelled before it went on air; the point keeps its value.
+func (m *Module) updateWrittenPointCancelled(point *model.Point) (*model.Point, error) {
+	pointWriter := &dto.PointWriter{
+		OriginalValue: point.OriginalValue,
+		Message:       errWriteCancelled.Error(),
+		Fault:         false,
+		PollState:     datatype.PointStateApiWriteFailed,
+	}
+	pwResponse, err := m.grpcMarshaller.PointWrite(point.UUID, pointWriter)
+	if err != nil {
+		log.Errorf("updateWrittenPointCancelled() error: %s", err)
+		return nil, err
+	}
+	return &pwResponse.Point, nil
+}
+
 func (m *Module) updateDeviceMetaTags(uuid string, metaTags []*model.DeviceMetaTag) error {
 	err := m.grpcMarshaller.UpsertDeviceMetaTags(uuid, metaTags, nil)
 	if err != nil {
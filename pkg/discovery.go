@@ -0,0 +1,247 @@
+package pkg
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NubeIO/module-core-loraraw/codec"
+	"github.com/NubeIO/module-core-loraraw/codecs"
+	"github.com/NubeIO/module-core-loraraw/utils"
+	"github.com/NubeIO/nubeio-rubix-lib-models-go/model"
+)
+
+const (
+	// discoveryMaxEntries caps the inbox; the address heard least recently
+	// makes room for a new one.
+	discoveryMaxEntries = 256
+
+	// frameUnknownKey is the encryption guess of a frame shaped like a
+	// LoRaRAW ciphertext that does not verify with the default key.
+	frameUnknownKey = "encrypted_unknown_key"
+)
+
+// DiscoveredDevice is an address heard on the air that matches no device,
+// an entry of the discovery inbox. Encryption and Models are guessed from its
+// last frames: how it arrived (frameEncrypted means it verified with the
+// default key), and the models whose codec accepts the payload. A legacy
+// frame does not tell whether it is plaintext or encrypted with the default
+// key; LegacyAddress is the device's address in the second case.
+type DiscoveredDevice struct {
+	Address       string    `json:"address"`
+	LegacyAddress string    `json:"legacy_address,omitempty"`
+	NetworkUUID   string    `json:"network_uuid"`
+	FirstSeen     time.Time `json:"first_seen"`
+	LastSeen      time.Time `json:"last_seen"`
+	Frames        uint64    `json:"frames"`
+	RSSI          int       `json:"rssi"`
+	SNR           float32   `json:"snr"`
+	Encryption    string    `json:"encryption"`
+	Models        []string  `json:"models"`
+}
+
+// discoveryInbox keeps a DiscoveredDevice per address. It is in memory only:
+// a device that is still around is heard again after a restart.
+type discoveryInbox struct {
+	entries map[string]*DiscoveredDevice
+	mutex   sync.Mutex
+}
+
+func newDiscoveryInbox() *discoveryInbox {
+	return &discoveryInbox{entries: make(map[string]*DiscoveredDevice)}
+}
+
+// Seen records a frame from an unknown address. models may be empty when the
+// frame matched no codec; the last non-empty guess is kept.
+func (d *discoveryInbox) Seen(networkUUID string, res DispatchResult, encryption string, models []string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	now := time.Now()
+	e, ok := d.entries[res.Address]
+	if !ok {
+		if len(d.entries) >= discoveryMaxEntries {
+			d.evict()
+		}
+		e = &DiscoveredDevice{Address: res.Address, FirstSeen: now}
+		d.entries[res.Address] = e
+	}
+	e.NetworkUUID = networkUUID
+	e.LastSeen = now
+	e.Frames++
+	e.RSSI = res.RSSI
+	e.SNR = res.SNR
+	e.LegacyAddress = res.LegacyAddress
+	if len(models) > 0 || e.Encryption == "" {
+		e.Encryption = encryption
+		e.Models = models
+	}
+}
+
+func (d *discoveryInbox) evict() {
+	var oldest *DiscoveredDevice
+	for _, e := range d.entries {
+		if oldest == nil || e.LastSeen.Before(oldest.LastSeen) {
+			oldest = e
+		}
+	}
+	if oldest != nil {
+		delete(d.entries, oldest.Address)
+	}
+}
+
+// List returns the inbox, the address heard most recently first.
+func (d *discoveryInbox) List() []DiscoveredDevice {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	list := make([]DiscoveredDevice, 0, len(d.entries))
+	for _, e := range d.entries {
+		entry := *e
+		entry.Models = append([]string(nil), e.Models...)
+		list = append(list, entry)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].LastSeen.After(list[j].LastSeen) })
+	return list
+}
+
+func (d *discoveryInbox) Get(address string) (DiscoveredDevice, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	e, ok := d.entries[strings.ToUpper(address)]
+	if !ok {
+		return DiscoveredDevice{}, false
+	}
+	return *e, true
+}
+
+func (d *discoveryInbox) Forget(address string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	delete(d.entries, strings.ToUpper(address))
+}
+
+// guessDevice guesses how an unknown device's frame is encrypted, and which
+// models it may be: those whose codec accepts the payload.
+func (m *Module) guessDevice(res DispatchResult) (string, []string) {
+	dataBytes, err := hex.DecodeString(res.DataHex)
+	if err != nil {
+		return "", nil
+	}
+	if key, err := hex.DecodeString(m.config.deviceDefaultKey()); err == nil {
+		if decoded, err := tryDecryptLoRaRAWPkt(dataBytes, key); err == nil {
+			return frameEncrypted, guessModels(true, false, loRaRAWPayloadHex(decoded))
+		}
+	}
+	if isEncryptionShaped(dataBytes) {
+		return frameUnknownKey, guessModels(true, false, "")
+	}
+	if isUnencryptedLoRaRAW(dataBytes) {
+		if models := guessModels(true, true, loRaRAWPayloadHex(dataBytes)); len(models) > 0 {
+			return framePlaintext, models
+		}
+	}
+	return framePlaintext, guessModels(false, false, res.DataHex)
+}
+
+// guessModels returns the LoRaRAW (or legacy) models whose codec accepts
+// data; with plaintext, only the LoRaRAW models that allow it. An empty data
+// is not checked, for a payload that could not be decrypted.
+func guessModels(loRaRAW, plaintext bool, data string) []string {
+	var models []string
+	for i := range codecs.LoRaDeviceDescriptions {
+		desc := &codecs.LoRaDeviceDescriptions[i]
+		if desc.IsLoRaRAW != loRaRAW || (plaintext && !desc.AllowUnencrypted) {
+			continue
+		}
+		if data != "" && (desc.CheckLength == nil || !desc.CheckLength(data)) {
+			continue
+		}
+		models = append(models, desc.Model)
+	}
+	return models
+}
+
+func loRaRAWPayloadHex(dataBytes []byte) string {
+	if len(dataBytes) <= utils.LORARAW_PAYLOAD_START || !utils.CheckLoRaRAWPayloadLength(dataBytes) {
+		return ""
+	}
+	return hex.EncodeToString(utils.StripLoRaRAWPayload(dataBytes))
+}
+
+// ProvisionBody is the body of POST /api/discovered/:address. Model defaults
+// to the entry's first guess, and the device then learns its model (see
+// modelDetector); Key (hex) is the device key, empty for the
+// default key. LegacyEncrypted creates the device at the entry's
+// LegacyAddress. WithPoints defaults to true.
+type ProvisionBody struct {
+	Name            string `json:"name"`
+	Model           string `json:"model"`
+	Key             string `json:"key"`
+	NetworkUUID     string `json:"network_uuid"`
+	LegacyEncrypted bool   `json:"legacy_encrypted"`
+	WithPoints      *bool  `json:"with_points"`
+}
+
+// provisionDevice creates the device of an inbox entry and takes it off the
+// inbox.
+func (m *Module) provisionDevice(address string, body *ProvisionBody) (*model.Device, error) {
+	if m.discovery == nil {
+		return nil, errors.New("module is not enabled")
+	}
+	entry, ok := m.discovery.Get(address)
+	if !ok {
+		return nil, fmt.Errorf("address %s is not in the discovery inbox", address)
+	}
+	address = entry.Address
+	if body.LegacyEncrypted {
+		if entry.LegacyAddress == "" {
+			return nil, fmt.Errorf("%s does not decrypt with the default key", entry.Address)
+		}
+		address = entry.LegacyAddress
+	}
+	device := &model.Device{
+		Name: body.Name,
+		CommonDevice: model.CommonDevice{
+			Model:       body.Model,
+			AddressUUID: &address,
+			Manufacture: body.Key,
+		},
+		NetworkUUID: body.NetworkUUID,
+	}
+	learn := device.Model == ""
+	if learn {
+		if len(entry.Models) == 0 {
+			return nil, fmt.Errorf("no model guessed for %s, give one", entry.Address)
+		}
+		device.Model = entry.Models[0]
+	}
+	if codec.GetDeviceDescription(device, codecs.LoRaDeviceDescriptions) == &codec.NilLoRaDeviceDescription {
+		return nil, fmt.Errorf("unknown model %s", device.Model)
+	}
+	if device.Name == "" {
+		device.Name = fmt.Sprintf("%s-%s", device.Model, address)
+	}
+	if device.NetworkUUID == "" {
+		device.NetworkUUID = entry.NetworkUUID
+	}
+	if err := m.prepareDeviceKey("", device); err != nil {
+		return nil, err
+	}
+	withPoints := body.WithPoints == nil || *body.WithPoints
+	created, err := m.addDevice(device, withPoints)
+	if err != nil {
+		return nil, err
+	}
+	m.discovery.Forget(entry.Address)
+	if learn && m.modelDetector != nil {
+		m.modelDetector.SetLearning(created.UUID, true)
+	}
+	return created, nil
+}
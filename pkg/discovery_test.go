@@ -0,0 +1,80 @@
+package pkg
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/NubeIO/module-core-loraraw/schema"
+	"github.com/NubeIO/nubeio-rubix-lib-models-go/model"
+)
+
+func TestDispatchFrame_UnknownDevice(t *testing.T) {
+	m := &Module{config: &Config{DefaultKey: testDefaultKey}}
+	res := m.dispatchFrame(testCaptureFrame, noDevice,
+		nil, noopPointErr, noopMetaTags, noopWrittenOK, noopWrittenErr)
+	if res.OK || !res.Unknown || res.Address != "65C0640D" || res.DataHex != testCaptureFrame {
+		t.Fatalf("unexpected result %+v", res)
+	}
+
+	encryption, models := m.guessDevice(res)
+	if encryption != frameEncrypted || !containsModel(models, schema.DeviceModelRubixEncrypted) || containsModel(models, schema.DeviceModelTHLM) {
+		t.Fatalf("unexpected guess %s %v", encryption, models)
+	}
+
+	m.config = &Config{DefaultKey: testOtherKey}
+	if encryption, _ = m.guessDevice(res); encryption != frameUnknownKey {
+		t.Fatalf("expected %s, got %s", frameUnknownKey, encryption)
+	}
+
+	// A legacy Droplet frame: plaintext, or legacy-encrypted at another
+	// address.
+	m.config = &Config{DefaultKey: testDefaultKey}
+	res = m.dispatchFrame("CBB272EAB20696263C0000DD000000041861", noDevice,
+		nil, noopPointErr, noopMetaTags, noopWrittenOK, noopWrittenErr)
+	if !res.Unknown || res.Address != "CBB272EA" || res.LegacyAddress == "" {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	if encryption, models = m.guessDevice(res); encryption != framePlaintext || !containsModel(models, schema.DeviceModelTHLM) {
+		t.Fatalf("unexpected guess %s %v", encryption, models)
+	}
+}
+
+func TestDiscoveryInbox(t *testing.T) {
+	inbox := newDiscoveryInbox()
+	res := DispatchResult{Address: "65C0640D", RSSI: -80, SNR: 7.5}
+	inbox.Seen("net-1", res, frameEncrypted, []string{schema.DeviceModelRubix})
+	res.RSSI = -70
+	inbox.Seen("net-1", res, frameUnknownKey, nil)
+
+	entry, ok := inbox.Get("65c0640d")
+	if !ok || entry.Frames != 2 || entry.RSSI != -70 || entry.Encryption != frameEncrypted || len(entry.Models) != 1 {
+		t.Fatalf("unexpected entry %+v", entry)
+	}
+
+	for i := 0; i < discoveryMaxEntries; i++ {
+		inbox.Seen("net-1", DispatchResult{Address: fmt.Sprintf("%08X", i)}, framePlaintext, nil)
+	}
+	list := inbox.List()
+	if len(list) != discoveryMaxEntries || list[0].Address != fmt.Sprintf("%08X", discoveryMaxEntries-1) {
+		t.Fatalf("unexpected list of %d, first %+v", len(list), list[0])
+	}
+	if _, ok = inbox.Get("65C0640D"); ok {
+		t.Fatalf("the address heard least recently must be evicted")
+	}
+
+	inbox.Forget(list[0].Address)
+	if _, ok = inbox.Get(list[0].Address); ok {
+		t.Fatalf("entry not forgotten")
+	}
+}
+
+func noDevice(string) *model.Device { return nil }
+
+func containsModel(models []string, model string) bool {
+	for _, m := range models {
+		if m == model {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,505 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NubeIO/module-core-loraraw/codecs/rubixDataEncoding"
+	"github.com/NubeIO/nubeio-rubix-lib-helpers-go/pkg/nils"
+	"github.com/NubeIO/nubeio-rubix-lib-models-go/datatype"
+	"github.com/NubeIO/nubeio-rubix-lib-models-go/dto"
+	"github.com/NubeIO/nubeio-rubix-lib-models-go/model"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	downlinkScheduleFile = "downlink-schedules.json"
+
+	downlinkScheduleCheckPeriod = 15 * time.Second
+
+	// minScheduleInterval keeps an interval schedule from flooding the
+	// write queue and the duty-cycle budget.
+	minScheduleInterval = time.Minute
+
+	// Value sources of a schedule. With none the schedule writes its value,
+	// or re-asserts the point's current write value.
+	valueSourceUnixTime  = "unix_time"  // seconds since the epoch, UTC
+	valueSourceLocalTime = "local_time" // the same, shifted by the local zone offset
+)
+
+// DownlinkSchedule writes to a device on a cron spec or an interval.
+//
+// With a point_uuid the point is written: value if set, else its current
+// write value again (e.g. hourly re-assertion of a write_and_maintain point).
+// Without one a value is sent to io_number of device_uuid with data_type (a
+// rubix MDK number), the way the UART ping is, no point is needed.
+//
+// A point value is written at write_priority of the point's priority array,
+// 16 when unset; use a slot nothing else writes to so the schedule does not
+// overwrite it.
+type DownlinkSchedule struct {
+	UUID          string                `json:"uuid"`
+	Name          string                `json:"name,omitempty"`
+	DeviceUUID    string                `json:"device_uuid"`
+	PointUUID     string                `json:"point_uuid,omitempty"`
+	IoNumber      string                `json:"io_number,omitempty"`
+	DataType      string                `json:"data_type,omitempty"`
+	Value         *float64              `json:"value,omitempty"`
+	WritePriority int                   `json:"write_priority,omitempty"`
+	ValueSource   string                `json:"value_source,omitempty"`
+	Cron          string                `json:"cron,omitempty"`
+	Interval      string                `json:"interval,omitempty"`
+	Priority      datatype.PollPriority `json:"priority,omitempty"`
+	Enabled       bool                  `json:"enabled"`
+
+	LastRun   *time.Time `json:"last_run,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+	NextRun   *time.Time `json:"next_run,omitempty"`
+}
+
+// validate checks the schedule and returns when it runs next after now.
+func (s *DownlinkSchedule) validate(now time.Time) (time.Time, error) {
+	if s.DeviceUUID == "" && s.PointUUID == "" {
+		return time.Time{}, errors.New("schedule needs a device_uuid or a point_uuid")
+	}
+	if s.PointUUID == "" {
+		if s.IoNumber == "" || s.DataType == "" {
+			return time.Time{}, errors.New("schedule without a point_uuid needs an io_number and a data_type")
+		}
+		if _, err := strconv.Atoi(s.DataType); err != nil {
+			return time.Time{}, fmt.Errorf("invalid data_type %q: must be a rubix data type number", s.DataType)
+		}
+		if s.Value == nil && s.ValueSource == "" {
+			return time.Time{}, errors.New("schedule without a point_uuid needs a value or a value_source")
+		}
+	}
+	if s.WritePriority < 0 || s.WritePriority > 16 {
+		return time.Time{}, fmt.Errorf("invalid write_priority %d: must be 1 to 16", s.WritePriority)
+	}
+	switch s.ValueSource {
+	case "", valueSourceUnixTime, valueSourceLocalTime:
+	default:
+		return time.Time{}, fmt.Errorf("invalid value_source %q", s.ValueSource)
+	}
+	if err := s.Priority.Validate(); err != nil {
+		return time.Time{}, err
+	}
+	return s.next(now)
+}
+
+// next returns when the schedule runs next after now.
+func (s *DownlinkSchedule) next(now time.Time) (time.Time, error) {
+	if (s.Cron == "") == (s.Interval == "") {
+		return time.Time{}, errors.New("schedule needs either a cron or an interval")
+	}
+	if s.Cron != "" {
+		spec, err := parseCron(s.Cron)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return spec.Next(now)
+	}
+	interval, err := time.ParseDuration(s.Interval)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if interval < minScheduleInterval {
+		return time.Time{}, fmt.Errorf("interval must be at least %s", minScheduleInterval)
+	}
+	return now.Add(interval), nil
+}
+
+// writePriority is the priority array slot a value is written at.
+func (s *DownlinkSchedule) writePriority() int {
+	if s.WritePriority == 0 {
+		return 16
+	}
+	return s.WritePriority
+}
+
+// value is what a run at now writes, nil to re-assert the point.
+func (s *DownlinkSchedule) value(now time.Time) *float64 {
+	switch s.ValueSource {
+	case valueSourceUnixTime:
+		return nils.NewFloat64(float64(now.Unix()))
+	case valueSourceLocalTime:
+		_, offset := now.Zone()
+		return nils.NewFloat64(float64(now.Unix() + int64(offset)))
+	}
+	return s.Value
+}
+
+// downlinkScheduler holds the downlink schedules, persisted to the module
+// data dir. Due hands out the schedules to run and moves them on; a run
+// missed while the module was down is made once at start.
+type downlinkScheduler struct {
+	path      string
+	schedules map[string]*DownlinkSchedule
+	mutex     sync.Mutex
+}
+
+func newDownlinkScheduler(path string) *downlinkScheduler {
+	d := &downlinkScheduler{path: path, schedules: make(map[string]*DownlinkSchedule)}
+	if err := loadState(path, &d.schedules); err != nil {
+		log.Errorf("schedules: failed to load schedules from %s: %s", path, err)
+	}
+	if d.schedules == nil {
+		d.schedules = make(map[string]*DownlinkSchedule)
+	}
+	return d
+}
+
+func (d *downlinkScheduler) save() {
+	if err := saveState(d.path, d.schedules); err != nil {
+		log.Errorf("schedules: failed to save schedules to %s: %s", d.path, err)
+	}
+}
+
+// List returns the schedules of a device, or all of them for "", by name.
+func (d *downlinkScheduler) List(deviceUUID string) []DownlinkSchedule {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	list := make([]DownlinkSchedule, 0, len(d.schedules))
+	for _, s := range d.schedules {
+		if deviceUUID == "" || s.DeviceUUID == deviceUUID {
+			list = append(list, *s)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Name != list[j].Name {
+			return list[i].Name < list[j].Name
+		}
+		return list[i].UUID < list[j].UUID
+	})
+	return list
+}
+
+func (d *downlinkScheduler) Get(uuid string) (DownlinkSchedule, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	s, ok := d.schedules[uuid]
+	if !ok {
+		return DownlinkSchedule{}, false
+	}
+	return *s, true
+}
+
+// Put creates the schedule, or replaces the one with its UUID, and plans its
+// next run. Run state is kept from the schedule it replaces.
+func (d *downlinkScheduler) Put(s DownlinkSchedule, now time.Time) (DownlinkSchedule, error) {
+	next, err := s.validate(now)
+	if err != nil {
+		return DownlinkSchedule{}, err
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	s.LastRun, s.LastError, s.NextRun = nil, "", nil
+	if s.UUID == "" {
+		s.UUID = "sch_" + newCorrelationID()
+	} else if old, ok := d.schedules[s.UUID]; ok {
+		s.LastRun, s.LastError = old.LastRun, old.LastError
+	}
+	if s.Enabled {
+		s.NextRun = &next
+	}
+	d.schedules[s.UUID] = &s
+	d.save()
+	return s, nil
+}
+
+func (d *downlinkScheduler) Delete(uuid string) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if _, ok := d.schedules[uuid]; !ok {
+		return false
+	}
+	delete(d.schedules, uuid)
+	d.save()
+	return true
+}
+
+// Forget deletes the schedules of a deleted device or point.
+func (d *downlinkScheduler) Forget(uuid string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	changed := false
+	for id, s := range d.schedules {
+		if s.DeviceUUID == uuid || s.PointUUID == uuid {
+			delete(d.schedules, id)
+			changed = true
+		}
+	}
+	if changed {
+		d.save()
+	}
+}
+
+// Due returns the enabled schedules whose run is due at now and plans their
+// next run.
+func (d *downlinkScheduler) Due(now time.Time) []DownlinkSchedule {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	var due []DownlinkSchedule
+	for _, s := range d.schedules {
+		if !s.Enabled || s.NextRun == nil || s.NextRun.After(now) {
+			continue
+		}
+		due = append(due, *s)
+		if next, err := s.next(now); err == nil {
+			s.NextRun = &next
+		} else {
+			s.NextRun = nil
+			s.LastError = err.Error()
+		}
+	}
+	if len(due) > 0 {
+		d.save()
+	}
+	return due
+}
+
+// Ran records the outcome of a run of the schedule.
+func (d *downlinkScheduler) Ran(uuid string, at time.Time, err error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	s, ok := d.schedules[uuid]
+	if !ok {
+		return
+	}
+	s.LastRun = &at
+	s.LastError = ""
+	if err != nil {
+		s.LastError = err.Error()
+	}
+	d.save()
+}
+
+func (m *Module) startDownlinkScheduler() {
+	m.stopDownlinkScheduler()
+	d := newDownlinkScheduler(m.statePath(downlinkScheduleFile))
+	done := make(chan struct{})
+	m.downlinkScheduler = d
+	m.downlinkSchedulerDone = done
+	go m.runDownlinkScheduler(d, done)
+}
+
+func (m *Module) stopDownlinkScheduler() {
+	if m.downlinkSchedulerDone != nil {
+		close(m.downlinkSchedulerDone)
+	}
+	m.downlinkScheduler = nil
+	m.downlinkSchedulerDone = nil
+}
+
+func (m *Module) runDownlinkScheduler(d *downlinkScheduler, done <-chan struct{}) {
+	ticker := time.NewTicker(downlinkScheduleCheckPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			for _, s := range d.Due(now) {
+				m.runSchedule(d, s, now)
+			}
+		}
+	}
+}
+
+// putSchedule creates or replaces a schedule. A point schedule belongs to
+// the point's device.
+func (m *Module) putSchedule(s DownlinkSchedule) (DownlinkSchedule, error) {
+	if m.downlinkScheduler == nil {
+		return DownlinkSchedule{}, errors.New("module is not enabled")
+	}
+	if s.PointUUID != "" {
+		point, err := m.grpcMarshaller.GetPoint(s.PointUUID)
+		if err != nil {
+			return DownlinkSchedule{}, err
+		}
+		s.DeviceUUID = point.DeviceUUID
+	}
+	return m.downlinkScheduler.Put(s, time.Now())
+}
+
+// runSchedule queues the write of one run of the schedule.
+func (m *Module) runSchedule(d *downlinkScheduler, s DownlinkSchedule, now time.Time) {
+	err := m.enqueueScheduledWrite(s, now)
+	if err != nil {
+		log.Errorf("schedule %s (%s): %s", s.UUID, s.Name, err)
+	} else {
+		log.Infof("schedule %s (%s): write queued for device %s", s.UUID, s.Name, s.DeviceUUID)
+	}
+	d.Ran(s.UUID, now, err)
+}
+
+func (m *Module) enqueueScheduledWrite(s DownlinkSchedule, now time.Time) error {
+	value := s.value(now)
+	var point *model.Point
+	var err error
+	switch {
+	case s.PointUUID != "" && value != nil:
+		slot := fmt.Sprintf("_%d", s.writePriority())
+		point, err = m.writePoint(s.PointUUID, &dto.PointWriter{Priority: &map[string]*float64{slot: value}})
+	case s.PointUUID != "":
+		point, err = m.grpcMarshaller.GetPoint(s.PointUUID)
+		if err == nil && point.WriteValue == nil {
+			err = errors.New("point has no write value to re-assert")
+		}
+	default:
+		point, err = m.scheduledPoint(s, value)
+	}
+	if err != nil {
+		return err
+	}
+	if s.Priority != "" {
+		point.PollPriority = s.Priority
+	}
+	return m.enqueuePoint(point)
+}
+
+// scheduledPoint builds the point written by a schedule without one, as the
+// UART ping does.
+func (m *Module) scheduledPoint(s DownlinkSchedule, value *float64) (*model.Point, error) {
+	device, err := m.getDevice(s.DeviceUUID)
+	if err != nil {
+		return nil, err
+	}
+	point := &model.Point{
+		IoNumber:    s.IoNumber,
+		DataType:    s.DataType,
+		DeviceUUID:  device.UUID,
+		AddressUUID: device.AddressUUID,
+		WriteValue:  value,
+	}
+	if _, err = rubixDataEncoding.EncodeRequestMessage([]*model.Point{point}); err != nil {
+		return nil, err
+	}
+	return point, nil
+}
+
+// cronSpec is a parsed 5-field cron spec: minute hour day-of-month month
+// day-of-week, each a bitset of the values it matches.
+type cronSpec struct {
+	minute, hour, dom, month, dow uint64
+	// As in cron, a day matches either restricted day field when both are;
+	// a day field starting with "*" ("*/2" too) does not count as restricted.
+	domAny, dowAny bool
+}
+
+var cronDescriptors = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+}
+
+// parseCron parses "minute hour day-of-month month day-of-week". Fields take
+// "*", values, ranges "a-b", steps "*/n" and "a-b/n", and comma lists;
+// Sunday is 0 or 7. @hourly, @daily, @midnight, @weekly and @monthly are
+// accepted too.
+func parseCron(spec string) (*cronSpec, error) {
+	if d, ok := cronDescriptors[strings.TrimSpace(spec)]; ok {
+		spec = d
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid cron %q: want 5 fields", spec)
+	}
+	bounds := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	var sets [5]uint64
+	for i, field := range fields {
+		set, err := parseCronField(field, bounds[i][0], bounds[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron %q: %s", spec, err)
+		}
+		sets[i] = set
+	}
+	if sets[4]&(1<<7) != 0 {
+		sets[4] |= 1
+	}
+	return &cronSpec{
+		minute: sets[0], hour: sets[1], dom: sets[2], month: sets[3], dow: sets[4],
+		domAny: strings.HasPrefix(fields[2], "*"), dowAny: strings.HasPrefix(fields[4], "*"),
+	}, nil
+}
+
+func parseCronField(field string, min, max int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			rng, step = part[:i], n
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			bounds := strings.SplitN(rng, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("invalid value in %q", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("invalid value in %q", part)
+				}
+			} else if step > 1 {
+				hi = max // "a/n" runs from a to the end
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q is out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return set, nil
+}
+
+func (c *cronSpec) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domAny || c.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Next returns the first minute after t the spec matches, in t's location.
+func (c *cronSpec) Next(t time.Time) (time.Time, error) {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.New("cron never matches")
+}
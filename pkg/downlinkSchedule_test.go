@@ -0,0 +1,161 @@
+package pkg
+
+import (
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/NubeIO/module-core-loraraw/codecs/rubixDataEncoding"
+)
+
+func TestParseCron_Next(t *testing.T) {
+	at := func(s string) time.Time {
+		v, err := time.ParseInLocation("2006-01-02 15:04", s, time.UTC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	tests := []struct {
+		spec, from, want string
+	}{
+		{"0 2 * * *", "2024-03-10 01:59", "2024-03-10 02:00"},
+		{"0 2 * * *", "2024-03-10 02:00", "2024-03-11 02:00"},
+		{"@hourly", "2024-03-10 02:30", "2024-03-10 03:00"},
+		{"*/15 * * * *", "2024-03-10 02:31", "2024-03-10 02:45"},
+		{"30 8-17/4 * * 1-5", "2024-03-09 09:00", "2024-03-11 08:30"}, // Saturday -> Monday
+		{"0 0 * * 7", "2024-03-10 00:00", "2024-03-17 00:00"},         // 7 is Sunday
+		{"0 0 29 2 *", "2024-03-01 00:00", "2028-02-29 00:00"},
+		{"0 12 1,15 * *", "2024-01-15 12:00", "2024-02-01 12:00"},
+		// Both day fields restricted: either matches.
+		{"0 0 13 * 5", "2024-09-01 00:00", "2024-09-06 00:00"},
+		// A stepped "*/2" is unrestricted: odd days that are also Mondays.
+		{"0 3 */2 * 1", "2024-04-01 04:00", "2024-04-15 03:00"},
+	}
+	for _, tt := range tests {
+		spec, err := parseCron(tt.spec)
+		if err != nil {
+			t.Fatalf("%q: %s", tt.spec, err)
+		}
+		next, err := spec.Next(at(tt.from))
+		if err != nil {
+			t.Fatalf("%q: %s", tt.spec, err)
+		}
+		if !next.Equal(at(tt.want)) {
+			t.Errorf("%q from %s: got %s, want %s", tt.spec, tt.from, next.Format("2006-01-02 15:04"), tt.want)
+		}
+	}
+
+	for _, bad := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		if _, err := parseCron(bad); err == nil {
+			t.Errorf("%q must not parse", bad)
+		}
+	}
+	spec, _ := parseCron("0 0 31 2 *")
+	if _, err := spec.Next(at("2024-01-01 00:00")); err == nil {
+		t.Error("a spec that never matches must fail")
+	}
+}
+
+func TestDownlinkSchedule_Validate(t *testing.T) {
+	now := time.Now()
+	value := 1.0
+	valid := []DownlinkSchedule{
+		{PointUUID: "pnt", Interval: "1h"}, // re-assert
+		{PointUUID: "pnt", Cron: "@daily", Value: &value},
+		{PointUUID: "pnt", Cron: "@daily", Value: &value, WritePriority: 8},
+		{DeviceUUID: "dev", IoNumber: "UVP-10", DataType: strconv.Itoa(int(rubixDataEncoding.MDK_UINT_32)), ValueSource: valueSourceLocalTime, Cron: "0 2 * * *"},
+	}
+	for _, s := range valid {
+		if _, err := s.validate(now); err != nil {
+			t.Errorf("%+v: %s", s, err)
+		}
+	}
+	invalid := []DownlinkSchedule{
+		{Interval: "1h"},
+		{PointUUID: "pnt"},
+		{PointUUID: "pnt", Interval: "1h", Cron: "@daily"},
+		{PointUUID: "pnt", Interval: "10s"},
+		{PointUUID: "pnt", Interval: "1h", ValueSource: "moon"},
+		{PointUUID: "pnt", Interval: "1h", Priority: "urgent"},
+		{PointUUID: "pnt", Interval: "1h", Value: &value, WritePriority: 17},
+		{DeviceUUID: "dev", IoNumber: "UVP-10", DataType: "uint32", Value: &value, Interval: "1h"},
+		{DeviceUUID: "dev", IoNumber: "UVP-10", DataType: "4", Interval: "1h"},
+	}
+	for _, s := range invalid {
+		if _, err := s.validate(now); err == nil {
+			t.Errorf("%+v must not validate", s)
+		}
+	}
+}
+
+func TestDownlinkSchedule_Value(t *testing.T) {
+	now := time.Date(2024, 3, 10, 2, 0, 0, 0, time.FixedZone("AEDT", 11*3600))
+	s := DownlinkSchedule{ValueSource: valueSourceUnixTime}
+	if v := s.value(now); v == nil || int64(*v) != now.Unix() {
+		t.Fatalf("unix_time: %v", v)
+	}
+	s.ValueSource = valueSourceLocalTime
+	if v := s.value(now); v == nil || int64(*v) != now.Unix()+11*3600 {
+		t.Fatalf("local_time: %v", v)
+	}
+	s.ValueSource = ""
+	if v := s.value(now); v != nil {
+		t.Fatalf("re-assert must have no value, got %v", *v)
+	}
+}
+
+func TestDownlinkScheduler_DueAndPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), downlinkScheduleFile)
+	d := newDownlinkScheduler(path)
+	now := time.Now()
+
+	hourly, err := d.Put(DownlinkSchedule{Name: "maintain", PointUUID: "pnt", DeviceUUID: "dev", Interval: "1h", Enabled: true}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	off, err := d.Put(DownlinkSchedule{Name: "off", PointUUID: "other", DeviceUUID: "dev", Interval: "1h"}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hourly.UUID == "" || hourly.NextRun == nil || !hourly.NextRun.Equal(now.Add(time.Hour)) {
+		t.Fatalf("next run %+v", hourly)
+	}
+	if off.NextRun != nil {
+		t.Fatal("a disabled schedule must not be planned")
+	}
+
+	if due := d.Due(now.Add(59 * time.Minute)); len(due) != 0 {
+		t.Fatalf("due early: %+v", due)
+	}
+	due := d.Due(now.Add(time.Hour))
+	if len(due) != 1 || due[0].UUID != hourly.UUID {
+		t.Fatalf("due %+v", due)
+	}
+	d.Ran(hourly.UUID, now.Add(time.Hour), nil)
+	if due := d.Due(now.Add(time.Hour)); len(due) != 0 {
+		t.Fatalf("ran twice: %+v", due)
+	}
+
+	// The schedules and their run state survive a restart.
+	d = newDownlinkScheduler(path)
+	got, ok := d.Get(hourly.UUID)
+	if !ok || got.LastRun == nil || got.NextRun == nil || !got.NextRun.Equal(now.Add(2*time.Hour)) {
+		t.Fatalf("after reload %+v", got)
+	}
+	if list := d.List("dev"); len(list) != 2 || list[0].Name != "maintain" {
+		t.Fatalf("list %+v", list)
+	}
+
+	// Updating keeps the run state; deleting the point forgets its schedules.
+	got.Interval = "2h"
+	updated, err := d.Put(got, now)
+	if err != nil || updated.LastRun == nil || !updated.NextRun.Equal(now.Add(2*time.Hour)) {
+		t.Fatalf("update %+v: %v", updated, err)
+	}
+	d.Forget("pnt")
+	if list := d.List(""); len(list) != 1 || list[0].UUID != off.UUID {
+		t.Fatalf("after forget %+v", list)
+	}
+}
@@ -0,0 +1,222 @@
+package pkg
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// loRaPreambleSymbols is the preamble length of the LoRaRAW radios.
+	// Frames have an explicit header and a CRC.
+	loRaPreambleSymbols = 8
+)
+
+// timeOnAir estimates how long a LoRa frame of payloadLen bytes is on air
+// (Semtech AN1200.13). bandwidthKHz is 125, 250 or 500 and codingRate is the
+// denominator of the 4/x coding rate (5 to 8). Low data rate optimisation is
+// on for SF11 and SF12 at 125 kHz, as the radios set it.
+func timeOnAir(payloadLen, spreadingFactor int, bandwidthKHz float64, codingRate int) time.Duration {
+	sf := float64(spreadingFactor)
+	symbol := math.Pow(2, sf) / (bandwidthKHz * 1000) // seconds
+	lowDataRate := 0.0
+	if spreadingFactor >= 11 && bandwidthKHz <= 125 {
+		lowDataRate = 1
+	}
+	const crc, implicitHeader = 1.0, 0.0
+	bits := 8*float64(payloadLen) - 4*sf + 28 + 16*crc - 20*implicitHeader
+	payloadSymbols := 8 + math.Max(math.Ceil(bits/(4*(sf-2*lowDataRate)))*float64(codingRate), 0)
+	preamble := (loRaPreambleSymbols + 4.25) * symbol
+	seconds := preamble + payloadSymbols*symbol
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// DutyCycleError is returned for a frame the duty-cycle budget does not
+// allow yet. Wait is how long until it fits; Never is set for a frame longer
+// than the whole budget.
+type DutyCycleError struct {
+	Airtime time.Duration
+	Wait    time.Duration
+	Never   bool
+}
+
+func (e *DutyCycleError) Error() string {
+	if e.Never {
+		return fmt.Sprintf("duty cycle: a %s frame exceeds the whole budget", e.Airtime)
+	}
+	return fmt.Sprintf("duty cycle: budget spent, a %s frame fits in %s", e.Airtime, e.Wait.Round(time.Millisecond))
+}
+
+// DutyCycleStats is the airtime budget of a radio over the sliding window.
+type DutyCycleStats struct {
+	LimitPercent float64 `json:"limit_percent"`
+	Window       string  `json:"window"`
+	BudgetMs     float64 `json:"budget_ms"`
+	UsedMs       float64 `json:"used_ms"`
+	RemainingMs  float64 `json:"remaining_ms"`
+	Frames       int     `json:"frames"`
+	Deferred     uint64  `json:"deferred"`
+	Refused      uint64  `json:"refused"`
+}
+
+type airtimeRecord struct {
+	at      time.Time
+	airtime time.Duration
+}
+
+// dutyCycle accounts the airtime a radio spent over a sliding window (e.g.
+// 1% of any hour for EU868) and refuses frames that would go over it. A nil
+// dutyCycle allows everything.
+type dutyCycle struct {
+	limit           float64
+	window          time.Duration
+	spreadingFactor int
+	bandwidthKHz    float64
+	codingRate      int
+
+	records  []airtimeRecord
+	deferred uint64
+	refused  uint64
+	mutex    sync.Mutex
+}
+
+// newDutyCycle returns nil when limitPercent is 0, which disables the budget.
+func newDutyCycle(limitPercent float64, window time.Duration, spreadingFactor int, bandwidthKHz float64, codingRate int) *dutyCycle {
+	if limitPercent <= 0 || window <= 0 {
+		return nil
+	}
+	return &dutyCycle{
+		limit:           limitPercent / 100,
+		window:          window,
+		spreadingFactor: spreadingFactor,
+		bandwidthKHz:    bandwidthKHz,
+		codingRate:      codingRate,
+	}
+}
+
+func (d *dutyCycle) airtime(frameLen int) time.Duration {
+	return timeOnAir(frameLen, d.spreadingFactor, d.bandwidthKHz, d.codingRate)
+}
+
+func (d *dutyCycle) budget() time.Duration {
+	return time.Duration(float64(d.window) * d.limit)
+}
+
+// Reserve books the airtime of a frame about to go on air, or returns a
+// *DutyCycleError when it does not fit the budget at now.
+func (d *dutyCycle) Reserve(frameLen int, now time.Time) error {
+	if d == nil {
+		return nil
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	airtime := d.airtime(frameLen)
+	d.expire(now)
+	if airtime > d.budget() {
+		d.refused++
+		return &DutyCycleError{Airtime: airtime, Never: true}
+	}
+	if wait := d.wait(airtime, now); wait > 0 {
+		d.deferred++
+		return &DutyCycleError{Airtime: airtime, Wait: wait}
+	}
+	d.records = append(d.records, airtimeRecord{at: now, airtime: airtime})
+	return nil
+}
+
+// Release gives back the airtime Reserve booked at the same time for a frame
+// that never went on air.
+func (d *dutyCycle) Release(frameLen int, at time.Time) {
+	if d == nil {
+		return
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	airtime := d.airtime(frameLen)
+	for i := len(d.records) - 1; i >= 0; i-- {
+		if d.records[i].at.Equal(at) && d.records[i].airtime == airtime {
+			d.records = append(d.records[:i], d.records[i+1:]...)
+			return
+		}
+	}
+}
+
+func (d *dutyCycle) expire(now time.Time) {
+	i := 0
+	for i < len(d.records) && !d.records[i].at.Add(d.window).After(now) {
+		i++
+	}
+	d.records = d.records[i:]
+}
+
+func (d *dutyCycle) used() time.Duration {
+	var used time.Duration
+	for _, r := range d.records {
+		used += r.airtime
+	}
+	return used
+}
+
+// wait is how long until enough of the window's airtime has expired for
+// airtime to fit.
+func (d *dutyCycle) wait(airtime time.Duration, now time.Time) time.Duration {
+	over := d.used() + airtime - d.budget()
+	for _, r := range d.records {
+		if over <= 0 {
+			break
+		}
+		over -= r.airtime
+		if over <= 0 {
+			return r.at.Add(d.window).Sub(now)
+		}
+	}
+	return 0
+}
+
+func (d *dutyCycle) Stats(now time.Time) DutyCycleStats {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.expire(now)
+	budget, used := d.budget(), d.used()
+	remaining := budget - used
+	if remaining < 0 {
+		remaining = 0
+	}
+	return DutyCycleStats{
+		LimitPercent: d.limit * 100,
+		Window:       d.window.String(),
+		BudgetMs:     durationMs(budget),
+		UsedMs:       durationMs(used),
+		RemainingMs:  durationMs(remaining),
+		Frames:       len(d.records),
+		Deferred:     d.deferred,
+		Refused:      d.refused,
+	}
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// retryBackoff is the pause before the next attempt of a write that failed
+// retry times: base doubled per retry up to max, with jitter so devices that
+// failed together do not retry together. It is 0 when base is 0.
+func retryBackoff(retry int, base, max time.Duration) time.Duration {
+	if base <= 0 || retry <= 0 {
+		return 0
+	}
+	backoff := base
+	for i := 1; i < retry && (max <= 0 || backoff < max); i++ {
+		backoff *= 2
+	}
+	if max > 0 && backoff > max {
+		backoff = max
+	}
+	half := backoff / 2
+	return half + time.Duration(rand.Int63n(int64(backoff-half)+1))
+}
@@ -0,0 +1,102 @@
+package pkg
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestTimeOnAir(t *testing.T) {
+	cases := []struct {
+		payloadLen, sf int
+		bandwidth      float64
+		want           float64 // ms
+	}{
+		{20, 7, 125, 56.576},
+		{51, 12, 125, 2465.792}, // low data rate optimisation on
+		{20, 7, 250, 28.288},
+	}
+	for _, c := range cases {
+		got := durationMs(timeOnAir(c.payloadLen, c.sf, c.bandwidth, 5))
+		if math.Abs(got-c.want) > 0.01 {
+			t.Fatalf("time on air of %d bytes at SF%d/%v kHz = %.3fms, want %.3fms", c.payloadLen, c.sf, c.bandwidth, got, c.want)
+		}
+	}
+}
+
+func TestDutyCycle_Budget(t *testing.T) {
+	d := newDutyCycle(1, 10*time.Second, 7, 125, 5) // 100ms per 10s
+	now := time.Now()
+
+	if err := d.Reserve(20, now); err != nil {
+		t.Fatalf("first frame should fit: %s", err)
+	}
+	err := d.Reserve(20, now.Add(time.Second))
+	var dutyCycleErr *DutyCycleError
+	if !errors.As(err, &dutyCycleErr) || dutyCycleErr.Never || dutyCycleErr.Wait != 9*time.Second {
+		t.Fatalf("second frame should wait 9s for the first to leave the window, got %v", err)
+	}
+	if err = d.Reserve(20, now.Add(10*time.Second)); err != nil {
+		t.Fatalf("frame should fit once the window moved: %s", err)
+	}
+
+	err = d.Reserve(255, now.Add(10*time.Second))
+	if !errors.As(err, &dutyCycleErr) || !dutyCycleErr.Never {
+		t.Fatalf("a frame longer than the budget can never go, got %v", err)
+	}
+
+	stats := d.Stats(now.Add(10 * time.Second))
+	if stats.Frames != 1 || stats.Deferred != 1 || stats.Refused != 1 || math.Abs(stats.RemainingMs-(100-56.576)) > 0.01 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	var disabled *dutyCycle
+	if newDutyCycle(0, time.Hour, 7, 125, 5) != nil || disabled.Reserve(255, now) != nil {
+		t.Fatalf("a 0%% limit disables the budget")
+	}
+}
+
+func TestDutyCycle_TimedOutFrameGivesAirtimeBack(t *testing.T) {
+	d := newDutyCycle(1, 10*time.Second, 7, 125, 5) // 100ms per 10s
+	now := time.Now()
+	if err := d.Reserve(20, now); err != nil {
+		t.Fatal(err)
+	}
+	d.Release(20, now.Add(time.Millisecond)) // not this frame's booking
+	if stats := d.Stats(now); stats.Frames != 1 {
+		t.Fatalf("only the frame's own booking may be released, got %+v", stats)
+	}
+
+	// A frame the drainer never takes does not go on air.
+	n := &loRaNetwork{
+		uuid:       "net-1",
+		dutyCycle:  d,
+		transport:  newUDPTransport("127.0.0.1:0", nil),
+		writeQueue: make(chan []byte),
+	}
+	d.Release(20, now)
+	if err := n.WriteToLoRaRaw(make([]byte, 20)); err == nil {
+		t.Fatal("a frame the drainer does not take must fail")
+	}
+	if stats := d.Stats(time.Now()); stats.Frames != 0 || stats.UsedMs != 0 {
+		t.Fatalf("a timed-out frame must not use the budget, got %+v", stats)
+	}
+	if err := d.Reserve(20, time.Now()); err != nil {
+		t.Fatalf("the budget should be free again: %s", err)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	base, max := time.Second, 5*time.Second
+	for retry, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: max, 9: max} {
+		for i := 0; i < 20; i++ {
+			if got := retryBackoff(retry, base, max); got < want/2 || got > want {
+				t.Fatalf("retry %d: backoff %s outside [%s, %s]", retry, got, want/2, want)
+			}
+		}
+	}
+	if retryBackoff(3, 0, max) != 0 {
+		t.Fatalf("no base, no backoff")
+	}
+}
@@ -21,52 +21,96 @@ func (m *Module) Enable() error {
 		_ = m.updatePluginMessage(dto.MessageLevel.Fail, err.Error())
 	}
 
-	m.initWriteQueue()
-	if m.pointWriteQueueManager != nil {
-		m.pointWriteQueueManager.Stop()
+	// The networks' run loops use the trackers below: stop them before the
+	// trackers are replaced, and save what the old replay guard holds.
+	m.stopNetworks()
+	if m.replayGuard != nil {
+		m.replayGuard.Flush()
+	}
+
+	m.dataDir = m.resolveDataDir()
+	m.replayGuard = nil
+	if m.config.ReplayProtection {
+		m.replayGuard = newReplayGuard(m.statePath(replayStateFile), m.config.ReplayWindowSize, m.config.ReplayResyncCount)
+	}
+	m.sealDeviceKeys()
+	m.keyRing = newKeyRing(m.statePath(keyRingStateFile), m.statePath(keyAuditFile), m.config.KeyRotationWindow, m.config.sealer)
+	if m.discovery == nil {
+		m.discovery = newDiscoveryInbox()
+	}
+	if m.modelDetector == nil {
+		m.modelDetector = newModelDetector()
+	}
+	if m.linkTracker == nil || m.linkTracker.window != m.config.LinkStatsWindow {
+		m.linkTracker = newLinkTracker(m.config.LinkStatsWindow)
 	}
-	m.pointWriteQueueManager = NewPointWriteQueueManager(
-		m.config.WriteQueueMaxRetries,
-		m.config.WriteResponseTimeout,
-		m.getDevice,
-		m.getEncryptionKey,
-		m.WriteToLoRaRaw,
-		m.onWriteExhausted)
 
 	if m.config.MQTTEnable && m.mqttClient == nil {
-		m.mqttClient = NewMQTTClient(
-			m.config.MQTTBroker,
-			m.config.MQTTClientID,
-			m.config.MQTTUsername,
-			m.config.MQTTPassword,
-			m.config.MQTTTopicPrefix,
-		)
+		pointTopic := m.config.MQTTPointTopic
+		var onConnect func()
+		if m.config.HADiscovery {
+			m.haDiscovery = newHADiscovery(m.config.HADiscoveryPrefix)
+			if pointTopic == "" {
+				pointTopic = haPointTopic
+			}
+			onConnect = m.publishHADiscovery
+		}
+		m.mqttClient = NewMQTTClient(MQTTOptions{
+			Broker:             m.config.MQTTBroker,
+			ClientID:           m.config.MQTTClientID,
+			Username:           m.config.MQTTUsername,
+			Password:           m.config.MQTTPassword,
+			TopicPrefix:        m.config.MQTTTopicPrefix,
+			QoS:                byte(m.config.MQTTQoS),
+			Retain:             m.config.MQTTRetain,
+			PointTopic:         pointTopic,
+			ValueSchema:        m.config.MQTTValueSchema,
+			OnConnect:          onConnect,
+			CAFile:             m.config.MQTTCAFile,
+			CertFile:           m.config.MQTTCertFile,
+			KeyFile:            m.config.MQTTKeyFile,
+			InsecureSkipVerify: m.config.MQTTInsecureSkipVerify,
+			ProtocolVersion:    m.config.MQTTProtocolVersion,
+			UserProperties:     m.config.MQTTUserProperties,
+			Buffer:             m.config.MQTTBufferEnable,
+			BufferPath:         m.statePath(mqttBufferFile),
+			BufferMaxSize:      int64(m.config.MQTTBufferMaxSizeMB) * 1024 * 1024,
+			BufferMaxAge:       m.config.MQTTBufferMaxAge,
+		})
+		m.mqttClient.Subscribe(m.mqttClient.Topic(writeCommandTopic, "+", "+"), m.handleWriteCommand)
 	}
 
+	m.loadCodecFiles()
+	m.startOfflineWatchdog()
+	m.startFrameCapture()
+	m.startDownlinkScheduler()
 	if len(networks) == 0 {
 		warnMsg := "no LoRaRAW networks exist"
 		log.Warn(warnMsg)
 		_ = m.updatePluginMessage(dto.MessageLevel.Warning, warnMsg)
-	} else {
-		network := networks[0]
+	}
+	for _, network := range networks {
+		n := m.startNetwork(network.UUID)
 		net, err := m.grpcMarshaller.GetNetwork(network.UUID, &nmodule.Opts{Args: &nargs.Args{WithDevices: true, WithPoints: true}})
 		if err != nil {
 			log.Errorf("error getting network: %s", err.Error())
-		} else {
-			for _, device := range net.Devices {
-				for _, point := range device.Points {
-					if point.PointState == datatype.PointStateApiWritePending ||
-						point.PointState == datatype.PointStateApiWriteFailed {
-						m.pointWriteQueueManager.EnqueuePoint(point)
-					}
+			continue
+		}
+		// The write queue resumes from its file. Writes still pending that it
+		// does not hold (made just before a crash, or without a data dir) are
+		// queued again; failed ones are not retried.
+		queued := n.pointWriteQueueManager.QueuedPoints()
+		for _, device := range net.Devices {
+			for _, point := range device.Points {
+				if point.PointState == datatype.PointStateApiWritePending && !queued[point.UUID] {
+					n.pointWriteQueueManager.EnqueuePoint(point)
 				}
 			}
 		}
 	}
-	_ = m.updatePluginMessage(dto.MessageLevel.Info, "")
-
-	m.interruptChan = make(chan struct{}, 1)
-	go m.run()
+	if len(networks) > 0 {
+		_ = m.updatePluginMessage(dto.MessageLevel.Info, "")
+	}
 
 	log.Info("plugin is enabled")
 	return nil
@@ -76,15 +120,18 @@ func (m *Module) Disable() error {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 	log.Info("plugin is disabling...")
-	m.interruptChan <- struct{}{}
-	if m.pointWriteQueueManager != nil {
-		m.pointWriteQueueManager.Stop()
+	m.stopNetworks()
+	m.stopOfflineWatchdog()
+	m.stopFrameCapture()
+	m.stopDownlinkScheduler()
+	if m.replayGuard != nil {
+		m.replayGuard.Flush()
 	}
-	m.stopWriteQueue()
 
 	if m.mqttClient != nil {
 		m.mqttClient.Disconnect()
 		m.mqttClient = nil
+		m.haDiscovery = nil
 	}
 
 	time.Sleep(m.config.ReIterationTime + 1*time.Second) // we need to do this because, before disable it could possibly be restarted
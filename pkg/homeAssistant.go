@@ -0,0 +1,214 @@
+package pkg
+
+import (
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/NubeIO/lib-module-go/nmodule"
+	"github.com/NubeIO/module-core-loraraw/codec"
+	"github.com/NubeIO/module-core-loraraw/codecs"
+	"github.com/NubeIO/nubeio-rubix-lib-models-go/model"
+	"github.com/NubeIO/nubeio-rubix-lib-models-go/nargs"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// HADiscoveryPrefix is Home Assistant's default discovery prefix.
+	HADiscoveryPrefix = "homeassistant"
+
+	// haPointTopic is the per-point topic used for the sensors' state when
+	// mqtt_point_topic is not set.
+	haPointTopic = topicPlaceholderPrefix + "/devices/" + topicPlaceholderAddress + "/" + topicPlaceholderPoint
+
+	haManufacturer = "Nube iO"
+
+	// haRefreshDelay batches the re-publish after device/point changes, e.g.
+	// a new device whose points are created one by one.
+	haRefreshDelay = 2 * time.Second
+)
+
+// haDeviceClasses maps a unit symbol to the Home Assistant sensor device
+// class, so HA picks the right icon and graph.
+var haDeviceClasses = map[string]string{
+	"°C":  "temperature",
+	"°F":  "temperature",
+	"K":   "temperature",
+	"dBm": "signal_strength",
+	"dB":  "signal_strength",
+	"V":   "voltage",
+	"A":   "current",
+	"W":   "power",
+	"kW":  "power",
+	"Wh":  "energy",
+	"kWh": "energy",
+	"Pa":  "pressure",
+	"kPa": "pressure",
+	"lx":  "illuminance",
+}
+
+var haObjectIDInvalid = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+// haSensorConfig is the discovery payload of one sensor.
+type haSensorConfig struct {
+	Name                string   `json:"name"`
+	UniqueID            string   `json:"unique_id"`
+	StateTopic          string   `json:"state_topic"`
+	UnitOfMeasurement   string   `json:"unit_of_measurement,omitempty"`
+	DeviceClass         string   `json:"device_class,omitempty"`
+	StateClass          string   `json:"state_class,omitempty"`
+	AvailabilityTopic   string   `json:"availability_topic"`
+	PayloadAvailable    string   `json:"payload_available"`
+	PayloadNotAvailable string   `json:"payload_not_available"`
+	Device              haDevice `json:"device"`
+}
+
+type haDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Model        string   `json:"model"`
+	Manufacturer string   `json:"manufacturer"`
+}
+
+// haDiscovery remembers the config topics it published, so the sensors of a
+// deleted device or point are removed from Home Assistant (by an empty
+// retained config) on the next publish.
+type haDiscovery struct {
+	prefix    string
+	published map[string]bool
+	mutex     sync.Mutex
+
+	refresh      *time.Timer
+	refreshMutex sync.Mutex
+}
+
+func newHADiscovery(prefix string) *haDiscovery {
+	return &haDiscovery{prefix: prefix, published: make(map[string]bool)}
+}
+
+// configs returns the discovery config of every point of the devices, keyed
+// by config topic.
+func (h *haDiscovery) configs(c *MQTTClient, devices []*model.Device) map[string]haSensorConfig {
+	configs := map[string]haSensorConfig{}
+	for _, device := range devices {
+		if device.AddressUUID == nil || *device.AddressUUID == "" {
+			continue
+		}
+		address := *device.AddressUUID
+		devDesc := codec.GetDeviceDescription(device, codecs.LoRaDeviceDescriptions)
+		deviceModel := devDesc.DeviceName
+		if deviceModel == "" {
+			deviceModel = device.Model
+		}
+		haDev := haDevice{
+			Identifiers:  []string{"loraraw_" + haObjectID(address)},
+			Name:         device.Name,
+			Model:        deviceModel,
+			Manufacturer: haManufacturer,
+		}
+		for _, point := range device.Points {
+			objectID := haObjectID(address + "_" + point.IoNumber)
+			name := point.Name
+			if name == "" {
+				name = point.IoNumber
+			}
+			unit := pointUnit(point, point.IoNumber, devDesc)
+			configs[h.prefix+"/sensor/"+objectID+"/config"] = haSensorConfig{
+				Name:                name,
+				UniqueID:            "loraraw_" + objectID,
+				StateTopic:          c.pointValueTopic(address, device.Name, point.IoNumber),
+				UnitOfMeasurement:   unit,
+				DeviceClass:         haDeviceClasses[unit],
+				StateClass:          haStateClass(point, devDesc, unit),
+				AvailabilityTopic:   c.statusTopic,
+				PayloadAvailable:    "online",
+				PayloadNotAvailable: "offline",
+				Device:              haDev,
+			}
+		}
+	}
+	return configs
+}
+
+// haStateClass is the point's state class: the codec's, else measurement
+// for a numeric point with a unit (total_increasing for an energy meter).
+// A bool or a point without a unit, e.g. a status or enum code, gets none,
+// as Home Assistant rejects a state class on values it cannot add up.
+func haStateClass(point *model.Point, devDesc *codec.LoRaDeviceDescription, unit string) string {
+	if devDesc != nil && devDesc.GetPointConfig != nil {
+		if config := devDesc.GetPointConfig(point.IoNumber); config != nil && config.StateClass != "" {
+			return config.StateClass
+		}
+	}
+	if unit == "" || (point.IsTypeBool != nil && *point.IsTypeBool) {
+		return ""
+	}
+	if haDeviceClasses[unit] == "energy" {
+		return "total_increasing"
+	}
+	return "measurement"
+}
+
+func haObjectID(s string) string {
+	return haObjectIDInvalid.ReplaceAllString(s, "_")
+}
+
+// publish publishes the configs (retained) and removes the ones published
+// before that are gone now.
+func (h *haDiscovery) publish(c *MQTTClient, devices []*model.Device) {
+	configs := h.configs(c, devices)
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for topic, config := range configs {
+		c.publishWith(topic, 1, true, config)
+	}
+	for topic := range h.published {
+		if _, ok := configs[topic]; !ok {
+			c.publishWith(topic, 1, true, "")
+		}
+	}
+	h.published = make(map[string]bool, len(configs))
+	for topic := range configs {
+		h.published[topic] = true
+	}
+	log.Infof("mqtt: published Home Assistant discovery for %d points", len(configs))
+}
+
+// refreshHADiscovery re-publishes the discovery configs shortly, after the
+// module's devices or points changed.
+func (m *Module) refreshHADiscovery() {
+	discovery := m.haDiscovery
+	if discovery == nil {
+		return
+	}
+	discovery.refreshMutex.Lock()
+	defer discovery.refreshMutex.Unlock()
+
+	if discovery.refresh != nil {
+		discovery.refresh.Stop()
+	}
+	discovery.refresh = time.AfterFunc(haRefreshDelay, m.publishHADiscovery)
+}
+
+// publishHADiscovery (re)publishes the discovery configs of every device of
+// the module. It is called on every MQTT connect and when devices or points
+// are added or removed.
+func (m *Module) publishHADiscovery() {
+	client, discovery := m.mqttClient, m.haDiscovery
+	if client == nil || discovery == nil || m.grpcMarshaller == nil {
+		return
+	}
+	opts := &nmodule.Opts{Args: &nargs.Args{WithDevices: true, WithPoints: true}}
+	networks, err := m.grpcMarshaller.GetNetworksByPluginName(m.moduleName, opts)
+	if err != nil {
+		log.Errorf("mqtt: Home Assistant discovery: %s", err)
+		return
+	}
+	var devices []*model.Device
+	for _, network := range networks {
+		devices = append(devices, network.Devices...)
+	}
+	discovery.publish(client, devices)
+}
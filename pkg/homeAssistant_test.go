@@ -0,0 +1,78 @@
+package pkg
+
+import (
+	"testing"
+
+	"github.com/NubeIO/module-core-loraraw/codec"
+	"github.com/NubeIO/module-core-loraraw/schema"
+	"github.com/NubeIO/nubeio-rubix-lib-models-go/model"
+)
+
+func TestHADiscovery_Configs(t *testing.T) {
+	addr := "65C0640D"
+	celsius, kwh, yes := "celsius", "kWh", true
+	device := &model.Device{
+		Name:         "plant room",
+		CommonDevice: model.CommonDevice{Model: schema.DeviceModelRubix, AddressUUID: &addr},
+		Points: []*model.Point{
+			{IoNumber: codec.RssiField},
+			{Name: "Supply temp", IoNumber: "UI-1", Unit: &celsius},
+			{Name: "Mode", IoNumber: "UI-2"},
+			{Name: "Pump", IoNumber: "DI-1", Unit: &celsius, IsTypeBool: &yes},
+			{Name: "Energy", IoNumber: "UI-3", Unit: &kwh},
+		},
+	}
+	unaddressed := &model.Device{Name: "new", Points: []*model.Point{{IoNumber: codec.RssiField}}}
+	c := &MQTTClient{topicPrefix: MQTTTopicPrefix, statusTopic: MQTTTopicPrefix + "/status", pointTopic: haPointTopic}
+	h := newHADiscovery(HADiscoveryPrefix)
+
+	configs := h.configs(c, []*model.Device{device, unaddressed})
+	if len(configs) != 5 {
+		t.Fatalf("expected 5 sensors, got %d", len(configs))
+	}
+	rssi, ok := configs["homeassistant/sensor/65C0640D_rssi/config"]
+	if !ok {
+		t.Fatalf("missing rssi sensor: %v", configs)
+	}
+	if rssi.Name != codec.RssiField || rssi.UnitOfMeasurement != "dBm" || rssi.DeviceClass != "signal_strength" || rssi.StateClass != "measurement" {
+		t.Fatalf("rssi: %+v", rssi)
+	}
+	if rssi.StateTopic != "module-core-loraraw/devices/65C0640D/rssi" || rssi.AvailabilityTopic != "module-core-loraraw/status" {
+		t.Fatalf("rssi topics: %+v", rssi)
+	}
+	if rssi.Device.Name != "plant room" || rssi.Device.Identifiers[0] != "loraraw_65C0640D" || rssi.Device.Model == "" {
+		t.Fatalf("rssi device: %+v", rssi.Device)
+	}
+
+	temp := configs["homeassistant/sensor/65C0640D_UI-1/config"]
+	if temp.Name != "Supply temp" || temp.UnitOfMeasurement != "°C" || temp.DeviceClass != "temperature" || temp.UniqueID != "loraraw_65C0640D_UI-1" {
+		t.Fatalf("temperature: %+v", temp)
+	}
+
+	// A point without a unit (an enum or status code) or a bool has no state
+	// class; an energy meter only counts up.
+	if mode := configs["homeassistant/sensor/65C0640D_UI-2/config"]; mode.StateClass != "" {
+		t.Fatalf("unitless point state class %q", mode.StateClass)
+	}
+	if pump := configs["homeassistant/sensor/65C0640D_DI-1/config"]; pump.StateClass != "" {
+		t.Fatalf("bool point state class %q", pump.StateClass)
+	}
+	if energy := configs["homeassistant/sensor/65C0640D_UI-3/config"]; energy.StateClass != "total_increasing" {
+		t.Fatalf("energy point state class %q", energy.StateClass)
+	}
+}
+
+func TestHAStateClass_FromCodec(t *testing.T) {
+	devDesc := &codec.LoRaDeviceDescription{GetPointConfig: func(name string) *codec.PointConfig {
+		if name == "pulses" {
+			return &codec.PointConfig{StateClass: "total_increasing"}
+		}
+		return nil
+	}}
+	if got := haStateClass(&model.Point{IoNumber: "pulses"}, devDesc, ""); got != "total_increasing" {
+		t.Fatalf("the codec's state class should win, got %q", got)
+	}
+	if got := haStateClass(&model.Point{IoNumber: "level"}, devDesc, "%"); got != "measurement" {
+		t.Fatalf("a numeric point with a unit is a measurement, got %q", got)
+	}
+}
@@ -0,0 +1,546 @@
+package pkg
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NubeIO/nubeio-rubix-lib-models-go/model"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	keyRingStateFile = "device-keys.json"
+	keyAuditFile     = "key-audit.jsonl"
+
+	// The keys a device may use: its current key (device.Manufacture, else
+	// the default key), the next key it is being rotated to, and the key it
+	// used before the last rotation.
+	keyCurrent  = "current"
+	keyNext     = "next"
+	keyPrevious = "previous"
+
+	keyEventNextSet       = "next_key_set"
+	keyEventNextCleared   = "next_key_cleared"
+	keyEventPromoted      = "promoted"
+	keyEventPromoteFailed = "promote_failed"
+	keyEventPreviousUsed  = "previous_key_used"
+	keyEventPreviousEnded = "previous_key_expired"
+)
+
+// deviceKeys is the rotation state of one device. The current key itself is
+// not kept here but in the device (Manufacture).
+type deviceKeys struct {
+	Next          string    `json:"next,omitempty"`
+	Previous      string    `json:"previous,omitempty"`
+	PreviousUntil time.Time `json:"previous_until,omitempty"`
+	// Proved is the key the device's last accepted uplink verified with;
+	// downlinks are encrypted with it.
+	Proved   string    `json:"proved,omitempty"`
+	ProvedAt time.Time `json:"proved_at,omitempty"`
+}
+
+// KeyStatus is the rotation state of a device as the API returns it. Keys are
+// identified by fingerprint only.
+type KeyStatus struct {
+	DeviceUUID    string     `json:"device_uuid"`
+	Current       string     `json:"current"`
+	Next          string     `json:"next,omitempty"`
+	Previous      string     `json:"previous,omitempty"`
+	PreviousUntil *time.Time `json:"previous_until,omitempty"`
+	Proved        string     `json:"proved"`
+	ProvedAt      *time.Time `json:"proved_at,omitempty"`
+}
+
+// KeyEvent is one line of the key audit log.
+type KeyEvent struct {
+	Time       time.Time `json:"time"`
+	DeviceUUID string    `json:"device_uuid"`
+	Event      string    `json:"event"`
+	Key        string    `json:"key,omitempty"` // fingerprint
+	Detail     string    `json:"detail,omitempty"`
+}
+
+type labeledKey struct {
+	label string
+	key   []byte
+}
+
+// keyFingerprint identifies a key in the API and the audit log without
+// revealing it: the first 4 bytes of its SHA-256, in hex.
+func keyFingerprint(hexKey string) string {
+	if hexKey == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(strings.ToLower(hexKey)))
+	return hex.EncodeToString(sum[:4])
+}
+
+// parseDeviceKey decodes a hex AES key, rejecting lengths AES does not take.
+func parseDeviceKey(hexKey string) ([]byte, error) {
+	key, err := hex.DecodeString(hexKey)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = aes.NewCipher(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// keyRing holds the rotation state of every device that has a next or a
+// previous key, persisted to the module data dir, and audits every change.
+//
+// A device is re-keyed by setting its next key. Uplinks are then verified
+// with the current and the next key; the first uplink that verifies with the
+// next key promotes it to current, and the old key stays accepted for window
+// after that, for frames already in flight.
+//
+// Next and previous keys are stored sealed when a master key is set.
+type keyRing struct {
+	path    string
+	window  time.Duration
+	sealer  *keySealer
+	audit   *keyAudit
+	devices map[string]*deviceKeys
+	mutex   sync.Mutex
+}
+
+func newKeyRing(path, auditPath string, window time.Duration, sealer *keySealer) *keyRing {
+	r := &keyRing{
+		path:    path,
+		window:  window,
+		sealer:  sealer,
+		audit:   newKeyAudit(auditPath),
+		devices: make(map[string]*deviceKeys),
+	}
+	if err := loadState(path, &r.devices); err != nil {
+		log.Errorf("keys: failed to load key state from %s: %s", path, err)
+	}
+	if r.devices == nil {
+		r.devices = make(map[string]*deviceKeys)
+	}
+	if sealer != nil {
+		r.sealAll()
+	}
+	return r
+}
+
+// sealAll seals the keys stored before the master key was set.
+func (r *keyRing) sealAll() {
+	changed := false
+	for _, d := range r.devices {
+		for _, key := range []*string{&d.Next, &d.Previous} {
+			if *key == "" || isSealedKey(*key) {
+				continue
+			}
+			if sealed, err := r.sealer.seal(*key); err == nil {
+				*key = sealed
+				changed = true
+			}
+		}
+	}
+	if changed {
+		r.save()
+	}
+}
+
+// plain returns the hex key of a stored key, "" when it does not open.
+func (r *keyRing) plain(stored string) string {
+	key, err := r.sealer.open(stored)
+	if err != nil {
+		log.Errorf("keys: %s", err)
+		return ""
+	}
+	return key
+}
+
+func (r *keyRing) fingerprint(stored string) string {
+	return keyFingerprint(r.plain(stored))
+}
+
+// expire drops the previous key once its window has passed.
+func (r *keyRing) expire(deviceUUID string, d *deviceKeys) {
+	if d.Previous == "" || time.Now().Before(d.PreviousUntil) {
+		return
+	}
+	r.audit.add(deviceUUID, keyEventPreviousEnded, r.fingerprint(d.Previous), "")
+	d.Previous = ""
+	d.PreviousUntil = time.Time{}
+	if d.Proved == keyPrevious {
+		d.Proved = keyCurrent
+	}
+	r.save()
+}
+
+// uplinkKeys returns the keys to verify an uplink with, current first.
+func (r *keyRing) uplinkKeys(deviceUUID string, current []byte) []labeledKey {
+	keys := []labeledKey{{keyCurrent, current}}
+	if r == nil {
+		return keys
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	d, ok := r.devices[deviceUUID]
+	if !ok {
+		return keys
+	}
+	r.expire(deviceUUID, d)
+	for _, k := range []struct{ label, hexKey string }{{keyNext, d.Next}, {keyPrevious, d.Previous}} {
+		if k.hexKey == "" {
+			continue
+		}
+		if key, err := hex.DecodeString(r.plain(k.hexKey)); err == nil && len(key) > 0 {
+			keys = append(keys, labeledKey{k.label, key})
+		}
+	}
+	return keys
+}
+
+// downlinkKey returns the hex key downlinks to the device are encrypted with:
+// the one its last uplink proved, the current (hex) key when that is not
+// known.
+func (r *keyRing) downlinkKey(deviceUUID, current string) string {
+	if r == nil {
+		return current
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	d, ok := r.devices[deviceUUID]
+	if !ok {
+		return current
+	}
+	r.expire(deviceUUID, d)
+	switch {
+	case d.Proved == keyNext && d.Next != "":
+		return r.plain(d.Next)
+	case d.Proved == keyPrevious && d.Previous != "":
+		return r.plain(d.Previous)
+	}
+	return current
+}
+
+// proved records that an accepted uplink verified with the labelled key. It
+// returns the next key (as stored) when that is what the device used, to be
+// promoted.
+func (r *keyRing) proved(deviceUUID, label string) string {
+	if r == nil {
+		return ""
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	d, ok := r.devices[deviceUUID]
+	if !ok {
+		return ""
+	}
+	if d.Proved != label {
+		if label == keyPrevious {
+			r.audit.add(deviceUUID, keyEventPreviousUsed, r.fingerprint(d.Previous), "downlinks use the previous key")
+		}
+		d.Proved = label
+		d.ProvedAt = time.Now().UTC()
+		r.save()
+	}
+	if label == keyNext {
+		return d.Next
+	}
+	return ""
+}
+
+// promoted records that the next key became the device's current key; the
+// old key (as stored) is kept as the previous key for the window.
+func (r *keyRing) promoted(deviceUUID, oldCurrent string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	d, ok := r.devices[deviceUUID]
+	if !ok || d.Next == "" {
+		return
+	}
+	next := d.Next
+	d.Next = ""
+	d.Proved = keyCurrent
+	d.ProvedAt = time.Now().UTC()
+	d.Previous, d.PreviousUntil = "", time.Time{}
+	if r.window > 0 {
+		d.Previous, _ = r.sealer.seal(oldCurrent)
+		d.PreviousUntil = time.Now().Add(r.window).UTC()
+	}
+	r.audit.add(deviceUUID, keyEventPromoted, r.fingerprint(next), "replaces "+r.fingerprint(oldCurrent))
+	r.save()
+}
+
+func (r *keyRing) promoteFailed(deviceUUID string, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	next := ""
+	if d, ok := r.devices[deviceUUID]; ok {
+		next = d.Next
+	}
+	r.audit.add(deviceUUID, keyEventPromoteFailed, r.fingerprint(next), err.Error())
+}
+
+// setNext sets the (hex) key the device is being rotated to.
+func (r *keyRing) setNext(deviceUUID, next string) error {
+	stored, err := r.sealer.seal(strings.ToLower(next))
+	if err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	d, ok := r.devices[deviceUUID]
+	if !ok {
+		d = &deviceKeys{}
+		r.devices[deviceUUID] = d
+	}
+	d.Next = stored
+	if d.Proved == keyNext {
+		d.Proved = ""
+	}
+	r.audit.add(deviceUUID, keyEventNextSet, keyFingerprint(next), "")
+	r.save()
+	return nil
+}
+
+// clearNext cancels the rotation of the device.
+func (r *keyRing) clearNext(deviceUUID string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	d, ok := r.devices[deviceUUID]
+	if !ok || d.Next == "" {
+		return
+	}
+	r.audit.add(deviceUUID, keyEventNextCleared, r.fingerprint(d.Next), "")
+	d.Next = ""
+	if d.Proved == keyNext {
+		d.Proved = ""
+	}
+	if d.Previous == "" {
+		delete(r.devices, deviceUUID)
+	}
+	r.save()
+}
+
+// forget drops the state of a deleted device.
+func (r *keyRing) forget(deviceUUID string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, ok := r.devices[deviceUUID]; ok {
+		delete(r.devices, deviceUUID)
+		r.save()
+	}
+}
+
+func (r *keyRing) status(deviceUUID, current string) KeyStatus {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	status := KeyStatus{DeviceUUID: deviceUUID, Current: keyFingerprint(current), Proved: keyCurrent}
+	d, ok := r.devices[deviceUUID]
+	if !ok {
+		return status
+	}
+	r.expire(deviceUUID, d)
+	status.Next = r.fingerprint(d.Next)
+	status.Previous = r.fingerprint(d.Previous)
+	if d.Previous != "" {
+		until := d.PreviousUntil
+		status.PreviousUntil = &until
+	}
+	if d.Proved != "" {
+		status.Proved = d.Proved
+	}
+	if !d.ProvedAt.IsZero() {
+		provedAt := d.ProvedAt
+		status.ProvedAt = &provedAt
+	}
+	return status
+}
+
+func (r *keyRing) save() {
+	if err := saveState(r.path, r.devices); err != nil {
+		log.Errorf("keys: failed to save key state to %s: %s", r.path, err)
+	}
+}
+
+// keyAudit appends key events to a JSONL file in the module data dir (kept
+// in memory only without one).
+type keyAudit struct {
+	path   string
+	events []KeyEvent
+	mutex  sync.Mutex
+}
+
+func newKeyAudit(path string) *keyAudit {
+	a := &keyAudit{path: path}
+	if path == "" {
+		return a
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Errorf("keys: failed to read audit log %s: %s", path, err)
+		}
+		return a
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event KeyEvent
+		if json.Unmarshal(scanner.Bytes(), &event) == nil {
+			a.events = append(a.events, event)
+		}
+	}
+	return a
+}
+
+func (a *keyAudit) add(deviceUUID, event, key, detail string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	e := KeyEvent{Time: time.Now().UTC(), DeviceUUID: deviceUUID, Event: event, Key: key, Detail: detail}
+	a.events = append(a.events, e)
+	log.Infof("keys: device %s: %s %s %s", deviceUUID, event, key, detail)
+	if a.path == "" {
+		return
+	}
+	line, _ := json.Marshal(e)
+	if err := appendLine(a.path, line); err != nil {
+		log.Errorf("keys: failed to write audit log %s: %s", a.path, err)
+	}
+}
+
+// list returns the events of the device, or all events for "".
+func (a *keyAudit) list(deviceUUID string) []KeyEvent {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	events := make([]KeyEvent, 0, len(a.events))
+	for _, e := range a.events {
+		if deviceUUID == "" || e.DeviceUUID == deviceUUID {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+func appendLine(path string, line []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(line, '\n'))
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// currentKey is the device's current hex key.
+func (m *Module) currentKey(device *model.Device) (string, error) {
+	if device.Manufacture != "" {
+		// Manufacture property from device model holds the key, sealed when a
+		// master key is set.
+		return m.config.sealer.open(device.Manufacture)
+	}
+	return m.config.deviceDefaultKey(), nil
+}
+
+// uplinkKeys returns the keys an uplink of the device may be encrypted with.
+func (m *Module) uplinkKeys(device *model.Device) ([]labeledKey, error) {
+	hexKey, err := m.currentKey(device)
+	if err != nil {
+		return nil, err
+	}
+	current, err := hex.DecodeString(hexKey)
+	if err != nil {
+		return nil, err
+	}
+	return m.keyRing.uplinkKeys(device.UUID, current), nil
+}
+
+// keyProved promotes the device's next key once an uplink proved the device
+// uses it: the key is stored as the device's key (Manufacture).
+func (m *Module) keyProved(device *model.Device, label string) {
+	next := m.keyRing.proved(device.UUID, label)
+	if next == "" {
+		return
+	}
+	oldCurrent := device.Manufacture
+	if oldCurrent == "" {
+		oldCurrent = m.config.deviceDefaultKey()
+	}
+	if m.grpcMarshaller == nil {
+		m.keyRing.promoteFailed(device.UUID, errors.New("no host to store the key"))
+		return
+	}
+	body := *device
+	body.Points = nil
+	body.MetaTags = nil
+	body.Manufacture = next
+	if _, err := m.grpcMarshaller.UpdateDevice(device.UUID, &body); err != nil {
+		// Downlinks keep using the next key, as proved; the promotion is
+		// retried on the next uplink.
+		m.keyRing.promoteFailed(device.UUID, err)
+		return
+	}
+	device.Manufacture = next
+	m.keyRing.promoted(device.UUID, oldCurrent)
+}
+
+// setNextKey starts rotating the device to key.
+func (m *Module) setNextKey(deviceUUID, key string) error {
+	if m.keyRing == nil {
+		return errors.New("module is not enabled")
+	}
+	if _, err := parseDeviceKey(key); err != nil {
+		return fmt.Errorf("invalid key: %w", err)
+	}
+	device, err := m.getDevice(deviceUUID)
+	if err != nil {
+		return err
+	}
+	current, err := m.currentKey(device)
+	if err != nil {
+		return err
+	}
+	if strings.EqualFold(key, current) {
+		return errors.New("the next key is the device's current key")
+	}
+	return m.keyRing.setNext(device.UUID, key)
+}
+
+func (m *Module) keyStatus(deviceUUID string) (*KeyStatus, error) {
+	if m.keyRing == nil {
+		return nil, errors.New("module is not enabled")
+	}
+	device, err := m.getDevice(deviceUUID)
+	if err != nil {
+		return nil, err
+	}
+	current, err := m.currentKey(device)
+	if err != nil {
+		return nil, err
+	}
+	status := m.keyRing.status(device.UUID, current)
+	return &status, nil
+}
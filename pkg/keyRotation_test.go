@@ -0,0 +1,109 @@
+package pkg
+
+import (
+	"encoding/hex"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/NubeIO/module-core-loraraw/codec"
+	"github.com/NubeIO/module-core-loraraw/schema"
+	"github.com/NubeIO/nubeio-rubix-lib-models-go/model"
+)
+
+const testOtherKey = "000102030405060708090a0b0c0d0e0f"
+
+func TestKeyRing_Rotation(t *testing.T) {
+	dir := t.TempDir()
+	addr := "65C0640D"
+	device := &model.Device{
+		CommonUUID: model.CommonUUID{UUID: "dev-optical"},
+		CommonDevice: model.CommonDevice{
+			Model:       schema.DeviceModelRubixEncrypted,
+			AddressUUID: &addr,
+			Manufacture: testOtherKey,
+		},
+	}
+	m := &Module{
+		config:  &Config{DefaultKey: testDefaultKey},
+		keyRing: newKeyRing(filepath.Join(dir, keyRingStateFile), filepath.Join(dir, keyAuditFile), time.Hour, nil),
+	}
+	dispatch := func() DispatchResult {
+		return m.dispatchFrame(testCaptureFrame, newMockGetDevice(device, addr),
+			func(string, float64, *model.Device, *codec.LoRaDeviceDescription) error { return nil },
+			noopPointErr, noopMetaTags, noopWrittenOK, noopWrittenErr)
+	}
+	downlinkKey := func() string {
+		key, err := m.getEncryptionKey(device)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return keyFingerprint(hex.EncodeToString(key))
+	}
+
+	if res := dispatch(); res.OK {
+		t.Fatalf("a frame under another key must not verify")
+	}
+
+	// The device was re-keyed to testDefaultKey: its frames verify with the
+	// next key, and downlinks follow.
+	m.keyRing.setNext(device.UUID, testDefaultKey)
+	if downlinkKey() != keyFingerprint(testOtherKey) {
+		t.Fatalf("downlinks must use the current key until the device proves the next one")
+	}
+	if res := dispatch(); !res.OK {
+		t.Fatalf("expected the frame to verify with the next key")
+	}
+	if downlinkKey() != keyFingerprint(testDefaultKey) {
+		t.Fatalf("downlinks must use the proved next key")
+	}
+	// Without a host the promotion fails and is audited; the key stays next.
+	events := m.keyRing.audit.list(device.UUID)
+	if len(events) != 2 || events[0].Event != keyEventNextSet || events[1].Event != keyEventPromoteFailed {
+		t.Fatalf("unexpected audit %+v", events)
+	}
+
+	device.Manufacture = testDefaultKey
+	m.keyRing.promoted(device.UUID, testOtherKey)
+	current, _ := m.currentKey(device)
+	status := m.keyRing.status(device.UUID, current)
+	if status.Next != "" || status.Previous != keyFingerprint(testOtherKey) || status.PreviousUntil == nil || status.Proved != keyCurrent {
+		t.Fatalf("unexpected status after promotion %+v", status)
+	}
+
+	// A frame under the old key is still accepted inside the window, and
+	// switches downlinks back to it.
+	device.Manufacture = "ffffffffffffffffffffffffffffffff"
+	m.keyRing.devices[device.UUID].Previous = testDefaultKey
+	if res := dispatch(); !res.OK {
+		t.Fatalf("expected the frame to verify with the previous key")
+	}
+	if downlinkKey() != keyFingerprint(testDefaultKey) {
+		t.Fatalf("downlinks must use the proved previous key")
+	}
+	m.keyRing.devices[device.UUID].PreviousUntil = time.Now().Add(-time.Second)
+	if res := dispatch(); res.OK {
+		t.Fatalf("the previous key must not verify after the window")
+	}
+
+	// The state and audit survive a restart.
+	ring := newKeyRing(filepath.Join(dir, keyRingStateFile), filepath.Join(dir, keyAuditFile), time.Hour, nil)
+	last := ring.audit.list("")
+	if len(last) != 5 || last[4].Event != keyEventPreviousEnded {
+		t.Fatalf("unexpected audit after reload %+v", last)
+	}
+	if ring.devices[device.UUID] == nil || ring.devices[device.UUID].Previous != "" {
+		t.Fatalf("unexpected state after reload %+v", ring.devices[device.UUID])
+	}
+}
+
+func TestParseDeviceKey(t *testing.T) {
+	if _, err := parseDeviceKey(testDefaultKey); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"", "zz", "0102"} {
+		if _, err := parseDeviceKey(key); err == nil {
+			t.Errorf("expected %q to be rejected", key)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package pkg
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/NubeIO/lib-module-go/nmodule"
+	"github.com/NubeIO/nubeio-rubix-lib-models-go/model"
+	"github.com/NubeIO/nubeio-rubix-lib-models-go/nargs"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// sealedKeyPrefix marks a device key encrypted with the master key, as
+	// stored in the device's Manufacture (or default_key).
+	sealedKeyPrefix = "enc:v1:"
+
+	// The environment variables override master_key_file and default_key.
+	masterKeyEnv  = "LORARAW_MASTER_KEY"
+	defaultKeyEnv = "LORARAW_DEFAULT_KEY"
+)
+
+func isSealedKey(stored string) bool {
+	return strings.HasPrefix(stored, sealedKeyPrefix)
+}
+
+// keySealer encrypts device keys at rest with the module master key
+// (AES-GCM). A nil sealer stores keys as they are.
+type keySealer struct {
+	aead cipher.AEAD
+}
+
+func newKeySealer(hexMasterKey string) (*keySealer, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(hexMasterKey))
+	if err != nil {
+		return nil, fmt.Errorf("invalid master key: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid master key: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &keySealer{aead: aead}, nil
+}
+
+// seal encrypts a hex key for storage. Sealed keys are returned as they are.
+func (s *keySealer) seal(hexKey string) (string, error) {
+	if s == nil || hexKey == "" || isSealedKey(hexKey) {
+		return hexKey, nil
+	}
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := s.aead.Seal(nonce, nonce, []byte(strings.ToLower(hexKey)), nil)
+	return sealedKeyPrefix + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// open returns the hex key of a stored key. Keys stored in plaintext (from
+// before the master key was set) are returned as they are.
+func (s *keySealer) open(stored string) (string, error) {
+	if !isSealedKey(stored) {
+		return stored, nil
+	}
+	if s == nil {
+		return "", errors.New("key is encrypted but no master key is set")
+	}
+	data, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(stored, sealedKeyPrefix))
+	if err != nil || len(data) < s.aead.NonceSize() {
+		return "", errors.New("malformed encrypted key")
+	}
+	nonceSize := s.aead.NonceSize()
+	plain, err := s.aead.Open(nil, data[:nonceSize], data[nonceSize:], nil)
+	if err != nil {
+		return "", errors.New("encrypted key does not open with the master key")
+	}
+	return string(plain), nil
+}
+
+// resolveKeys reads the master key (LORARAW_MASTER_KEY, else MasterKeyFile)
+// and the default key (LORARAW_DEFAULT_KEY, else DefaultKeyFile, else
+// DefaultKey, which may be sealed). The resolved keys are kept out of the
+// YAML, so the host never stores them in plaintext.
+func (c *Config) resolveKeys() error {
+	c.sealer = nil
+	c.defaultKey = ""
+
+	masterKey := os.Getenv(masterKeyEnv)
+	if masterKey == "" && c.MasterKeyFile != "" {
+		data, err := os.ReadFile(c.MasterKeyFile)
+		if err != nil {
+			return fmt.Errorf("master key file: %w", err)
+		}
+		masterKey = string(data)
+	}
+	if strings.TrimSpace(masterKey) != "" {
+		sealer, err := newKeySealer(masterKey)
+		if err != nil {
+			return err
+		}
+		c.sealer = sealer
+	}
+
+	defaultKey := os.Getenv(defaultKeyEnv)
+	if defaultKey == "" && c.DefaultKeyFile != "" {
+		data, err := os.ReadFile(c.DefaultKeyFile)
+		if err != nil {
+			return fmt.Errorf("default key file: %w", err)
+		}
+		defaultKey = string(data)
+	}
+	if defaultKey = strings.TrimSpace(defaultKey); defaultKey == "" {
+		defaultKey = c.DefaultKey
+	}
+	defaultKey, err := c.sealer.open(defaultKey)
+	if err != nil {
+		return fmt.Errorf("default key: %w", err)
+	}
+	c.defaultKey = defaultKey
+	return nil
+}
+
+// deviceDefaultKey is the hex key of devices without a key of their own.
+func (c *Config) deviceDefaultKey() string {
+	if c.defaultKey != "" {
+		return c.defaultKey
+	}
+	return c.DefaultKey
+}
+
+// storeDeviceKey validates a key given through the device API and returns
+// the form to store: sealed when a master key is set.
+func (m *Module) storeDeviceKey(key string) (string, error) {
+	if isSealedKey(key) {
+		if _, err := m.config.sealer.open(key); err != nil {
+			return "", err
+		}
+		return key, nil
+	}
+	if _, err := parseDeviceKey(key); err != nil {
+		return "", fmt.Errorf("invalid device key (manufacture): %w", err)
+	}
+	return m.config.sealer.seal(key)
+}
+
+// prepareDeviceKey replaces the key in a device body from the API with its
+// stored form. Keys are never returned by the API, so a body without a key
+// (e.g. one read back and edited) keeps the key the device has.
+func (m *Module) prepareDeviceKey(uuid string, body *model.Device) error {
+	if body.Manufacture == "" {
+		if uuid == "" {
+			return nil
+		}
+		existing, err := m.grpcMarshaller.GetDevice(uuid)
+		if err != nil {
+			return err
+		}
+		body.Manufacture = existing.Manufacture
+		return nil
+	}
+	stored, err := m.storeDeviceKey(body.Manufacture)
+	if err != nil {
+		return err
+	}
+	body.Manufacture = stored
+	return nil
+}
+
+// DeviceResponse is a device as the module's API returns it: without its key,
+// but with the key's fingerprint (see keyFingerprint) to check which key is
+// set. KeyFingerprint is empty for a device on the default key.
+type DeviceResponse struct {
+	*model.Device
+	KeyFingerprint string `json:"key_fingerprint,omitempty"`
+}
+
+func (m *Module) redactDevice(device *model.Device) *DeviceResponse {
+	if device == nil {
+		return nil
+	}
+	redacted := *device
+	redacted.Manufacture = ""
+	response := &DeviceResponse{Device: &redacted}
+	if device.Manufacture != "" {
+		if key, err := m.config.sealer.open(device.Manufacture); err == nil {
+			response.KeyFingerprint = keyFingerprint(key)
+		}
+	}
+	return response
+}
+
+// sealDeviceKeys encrypts the keys of the module's devices still stored in
+// plaintext, once a master key is set.
+func (m *Module) sealDeviceKeys() {
+	if m.config.sealer == nil || m.grpcMarshaller == nil {
+		return
+	}
+	opts := &nmodule.Opts{Args: &nargs.Args{WithDevices: true}}
+	networks, err := m.grpcMarshaller.GetNetworksByPluginName(m.moduleName, opts)
+	if err != nil {
+		log.Errorf("keys: failed to list devices to encrypt their keys: %s", err)
+		return
+	}
+	sealed := 0
+	for _, network := range networks {
+		for _, device := range network.Devices {
+			if device.Manufacture == "" || isSealedKey(device.Manufacture) {
+				continue
+			}
+			stored, err := m.config.sealer.seal(device.Manufacture)
+			if err != nil {
+				log.Errorf("keys: device %s: %s", device.Name, err)
+				continue
+			}
+			body := *device
+			body.Points = nil
+			body.MetaTags = nil
+			body.Manufacture = stored
+			if _, err = m.grpcMarshaller.UpdateDevice(device.UUID, &body); err != nil {
+				log.Errorf("keys: device %s: failed to store encrypted key: %s", device.Name, err)
+				continue
+			}
+			sealed++
+		}
+	}
+	if sealed > 0 {
+		log.Infof("keys: encrypted the keys of %d devices with the master key", sealed)
+	}
+}
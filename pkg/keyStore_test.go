@@ -0,0 +1,155 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/NubeIO/module-core-loraraw/codec"
+	"github.com/NubeIO/module-core-loraraw/schema"
+	"github.com/NubeIO/nubeio-rubix-lib-models-go/model"
+)
+
+const testMasterKey = "8f1e3a5c7b9d0f2e4a6c8e0b2d4f6a8c1e3a5c7b9d0f2e4a6c8e0b2d4f6a8c0e"
+
+func TestKeySealer_SealOpen(t *testing.T) {
+	sealer, err := newKeySealer(testMasterKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := sealer.seal(testDefaultKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isSealedKey(sealed) || strings.Contains(sealed, testDefaultKey) {
+		t.Fatalf("key not sealed: %s", sealed)
+	}
+	if again, _ := sealer.seal(sealed); again != sealed {
+		t.Fatalf("a sealed key must not be sealed twice")
+	}
+	if key, err := sealer.open(sealed); err != nil || key != testDefaultKey {
+		t.Fatalf("open = %q, %v", key, err)
+	}
+	if key, err := sealer.open(testOtherKey); err != nil || key != testOtherKey {
+		t.Fatalf("a plaintext key must open as is, got %q, %v", key, err)
+	}
+
+	other, _ := newKeySealer(strings.Repeat("ab", 32))
+	if _, err = other.open(sealed); err == nil {
+		t.Fatalf("a key sealed with another master key must not open")
+	}
+	var none *keySealer
+	if _, err = none.open(sealed); err == nil {
+		t.Fatalf("a sealed key must not open without a master key")
+	}
+	if _, err = newKeySealer("0102"); err == nil {
+		t.Fatalf("expected a short master key to be rejected")
+	}
+}
+
+func TestConfig_ResolveKeys(t *testing.T) {
+	dir := t.TempDir()
+	masterFile := filepath.Join(dir, "master.key")
+	if err := os.WriteFile(masterFile, []byte(testMasterKey+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	sealer, _ := newKeySealer(testMasterKey)
+	sealedDefault, _ := sealer.seal(testOtherKey)
+
+	config := &Config{DefaultKey: sealedDefault, MasterKeyFile: masterFile}
+	if err := config.resolveKeys(); err != nil {
+		t.Fatal(err)
+	}
+	if config.sealer == nil || config.deviceDefaultKey() != testOtherKey {
+		t.Fatalf("sealed default key not resolved: %q", config.deviceDefaultKey())
+	}
+
+	defaultFile := filepath.Join(dir, "default.key")
+	if err := os.WriteFile(defaultFile, []byte(testDefaultKey+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config.DefaultKeyFile = defaultFile
+	if err := config.resolveKeys(); err != nil || config.deviceDefaultKey() != testDefaultKey {
+		t.Fatalf("default key file not used: %q, %v", config.deviceDefaultKey(), err)
+	}
+
+	t.Setenv(defaultKeyEnv, DefaultDeviceKey)
+	if err := config.resolveKeys(); err != nil || config.deviceDefaultKey() != DefaultDeviceKey {
+		t.Fatalf("%s not used: %q, %v", defaultKeyEnv, config.deviceDefaultKey(), err)
+	}
+
+	t.Setenv(defaultKeyEnv, "")
+	config = &Config{DefaultKey: sealedDefault}
+	if err := config.resolveKeys(); err == nil {
+		t.Fatalf("a sealed default key needs the master key")
+	}
+	t.Setenv(masterKeyEnv, testMasterKey)
+	if err := config.resolveKeys(); err != nil || config.deviceDefaultKey() != testOtherKey {
+		t.Fatalf("%s not used: %q, %v", masterKeyEnv, config.deviceDefaultKey(), err)
+	}
+}
+
+func TestModule_DeviceKeyAPI(t *testing.T) {
+	sealer, _ := newKeySealer(testMasterKey)
+	m := &Module{config: &Config{DefaultKey: testDefaultKey, sealer: sealer}}
+
+	if _, err := m.storeDeviceKey("0102"); err == nil {
+		t.Fatalf("expected a short key to be rejected")
+	}
+	stored, err := m.storeDeviceKey(testOtherKey)
+	if err != nil || !isSealedKey(stored) {
+		t.Fatalf("storeDeviceKey = %q, %v", stored, err)
+	}
+	body := &model.Device{CommonDevice: model.CommonDevice{Manufacture: testOtherKey}}
+	if err = m.prepareDeviceKey("", body); err != nil || !isSealedKey(body.Manufacture) {
+		t.Fatalf("prepareDeviceKey = %q, %v", body.Manufacture, err)
+	}
+
+	response := m.redactDevice(body)
+	if response.Manufacture != "" || response.KeyFingerprint != keyFingerprint(testOtherKey) {
+		t.Fatalf("unexpected redacted device %+v", response)
+	}
+	if body.Manufacture == "" {
+		t.Fatalf("redactDevice must not change the device")
+	}
+	if response = m.redactDevice(&model.Device{}); response.KeyFingerprint != "" {
+		t.Fatalf("a device on the default key has no fingerprint")
+	}
+}
+
+func TestModule_DecodeWithSealedKey(t *testing.T) {
+	dir := t.TempDir()
+	sealer, _ := newKeySealer(testMasterKey)
+	stored, _ := sealer.seal(testDefaultKey)
+	addr := "65C0640D"
+	device := &model.Device{
+		CommonUUID: model.CommonUUID{UUID: "dev-sealed"},
+		CommonDevice: model.CommonDevice{
+			Model:       schema.DeviceModelRubixEncrypted,
+			AddressUUID: &addr,
+			Manufacture: stored,
+		},
+	}
+	m := &Module{
+		config:  &Config{DefaultKey: testOtherKey, sealer: sealer},
+		keyRing: newKeyRing(filepath.Join(dir, keyRingStateFile), filepath.Join(dir, keyAuditFile), time.Hour, sealer),
+	}
+	res := m.dispatchFrame(testCaptureFrame, newMockGetDevice(device, addr),
+		func(string, float64, *model.Device, *codec.LoRaDeviceDescription) error { return nil },
+		noopPointErr, noopMetaTags, noopWrittenOK, noopWrittenErr)
+	if !res.OK {
+		t.Fatalf("frame not decoded with the sealed device key")
+	}
+
+	if err := m.keyRing.setNext(device.UUID, testOtherKey); err != nil {
+		t.Fatal(err)
+	}
+	if next := m.keyRing.devices[device.UUID].Next; !isSealedKey(next) {
+		t.Fatalf("next key stored in plaintext: %s", next)
+	}
+	if status := m.keyRing.status(device.UUID, testDefaultKey); status.Next != keyFingerprint(testOtherKey) {
+		t.Fatalf("unexpected status %+v", status)
+	}
+}
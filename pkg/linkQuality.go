@@ -0,0 +1,205 @@
+package pkg
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	linkDropCMAC   = "cmac"
+	linkDropReplay = "replay"
+
+	// linkMaxNonceGap is the largest nonce jump counted as lost frames; a
+	// bigger one is a device reboot (or a resync), not 128+ missed uplinks.
+	linkMaxNonceGap = 64
+
+	linkRssiAvgField    = "rssi_avg"
+	linkSnrAvgField     = "snr_avg"
+	linkPacketLossField = "packet_loss"
+)
+
+// LinkStats is the radio link quality of one device, as seen by the module.
+// RSSI/SNR figures cover the last Window frames; the counters cover the
+// module's lifetime (or since the last reset).
+type LinkStats struct {
+	Window      int       `json:"window"`
+	Samples     int       `json:"samples"`
+	RssiMin     int       `json:"rssi_min"`
+	RssiAvg     float64   `json:"rssi_avg"`
+	RssiMax     int       `json:"rssi_max"`
+	SnrMin      float32   `json:"snr_min"`
+	SnrAvg      float64   `json:"snr_avg"`
+	SnrMax      float32   `json:"snr_max"`
+	Received    uint64    `json:"received"`
+	Lost        uint64    `json:"lost"`
+	LossPercent float64   `json:"loss_percent"`
+	CMACDrops   uint64    `json:"cmac_drops"`
+	ReplayDrops uint64    `json:"replay_drops"`
+	LastSeen    time.Time `json:"last_seen,omitempty"`
+	LastNonce   *uint8    `json:"last_nonce,omitempty"`
+}
+
+type linkSample struct {
+	rssi int
+	snr  float32
+}
+
+type deviceLink struct {
+	samples   []linkSample // ring buffer
+	next      int
+	received  uint64
+	lost      uint64
+	cmacDrops uint64
+	replays   uint64
+	lastSeen  time.Time
+	lastNonce *uint8
+}
+
+// linkTracker keeps a deviceLink per device UUID. Stats are in memory only:
+// they describe the current run of the radio, not the device's history.
+type linkTracker struct {
+	window int
+	links  map[string]*deviceLink
+	mutex  sync.Mutex
+}
+
+func newLinkTracker(window int) *linkTracker {
+	return &linkTracker{window: window, links: make(map[string]*deviceLink)}
+}
+
+func (t *linkTracker) link(deviceUUID string) *deviceLink {
+	l, ok := t.links[deviceUUID]
+	if !ok {
+		l = &deviceLink{samples: make([]linkSample, 0, t.window)}
+		t.links[deviceUUID] = l
+	}
+	return l
+}
+
+// Received records a decoded frame. hasNonce is false for frames without a
+// LoRaRAW uplink nonce (legacy devices, responses); those do not count
+// towards the loss estimate.
+func (t *linkTracker) Received(deviceUUID string, rssi int, snr float32, nonce uint8, hasNonce bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	l := t.link(deviceUUID)
+	l.received++
+	l.lastSeen = time.Now()
+	sample := linkSample{rssi: rssi, snr: snr}
+	if len(l.samples) < t.window {
+		l.samples = append(l.samples, sample)
+	} else {
+		l.samples[l.next] = sample
+		l.next = (l.next + 1) % t.window
+	}
+
+	if !hasNonce {
+		return
+	}
+	if l.lastNonce != nil {
+		last := *l.lastNonce
+		if gap := nonce - last - 1; gap < linkMaxNonceGap {
+			l.lost += uint64(gap)
+		} else if behind := last - nonce; behind < linkMaxNonceGap {
+			// A late frame that was already counted as lost.
+			if l.lost > 0 {
+				l.lost--
+			}
+			return
+		}
+	}
+	l.lastNonce = &nonce
+}
+
+// Dropped records a frame of a known device that was not decoded.
+func (t *linkTracker) Dropped(deviceUUID, reason string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	l := t.link(deviceUUID)
+	l.lastSeen = time.Now()
+	switch reason {
+	case linkDropCMAC:
+		l.cmacDrops++
+	case linkDropReplay:
+		l.replays++
+	}
+}
+
+// Get returns the device's stats, or nil when nothing was heard from it yet.
+func (t *linkTracker) Get(deviceUUID string) *LinkStats {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	l, ok := t.links[deviceUUID]
+	if !ok {
+		return nil
+	}
+	stats := &LinkStats{
+		Window:      t.window,
+		Samples:     len(l.samples),
+		Received:    l.received,
+		Lost:        l.lost,
+		CMACDrops:   l.cmacDrops,
+		ReplayDrops: l.replays,
+		LastSeen:    l.lastSeen,
+	}
+	if l.lastNonce != nil {
+		nonce := *l.lastNonce
+		stats.LastNonce = &nonce
+	}
+	if l.received+l.lost > 0 {
+		stats.LossPercent = float64(l.lost) * 100 / float64(l.received+l.lost)
+	}
+	for i, s := range l.samples {
+		if i == 0 || s.rssi < stats.RssiMin {
+			stats.RssiMin = s.rssi
+		}
+		if i == 0 || s.rssi > stats.RssiMax {
+			stats.RssiMax = s.rssi
+		}
+		if i == 0 || s.snr < stats.SnrMin {
+			stats.SnrMin = s.snr
+		}
+		if i == 0 || s.snr > stats.SnrMax {
+			stats.SnrMax = s.snr
+		}
+		stats.RssiAvg += float64(s.rssi)
+		stats.SnrAvg += float64(s.snr)
+	}
+	if len(l.samples) > 0 {
+		stats.RssiAvg /= float64(len(l.samples))
+		stats.SnrAvg /= float64(len(l.samples))
+	}
+	return stats
+}
+
+// Reset forgets the device's stats.
+func (t *linkTracker) Reset(deviceUUID string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	delete(t.links, deviceUUID)
+}
+
+// updateLinkStats records a decoded frame and, with link_stats_points, writes
+// the rolling figures to the device's points.
+func (m *Module) updateLinkStats(res DispatchResult) {
+	if m.linkTracker == nil {
+		return
+	}
+	m.linkTracker.Received(res.Device.UUID, res.RSSI, res.SNR, res.Nonce, res.HasNonce)
+	if !m.config.LinkStatsPoints {
+		return
+	}
+	stats := m.linkTracker.Get(res.Device.UUID)
+	_ = m.updateDevicePointSuccess(linkRssiAvgField, round2(stats.RssiAvg), res.Device, res.DevDesc)
+	_ = m.updateDevicePointSuccess(linkSnrAvgField, round2(stats.SnrAvg), res.Device, res.DevDesc)
+	_ = m.updateDevicePointSuccess(linkPacketLossField, round2(stats.LossPercent), res.Device, res.DevDesc)
+}
+
+func round2(v float64) float64 {
+	return math.Round(v*100) / 100
+}
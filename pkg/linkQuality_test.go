@@ -0,0 +1,110 @@
+package pkg
+
+import (
+	"testing"
+
+	"github.com/NubeIO/module-core-loraraw/codec"
+	"github.com/NubeIO/module-core-loraraw/schema"
+	"github.com/NubeIO/nubeio-rubix-lib-models-go/model"
+)
+
+func TestLinkTracker_RollingWindow(t *testing.T) {
+	tracker := newLinkTracker(3)
+	if tracker.Get("dev") != nil {
+		t.Fatalf("expected no stats before the first frame")
+	}
+	for _, rssi := range []int{-120, -90, -100, -110} {
+		tracker.Received("dev", rssi, float32(rssi)/10, 0, false)
+	}
+
+	stats := tracker.Get("dev")
+	if stats.Received != 4 || stats.Samples != 3 {
+		t.Fatalf("received %d samples %d", stats.Received, stats.Samples)
+	}
+	// -120 has rolled out of the window.
+	if stats.RssiMin != -110 || stats.RssiMax != -90 || stats.RssiAvg != -100 {
+		t.Fatalf("rssi min/avg/max %d/%v/%d", stats.RssiMin, stats.RssiAvg, stats.RssiMax)
+	}
+	if stats.SnrMin != -11 || stats.SnrMax != -9 {
+		t.Fatalf("snr min/max %v/%v", stats.SnrMin, stats.SnrMax)
+	}
+	if stats.LastNonce != nil || stats.Lost != 0 {
+		t.Fatalf("legacy frames must not count towards loss: %+v", stats)
+	}
+}
+
+func TestLinkTracker_LossFromNonceGaps(t *testing.T) {
+	tracker := newLinkTracker(10)
+	receive := func(nonce uint8) { tracker.Received("dev", -100, 5, nonce, true) }
+
+	receive(250)
+	receive(253) // 251, 252 missed
+	receive(1)   // wraps: 254, 255, 0 missed
+	if stats := tracker.Get("dev"); stats.Lost != 5 || stats.Received != 3 {
+		t.Fatalf("lost %d received %d", stats.Lost, stats.Received)
+	}
+
+	receive(0) // the late frame turns up after all
+	if stats := tracker.Get("dev"); stats.Lost != 4 || *stats.LastNonce != 1 {
+		t.Fatalf("late frame: lost %d last nonce %d", stats.Lost, *stats.LastNonce)
+	}
+
+	receive(150) // reboot, not 148 lost frames
+	receive(151)
+	stats := tracker.Get("dev")
+	if stats.Lost != 4 || *stats.LastNonce != 151 {
+		t.Fatalf("reboot: lost %d last nonce %d", stats.Lost, *stats.LastNonce)
+	}
+	if stats.LossPercent != 4*100.0/10 {
+		t.Fatalf("loss %v%%", stats.LossPercent)
+	}
+
+	tracker.Dropped("dev", linkDropCMAC)
+	tracker.Dropped("dev", linkDropReplay)
+	tracker.Dropped("dev", linkDropCMAC)
+	if stats := tracker.Get("dev"); stats.CMACDrops != 2 || stats.ReplayDrops != 1 || stats.Received != 6 {
+		t.Fatalf("drops %+v", stats)
+	}
+
+	tracker.Reset("dev")
+	if tracker.Get("dev") != nil {
+		t.Fatalf("expected stats to be reset")
+	}
+}
+
+func TestDispatchFrame_ReportsNonceAndDropReason(t *testing.T) {
+	addr := "65C0640D"
+	device := &model.Device{
+		CommonUUID: model.CommonUUID{UUID: "dev-optical"},
+		CommonDevice: model.CommonDevice{
+			Model:       schema.DeviceModelRubixEncrypted,
+			AddressUUID: &addr,
+		},
+	}
+	m := &Module{
+		config:      &Config{DefaultKey: testDefaultKey},
+		replayGuard: newReplayGuard("", 32, 0),
+	}
+	dispatch := func(frame string) DispatchResult {
+		return m.dispatchFrame(frame, newMockGetDevice(device, addr),
+			func(string, float64, *model.Device, *codec.LoRaDeviceDescription) error { return nil },
+			noopPointErr, noopMetaTags, noopWrittenOK, noopWrittenErr)
+	}
+
+	frame := "65C0640DA98521CC47B800BF4F2E90E4014F5279F207180C56A29EE9604CE987A1BA825351BDEF154126"
+	res := dispatch(frame)
+	if !res.OK || !res.HasNonce || res.Dropped != "" {
+		t.Fatalf("first reception: %+v", res)
+	}
+	res = dispatch(frame)
+	if res.OK || res.Dropped != linkDropReplay || res.Device != device {
+		t.Fatalf("replayed frame: OK=%v Dropped=%q", res.OK, res.Dropped)
+	}
+
+	// Corrupt the CMAC: it no longer verifies.
+	corrupted := frame[:74] + "00" + frame[76:]
+	res = dispatch(corrupted)
+	if res.OK || res.Dropped != linkDropCMAC || res.Device != device {
+		t.Fatalf("corrupted frame: OK=%v Dropped=%q", res.OK, res.Dropped)
+	}
+}
@@ -0,0 +1,343 @@
+package pkg
+
+import (
+	"encoding/hex"
+	"errors"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/NubeIO/module-core-loraraw/codec"
+	"github.com/NubeIO/module-core-loraraw/codecs"
+	"github.com/NubeIO/module-core-loraraw/utils"
+	"github.com/NubeIO/nubeio-rubix-lib-models-go/model"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// modelDetectionFrames is how many recent frames per device are kept to
+	// score models against.
+	modelDetectionFrames = 10
+
+	// Per-frame score of a model: the frame is accepted by the model's codec,
+	// it verified with the device key (CMAC), and the model is encryption-only
+	// so it would also drop a corrupted frame. Each decoded point adds
+	// modelScorePoint when it is in range and live (non-zero in some frame),
+	// and costs modelScoreOutOfRange when out of range.
+	modelScoreAccepted   = 1.0
+	modelScoreVerified   = 1.0
+	modelScoreStrict     = 0.5
+	modelScorePoint      = 0.1
+	modelScoreOutOfRange = 0.5
+	modelScoreTolerance  = 1e-9
+)
+
+// pointRanges are the physical ranges of the points that have one; a point
+// not listed here only has to decode to a finite number.
+var pointRanges = map[string][2]float64{
+	"temperature": {-40, 85},
+	"humidity":    {0, 100},
+	"pressure":    {300, 1100},
+	"voltage":     {0, 30},
+	"light":       {0, 100000},
+	"motion":      {0, 1},
+	"ai_1":        {0, 1023},
+	"ai_2":        {0, 1023},
+	"ai_3":        {0, 1023},
+}
+
+// ModelScore is how well a model decodes a device's recent frames: Score is
+// the mean per-frame score (see modelScoreAccepted), Accepted the frames its
+// codec accepted, Verified those that verified with the device key, Points
+// the points it decoded and OutOfRange the decoded values outside their
+// physical range.
+type ModelScore struct {
+	Model      string  `json:"model"`
+	Score      float64 `json:"score"`
+	Accepted   int     `json:"accepted"`
+	Verified   int     `json:"verified"`
+	Points     int     `json:"points"`
+	OutOfRange int     `json:"out_of_range"`
+}
+
+// ModelSuggestion is the model detection of a device. Suggested is set when a
+// model scores better than the device's own; Scores are best first.
+type ModelSuggestion struct {
+	DeviceUUID string       `json:"device_uuid"`
+	Model      string       `json:"model"`
+	Suggested  string       `json:"suggested,omitempty"`
+	Frames     int          `json:"frames"`
+	Learning   bool         `json:"learning"`
+	Scores     []ModelScore `json:"scores"`
+}
+
+// modelDetector keeps the recent frames of each device (as received, or as
+// legacy-decrypted) and which devices are learning their model. It is in
+// memory only.
+type modelDetector struct {
+	frames   map[string][]string
+	learning map[string]bool
+	mutex    sync.Mutex
+}
+
+func newModelDetector() *modelDetector {
+	return &modelDetector{frames: make(map[string][]string), learning: make(map[string]bool)}
+}
+
+func (d *modelDetector) Frame(deviceUUID, dataHex string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	frames := append(d.frames[deviceUUID], dataHex)
+	if len(frames) > modelDetectionFrames {
+		frames = frames[len(frames)-modelDetectionFrames:]
+	}
+	d.frames[deviceUUID] = frames
+}
+
+func (d *modelDetector) Frames(deviceUUID string) []string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return append([]string(nil), d.frames[deviceUUID]...)
+}
+
+// SetLearning starts (or stops) learning the device's model: once enough
+// frames were heard, the device's model is corrected if another one scores
+// better.
+func (d *modelDetector) SetLearning(deviceUUID string, learning bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if learning {
+		d.learning[deviceUUID] = true
+	} else {
+		delete(d.learning, deviceUUID)
+	}
+}
+
+func (d *modelDetector) Learning(deviceUUID string) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.learning[deviceUUID]
+}
+
+func (d *modelDetector) Forget(deviceUUID string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	delete(d.frames, deviceUUID)
+	delete(d.learning, deviceUUID)
+}
+
+// suggestModel scores every model against the device's recent frames.
+func (m *Module) suggestModel(device *model.Device) (*ModelSuggestion, error) {
+	if m.modelDetector == nil {
+		return nil, errors.New("module is not enabled")
+	}
+	frames := m.modelDetector.Frames(device.UUID)
+	suggestion := &ModelSuggestion{
+		DeviceUUID: device.UUID,
+		Model:      device.Model,
+		Frames:     len(frames),
+		Learning:   m.modelDetector.Learning(device.UUID),
+	}
+	if len(frames) == 0 {
+		return suggestion, nil
+	}
+	suggestion.Scores = m.scoreModels(device, frames)
+
+	current := math.Inf(-1)
+	for _, score := range suggestion.Scores {
+		if strings.EqualFold(score.Model, device.Model) {
+			current = score.Score
+		}
+	}
+	if best := suggestion.Scores[0]; best.Score > current+modelScoreTolerance && best.Accepted > 0 {
+		suggestion.Suggested = best.Model
+	}
+	return suggestion, nil
+}
+
+// learnModel corrects the model of a learning device once it has enough
+// frames, and ends learning.
+func (m *Module) learnModel(device *model.Device) {
+	if m.modelDetector == nil || !m.modelDetector.Learning(device.UUID) {
+		return
+	}
+	if len(m.modelDetector.Frames(device.UUID)) < m.config.ModelLearningFrames {
+		return
+	}
+	suggestion, err := m.suggestModel(device)
+	if err != nil {
+		return
+	}
+	m.modelDetector.SetLearning(device.UUID, false)
+	if suggestion.Suggested == "" {
+		log.Infof("model detection: device %s confirmed as %s", device.Name, device.Model)
+		return
+	}
+	if m.grpcMarshaller == nil {
+		return
+	}
+	body := *device
+	body.Points = nil
+	body.MetaTags = nil
+	body.Model = suggestion.Suggested
+	if _, err = m.grpcMarshaller.UpdateDevice(device.UUID, &body); err != nil {
+		log.Errorf("model detection: failed to change the model of device %s to %s: %s", device.Name, suggestion.Suggested, err)
+		return
+	}
+	log.Infof("model detection: changed the model of device %s from %s to %s", device.Name, device.Model, suggestion.Suggested)
+	device.Model = suggestion.Suggested
+	m.refreshHADiscovery()
+}
+
+// scoreModels scores every model against frames, best first. Ties go to the
+// device's model, then to the models related to it (TH, THL, THLM; Rubix,
+// RubixEncrypted), then to the model with the fewest points: a THLM whose
+// motion never fired is as likely a THL.
+func (m *Module) scoreModels(device *model.Device, frames []string) []ModelScore {
+	var keys [][]byte
+	if labeled, err := m.uplinkKeys(device); err == nil {
+		for _, k := range labeled {
+			keys = append(keys, k.key)
+		}
+	}
+	scores := make([]ModelScore, 0, len(codecs.LoRaDeviceDescriptions))
+	for i := range codecs.LoRaDeviceDescriptions {
+		scores = append(scores, scoreModel(&codecs.LoRaDeviceDescriptions[i], device, keys, frames))
+	}
+	rank := func(model string) int {
+		switch {
+		case strings.EqualFold(model, device.Model):
+			return 0
+		case relatedModels(model, device.Model):
+			return 1
+		}
+		return 2
+	}
+	sort.SliceStable(scores, func(i, j int) bool {
+		if math.Abs(scores[i].Score-scores[j].Score) > modelScoreTolerance {
+			return scores[i].Score > scores[j].Score
+		}
+		if ri, rj := rank(scores[i].Model), rank(scores[j].Model); ri != rj {
+			return ri < rj
+		}
+		return scores[i].Points < scores[j].Points
+	})
+	return scores
+}
+
+func relatedModels(a, b string) bool {
+	a, b = strings.ToLower(a), strings.ToLower(b)
+	return a != "" && b != "" && (strings.HasPrefix(a, b) || strings.HasPrefix(b, a))
+}
+
+// scoreModel decodes each frame as the model would, without side effects.
+func scoreModel(desc *codec.LoRaDeviceDescription, device *model.Device, keys [][]byte, frames []string) ModelScore {
+	score := ModelScore{Model: desc.Model}
+	candidate := *device
+	candidate.Model = desc.Model
+
+	var decoded []map[string]float64
+	total := 0.0
+	for _, dataHex := range frames {
+		values, verified, ok := decodeAs(desc, &candidate, keys, dataHex)
+		if !ok {
+			continue
+		}
+		score.Accepted++
+		total += modelScoreAccepted
+		if verified {
+			score.Verified++
+			total += modelScoreVerified
+			if !desc.AllowUnencrypted {
+				total += modelScoreStrict
+			}
+		}
+		decoded = append(decoded, values)
+	}
+
+	live := map[string]bool{}
+	for _, values := range decoded {
+		for name, value := range values {
+			live[name] = live[name] || value != 0
+		}
+	}
+	score.Points = len(live)
+	for _, values := range decoded {
+		for name, value := range values {
+			if !pointInRange(name, value) {
+				score.OutOfRange++
+				total -= modelScoreOutOfRange
+			} else if live[name] {
+				total += modelScorePoint
+			}
+		}
+	}
+	score.Score = total / float64(len(frames))
+	return score
+}
+
+// decodeAs decodes a frame with the model's codec, following dispatchFrame:
+// LoRaRAW frames are decrypted with the device keys, or taken as plaintext
+// when the model allows it. Only uplinks are decoded; ok is false for a frame
+// the model does not accept.
+func decodeAs(desc *codec.LoRaDeviceDescription, device *model.Device, keys [][]byte, dataHex string) (values map[string]float64, verified bool, ok bool) {
+	dataBytes, err := hex.DecodeString(dataHex)
+	if err != nil || desc.DecodeUplink == nil {
+		return nil, false, false
+	}
+	values = map[string]float64{}
+	pointFn := func(name string, value float64, _ *model.Device, _ *codec.LoRaDeviceDescription) error {
+		values[name] = value
+		return nil
+	}
+	pointErrFn := func(string, error, *model.Device, *codec.LoRaDeviceDescription) error { return nil }
+	metaFn := func(string, []*model.DeviceMetaTag) error { return nil }
+	defer func() {
+		// A codec fed a frame of another model must not take the module down.
+		if r := recover(); r != nil {
+			values, verified, ok = nil, false, false
+		}
+	}()
+
+	if !desc.IsLoRaRAW {
+		if desc.CheckLength == nil || !desc.CheckLength(dataHex) {
+			return nil, false, false
+		}
+		if err = desc.DecodeUplink(dataHex, dataBytes, desc, device, pointFn, pointErrFn, metaFn); err != nil {
+			return nil, false, false
+		}
+		return values, false, true
+	}
+
+	frame := dataBytes
+	for _, key := range keys {
+		if decrypted, err := tryDecryptLoRaRAWPkt(dataBytes, key); err == nil {
+			frame, verified = decrypted, true
+			break
+		}
+	}
+	if !verified && (!desc.AllowUnencrypted || isEncryptionShaped(dataBytes) || !isUnencryptedLoRaRAW(dataBytes)) {
+		return nil, false, false
+	}
+	if _, isUplink := uplinkNonce(frame); !isUplink || !utils.CheckLoRaRAWPayloadLength(frame) {
+		return nil, false, false
+	}
+	if err = desc.DecodeUplink(dataHex, utils.StripLoRaRAWPayload(frame), desc, device, pointFn, pointErrFn, metaFn); err != nil {
+		return nil, false, false
+	}
+	return values, verified, true
+}
+
+func pointInRange(name string, value float64) bool {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return false
+	}
+	r, ok := pointRanges[name]
+	return !ok || (value >= r[0] && value <= r[1])
+}
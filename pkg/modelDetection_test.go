@@ -0,0 +1,87 @@
+package pkg
+
+import (
+	"testing"
+
+	"github.com/NubeIO/module-core-loraraw/schema"
+	"github.com/NubeIO/nubeio-rubix-lib-models-go/model"
+)
+
+var testDropletFrames = []string{
+	"CBB272EAB20696263C0000DD000000041861",
+	"1AB22D4F2006C6263D0200DB000000E81A62",
+	"B3B25D0193FF5E273F0000F2CC7D192D5F25",
+}
+
+func newModelTestModule(device *model.Device, frames ...string) *Module {
+	m := &Module{config: &Config{DefaultKey: testDefaultKey, ModelLearningFrames: 3}, modelDetector: newModelDetector()}
+	for _, frame := range frames {
+		m.modelDetector.Frame(device.UUID, frame)
+	}
+	return m
+}
+
+func TestSuggestModel_Droplet(t *testing.T) {
+	device := &model.Device{CommonUUID: model.CommonUUID{UUID: "dev-th"}, CommonDevice: model.CommonDevice{Model: schema.DeviceModelTH}}
+	m := newModelTestModule(device, testDropletFrames...)
+
+	// The light sensor reads, the motion sensor never fired: a THL.
+	suggestion, err := m.suggestModel(device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if suggestion.Suggested != schema.DeviceModelTHL || suggestion.Frames != len(testDropletFrames) {
+		t.Fatalf("unexpected suggestion %+v", suggestion)
+	}
+	for _, score := range suggestion.Scores {
+		if score.Model == schema.DeviceModelMicroEdgeV1 && score.OutOfRange == 0 {
+			t.Fatalf("droplet frames must decode out of range as a MicroEdge %+v", score)
+		}
+	}
+
+	// A THLM is as likely: its model is kept.
+	device.Model = schema.DeviceModelTHLM
+	if suggestion, _ = m.suggestModel(device); suggestion.Suggested != "" {
+		t.Fatalf("unexpected suggestion %+v", suggestion)
+	}
+}
+
+func TestSuggestModel_Rubix(t *testing.T) {
+	device := &model.Device{
+		CommonUUID:   model.CommonUUID{UUID: "dev-rubix"},
+		CommonDevice: model.CommonDevice{Model: schema.DeviceModelRubix},
+	}
+	m := newModelTestModule(device, testCaptureFrame)
+
+	// Its frames verify with the device key: encryption-only is safer.
+	suggestion, _ := m.suggestModel(device)
+	if suggestion.Suggested != schema.DeviceModelRubixEncrypted || suggestion.Scores[0].Verified != 1 {
+		t.Fatalf("unexpected suggestion %+v", suggestion)
+	}
+	device.Model = schema.DeviceModelRubixEncrypted
+	if suggestion, _ = m.suggestModel(device); suggestion.Suggested != "" {
+		t.Fatalf("unexpected suggestion %+v", suggestion)
+	}
+
+	// With the wrong key, no LoRaRAW model accepts the frame.
+	m.config.DefaultKey = testOtherKey
+	if suggestion, _ = m.suggestModel(device); suggestion.Suggested != "" || suggestion.Scores[0].Accepted != 0 {
+		t.Fatalf("unexpected suggestion %+v", suggestion)
+	}
+}
+
+func TestLearnModel_Confirms(t *testing.T) {
+	device := &model.Device{CommonUUID: model.CommonUUID{UUID: "dev-thlm"}, CommonDevice: model.CommonDevice{Model: schema.DeviceModelTHLM}}
+	m := newModelTestModule(device, testDropletFrames[:2]...)
+	m.modelDetector.SetLearning(device.UUID, true)
+
+	m.learnModel(device)
+	if !m.modelDetector.Learning(device.UUID) {
+		t.Fatalf("learning must wait for %d frames", m.config.ModelLearningFrames)
+	}
+	m.modelDetector.Frame(device.UUID, testDropletFrames[2])
+	m.learnModel(device)
+	if m.modelDetector.Learning(device.UUID) || device.Model != schema.DeviceModelTHLM {
+		t.Fatalf("expected the model to be confirmed, learning=%v model=%s", m.modelDetector.Learning(device.UUID), device.Model)
+	}
+}
@@ -7,23 +7,39 @@ import (
 )
 
 type Module struct {
-	dbHelper               nmodule.DBHelper
-	moduleName             string
-	grpcMarshaller         nmodule.Marshaller
-	config                 *Config
-	networkUUID            string
-	interruptChan          chan struct{}
-	mutex                  *sync.RWMutex
-	pointWriteQueueManager *PointWriteQueueManager
-	writeQueue             chan []byte
-	writeQueueDone         chan struct{}
-	writeQueueMutex        sync.Mutex
-	mqttClient             *MQTTClient
+	dbHelper       nmodule.DBHelper
+	moduleName     string
+	grpcMarshaller nmodule.Marshaller
+	config         *Config
+	mutex          *sync.RWMutex
+	networks       map[string]*loRaNetwork // network UUID -> runner
+	networksMutex  sync.Mutex
+	mqttClient     *MQTTClient
+	dataDir        string
+	replayGuard    *replayGuard
+	linkTracker    *linkTracker
+	frameCapture   *frameCapture
+	commandWrites  *commandWrites
+	haDiscovery    *haDiscovery
+	keyRing        *keyRing
+	discovery      *discoveryInbox
+	modelDetector  *modelDetector
+
+	// networkStartMutex serialises starting and stopping network runners.
+	// It is held while an old runner is stopped; networksMutex never is.
+	networkStartMutex sync.Mutex
+
+	offlineWatchdog     *offlineWatchdog
+	offlineWatchdogDone chan struct{}
+
+	downlinkScheduler     *downlinkScheduler
+	downlinkSchedulerDone chan struct{}
 }
 
 func (m *Module) Init(dbHelper nmodule.DBHelper, moduleName string) error {
 	InitRouter()
 	m.mutex = &sync.RWMutex{}
+	m.commandWrites = newCommandWrites()
 	grpcMarshaller := nmodule.GRPCMarshaller{DbHelper: dbHelper}
 	m.dbHelper = dbHelper
 	m.moduleName = moduleName
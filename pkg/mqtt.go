@@ -3,38 +3,96 @@ package pkg
 import (
 	"encoding/json"
 	"fmt"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	mqtt "github.com/eclipse/paho.mqtt.golang"
 	log "github.com/sirupsen/logrus"
 )
 
 // MQTTTopicPrefix is the base topic name used for all publishes from this module.
 const MQTTTopicPrefix = "module-core-loraraw"
 
-// MQTTClient is a thin wrapper around paho.mqtt.golang that:
-//   - keeps a connection to the local broker open
+// MQTTClient is a thin wrapper around the paho MQTT clients that:
+//   - keeps a connection to the broker open, over TCP, TLS or websockets
 //   - retries the initial connect forever (until the broker is up)
 //   - automatically reconnects after a connection loss
 //   - silently no-ops publishes while disconnected (so the rest of the module
-//     keeps working even if the broker is down).
+//     keeps working even if the broker is down), or, with the buffer enabled,
+//     holds the raw and value publishes and sends them in order on reconnect
+//   - re-subscribes its subscriptions on every (re)connect, as the session is
+//     not kept by the broker.
 type MQTTClient struct {
-	client      mqtt.Client
-	topicPrefix string
-	statusTopic string
-	mu          sync.RWMutex
+	transport     mqttTransport
+	topicPrefix   string
+	statusTopic   string
+	qos           byte
+	retain        bool
+	pointTopic    string
+	valueSchema   int
+	onConnect     func()
+	buffer        *mqttBuffer
+	draining      int32
+	subscriptions map[string]func(topic string, payload []byte)
+	mu            sync.RWMutex
 }
 
-// normalizeBroker ensures the broker URL has the tcp:// scheme paho expects.
-// Accepts values like "127.0.0.1:1883" or "localhost:1883" and prefixes tcp://.
+// MQTTOptions configures NewMQTTClient. QoS applies to the data publishes;
+// Retain only to the per-point topics (PointTopic, empty disables them), as
+// retaining the shared value topic would only keep the last device.
+// OnConnect runs in its own goroutine after every (re)connect.
+//
+// The TLS settings apply to ssl://, tls://, mqtts:// and wss:// brokers; a
+// client certificate (CertFile and KeyFile) is presented for mutual TLS.
+// ProtocolVersion is MQTTProtocolV3 (default) or MQTTProtocolV5;
+// UserProperties are sent with every publish on MQTT 5 only. ValueSchema is
+// the schema version of the value payload, ValueSchemaV1 when 0.
+//
+// With Buffer set the raw and value publishes made while the broker is down
+// are kept (in BufferPath, empty keeps them in memory) up to BufferMaxSize
+// bytes of payload and BufferMaxAge (0 is no limit).
+type MQTTOptions struct {
+	Broker             string
+	ClientID           string
+	Username           string
+	Password           string
+	TopicPrefix        string
+	QoS                byte
+	Retain             bool
+	PointTopic         string
+	ValueSchema        int
+	OnConnect          func()
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+	InsecureSkipVerify bool
+	ProtocolVersion    int
+	UserProperties     map[string]string
+	Buffer             bool
+	BufferPath         string
+	BufferMaxSize      int64
+	BufferMaxAge       time.Duration
+}
+
+// Placeholders of MQTTOptions.PointTopic.
+const (
+	topicPlaceholderPrefix  = "<prefix>"
+	topicPlaceholderAddress = "<address>"
+	topicPlaceholderDevice  = "<device>"
+	topicPlaceholderPoint   = "<point>"
+)
+
+// normalizeBroker ensures the broker URL has a scheme. Accepts values like
+// "127.0.0.1:1883" or "localhost:1883" and prefixes tcp://; URLs with a
+// scheme (tcp, mqtt, ssl, tls, mqtts, ws, wss) are kept as they are.
 func normalizeBroker(b string) string {
 	b = strings.TrimSpace(b)
 	if b == "" {
 		return ""
 	}
-	if strings.HasPrefix(strings.ToLower(b), "tcp://") {
+	if strings.Contains(b, "://") {
 		return b
 	}
 	return "tcp://" + b
@@ -43,9 +101,11 @@ func normalizeBroker(b string) string {
 // NewMQTTClient constructs and starts a new MQTT client. Connection is attempted
 // asynchronously and will be retried indefinitely until it succeeds. The same
 // client will also automatically reconnect on any future disconnect.
-// Returns nil when broker is empty.
-func NewMQTTClient(broker, clientID, username, password, topicPrefix string) *MQTTClient {
-	broker = normalizeBroker(broker)
+// Returns nil when broker is empty or the TLS files cannot be loaded.
+func NewMQTTClient(o MQTTOptions) *MQTTClient {
+	broker := normalizeBroker(o.Broker)
+	topicPrefix := o.TopicPrefix
+	clientID := o.ClientID
 	if broker == "" {
 		log.Warn("mqtt: broker is empty, MQTT publishing disabled")
 		return nil
@@ -58,98 +118,233 @@ func NewMQTTClient(broker, clientID, username, password, topicPrefix string) *MQ
 	}
 	statusTopic := fmt.Sprintf("%s/status", topicPrefix)
 
-	c := &MQTTClient{topicPrefix: topicPrefix, statusTopic: statusTopic}
-
-	opts := mqtt.NewClientOptions().
-		AddBroker(broker).
-		SetClientID(clientID).
-		SetAutoReconnect(true).
-		SetConnectRetry(true).
-		SetConnectRetryInterval(5*time.Second).
-		SetMaxReconnectInterval(30*time.Second).
-		SetKeepAlive(30*time.Second).
-		SetPingTimeout(10*time.Second).
-		SetCleanSession(true).
-		SetOrderMatters(false).
-		// Last Will: if this module dies or the TCP link drops without a
-		// clean disconnect, the broker publishes "offline" retained.
-		SetWill(statusTopic, "offline", 0, true).
-		SetOnConnectHandler(func(cl mqtt.Client) {
-			log.Infof("mqtt: connected to broker %s", broker)
-			// Announce ourselves as online (retained) so any subscriber
-			// joining later sees the current state immediately.
-			tok := cl.Publish(statusTopic, 0, true, "online")
-			go func() {
-				tok.Wait()
-				if err := tok.Error(); err != nil {
-					log.Warnf("mqtt: failed to publish online status: %v", err)
-				}
-			}()
-		}).
-		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
-			log.Warnf("mqtt: connection lost: %v (auto-reconnect enabled)", err)
-		}).
-		SetReconnectingHandler(func(_ mqtt.Client, _ *mqtt.ClientOptions) {
-			log.Info("mqtt: reconnecting...")
-		})
+	tlsConfig, err := newTLSConfig(mqttTLSOptions{
+		CAFile:             o.CAFile,
+		CertFile:           o.CertFile,
+		KeyFile:            o.KeyFile,
+		InsecureSkipVerify: o.InsecureSkipVerify,
+	})
+	if err != nil {
+		log.Errorf("mqtt: %v, MQTT publishing disabled", err)
+		return nil
+	}
 
-	if username != "" {
-		opts.SetUsername(username)
-		opts.SetPassword(password)
+	c := &MQTTClient{
+		topicPrefix:   topicPrefix,
+		statusTopic:   statusTopic,
+		qos:           o.QoS,
+		retain:        o.Retain,
+		pointTopic:    o.PointTopic,
+		valueSchema:   o.ValueSchema,
+		onConnect:     o.OnConnect,
+		subscriptions: make(map[string]func(topic string, payload []byte)),
+	}
+	if o.Buffer {
+		c.buffer = newMQTTBuffer(o.BufferPath, o.BufferMaxSize, o.BufferMaxAge)
 	}
 
-	c.client = mqtt.NewClient(opts)
+	switch o.ProtocolVersion {
+	case 0, MQTTProtocolV3:
+		if len(o.UserProperties) > 0 {
+			log.Warn("mqtt: user properties need MQTT 5 (mqtt_protocol_version: 5), ignoring them")
+		}
+		c.transport = newMQTTv3(broker, clientID, o, tlsConfig, statusTopic, c.connected)
+	case MQTTProtocolV5:
+		c.transport, err = newMQTTv5(broker, clientID, o, tlsConfig, statusTopic, c.connected)
+		if err != nil {
+			log.Errorf("mqtt: %v, MQTT publishing disabled", err)
+			return nil
+		}
+	default:
+		log.Errorf("mqtt: unsupported protocol version %d, MQTT publishing disabled", o.ProtocolVersion)
+		return nil
+	}
+	c.transport.connect()
+	return c
+}
 
-	// Connect in background. With SetConnectRetry(true) the paho client will
-	// keep retrying until the broker becomes reachable.
+// connected runs after every (re)connect.
+func (c *MQTTClient) connected() {
+	// Announce ourselves as online (retained) so any subscriber joining later
+	// sees the current state immediately.
+	result := c.transport.publish(c.statusTopic, 0, true, []byte("online"))
 	go func() {
-		token := c.client.Connect()
-		token.Wait()
-		if err := token.Error(); err != nil {
-			log.Warnf("mqtt: initial connect attempt failed (will keep retrying): %v", err)
+		if err := <-result; err != nil {
+			log.Warnf("mqtt: failed to publish online status: %v", err)
 		}
 	}()
-
-	return c
+	c.mu.RLock()
+	for topic, handler := range c.subscriptions {
+		c.subscribe(topic, handler)
+	}
+	c.mu.RUnlock()
+	if c.onConnect != nil {
+		go c.onConnect()
+	}
+	go c.drain()
 }
 
-// publish marshals and publishes the payload at QoS 0. Any error is logged but
-// not returned because the rest of the data flow must not be affected by MQTT
-// failures.
+// publish marshals and publishes the payload at the configured QoS, not
+// retained. Any error is logged but not returned because the rest of the data
+// flow must not be affected by MQTT failures.
 func (c *MQTTClient) publish(topic string, payload interface{}) {
-	if c == nil || c.client == nil {
+	if c == nil {
 		return
 	}
-	if !c.client.IsConnectionOpen() {
+	c.publishWith(topic, c.qos, false, payload)
+}
+
+func (c *MQTTClient) publishWith(topic string, qos byte, retained bool, payload interface{}) {
+	if c == nil || c.transport == nil {
+		return
+	}
+	if !c.transport.connected() {
 		log.Debugf("mqtt: skipping publish to %s, not connected", topic)
 		return
 	}
+	data, ok := marshalPayload(topic, payload)
+	if !ok {
+		return
+	}
+	log.Infof("mqtt: publishing topic=%s bytes=%d payload=%s", topic, len(data), string(data))
+	result := c.transport.publish(topic, qos, retained, data)
+	go func() {
+		if err := <-result; err != nil {
+			log.Warnf("mqtt: publish failed topic=%s err=%v", topic, err)
+		}
+	}()
+}
+
+// publishBuffered publishes like publish, but with the buffer enabled a
+// publish made while disconnected (or while older ones are still buffered,
+// to keep the order) is buffered instead of skipped.
+func (c *MQTTClient) publishBuffered(topic string, payload interface{}) {
+	if c == nil || c.transport == nil {
+		return
+	}
+	if c.buffer == nil {
+		c.publish(topic, payload)
+		return
+	}
+	data, ok := marshalPayload(topic, payload)
+	if !ok {
+		return
+	}
+	if !c.transport.connected() || c.buffer.len() > 0 {
+		log.Debugf("mqtt: buffering publish to %s", topic)
+		c.buffer.push(topic, c.qos, data)
+		if c.transport.connected() {
+			go c.drain()
+		}
+		return
+	}
+	log.Infof("mqtt: publishing topic=%s bytes=%d payload=%s", topic, len(data), string(data))
+	result := c.transport.publish(topic, c.qos, false, data)
+	go func() {
+		if err := <-result; err != nil {
+			log.Warnf("mqtt: publish failed topic=%s err=%v, buffering it", topic, err)
+			c.buffer.push(topic, c.qos, data)
+		}
+	}()
+}
+
+// drain sends the buffered messages in order while connected. Only one drain
+// runs at a time; a message is taken off the buffer once the broker accepted
+// it, so a crash mid-drain may send it twice.
+func (c *MQTTClient) drain() {
+	if c.buffer == nil {
+		return
+	}
+	for atomic.CompareAndSwapInt32(&c.draining, 0, 1) {
+		sent := 0
+		for c.transport.connected() {
+			msg, ok := c.buffer.peek()
+			if !ok {
+				break
+			}
+			if err := <-c.transport.publish(msg.Topic, msg.QoS, false, []byte(msg.Payload)); err != nil {
+				log.Warnf("mqtt: sending buffered message to %s failed: %v", msg.Topic, err)
+				break
+			}
+			c.buffer.remove(msg)
+			sent++
+		}
+		if sent > 0 {
+			log.Infof("mqtt: sent %d buffered messages", sent)
+		}
+		atomic.StoreInt32(&c.draining, 0)
+		// A publish may have been buffered after the last peek.
+		if c.buffer.len() == 0 || !c.transport.connected() {
+			return
+		}
+	}
+}
+
+// BufferStats returns the state of the store-and-forward buffer.
+func (c *MQTTClient) BufferStats() MQTTBufferStats {
+	if c == nil || c.buffer == nil {
+		return MQTTBufferStats{}
+	}
+	return c.buffer.stats()
+}
 
-	var data []byte
-	var err error
+// marshalPayload returns a string or []byte payload as is and marshals
+// anything else to JSON.
+func marshalPayload(topic string, payload interface{}) ([]byte, bool) {
 	switch p := payload.(type) {
 	case string:
-		data = []byte(p)
+		return []byte(p), true
 	case []byte:
-		data = p
+		return p, true
 	default:
-		data, err = json.Marshal(payload)
+		data, err := json.Marshal(payload)
 		if err != nil {
 			log.Errorf("mqtt: failed to marshal payload for %s: %v", topic, err)
-			return
+			return nil, false
 		}
+		return data, true
 	}
+}
 
-	log.Infof("mqtt: publishing topic=%s bytes=%d payload=%s", topic, len(data), string(data))
-	token := c.client.Publish(topic, 0, false, data)
+// Subscribe registers handler for topic (wildcards allowed). The subscription
+// is made now if connected, and again on every reconnect. Messages are
+// delivered at QoS 1.
+func (c *MQTTClient) Subscribe(topic string, handler func(topic string, payload []byte)) {
+	if c == nil || c.transport == nil {
+		return
+	}
+	c.mu.Lock()
+	c.subscriptions[topic] = handler
+	c.mu.Unlock()
+	if c.transport.connected() {
+		c.subscribe(topic, handler)
+	}
+}
+
+func (c *MQTTClient) subscribe(topic string, handler func(topic string, payload []byte)) {
+	result := c.transport.subscribe(topic, handler)
 	go func() {
-		token.Wait()
-		if err := token.Error(); err != nil {
-			log.Warnf("mqtt: publish failed topic=%s err=%v", topic, err)
+		if err := <-result; err != nil {
+			log.Warnf("mqtt: subscribe to %s failed: %v", topic, err)
+			return
 		}
+		log.Infof("mqtt: subscribed to %s", topic)
 	}()
 }
 
+// Topic joins parts under the topic prefix.
+func (c *MQTTClient) Topic(parts ...string) string {
+	if c == nil {
+		return ""
+	}
+	return strings.Join(append([]string{c.topicPrefix}, parts...), "/")
+}
+
+// Publish publishes payload (string, []byte or JSON-marshalled) to topic.
+func (c *MQTTClient) Publish(topic string, payload interface{}) {
+	c.publish(topic, payload)
+}
+
 // PublishRaw publishes the raw uplink hex string to <prefix>/raw.
 func (c *MQTTClient) PublishRaw(raw string) {
 	if c == nil {
@@ -157,39 +352,71 @@ func (c *MQTTClient) PublishRaw(raw string) {
 	}
 	topic := fmt.Sprintf("%s/raw", c.topicPrefix)
 	log.Infof("mqtt: publishing raw uplink topic=%s len=%d", topic, len(raw))
-	c.publish(topic, raw)
+	c.publishBuffered(topic, raw)
 }
 
-// PublishValues publishes the decoded values for a device to
-// <prefix>/value as a JSON object of the form:
+// PublishValues publishes a decoded uplink to <prefix>/value. With schema
+// version 2 the payload is msg; version 1 is the original envelope of the
+// point values, RSSI and SNR:
 //
 //	{"device_address_uuid": "...", "device_name": "...", "payload": {...}}
-func (c *MQTTClient) PublishValues(addressUUID, deviceName string, values map[string]float64) {
-	if c == nil || len(values) == 0 {
+func (c *MQTTClient) PublishValues(msg *ValueMessage) {
+	if c == nil || msg == nil {
 		return
 	}
 	topic := fmt.Sprintf("%s/value", c.topicPrefix)
-	envelope := map[string]interface{}{
-		"device_address_uuid": addressUUID,
-		"device_name":         deviceName,
-		"payload":             values,
-	}
+	values := msg.values()
 	log.Infof("mqtt: publishing decoded values topic=%s address=%s device=%s points=%d",
-		topic, addressUUID, deviceName, len(values))
-	c.publish(topic, envelope)
+		topic, msg.AddressUUID, msg.DeviceName, len(msg.Points))
+	if c.valueSchema == ValueSchemaV2 {
+		c.publishBuffered(topic, msg)
+	} else {
+		c.publishBuffered(topic, map[string]interface{}{
+			"device_address_uuid": msg.AddressUUID,
+			"device_name":         msg.DeviceName,
+			"payload":             values,
+		})
+	}
+
+	if c.pointTopic == "" {
+		return
+	}
+	for name, value := range values {
+		c.publishWith(c.pointValueTopic(msg.AddressUUID, msg.DeviceName, name), c.qos, c.retain, strconv.FormatFloat(value, 'f', -1, 64))
+	}
+}
+
+// pointValueTopic fills in the point topic template. Topic separators and
+// wildcards in the substituted names are replaced with "_".
+func (c *MQTTClient) pointValueTopic(addressUUID, deviceName, point string) string {
+	return strings.NewReplacer(
+		topicPlaceholderPrefix, c.topicPrefix,
+		topicPlaceholderAddress, topicLevel(addressUUID),
+		topicPlaceholderDevice, topicLevel(deviceName),
+		topicPlaceholderPoint, topicLevel(point),
+	).Replace(c.pointTopic)
+}
+
+var topicLevelReplacer = strings.NewReplacer("/", "_", "+", "_", "#", "_")
+
+func topicLevel(s string) string {
+	return topicLevelReplacer.Replace(s)
 }
 
 // Disconnect cleanly shuts down the MQTT client, publishing an "offline"
 // status (retained) before tearing down the connection.
 func (c *MQTTClient) Disconnect() {
-	if c == nil || c.client == nil {
+	if c == nil || c.transport == nil {
 		return
 	}
-	if c.client.IsConnectionOpen() {
-		tok := c.client.Publish(c.statusTopic, 0, true, "offline")
-		tok.WaitTimeout(500 * time.Millisecond)
+	if c.transport.connected() {
+		select {
+		case <-c.transport.publish(c.statusTopic, 0, true, []byte("offline")):
+		case <-time.After(500 * time.Millisecond):
+		}
 	}
-	if c.client.IsConnected() {
-		c.client.Disconnect(250)
+	c.transport.disconnect()
+	if c.buffer != nil {
+		c.buffer.close()
 	}
 }
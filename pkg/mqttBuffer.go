@@ -0,0 +1,299 @@
+package pkg
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	mqttBufferFile = "mqtt-buffer.jsonl"
+
+	// mqttBufferCompactAfter is how many sent or dropped messages may remain
+	// at the head of the buffer file before it is rewritten.
+	mqttBufferCompactAfter = 1000
+)
+
+// bufferedMessage is a publish held while the broker was unreachable, one
+// line of the buffer file. A line with only Removed set records that the
+// oldest message was sent or dropped.
+type bufferedMessage struct {
+	Time    time.Time `json:"time"`
+	Topic   string    `json:"topic"`
+	QoS     byte      `json:"qos"`
+	Payload string    `json:"payload"`
+	Removed bool      `json:"removed,omitempty"`
+
+	seq uint64
+}
+
+var mqttBufferRemovedLine = []byte(`{"removed":true}` + "\n")
+
+// MQTTBufferStats is the state of the store-and-forward buffer. Dropped
+// counts the messages discarded since Enable because the buffer was full or
+// they got older than the max age.
+type MQTTBufferStats struct {
+	Enabled  bool       `json:"enabled"`
+	Messages int        `json:"messages"`
+	Bytes    int64      `json:"bytes"`
+	Dropped  uint64     `json:"dropped"`
+	Oldest   *time.Time `json:"oldest,omitempty"`
+}
+
+// mqttBuffer is a bounded FIFO of publishes, kept in memory and appended to
+// a JSONL file so it survives a restart. Once the payloads exceed maxSize
+// bytes the oldest messages are dropped; messages older than maxAge (0 is no
+// limit) are dropped too. The file is append-only: a sent or dropped message
+// is followed by a removed line, until the file is compacted.
+type mqttBuffer struct {
+	path    string
+	maxSize int64
+	maxAge  time.Duration
+
+	messages []bufferedMessage
+	size     int64
+	dropped  uint64
+	seq      uint64
+	stale    int
+	file     *os.File
+	mutex    sync.Mutex
+}
+
+// newMQTTBuffer loads the messages left in path by the last run. An empty
+// path keeps the buffer in memory only.
+func newMQTTBuffer(path string, maxSize int64, maxAge time.Duration) *mqttBuffer {
+	b := &mqttBuffer{path: path, maxSize: maxSize, maxAge: maxAge}
+	if path == "" {
+		return b
+	}
+	if err := b.load(); err != nil {
+		log.Errorf("mqtt: buffer %s: %v", path, err)
+	}
+	if err := b.compact(); err != nil {
+		log.Errorf("mqtt: buffer %s: %v, buffering in memory only", path, err)
+		b.path = ""
+	}
+	if len(b.messages) > 0 {
+		log.Infof("mqtt: %d buffered messages to send", len(b.messages))
+	}
+	return b
+}
+
+func (b *mqttBuffer) load() error {
+	file, err := os.Open(b.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var msg bufferedMessage
+		if err = json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			continue // a line cut short by a crash
+		}
+		if !msg.Removed {
+			b.append(msg)
+		} else if len(b.messages) > 0 {
+			b.removeHead()
+		}
+	}
+	b.trim()
+	b.expire()
+	// Count only what is dropped from now on.
+	b.dropped = 0
+	return scanner.Err()
+}
+
+// push adds a message at the tail, dropping the oldest ones over the caps.
+func (b *mqttBuffer) push(topic string, qos byte, payload []byte) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	msg := bufferedMessage{Time: time.Now().UTC(), Topic: topic, QoS: qos, Payload: string(payload)}
+	b.expire()
+	if line, err := json.Marshal(msg); err == nil {
+		b.write(append(line, '\n'))
+	}
+	b.append(msg)
+	b.trim()
+	b.compactIfStale()
+}
+
+func (b *mqttBuffer) write(line []byte) {
+	if b.file == nil {
+		return
+	}
+	if _, err := b.file.Write(line); err != nil {
+		log.Errorf("mqtt: buffer %s: %v", b.path, err)
+	}
+}
+
+func (b *mqttBuffer) append(msg bufferedMessage) {
+	b.seq++
+	msg.seq = b.seq
+	b.messages = append(b.messages, msg)
+	b.size += int64(len(msg.Payload))
+}
+
+// trim drops the oldest messages over maxSize.
+func (b *mqttBuffer) trim() {
+	for b.size > b.maxSize && len(b.messages) > 0 {
+		b.dropHead()
+	}
+}
+
+// expire drops the messages at the head older than maxAge.
+func (b *mqttBuffer) expire() {
+	if b.maxAge <= 0 {
+		return
+	}
+	cutoff := time.Now().Add(-b.maxAge)
+	for len(b.messages) > 0 && b.messages[0].Time.Before(cutoff) {
+		b.dropHead()
+	}
+}
+
+func (b *mqttBuffer) dropHead() {
+	msg := b.removeHead()
+	b.dropped++
+	log.Debugf("mqtt: buffer full or message expired, dropped %s from %s", msg.Topic, msg.Time.Format(time.RFC3339))
+}
+
+func (b *mqttBuffer) removeHead() bufferedMessage {
+	msg := b.messages[0]
+	b.messages[0] = bufferedMessage{}
+	b.messages = b.messages[1:]
+	b.size -= int64(len(msg.Payload))
+	b.stale++
+	b.write(mqttBufferRemovedLine)
+	return msg
+}
+
+// peek returns the oldest message, to be sent next.
+func (b *mqttBuffer) peek() (bufferedMessage, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.expire()
+	if len(b.messages) == 0 {
+		return bufferedMessage{}, false
+	}
+	return b.messages[0], true
+}
+
+// remove takes msg off the head once it was sent, unless it was dropped in
+// the meantime.
+func (b *mqttBuffer) remove(msg bufferedMessage) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if len(b.messages) == 0 || b.messages[0].seq != msg.seq {
+		return
+	}
+	b.removeHead()
+	if len(b.messages) == 0 {
+		b.messages = nil
+	}
+	b.compactIfStale()
+}
+
+func (b *mqttBuffer) len() int {
+	if b == nil {
+		return 0
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return len(b.messages)
+}
+
+func (b *mqttBuffer) stats() MQTTBufferStats {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	stats := MQTTBufferStats{Enabled: true, Messages: len(b.messages), Bytes: b.size, Dropped: b.dropped}
+	if len(b.messages) > 0 {
+		oldest := b.messages[0].Time
+		stats.Oldest = &oldest
+	}
+	return stats
+}
+
+// compactIfStale rewrites the file once it is empty or mostly holds messages
+// that were already sent or dropped.
+func (b *mqttBuffer) compactIfStale() {
+	if b.file == nil || b.stale == 0 {
+		return
+	}
+	if len(b.messages) > 0 && (b.stale < mqttBufferCompactAfter || b.stale < len(b.messages)) {
+		return
+	}
+	if err := b.compact(); err != nil {
+		log.Errorf("mqtt: buffer %s: %v", b.path, err)
+	}
+}
+
+// compact rewrites the file with the buffered messages only, via a temp file
+// and rename, and reopens it for appending.
+func (b *mqttBuffer) compact() error {
+	if b.path == "" {
+		return nil
+	}
+	if b.file != nil {
+		_ = b.file.Close()
+		b.file = nil
+	}
+	if err := os.MkdirAll(filepath.Dir(b.path), 0755); err != nil {
+		return err
+	}
+	tmp := b.path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	for _, msg := range b.messages {
+		line, err := json.Marshal(msg)
+		if err != nil {
+			continue
+		}
+		_, _ = writer.Write(append(line, '\n'))
+	}
+	if err = writer.Flush(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, b.path); err != nil {
+		return err
+	}
+	b.file, err = os.OpenFile(b.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	b.stale = 0
+	return nil
+}
+
+func (b *mqttBuffer) close() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.file != nil {
+		_ = b.file.Close()
+		b.file = nil
+	}
+}
@@ -0,0 +1,107 @@
+package pkg
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeTransport records publishes and is connected when up is set.
+type fakeTransport struct {
+	up        bool
+	published []string
+	mutex     sync.Mutex
+}
+
+func (f *fakeTransport) connect() {}
+
+func (f *fakeTransport) connected() bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.up
+}
+
+func (f *fakeTransport) publish(topic string, _ byte, _ bool, data []byte) <-chan error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.published = append(f.published, topic+" "+string(data))
+	result := make(chan error, 1)
+	result <- nil
+	return result
+}
+
+func (f *fakeTransport) subscribe(string, func(string, []byte)) <-chan error {
+	result := make(chan error, 1)
+	result <- nil
+	return result
+}
+
+func (f *fakeTransport) disconnect() {}
+
+func TestMQTTBuffer_CapsAndReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), mqttBufferFile)
+	b := newMQTTBuffer(path, 10, 0)
+	for _, payload := range []string{"aaaa", "bbbb", "cccc", "dddd"} {
+		b.push("t", 0, []byte(payload))
+	}
+	stats := b.stats()
+	if stats.Messages != 2 || stats.Bytes != 8 || stats.Dropped != 2 || stats.Oldest == nil {
+		t.Fatalf("expected the 2 newest kept and 2 dropped: %+v", stats)
+	}
+	msg, _ := b.peek()
+	b.remove(msg)
+	b.close()
+
+	b = newMQTTBuffer(path, 10, 0)
+	if msg, ok := b.peek(); !ok || msg.Payload != "dddd" || b.len() != 1 || b.stats().Dropped != 0 {
+		t.Fatalf("expected dddd left after reload, got %+v (%d messages)", msg, b.len())
+	}
+	b.close()
+
+	b = newMQTTBuffer(path, 10, time.Nanosecond)
+	if b.len() != 0 {
+		t.Fatalf("expected expired messages dropped on load")
+	}
+}
+
+func TestMQTTClient_BuffersWhileDisconnected(t *testing.T) {
+	transport := &fakeTransport{}
+	c := &MQTTClient{
+		transport:     transport,
+		topicPrefix:   MQTTTopicPrefix,
+		statusTopic:   MQTTTopicPrefix + "/status",
+		buffer:        newMQTTBuffer("", 1024, 0),
+		subscriptions: map[string]func(string, []byte){},
+	}
+	c.PublishRaw("AA")
+	c.PublishRaw("BB")
+	if len(transport.published) != 0 || c.BufferStats().Messages != 2 {
+		t.Fatalf("expected both publishes buffered: %v", transport.published)
+	}
+
+	transport.up = true
+	c.connected()
+	deadline := time.Now().Add(time.Second)
+	for c.buffer.len() > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	c.PublishRaw("CC")
+
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+	want := []string{
+		"module-core-loraraw/status online",
+		"module-core-loraraw/raw AA",
+		"module-core-loraraw/raw BB",
+		"module-core-loraraw/raw CC",
+	}
+	if len(transport.published) != len(want) {
+		t.Fatalf("published %v, want %v", transport.published, want)
+	}
+	for i := range want {
+		if transport.published[i] != want[i] {
+			t.Fatalf("published %v, want %v", transport.published, want)
+		}
+	}
+}
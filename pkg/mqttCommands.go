@@ -0,0 +1,269 @@
+package pkg
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NubeIO/lib-utils-go/nstring"
+	"github.com/NubeIO/module-core-loraraw/codecs/rubixDataEncoding"
+	"github.com/NubeIO/nubeio-rubix-lib-models-go/dto"
+	"github.com/NubeIO/nubeio-rubix-lib-models-go/model"
+	log "github.com/sirupsen/logrus"
+)
+
+// Point writes over MQTT:
+//
+//	<prefix>/cmd/write/<address_uuid>/<io_number>   ← 21.5 or {"value": 21.5, "priority": 16, "correlation_id": "..."}
+//	<prefix>/cmd/result/<address_uuid>/<io_number>  → WriteResult
+const (
+	writeCommandTopic = "cmd/write"
+	writeResultTopic  = "cmd/result"
+
+	defaultWritePriority = 16
+
+	writeStatusQueued     = "queued"
+	writeStatusAcked      = "acked"
+	writeStatusError      = "error"
+	writeStatusExhausted  = "exhausted"
+	writeStatusDropped    = "dropped"
+	writeStatusRejected   = "rejected"
+	writeStatusSuperseded = "superseded"
+	writeStatusCancelled  = "cancelled"
+)
+
+// WriteCommand is the JSON form of a write command payload. A bare number
+// or boolean is accepted too.
+type WriteCommand struct {
+	Value         *float64 `json:"value"`
+	Priority      int      `json:"priority"`
+	CorrelationID string   `json:"correlation_id"`
+}
+
+// WriteResult is published on the result topic when a write command is
+// queued and again once it completes. ErrorCode is the MDK_ERROR the device
+// returned, for status error.
+type WriteResult struct {
+	CorrelationID string    `json:"correlation_id"`
+	AddressUUID   string    `json:"device_address_uuid"`
+	IoNumber      string    `json:"io_number"`
+	PointUUID     string    `json:"point_uuid,omitempty"`
+	Value         *float64  `json:"value,omitempty"`
+	Priority      int       `json:"priority,omitempty"`
+	Status        string    `json:"status"`
+	Error         string    `json:"error,omitempty"`
+	ErrorCode     *uint8    `json:"error_code,omitempty"`
+	Timestamp     time.Time `json:"timestamp"`
+}
+
+// commandWriteKey is a write queued from MQTT: the point and the
+// correlation ID the write queue carries (and saves) with the write.
+type commandWriteKey struct {
+	pointUUID     string
+	correlationID string
+}
+
+// commandWrites keeps the queued result of the writes queued from MQTT, so
+// the write's outcome is published with the command's value and priority.
+type commandWrites struct {
+	pending map[commandWriteKey]WriteResult
+	mutex   sync.Mutex
+}
+
+func newCommandWrites() *commandWrites {
+	return &commandWrites{pending: make(map[commandWriteKey]WriteResult)}
+}
+
+func (c *commandWrites) add(result WriteResult) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.pending[commandWriteKey{result.PointUUID, result.CorrelationID}] = result
+}
+
+func (c *commandWrites) take(pointUUID, correlationID string) (WriteResult, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	key := commandWriteKey{pointUUID, correlationID}
+	result, ok := c.pending[key]
+	delete(c.pending, key)
+	return result, ok
+}
+
+// parseWriteCommand reads the address and io number from the topic and the
+// value from the payload.
+func parseWriteCommand(prefix, topic string, payload []byte) (addressUUID, ioNumber string, cmd WriteCommand, err error) {
+	rest := strings.TrimPrefix(topic, prefix+"/"+writeCommandTopic+"/")
+	parts := strings.Split(rest, "/")
+	if rest == topic || len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", cmd, fmt.Errorf("invalid write topic %s", topic)
+	}
+	addressUUID, ioNumber = parts[0], parts[1]
+
+	var body interface{}
+	if err = json.Unmarshal(payload, &body); err != nil {
+		return addressUUID, ioNumber, cmd, fmt.Errorf("invalid payload: %w", err)
+	}
+	switch v := body.(type) {
+	case float64:
+		cmd.Value = &v
+	case bool:
+		value := 0.0
+		if v {
+			value = 1
+		}
+		cmd.Value = &value
+	case map[string]interface{}:
+		if err = json.Unmarshal(payload, &cmd); err != nil {
+			return addressUUID, ioNumber, cmd, fmt.Errorf("invalid payload: %w", err)
+		}
+	default:
+		return addressUUID, ioNumber, cmd, errors.New("payload must be a number, a boolean or an object")
+	}
+	if cmd.Value == nil {
+		return addressUUID, ioNumber, cmd, errors.New("missing value")
+	}
+	if cmd.Priority == 0 {
+		cmd.Priority = defaultWritePriority
+	}
+	if cmd.Priority < 1 || cmd.Priority > 16 {
+		return addressUUID, ioNumber, cmd, fmt.Errorf("invalid priority %d, must be 1-16", cmd.Priority)
+	}
+	return addressUUID, ioNumber, cmd, nil
+}
+
+func newCorrelationID() string {
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// handleWriteCommand writes the point the way PATCH /api/points/:uuid/write
+// does and queues it for the device.
+func (m *Module) handleWriteCommand(topic string, payload []byte) {
+	addressUUID, ioNumber, cmd, err := parseWriteCommand(m.mqttClient.Topic(), topic, payload)
+	result := WriteResult{
+		CorrelationID: cmd.CorrelationID,
+		AddressUUID:   addressUUID,
+		IoNumber:      ioNumber,
+		Value:         cmd.Value,
+		Priority:      cmd.Priority,
+	}
+	if result.CorrelationID == "" {
+		result.CorrelationID = newCorrelationID()
+	}
+	if err == nil {
+		err = m.queueWriteCommand(addressUUID, ioNumber, cmd, &result)
+	}
+	if err != nil {
+		log.Warnf("mqtt: write command %s: %s", topic, err)
+		result.Status = writeStatusRejected
+		result.Error = err.Error()
+	}
+	if addressUUID == "" {
+		return // nowhere to publish the result
+	}
+	m.publishWriteResult(result)
+}
+
+func (m *Module) queueWriteCommand(addressUUID, ioNumber string, cmd WriteCommand, result *WriteResult) error {
+	device := m.getDeviceByLoRaAddress(addressUUID)
+	if device == nil {
+		return fmt.Errorf("no device with address %s", addressUUID)
+	}
+	if m.getNetwork(device.NetworkUUID) == nil {
+		return fmt.Errorf("network %s of device %s is not running", device.NetworkUUID, device.Name)
+	}
+	point := selectPointByIoNumber(ioNumber, device)
+	if point == nil {
+		return fmt.Errorf("device %s has no point %s", device.Name, ioNumber)
+	}
+	result.PointUUID = point.UUID
+
+	priority := map[string]*float64{"_" + strconv.Itoa(cmd.Priority): cmd.Value}
+	written, err := m.writePoint(point.UUID, &dto.PointWriter{Priority: &priority})
+	if err != nil {
+		return err
+	}
+	result.Status = writeStatusQueued
+	m.commandWrites.add(*result)
+	if err = m.enqueuePointOnNetwork(device.NetworkUUID, written, result.CorrelationID); err != nil {
+		m.commandWrites.take(point.UUID, result.CorrelationID)
+		return err
+	}
+	return nil
+}
+
+// finishWriteCommand publishes the outcome of a write, if it came from MQTT
+// (it has a correlation ID). A write restored after a restart has no queued
+// result any more; its result is made from the point.
+func (m *Module) finishWriteCommand(point *model.Point, correlationID string, status string, err error) {
+	if correlationID == "" {
+		return
+	}
+	var result WriteResult
+	ok := false
+	if m.commandWrites != nil {
+		result, ok = m.commandWrites.take(point.UUID, correlationID)
+	}
+	if !ok {
+		result = WriteResult{
+			CorrelationID: correlationID,
+			AddressUUID:   nstring.DerefString(point.AddressUUID),
+			IoNumber:      point.IoNumber,
+			PointUUID:     point.UUID,
+			Value:         point.WriteValue,
+		}
+	}
+	result.complete(status, err)
+	m.publishWriteResult(result)
+}
+
+func (r *WriteResult) complete(status string, err error) {
+	r.Status = status
+	if err == nil {
+		return
+	}
+	r.Error = err.Error()
+	var deviceErr *rubixDataEncoding.DeviceError
+	if errors.As(err, &deviceErr) {
+		code := deviceErr.Code
+		r.ErrorCode = &code
+	}
+}
+
+func (m *Module) publishWriteResult(result WriteResult) {
+	if m.mqttClient == nil {
+		return
+	}
+	result.Timestamp = time.Now().UTC()
+	m.mqttClient.Publish(m.mqttClient.Topic(writeResultTopic, result.AddressUUID, result.IoNumber), result)
+}
+
+// onWriteDropped is called by the write scheduler when a write cannot be
+// encoded at all (device gone, bad key, unsupported point), is superseded by
+// a newer write to its point, or is cancelled.
+func (m *Module) onWriteDropped(point *model.Point, correlationID string, err error) {
+	switch {
+	case errors.Is(err, errWriteSuperseded):
+		m.finishWriteCommand(point, correlationID, writeStatusSuperseded, nil)
+	case errors.Is(err, errWriteCancelled):
+		if point.UUID != "" && m.grpcMarshaller != nil {
+			_, _ = m.updateWrittenPointCancelled(point)
+		}
+		m.finishWriteCommand(point, correlationID, writeStatusCancelled, nil)
+	default:
+		// Failed for good: marked failed, so it is not queued again on Enable.
+		if point.UUID != "" && m.grpcMarshaller != nil {
+			_, _ = m.updateWrittenPointError(point, err)
+		}
+		m.finishWriteCommand(point, correlationID, writeStatusDropped, err)
+	}
+}
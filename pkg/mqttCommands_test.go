@@ -0,0 +1,97 @@
+package pkg
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/NubeIO/module-core-loraraw/codecs/rubixDataEncoding"
+	"github.com/NubeIO/nubeio-rubix-lib-models-go/model"
+)
+
+func TestParseWriteCommand(t *testing.T) {
+	prefix := MQTTTopicPrefix
+	topic := prefix + "/cmd/write/65C0640D/UO-1"
+
+	address, ioNumber, cmd, err := parseWriteCommand(prefix, topic, []byte("21.5"))
+	if err != nil || address != "65C0640D" || ioNumber != "UO-1" || *cmd.Value != 21.5 || cmd.Priority != defaultWritePriority {
+		t.Fatalf("bare number: %s %s %+v %v", address, ioNumber, cmd, err)
+	}
+	_, _, cmd, err = parseWriteCommand(prefix, topic, []byte("true"))
+	if err != nil || *cmd.Value != 1 {
+		t.Fatalf("boolean: %+v %v", cmd, err)
+	}
+	_, _, cmd, err = parseWriteCommand(prefix, topic, []byte(`{"value": 0, "priority": 8, "correlation_id": "abc"}`))
+	if err != nil || *cmd.Value != 0 || cmd.Priority != 8 || cmd.CorrelationID != "abc" {
+		t.Fatalf("object: %+v %v", cmd, err)
+	}
+
+	for _, bad := range []struct{ topic, payload string }{
+		{prefix + "/cmd/write/65C0640D", "1"},
+		{prefix + "/cmd/write/65C0640D/UO-1/x", "1"},
+		{"other/cmd/write/65C0640D/UO-1", "1"},
+		{topic, `"on"`},
+		{topic, `{"priority": 16}`},
+		{topic, `{"value": 1, "priority": 17}`},
+		{topic, "nope"},
+	} {
+		if _, _, _, err := parseWriteCommand(prefix, bad.topic, []byte(bad.payload)); err == nil {
+			t.Errorf("expected %s %s to be rejected", bad.topic, bad.payload)
+		}
+	}
+}
+
+func TestWriteResult_ErrorCode(t *testing.T) {
+	writes := newCommandWrites()
+	writes.add(WriteResult{CorrelationID: "abc", PointUUID: "pnt", Status: writeStatusQueued})
+
+	// A re-fetched or restored point is a new value: the write is found by
+	// point UUID and correlation ID.
+	if _, ok := writes.take("pnt", "other"); ok {
+		t.Fatalf("another write to the point must not match")
+	}
+	result, ok := writes.take("pnt", "abc")
+	if !ok || result.CorrelationID != "abc" {
+		t.Fatalf("tracked write not found")
+	}
+	if _, ok := writes.take("pnt", "abc"); ok {
+		t.Fatalf("a write must only complete once")
+	}
+
+	deviceErr := fmt.Errorf("write: %w", &rubixDataEncoding.DeviceError{Code: rubixDataEncoding.ErrorCodeNotAllowed})
+	result.complete(writeStatusError, deviceErr)
+	if result.Status != writeStatusError || result.ErrorCode == nil || *result.ErrorCode != rubixDataEncoding.ErrorCodeNotAllowed {
+		t.Fatalf("error code not reported: %+v", result)
+	}
+	if result.Error != "write: non-writable point" {
+		t.Fatalf("error %q", result.Error)
+	}
+
+	exhausted := WriteResult{}
+	exhausted.complete(writeStatusExhausted, fmt.Errorf("no response"))
+	if exhausted.ErrorCode != nil || exhausted.Error != "no response" {
+		t.Fatalf("exhausted: %+v", exhausted)
+	}
+}
+
+func TestWriteCommand_ResultAfterRestart(t *testing.T) {
+	transport := &fakeTransport{up: true}
+	m := &Module{
+		mqttClient:    &MQTTClient{transport: transport, topicPrefix: MQTTTopicPrefix},
+		commandWrites: newCommandWrites(),
+	}
+	addr, value := "65C0640D", 21.5
+	point := &model.Point{CommonUUID: model.CommonUUID{UUID: "pnt"}, IoNumber: "UO-1", AddressUUID: &addr, WriteValue: &value}
+
+	// The queued result was lost with the restart; the journal kept the ID.
+	m.finishWriteCommand(point, "", writeStatusAcked, nil) // a write not from MQTT publishes nothing
+	m.finishWriteCommand(point, "abc", writeStatusAcked, nil)
+	if len(transport.published) != 1 {
+		t.Fatalf("expected one result, got %v", transport.published)
+	}
+	want := MQTTTopicPrefix + "/cmd/result/65C0640D/UO-1 "
+	if got := transport.published[0]; !strings.HasPrefix(got, want) ||
+		!strings.Contains(got, `"correlation_id":"abc"`) || !strings.Contains(got, `"status":"acked"`) || !strings.Contains(got, `"value":21.5`) {
+		t.Fatalf("result %s", got)
+	}
+}
@@ -0,0 +1,287 @@
+package pkg
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+)
+
+// MQTT protocol versions of MQTTOptions.ProtocolVersion.
+const (
+	MQTTProtocolV3 = 3
+	MQTTProtocolV5 = 5
+)
+
+const mqttPublishTimeout = 10 * time.Second
+
+// mqttTransport is the connection under MQTTClient: paho.mqtt.golang for MQTT
+// 3.1.1, paho.golang for MQTT 5. Both reconnect on their own and call
+// onConnect after every (re)connect. publish and subscribe return at once;
+// the result is sent on the returned channel once the broker answered.
+type mqttTransport interface {
+	connect()
+	connected() bool
+	publish(topic string, qos byte, retained bool, data []byte) <-chan error
+	subscribe(topic string, handler func(topic string, payload []byte)) <-chan error
+	disconnect()
+}
+
+// mqttTLSOptions are the TLS settings of MQTTOptions. They apply to ssl://,
+// tls://, mqtts:// and wss:// brokers.
+type mqttTLSOptions struct {
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+	InsecureSkipVerify bool
+}
+
+// newTLSConfig builds the TLS config of the broker connection: the CA file
+// is added to the system roots, and the client certificate is presented for
+// mutual TLS. Returns nil when nothing is configured, so the defaults apply.
+func newTLSConfig(o mqttTLSOptions) (*tls.Config, error) {
+	if o.CAFile == "" && o.CertFile == "" && o.KeyFile == "" && !o.InsecureSkipVerify {
+		return nil, nil
+	}
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: o.InsecureSkipVerify, //nolint:gosec // opt-in, for lab brokers
+	}
+	if o.CAFile != "" {
+		pem, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("mqtt ca file: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("mqtt ca file %s: no PEM certificates found", o.CAFile)
+		}
+		config.RootCAs = pool
+	}
+	if o.CertFile != "" || o.KeyFile != "" {
+		if o.CertFile == "" || o.KeyFile == "" {
+			return nil, errors.New("mqtt client certificate needs both a cert file and a key file")
+		}
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("mqtt client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// mqttV3 is the MQTT 3.1.1 transport.
+type mqttV3 struct {
+	client mqtt.Client
+}
+
+func newMQTTv3(broker, clientID string, o MQTTOptions, tlsConfig *tls.Config, statusTopic string, onConnect func()) *mqttV3 {
+	opts := mqtt.NewClientOptions().
+		AddBroker(broker).
+		SetClientID(clientID).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(5*time.Second).
+		SetMaxReconnectInterval(30*time.Second).
+		SetKeepAlive(30*time.Second).
+		SetPingTimeout(10*time.Second).
+		SetCleanSession(true).
+		SetOrderMatters(false).
+		// Last Will: if this module dies or the TCP link drops without a
+		// clean disconnect, the broker publishes "offline" retained.
+		SetWill(statusTopic, "offline", 0, true).
+		SetOnConnectHandler(func(mqtt.Client) {
+			log.Infof("mqtt: connected to broker %s", broker)
+			onConnect()
+		}).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			log.Warnf("mqtt: connection lost: %v (auto-reconnect enabled)", err)
+		}).
+		SetReconnectingHandler(func(_ mqtt.Client, _ *mqtt.ClientOptions) {
+			log.Info("mqtt: reconnecting...")
+		})
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
+	if o.Username != "" {
+		opts.SetUsername(o.Username)
+		opts.SetPassword(o.Password)
+	}
+	return &mqttV3{client: mqtt.NewClient(opts)}
+}
+
+// connect connects in background. With SetConnectRetry(true) the paho client
+// will keep retrying until the broker becomes reachable.
+func (t *mqttV3) connect() {
+	go func() {
+		token := t.client.Connect()
+		token.Wait()
+		if err := token.Error(); err != nil {
+			log.Warnf("mqtt: initial connect attempt failed (will keep retrying): %v", err)
+		}
+	}()
+}
+
+func (t *mqttV3) connected() bool {
+	return t.client.IsConnectionOpen()
+}
+
+func (t *mqttV3) publish(topic string, qos byte, retained bool, data []byte) <-chan error {
+	return tokenResult(t.client.Publish(topic, qos, retained, data))
+}
+
+func (t *mqttV3) subscribe(topic string, handler func(topic string, payload []byte)) <-chan error {
+	return tokenResult(t.client.Subscribe(topic, 1, func(_ mqtt.Client, msg mqtt.Message) {
+		handler(msg.Topic(), msg.Payload())
+	}))
+}
+
+func (t *mqttV3) disconnect() {
+	if t.client.IsConnected() {
+		t.client.Disconnect(250)
+	}
+}
+
+func tokenResult(token mqtt.Token) <-chan error {
+	result := make(chan error, 1)
+	go func() {
+		token.Wait()
+		result <- token.Error()
+	}()
+	return result
+}
+
+// mqttV5 is the MQTT 5 transport. Every publish carries the user properties.
+type mqttV5 struct {
+	config         autopaho.ClientConfig
+	router         *paho.StandardRouter
+	userProperties paho.UserProperties
+	conn           *autopaho.ConnectionManager
+	up             atomic.Bool
+}
+
+func newMQTTv5(broker, clientID string, o MQTTOptions, tlsConfig *tls.Config, statusTopic string, onConnect func()) (*mqttV5, error) {
+	brokerURL, err := url.Parse(broker)
+	if err != nil {
+		return nil, fmt.Errorf("invalid broker %s: %w", broker, err)
+	}
+	t := &mqttV5{router: paho.NewStandardRouter()}
+	keys := make([]string, 0, len(o.UserProperties))
+	for key := range o.UserProperties {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		t.userProperties = append(t.userProperties, paho.UserProperty{Key: key, Value: o.UserProperties[key]})
+	}
+
+	t.config = autopaho.ClientConfig{
+		BrokerUrls:        []*url.URL{brokerURL},
+		TlsCfg:            tlsConfig,
+		KeepAlive:         30,
+		ConnectRetryDelay: 5 * time.Second,
+		OnConnectionUp: func(*autopaho.ConnectionManager, *paho.Connack) {
+			t.up.Store(true)
+			log.Infof("mqtt: connected to broker %s (MQTT 5)", broker)
+			onConnect()
+		},
+		OnConnectError: func(err error) {
+			log.Warnf("mqtt: connect attempt failed (will keep retrying): %v", err)
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID: clientID,
+			Router:   t.router,
+			OnClientError: func(err error) {
+				t.up.Store(false)
+				log.Warnf("mqtt: connection lost: %v (auto-reconnect enabled)", err)
+			},
+			OnServerDisconnect: func(d *paho.Disconnect) {
+				t.up.Store(false)
+				log.Warnf("mqtt: broker disconnected, reason code %d (auto-reconnect enabled)", d.ReasonCode)
+			},
+		},
+	}
+	t.config.SetWillMessage(statusTopic, []byte("offline"), 0, true)
+	if o.Username != "" {
+		t.config.SetUsernamePassword(o.Username, []byte(o.Password))
+	}
+	return t, nil
+}
+
+func (t *mqttV5) connect() {
+	// NewConnection only fails on an invalid config; connecting is retried in
+	// its own goroutine.
+	conn, err := autopaho.NewConnection(context.Background(), t.config)
+	if err != nil {
+		log.Errorf("mqtt: %v", err)
+		return
+	}
+	t.conn = conn
+}
+
+func (t *mqttV5) connected() bool {
+	return t.conn != nil && t.up.Load()
+}
+
+func (t *mqttV5) publish(topic string, qos byte, retained bool, data []byte) <-chan error {
+	publish := &paho.Publish{Topic: topic, QoS: qos, Retain: retained, Payload: data}
+	if len(t.userProperties) > 0 {
+		publish.Properties = &paho.PublishProperties{User: t.userProperties}
+	}
+	return t.do(func(ctx context.Context) error {
+		_, err := t.conn.Publish(ctx, publish)
+		return err
+	})
+}
+
+func (t *mqttV5) subscribe(topic string, handler func(topic string, payload []byte)) <-chan error {
+	t.router.UnregisterHandler(topic)
+	t.router.RegisterHandler(topic, func(p *paho.Publish) {
+		handler(p.Topic, p.Payload)
+	})
+	return t.do(func(ctx context.Context) error {
+		_, err := t.conn.Subscribe(ctx, &paho.Subscribe{
+			Subscriptions: []paho.SubscribeOptions{{Topic: topic, QoS: 1}},
+		})
+		return err
+	})
+}
+
+func (t *mqttV5) do(fn func(ctx context.Context) error) <-chan error {
+	result := make(chan error, 1)
+	if t.conn == nil {
+		result <- errors.New("not connected")
+		return result
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), mqttPublishTimeout)
+		defer cancel()
+		result <- fn(ctx)
+	}()
+	return result
+}
+
+func (t *mqttV5) disconnect() {
+	if t.conn == nil {
+		return
+	}
+	t.up.Store(false)
+	ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+	defer cancel()
+	_ = t.conn.Disconnect(ctx)
+}
@@ -0,0 +1,147 @@
+package pkg
+
+import (
+	"strings"
+	"time"
+
+	"github.com/NubeIO/lib-units/units"
+	"github.com/NubeIO/module-core-loraraw/codec"
+	"github.com/NubeIO/nubeio-rubix-lib-models-go/model"
+)
+
+// Schema versions of the <prefix>/value payload (mqtt_value_schema). Version
+// 1 is the original {device_address_uuid, device_name, payload} envelope.
+const (
+	ValueSchemaV1 = 1
+	ValueSchemaV2 = 2
+)
+
+// How an uplink arrived, DispatchResult.Encryption.
+const (
+	frameEncrypted       = "encrypted"
+	frameLegacyEncrypted = "legacy_encrypted"
+	framePlaintext       = "plaintext"
+)
+
+// commonPointUnits are the units of points every model has.
+var commonPointUnits = map[string]string{
+	codec.RssiField:     "dBm",
+	codec.SnrField:      "dB",
+	linkRssiAvgField:    "dBm",
+	linkSnrAvgField:     "dB",
+	linkPacketLossField: "%",
+}
+
+// ValueMessage is one decoded uplink, published on <prefix>/value as is with
+// schema version 2. Points holds the decoded points by io number; the radio's
+// RSSI and SNR are in Signal only.
+type ValueMessage struct {
+	SchemaVersion int                   `json:"schema_version"`
+	Timestamp     time.Time             `json:"timestamp"`
+	NetworkUUID   string                `json:"network_uuid"`
+	DeviceUUID    string                `json:"device_uuid"`
+	AddressUUID   string                `json:"device_address_uuid"`
+	DeviceName    string                `json:"device_name"`
+	DeviceModel   string                `json:"device_model"`
+	Encryption    string                `json:"encryption"`
+	Signal        ValueSignal           `json:"signal"`
+	Points        map[string]PointValue `json:"points"`
+}
+
+// ValueSignal is the radio metadata of the uplink. Nonce is set for LoRaRAW
+// frames only.
+type ValueSignal struct {
+	RSSI  int     `json:"rssi"`
+	SNR   float32 `json:"snr"`
+	Nonce *uint8  `json:"nonce,omitempty"`
+}
+
+// PointValue is a decoded point: its value, or the fault the decoder
+// reported for it. PointUUID is empty for a point created by this uplink.
+type PointValue struct {
+	PointUUID string   `json:"point_uuid,omitempty"`
+	Value     *float64 `json:"value,omitempty"`
+	Unit      string   `json:"unit,omitempty"`
+	Fault     string   `json:"fault,omitempty"`
+}
+
+// newValueMessage builds the message of a decoded uplink from the values and
+// faults its points decoded to.
+func newValueMessage(res DispatchResult, networkUUID string, received time.Time, values map[string]float64, faults map[string]string) *ValueMessage {
+	device := res.Device
+	msg := &ValueMessage{
+		SchemaVersion: ValueSchemaV2,
+		Timestamp:     received,
+		NetworkUUID:   networkUUID,
+		DeviceUUID:    device.UUID,
+		DeviceName:    device.Name,
+		DeviceModel:   device.Model,
+		Encryption:    res.Encryption,
+		Signal:        ValueSignal{RSSI: res.RSSI, SNR: res.SNR},
+		Points:        make(map[string]PointValue, len(values)+len(faults)),
+	}
+	if device.AddressUUID != nil {
+		msg.AddressUUID = *device.AddressUUID
+	}
+	if res.HasNonce {
+		nonce := res.Nonce
+		msg.Signal.Nonce = &nonce
+	}
+	point := func(ioNumber string) PointValue {
+		pv := PointValue{Unit: pointUnit(nil, ioNumber, res.DevDesc)}
+		if pnt := selectPointByIoNumber(ioNumber, device); pnt != nil {
+			pv.PointUUID = pnt.UUID
+			pv.Unit = pointUnit(pnt, ioNumber, res.DevDesc)
+		}
+		return pv
+	}
+	for ioNumber, value := range values {
+		if ioNumber == codec.RssiField || ioNumber == codec.SnrField {
+			continue
+		}
+		pv := point(ioNumber)
+		v := value
+		pv.Value = &v
+		msg.Points[ioNumber] = pv
+	}
+	for ioNumber, fault := range faults {
+		pv := point(ioNumber)
+		pv.Fault = fault
+		msg.Points[ioNumber] = pv
+	}
+	return msg
+}
+
+// values returns the point values and the RSSI and SNR as one flat map, the
+// version 1 payload and what the per-point topics carry.
+func (msg *ValueMessage) values() map[string]float64 {
+	values := make(map[string]float64, len(msg.Points)+2)
+	for ioNumber, pv := range msg.Points {
+		if pv.Value != nil {
+			values[ioNumber] = *pv.Value
+		}
+	}
+	values[codec.RssiField] = float64(msg.Signal.RSSI)
+	values[codec.SnrField] = float64(msg.Signal.SNR)
+	return values
+}
+
+// pointUnit is the unit symbol of a point: the point's own unit, else the
+// unit its model's codec gives, else the unit of a common point. point may be
+// nil for a point not stored yet.
+func pointUnit(point *model.Point, ioNumber string, devDesc *codec.LoRaDeviceDescription) string {
+	if point != nil && point.Unit != nil && *point.Unit != "" && *point.Unit != "disabled" {
+		for _, u := range units.SupportedUnits() {
+			if strings.EqualFold(u.LongName, *point.Unit) || strings.EqualFold(u.Name, *point.Unit) {
+				return u.Symbol
+			}
+		}
+		return *point.Unit
+	}
+	if devDesc != nil && devDesc.GetPointConfig != nil {
+		if config := devDesc.GetPointConfig(ioNumber); config != nil && config.Unit != "" {
+			return config.Unit
+		}
+	}
+	return commonPointUnits[ioNumber]
+}
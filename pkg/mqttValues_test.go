@@ -0,0 +1,106 @@
+package pkg
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/NubeIO/module-core-loraraw/codec"
+	"github.com/NubeIO/module-core-loraraw/schema"
+	"github.com/NubeIO/nubeio-rubix-lib-models-go/model"
+)
+
+func TestNewValueMessage(t *testing.T) {
+	addr := "65C0640D"
+	device := &model.Device{
+		CommonUUID: model.CommonUUID{UUID: "dev-optical"},
+		Name:       "optical",
+		CommonDevice: model.CommonDevice{
+			Model:       schema.DeviceModelRubixEncrypted,
+			AddressUUID: &addr,
+		},
+		NetworkUUID: "net-1",
+		Points: []*model.Point{{
+			CommonUUID: model.CommonUUID{UUID: "pnt-1"},
+			IoNumber:   codec.RssiField,
+		}},
+	}
+	m := &Module{config: &Config{DefaultKey: testDefaultKey}}
+	values := map[string]float64{}
+	res := m.dispatchFrame(testCaptureFrame, newMockGetDevice(device, addr),
+		func(name string, value float64, _ *model.Device, _ *codec.LoRaDeviceDescription) error {
+			values[name] = value
+			return nil
+		},
+		noopPointErr, noopMetaTags, noopWrittenOK, noopWrittenErr)
+	if !res.OK || res.Encryption != frameEncrypted {
+		t.Fatalf("expected an encrypted frame: %+v", res)
+	}
+	values[codec.RssiField] = float64(res.RSSI)
+	values[codec.SnrField] = float64(res.SNR)
+
+	received := time.Date(2026, 10, 1, 10, 0, 0, 0, time.UTC)
+	msg := newValueMessage(res, "net-1", received, values, map[string]string{"pulses": "sensor fault"})
+	if msg.SchemaVersion != ValueSchemaV2 || msg.DeviceUUID != "dev-optical" || msg.AddressUUID != addr ||
+		msg.NetworkUUID != "net-1" || msg.Encryption != frameEncrypted || !msg.Timestamp.Equal(received) {
+		t.Fatalf("unexpected message %+v", msg)
+	}
+	if msg.Signal.RSSI != res.RSSI || msg.Signal.Nonce == nil || *msg.Signal.Nonce != res.Nonce {
+		t.Fatalf("unexpected signal %+v", msg.Signal)
+	}
+	if _, ok := msg.Points[codec.RssiField]; ok {
+		t.Fatalf("rssi must only be in signal")
+	}
+	if pv := msg.Points["pulses"]; pv.Fault != "sensor fault" || pv.Value != nil {
+		t.Fatalf("unexpected fault point %+v", pv)
+	}
+	if len(msg.Points) < 2 {
+		t.Fatalf("expected decoded points, got %v", msg.Points)
+	}
+
+	flat := msg.values()
+	if flat[codec.RssiField] != float64(res.RSSI) || len(flat) != len(values) {
+		t.Fatalf("v1 values %v, want %v", flat, values)
+	}
+
+	res.Device.Points[0].IoNumber = "temp"
+	if pv := newValueMessage(res, "net-1", received, map[string]float64{"temp": 1}, nil).Points["temp"]; pv.PointUUID != "pnt-1" {
+		t.Fatalf("expected the stored point's uuid, got %+v", pv)
+	}
+	if unit := pointUnit(nil, codec.RssiField, res.DevDesc); unit != "dBm" {
+		t.Fatalf("rssi unit %q", unit)
+	}
+}
+
+func TestMQTTClient_PublishValuesSchema(t *testing.T) {
+	value := 21.5
+	msg := &ValueMessage{
+		SchemaVersion: ValueSchemaV2,
+		AddressUUID:   "65C0640D",
+		DeviceName:    "meter",
+		Encryption:    framePlaintext,
+		Signal:        ValueSignal{RSSI: -80, SNR: 7.5},
+		Points:        map[string]PointValue{"temp": {Value: &value, Unit: "°C"}},
+	}
+	for _, tc := range []struct {
+		schema int
+		want   string
+	}{
+		{ValueSchemaV1, `"payload":{"rssi":-80,"snr":7.5,"temp":21.5}`},
+		{ValueSchemaV2, `"points":{"temp":{"value":21.5,"unit":"°C"}}`},
+	} {
+		transport := &fakeTransport{up: true}
+		c := &MQTTClient{transport: transport, topicPrefix: MQTTTopicPrefix, valueSchema: tc.schema}
+		c.PublishValues(msg)
+		if len(transport.published) != 1 || !strings.Contains(transport.published[0], tc.want) {
+			t.Fatalf("schema %d: published %v, want %s", tc.schema, transport.published, tc.want)
+		}
+		if tc.schema == ValueSchemaV2 {
+			var decoded ValueMessage
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(transport.published[0], MQTTTopicPrefix+"/value ")), &decoded); err != nil || decoded.SchemaVersion != 2 {
+				t.Fatalf("v2 payload does not decode: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package pkg
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMQTTClient_PointValueTopic(t *testing.T) {
+	c := &MQTTClient{topicPrefix: MQTTTopicPrefix, pointTopic: "<prefix>/devices/<address>/<point>"}
+	if topic := c.pointValueTopic("65C0640D", "meter", "UO-1"); topic != "module-core-loraraw/devices/65C0640D/UO-1" {
+		t.Fatalf("topic %s", topic)
+	}
+
+	c.pointTopic = "site/<device>/<point>"
+	if topic := c.pointValueTopic("65C0640D", "plant room/#2", "temp+1"); topic != "site/plant room__2/temp_1" {
+		t.Fatalf("names must not add topic levels or wildcards: %s", topic)
+	}
+}
+
+func TestNormalizeBroker(t *testing.T) {
+	for in, want := range map[string]string{
+		"":                                "",
+		"127.0.0.1:1883":                  "tcp://127.0.0.1:1883",
+		" tcp://localhost:1883 ":          "tcp://localhost:1883",
+		"ssl://broker.example.com:8883":   "ssl://broker.example.com:8883",
+		"wss://broker.example.com/mqtt":   "wss://broker.example.com/mqtt",
+		"ws://127.0.0.1:9001/mqtt":        "ws://127.0.0.1:9001/mqtt",
+		"mqtts://broker.example.com:8883": "mqtts://broker.example.com:8883",
+	} {
+		if got := normalizeBroker(in); got != want {
+			t.Errorf("normalizeBroker(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	if config, err := newTLSConfig(mqttTLSOptions{}); config != nil || err != nil {
+		t.Fatalf("expected no TLS config without settings, got %v %v", config, err)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	writeTestCertificate(t, certFile, keyFile)
+
+	config, err := newTLSConfig(mqttTLSOptions{CAFile: certFile, CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.RootCAs == nil || len(config.Certificates) != 1 || config.InsecureSkipVerify {
+		t.Fatalf("unexpected TLS config %+v", config)
+	}
+
+	if config, err = newTLSConfig(mqttTLSOptions{InsecureSkipVerify: true}); err != nil || !config.InsecureSkipVerify {
+		t.Fatalf("expected insecure_skip_verify to apply: %v", err)
+	}
+	if _, err = newTLSConfig(mqttTLSOptions{CertFile: certFile}); err == nil {
+		t.Fatalf("expected an error for a cert without its key")
+	}
+	if _, err = newTLSConfig(mqttTLSOptions{CAFile: keyFile}); err == nil {
+		t.Fatalf("expected an error for a CA file without certificates")
+	}
+}
+
+func writeTestCertificate(t *testing.T, certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "loraraw-test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,346 @@
+package pkg
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/NubeIO/nubeio-rubix-lib-models-go/model"
+	log "github.com/sirupsen/logrus"
+)
+
+// loRaNetwork is one LoRaRAW radio. Every network of the module gets its own
+// transport, run loop, drainer and write scheduler, so two radios never share
+// a port or wait on each other's response timeouts.
+type loRaNetwork struct {
+	uuid   string
+	module *Module
+
+	transport      Transport
+	transportMutex sync.RWMutex
+
+	interruptChan chan struct{}
+	interruptOnce sync.Once
+	runDone       chan struct{}
+
+	pointWriteQueueManager *PointWriteQueueManager
+	dutyCycle              *dutyCycle
+	writeQueue             chan []byte
+	writeQueueDone         chan struct{}
+	writeQueueMutex        sync.Mutex
+}
+
+func newLoRaNetwork(m *Module, networkUUID string) *loRaNetwork {
+	n := &loRaNetwork{
+		uuid:          networkUUID,
+		module:        m,
+		interruptChan: make(chan struct{}),
+		dutyCycle: newDutyCycle(m.config.DutyCycleLimit, m.config.DutyCycleWindow,
+			m.config.LoRaSpreadingFactor, m.config.LoRaBandwidthKHz, m.config.LoRaCodingRate),
+	}
+	n.pointWriteQueueManager = NewPointWriteQueueManager(
+		m.config.WriteQueueMaxRetries,
+		m.config.WriteResponseTimeout,
+		m.config.WriteRetryBackoff,
+		m.config.WriteRetryBackoffMax,
+		m.getDevice,
+		m.getEncryptionKey,
+		n.WriteToLoRaRaw,
+		m.onWriteExhausted,
+		m.onWriteDropped)
+	return n
+}
+
+func (n *loRaNetwork) start() {
+	n.initWriteQueue()
+	n.runDone = make(chan struct{})
+	go func() {
+		defer close(n.runDone)
+		n.run()
+	}()
+}
+
+// stop ends the run loop, the scheduler and the drainer, and waits for the
+// run loop and the scheduler to return: no frame of the network is handled
+// after it. Safe to call more than once. It must not be called with
+// networksMutex held, as a frame being handled may need it.
+func (n *loRaNetwork) stop() {
+	n.interruptOnce.Do(func() { close(n.interruptChan) })
+	n.pointWriteQueueManager.Stop()
+	n.stopWriteQueue()
+	_ = n.closeTransport() // unblocks the reader
+	if n.runDone != nil {
+		<-n.runDone
+	}
+}
+
+func (n *loRaNetwork) getTransport() Transport {
+	n.transportMutex.RLock()
+	defer n.transportMutex.RUnlock()
+	return n.transport
+}
+
+// openTransport (re)connects the transport configured on the network and
+// reflects the outcome in the network fault.
+func (n *loRaNetwork) openTransport() (Transport, error) {
+	net, err := n.module.grpcMarshaller.GetNetwork(n.uuid)
+	if err != nil {
+		return nil, err
+	}
+	_ = n.closeTransport()
+
+	transport, err := newTransport(net)
+	if err == nil {
+		err = transport.Open()
+	}
+	if err != nil {
+		_ = n.module.grpcMarshaller.UpdateNetworkFault(net.UUID, &model.CommonFault{
+			InFault: true,
+			Message: err.Error(),
+		})
+		return nil, err
+	}
+	n.transportMutex.Lock()
+	n.transport = transport
+	n.transportMutex.Unlock()
+	return transport, nil
+}
+
+func (n *loRaNetwork) closeTransport() error {
+	n.transportMutex.Lock()
+	transport := n.transport
+	n.transport = nil
+	n.transportMutex.Unlock()
+	if transport == nil {
+		return nil
+	}
+	return transport.Close()
+}
+
+// WriteToLoRaRaw hands a frame to the drainer, which writes it out of the
+// transport. A frame the duty-cycle budget does not allow is refused with a
+// *DutyCycleError; one the drainer does not take gives its airtime back.
+func (n *loRaNetwork) WriteToLoRaRaw(data []byte) error {
+	n.initWriteQueue() // Make sure the queue is initialized
+
+	if n.getTransport() == nil {
+		return errors.New("transport not connected")
+	}
+	queue := n.getWriteQueue()
+	if queue == nil {
+		return errors.New("write queue stopped")
+	}
+	now := time.Now()
+	if err := n.dutyCycle.Reserve(len(data), now); err != nil {
+		return err
+	}
+
+	select {
+	case queue <- data:
+		return nil
+	case <-time.After(1 * time.Second):
+		n.dutyCycle.Release(len(data), now)
+		return errors.New("write queue full, timeout after 1 second")
+	}
+}
+
+// startNetwork starts (or restarts) the runner for networkUUID. Starts and
+// stops of runners take turns, so two starts of one network (Enable and a
+// network hook) cannot both put a runner in place and leak the first. The
+// old runner is taken out and stopped before the new one goes in, as the new
+// one resumes the write queue file the old one saves on stop.
+func (m *Module) startNetwork(networkUUID string) *loRaNetwork {
+	m.networkStartMutex.Lock()
+	defer m.networkStartMutex.Unlock()
+
+	if old := m.takeNetwork(networkUUID); old != nil {
+		old.stop()
+		log.Infof("stopped LoRaRAW network %s", networkUUID)
+	}
+	n := newLoRaNetwork(m, networkUUID)
+	if restored := n.pointWriteQueueManager.Restore(m.statePath(writeJournalFile(networkUUID))); restored > 0 {
+		log.Infof("restored %d pending writes of LoRaRAW network %s", restored, networkUUID)
+	}
+	m.networksMutex.Lock()
+	if m.networks == nil {
+		m.networks = make(map[string]*loRaNetwork)
+	}
+	m.networks[networkUUID] = n
+	m.networksMutex.Unlock()
+	n.start()
+	log.Infof("started LoRaRAW network %s", networkUUID)
+	return n
+}
+
+// takeNetwork removes the runner of networkUUID from the running networks
+// and returns it, nil when there is none.
+func (m *Module) takeNetwork(networkUUID string) *loRaNetwork {
+	m.networksMutex.Lock()
+	defer m.networksMutex.Unlock()
+
+	n := m.networks[networkUUID]
+	delete(m.networks, networkUUID)
+	return n
+}
+
+func (m *Module) stopNetwork(networkUUID string) {
+	m.networkStartMutex.Lock()
+	defer m.networkStartMutex.Unlock()
+
+	if n := m.takeNetwork(networkUUID); n != nil {
+		n.stop()
+		log.Infof("stopped LoRaRAW network %s", networkUUID)
+	}
+}
+
+func (m *Module) stopNetworks() {
+	m.networkStartMutex.Lock()
+	defer m.networkStartMutex.Unlock()
+
+	m.networksMutex.Lock()
+	networks := m.networks
+	m.networks = make(map[string]*loRaNetwork)
+	m.networksMutex.Unlock()
+
+	for _, n := range networks {
+		n.stop()
+	}
+}
+
+func (m *Module) getNetwork(networkUUID string) *loRaNetwork {
+	m.networksMutex.Lock()
+	defer m.networksMutex.Unlock()
+
+	return m.networks[networkUUID]
+}
+
+// WriteToLoRaRaw sends a raw frame out of the radio of the given network.
+func (m *Module) WriteToLoRaRaw(networkUUID string, data []byte) error {
+	n := m.getNetwork(networkUUID)
+	if n == nil {
+		return errors.New("network " + networkUUID + " is not running")
+	}
+	return n.WriteToLoRaRaw(data)
+}
+
+// enqueuePoint queues a point write on the scheduler of the network its device
+// belongs to.
+func (m *Module) enqueuePoint(point *model.Point) error {
+	device, err := m.getDevice(point.DeviceUUID)
+	if err != nil {
+		return err
+	}
+	return m.enqueuePointOnNetwork(device.NetworkUUID, point, "")
+}
+
+// enqueuePointOnNetwork queues a point write on the network's scheduler.
+// correlationID is the MQTT write command's, if it came from one.
+func (m *Module) enqueuePointOnNetwork(networkUUID string, point *model.Point, correlationID string) error {
+	n := m.getNetwork(networkUUID)
+	if n == nil {
+		return errors.New("network " + networkUUID + " is not running")
+	}
+	n.pointWriteQueueManager.EnqueueCommand(point, correlationID)
+	return nil
+}
+
+// dutyCycleStats returns the airtime budget of the network's radio. A
+// disabled budget has a zero limit.
+func (n *loRaNetwork) dutyCycleStats() DutyCycleStats {
+	if n.dutyCycle == nil {
+		return DutyCycleStats{}
+	}
+	return n.dutyCycle.Stats(time.Now())
+}
+
+// cancelPointWrite cancels the queued writes to a point.
+func (m *Module) cancelPointWrite(pointUUID string) (int, error) {
+	point, err := m.grpcMarshaller.GetPoint(pointUUID)
+	if err != nil {
+		return 0, err
+	}
+	manager, err := m.deviceWriteQueue(point.DeviceUUID)
+	if err != nil {
+		return 0, err
+	}
+	return manager.CancelPoint(point.DeviceUUID, pointUUID)
+}
+
+// getWriteQueueManager returns the write scheduler of the device's network.
+func (m *Module) getWriteQueueManager(device *model.Device) *PointWriteQueueManager {
+	n := m.getNetwork(device.NetworkUUID)
+	if n == nil {
+		return nil
+	}
+	return n.pointWriteQueueManager
+}
+
+// initWriteQueue starts the drainer if it is not running. It is safe to
+// call after stopWriteQueue, so an Enable following a Disable gets a fresh queue.
+func (n *loRaNetwork) initWriteQueue() {
+	n.writeQueueMutex.Lock()
+	defer n.writeQueueMutex.Unlock()
+
+	if n.writeQueue != nil {
+		return
+	}
+	n.writeQueue = make(chan []byte, 100)
+	n.writeQueueDone = make(chan struct{})
+
+	go n.processWriteQueue(n.writeQueue, n.writeQueueDone)
+}
+
+// stopWriteQueue stops the drainer. The send channel is never closed:
+// a concurrent WriteToLoRaRaw may still be holding it, and sending on a
+// closed channel panics. Dropping the reference is enough.
+func (n *loRaNetwork) stopWriteQueue() {
+	n.writeQueueMutex.Lock()
+	defer n.writeQueueMutex.Unlock()
+
+	if n.writeQueue == nil {
+		return
+	}
+	close(n.writeQueueDone)
+	n.writeQueue = nil
+	n.writeQueueDone = nil
+}
+
+// getWriteQueue returns the current send channel, or nil when stopped.
+func (n *loRaNetwork) getWriteQueue() chan []byte {
+	n.writeQueueMutex.Lock()
+	defer n.writeQueueMutex.Unlock()
+
+	return n.writeQueue
+}
+
+func (n *loRaNetwork) processWriteQueue(queue <-chan []byte, done <-chan struct{}) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorf("Recovered panic in processWriteQueue: %v", r)
+			// Restart goroutine
+			go n.processWriteQueue(queue, done)
+		}
+	}()
+
+	for {
+		select {
+		case data := <-queue:
+			transport := n.getTransport()
+			if transport == nil {
+				log.Errorf("[%s] Transport not connected", n.uuid)
+				continue
+			}
+
+			err := transport.Write(data)
+			if err != nil {
+				log.Errorf("[%s] Error writing to transport: %v", n.uuid, err)
+			}
+
+			// Wait a while after sending for the LoRa module to process
+			time.Sleep(50 * time.Millisecond)
+
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package pkg
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NubeIO/lib-module-go/nmodule"
+	"github.com/NubeIO/module-core-loraraw/codecs/rubixDataEncoding"
+	"github.com/NubeIO/nubeio-rubix-lib-models-go/model"
+	"github.com/NubeIO/nubeio-rubix-lib-models-go/nargs"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// uplinkIntervalMetaTag sets a device's expected uplink interval, e.g. "15m".
+	uplinkIntervalMetaTag = "uplink_interval"
+
+	// pushFrequencyUnit is the unit of the MDK_PUSH_FREQUENCY value Rubix
+	// devices report.
+	pushFrequencyUnit = time.Second
+
+	offlineCheckPeriod = time.Minute
+)
+
+// offlineWatchdog faults devices that have not sent a good frame for
+// missedIntervals of their expected uplink interval. Its clock starts at
+// Enable: after a restart every device gets the full grace period again.
+type offlineWatchdog struct {
+	missedIntervals int
+	defaultInterval time.Duration
+	modelIntervals  map[string]time.Duration
+	started         time.Time
+
+	lastUplink map[string]time.Time
+	offline    map[string]bool
+	mutex      sync.Mutex
+}
+
+// offlineDevice is a device that has just been found offline.
+type offlineDevice struct {
+	device  *model.Device
+	message string
+}
+
+func newOfflineWatchdog(missedIntervals int, defaultInterval time.Duration, modelIntervals map[string]time.Duration) *offlineWatchdog {
+	return &offlineWatchdog{
+		missedIntervals: missedIntervals,
+		defaultInterval: defaultInterval,
+		modelIntervals:  modelIntervals,
+		started:         time.Now(),
+		lastUplink:      make(map[string]time.Time),
+		offline:         make(map[string]bool),
+	}
+}
+
+// Seen records a good frame from the device. Its fault is cleared by the
+// caller, as for any good frame.
+func (w *offlineWatchdog) Seen(deviceUUID string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.lastUplink[deviceUUID] = time.Now()
+	delete(w.offline, deviceUUID)
+}
+
+// expectedInterval is, in order of precedence: the device's uplink_interval
+// meta tag, the push frequency the device reports, the model's configured
+// interval, the default interval. 0 means the device is not watched.
+func (w *offlineWatchdog) expectedInterval(device *model.Device) time.Duration {
+	for _, tag := range device.MetaTags {
+		if tag.Key == uplinkIntervalMetaTag {
+			if d, err := time.ParseDuration(tag.Value); err == nil {
+				return d
+			}
+			log.Warnf("device %s: invalid %s meta tag %q", device.Name, uplinkIntervalMetaTag, tag.Value)
+		}
+	}
+	for _, point := range device.Points {
+		if rubixDataEncoding.IsGeneralField(point.IoNumber, rubixDataEncoding.MDK_PUSH_FREQUENCY) && point.PresentValue != nil && *point.PresentValue > 0 {
+			return time.Duration(*point.PresentValue * float64(pushFrequencyUnit))
+		}
+	}
+	for model, d := range w.modelIntervals {
+		if strings.EqualFold(model, device.Model) {
+			return d
+		}
+	}
+	return w.defaultInterval
+}
+
+// Check returns the devices that have gone offline since the last check.
+func (w *offlineWatchdog) Check(devices []*model.Device, now time.Time) []offlineDevice {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	var found []offlineDevice
+	for _, device := range devices {
+		if device.Enable != nil && !*device.Enable {
+			continue
+		}
+		if w.offline[device.UUID] {
+			continue
+		}
+		interval := w.expectedInterval(device)
+		if interval <= 0 {
+			continue
+		}
+		last, ok := w.lastUplink[device.UUID]
+		if !ok {
+			last = w.started
+		}
+		silent := now.Sub(last)
+		if silent < time.Duration(w.missedIntervals)*interval {
+			continue
+		}
+		w.offline[device.UUID] = true
+		found = append(found, offlineDevice{
+			device:  device,
+			message: fmt.Sprintf("no uplink for %s (expected every %s)", silent.Round(time.Minute), interval),
+		})
+	}
+	return found
+}
+
+// Forget drops the device, e.g. once it is deleted.
+func (w *offlineWatchdog) Forget(deviceUUID string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	delete(w.lastUplink, deviceUUID)
+	delete(w.offline, deviceUUID)
+}
+
+func (m *Module) startOfflineWatchdog() {
+	m.stopOfflineWatchdog()
+	if m.config.OfflineMissedIntervals <= 0 {
+		return
+	}
+	w := newOfflineWatchdog(m.config.OfflineMissedIntervals, m.config.OfflineDefaultInterval, m.config.OfflineModelIntervals)
+	done := make(chan struct{})
+	m.offlineWatchdog = w
+	m.offlineWatchdogDone = done
+	go m.runOfflineWatchdog(w, done)
+}
+
+func (m *Module) stopOfflineWatchdog() {
+	if m.offlineWatchdogDone != nil {
+		close(m.offlineWatchdogDone)
+	}
+	m.offlineWatchdog = nil
+	m.offlineWatchdogDone = nil
+}
+
+func (m *Module) runOfflineWatchdog(w *offlineWatchdog, done <-chan struct{}) {
+	ticker := time.NewTicker(offlineCheckPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			m.checkOfflineDevices(w, now)
+		}
+	}
+}
+
+func (m *Module) checkOfflineDevices(w *offlineWatchdog, now time.Time) {
+	opts := &nmodule.Opts{Args: &nargs.Args{WithDevices: true, WithPoints: true, WithMetaTags: true}}
+	networks, err := m.grpcMarshaller.GetNetworksByPluginName(m.moduleName, opts)
+	if err != nil {
+		log.Errorf("offline check: %s", err)
+		return
+	}
+	var devices []*model.Device
+	for _, network := range networks {
+		devices = append(devices, network.Devices...)
+	}
+	for _, o := range w.Check(devices, now) {
+		log.Warnf("device %s (%s) is offline: %s", o.device.Name, o.device.UUID, o.message)
+		_ = m.grpcMarshaller.UpdateDeviceFault(o.device.UUID, &model.CommonFault{
+			InFault: true,
+			Message: o.message,
+		})
+	}
+}
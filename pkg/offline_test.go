@@ -0,0 +1,104 @@
+package pkg
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/NubeIO/module-core-loraraw/codec"
+	"github.com/NubeIO/module-core-loraraw/codecs/rubixDataEncoding"
+	"github.com/NubeIO/module-core-loraraw/schema"
+	"github.com/NubeIO/nubeio-rubix-lib-models-go/model"
+)
+
+func testOfflineDevice(uuid, deviceModel string) *model.Device {
+	return &model.Device{
+		CommonUUID:   model.CommonUUID{UUID: uuid},
+		CommonDevice: model.CommonDevice{Model: deviceModel},
+	}
+}
+
+// decodeRubixPoints decodes a Rubix uplink carrying value into the points
+// the device would get.
+func decodeRubixPoints(t *testing.T, device *model.Device, value float32, key rubixDataEncoding.MetaDataKey) []*model.Point {
+	serialData := rubixDataEncoding.NewSerialData()
+	if !rubixDataEncoding.EncodeData(serialData, value, key, 0) {
+		t.Fatalf("encoding %v failed", key)
+	}
+	var points []*model.Point
+	err := rubixDataEncoding.DecodeRubix(serialData.Buffer, device, nil, 0,
+		func(name string, value float64, _ *model.Device, _ *codec.LoRaDeviceDescription) error {
+			points = append(points, &model.Point{IoNumber: name, PresentValue: &value})
+			return nil
+		},
+		func(name string, err error, _ *model.Device, _ *codec.LoRaDeviceDescription) error {
+			t.Fatalf("decoding %s: %s", name, err)
+			return nil
+		},
+		nil, nil, nil,
+	)
+	if err != nil || len(points) == 0 {
+		t.Fatalf("decoded %+v: %v", points, err)
+	}
+	return points
+}
+
+func TestOfflineWatchdog_FaultsAfterMissedIntervals(t *testing.T) {
+	w := newOfflineWatchdog(3, 0, map[string]time.Duration{schema.DeviceModelTHLM: 15 * time.Minute})
+	droplet := testOfflineDevice("droplet", "thlm")
+	unwatched := testOfflineDevice("rubix", schema.DeviceModelRubix)
+	devices := []*model.Device{droplet, unwatched}
+
+	if found := w.Check(devices, w.started.Add(44*time.Minute)); len(found) != 0 {
+		t.Fatalf("faulted before 3 missed intervals: %+v", found)
+	}
+	found := w.Check(devices, w.started.Add(46*time.Minute))
+	if len(found) != 1 || found[0].device != droplet {
+		t.Fatalf("expected only the droplet offline, got %+v", found)
+	}
+	if !strings.Contains(found[0].message, "no uplink for 46m0s (expected every 15m0s)") {
+		t.Fatalf("message %q", found[0].message)
+	}
+	if found := w.Check(devices, w.started.Add(60*time.Minute)); len(found) != 0 {
+		t.Fatalf("an offline device must only be reported once, got %+v", found)
+	}
+
+	// The next good frame brings it back; it is watched again from then on.
+	w.Seen(droplet.UUID)
+	now := time.Now()
+	if found := w.Check(devices, now.Add(30*time.Minute)); len(found) != 0 {
+		t.Fatalf("faulted right after an uplink: %+v", found)
+	}
+	if found := w.Check(devices, now.Add(50*time.Minute)); len(found) != 1 {
+		t.Fatalf("expected the droplet offline again, got %+v", found)
+	}
+}
+
+func TestOfflineWatchdog_ExpectedInterval(t *testing.T) {
+	w := newOfflineWatchdog(3, time.Hour, map[string]time.Duration{schema.DeviceModelRubix: 30 * time.Minute})
+
+	device := testOfflineDevice("dev", schema.DeviceModelRubix)
+	if d := w.expectedInterval(device); d != 30*time.Minute {
+		t.Fatalf("model interval: %s", d)
+	}
+
+	device.Points = decodeRubixPoints(t, device, float32(600), rubixDataEncoding.MDK_PUSH_FREQUENCY)
+	if d := w.expectedInterval(device); d != 10*time.Minute {
+		t.Fatalf("push frequency of %s: %s", device.Points[0].IoNumber, d)
+	}
+
+	device.MetaTags = []*model.DeviceMetaTag{{Key: uplinkIntervalMetaTag, Value: "5m"}}
+	if d := w.expectedInterval(device); d != 5*time.Minute {
+		t.Fatalf("meta tag: %s", d)
+	}
+
+	if d := w.expectedInterval(testOfflineDevice("other", schema.DeviceModelTH)); d != time.Hour {
+		t.Fatalf("default interval: %s", d)
+	}
+
+	disabled := false
+	device.Enable = &disabled
+	if found := w.Check([]*model.Device{device}, time.Now().Add(24*time.Hour)); len(found) != 0 {
+		t.Fatalf("disabled devices must not be faulted: %+v", found)
+	}
+}
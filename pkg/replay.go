@@ -0,0 +1,204 @@
+package pkg
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	replayStateFile = "replay-windows.json"
+
+	// replayWindowMaxSize is the widest window the 64-bit seen mask can hold.
+	replayWindowMaxSize = 64
+
+	// replaySaveDelay batches the window updates of many uplinks into one
+	// write of the state file, to spare the flash. A crash loses at most
+	// this much; Disable flushes.
+	replaySaveDelay = 30 * time.Second
+)
+
+// replayWindow tracks the nonces recently accepted from one device.
+//
+// The LoRaRAW nonce is a single byte that wraps at 256, so "newer" is decided
+// modulo 256: a nonce up to 127 steps past Highest is ahead of it, anything
+// else is behind it. Behind nonces are only accepted while they are inside
+// the window and have not been seen yet, which still lets a frame that was
+// delayed (or re-ordered by the driver) through.
+type replayWindow struct {
+	Initialised  bool      `json:"initialised"`
+	Highest      uint8     `json:"highest"`
+	Seen         uint64    `json:"seen"` // bit i set: nonce Highest-i was accepted
+	Accepted     uint64    `json:"accepted"`
+	Rejected     uint64    `json:"rejected"`
+	LastAccepted time.Time `json:"last_accepted,omitempty"`
+	LastRejected time.Time `json:"last_rejected,omitempty"`
+
+	// A device that reboots starts counting from its boot nonce again, which
+	// can land behind the window. ResyncNext/ResyncRun track a run of
+	// consecutive nonces behind the window; once the run is long enough the
+	// window follows the device instead of locking it out for up to 128
+	// frames. Recorded traffic can build such a run too, so the re-sync is
+	// off unless configured; resetting the window over the API is the safe
+	// way back in.
+	ResyncNext uint8 `json:"resync_next"`
+	ResyncRun  int   `json:"resync_run"`
+}
+
+// check reports whether nonce is fresh, and records it when it is.
+func (w *replayWindow) check(nonce uint8, size, resyncCount int) bool {
+	now := time.Now()
+	if !w.Initialised {
+		w.reset(nonce)
+		w.accept(now)
+		return true
+	}
+
+	diff := nonce - w.Highest
+	switch {
+	case diff != 0 && diff < 128:
+		if diff >= replayWindowMaxSize {
+			w.Seen = 0
+		} else {
+			w.Seen <<= diff
+		}
+		w.Seen |= 1
+		w.Highest = nonce
+		w.accept(now)
+		return true
+	case diff != 0:
+		back := w.Highest - nonce
+		if int(back) < size && w.Seen&(1<<back) == 0 {
+			w.Seen |= 1 << back
+			w.accept(now)
+			return true
+		}
+	}
+
+	w.Rejected++
+	w.LastRejected = now
+	if back := w.Highest - nonce; diff == 0 || int(back) < size {
+		// A duplicate inside the window is a replay, never a reboot.
+		w.ResyncRun = 0
+	} else if resyncCount > 0 {
+		if w.ResyncRun > 0 && nonce == w.ResyncNext {
+			w.ResyncRun++
+		} else {
+			w.ResyncRun = 1
+		}
+		w.ResyncNext = nonce + 1
+		if w.ResyncRun >= resyncCount {
+			log.Warnf("replay: %d consecutive nonces behind the window ending at %d, resyncing (device rebooted?)", w.ResyncRun, nonce)
+			w.reset(nonce)
+			w.accept(now)
+			return true
+		}
+	}
+	return false
+}
+
+func (w *replayWindow) reset(nonce uint8) {
+	w.Initialised = true
+	w.Highest = nonce
+	w.Seen = 1
+	w.ResyncRun = 0
+}
+
+func (w *replayWindow) accept(now time.Time) {
+	w.Accepted++
+	w.LastAccepted = now
+	w.ResyncRun = 0
+}
+
+// replayGuard holds one replayWindow per device UUID and persists them to the
+// module data dir so a restart does not reopen the door to old frames.
+type replayGuard struct {
+	path        string
+	size        int
+	resyncCount int
+	windows     map[string]*replayWindow
+	dirty       bool
+	saveTimer   *time.Timer
+	mutex       sync.Mutex
+}
+
+func newReplayGuard(path string, size, resyncCount int) *replayGuard {
+	g := &replayGuard{
+		path:        path,
+		size:        size,
+		resyncCount: resyncCount,
+		windows:     make(map[string]*replayWindow),
+	}
+	if err := loadState(path, &g.windows); err != nil {
+		log.Errorf("replay: failed to load windows from %s: %s", path, err)
+	}
+	if g.windows == nil {
+		g.windows = make(map[string]*replayWindow)
+	}
+	return g
+}
+
+// Check reports whether the nonce of an uplink from deviceUUID is fresh.
+func (g *replayGuard) Check(deviceUUID string, nonce uint8) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	w, ok := g.windows[deviceUUID]
+	if !ok {
+		w = &replayWindow{}
+		g.windows[deviceUUID] = w
+	}
+	accepted := w.check(nonce, g.size, g.resyncCount)
+	g.dirty = true
+	if g.saveTimer == nil && g.path != "" {
+		g.saveTimer = time.AfterFunc(replaySaveDelay, g.Flush)
+	}
+	return accepted
+}
+
+// Get returns a copy of the device's window, or nil when nothing was received yet.
+func (g *replayGuard) Get(deviceUUID string) *replayWindow {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	w, ok := g.windows[deviceUUID]
+	if !ok {
+		return nil
+	}
+	c := *w
+	return &c
+}
+
+// Reset forgets the device's window; its next uplink is accepted as fresh.
+func (g *replayGuard) Reset(deviceUUID string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if _, ok := g.windows[deviceUUID]; !ok {
+		return
+	}
+	delete(g.windows, deviceUUID)
+	g.save()
+}
+
+// Flush saves the windows changed since the last save.
+func (g *replayGuard) Flush() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if g.dirty {
+		g.save()
+	}
+}
+
+func (g *replayGuard) save() {
+	if g.saveTimer != nil {
+		g.saveTimer.Stop()
+		g.saveTimer = nil
+	}
+	g.dirty = false
+	if err := saveState(g.path, g.windows); err != nil {
+		log.Errorf("replay: failed to save windows to %s: %s", g.path, err)
+	}
+}
@@ -0,0 +1,149 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/NubeIO/module-core-loraraw/logger"
+	"github.com/NubeIO/nubeio-rubix-lib-models-go/model"
+	log "github.com/sirupsen/logrus"
+)
+
+// ReplayCommand is the `replay` subcommand of the module binary: it decodes a
+// capture file offline, without the host or a radio, and prints the points
+// each frame decodes to.
+//
+//	module-core-loraraw replay -devices devices.json capture.jsonl
+//
+// devices.json is a JSON array of devices as the host stores them; only
+// address_uuid, model and manufacture (the device key) matter.
+func ReplayCommand(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	devicesFile := flags.String("devices", "", "JSON file with the devices to decode against (required)")
+	defaultKey := flags.String("key", DefaultDeviceKey, "default device key (hex)")
+	masterKeyFile := flags.String("master-key-file", "", "master key file, to decode with encrypted device keys")
+	codecsDir := flags.String("codecs", "", "dir of codec files to load")
+	network := flags.String("network", "", "only replay frames heard by this network")
+	replayProtection := flags.Bool("replay-protection", false, "drop re-transmitted frames, as replay_protection does")
+	asJSON := flags.Bool("json", false, "print one JSON object per frame")
+	logLevel := flags.String("log", "ERROR", "log level")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *devicesFile == "" || flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("usage: replay -devices devices.json [flags] capture.jsonl")
+	}
+
+	level, err := log.ParseLevel(*logLevel)
+	if err != nil {
+		return err
+	}
+	logger.SetLogger(level)
+
+	data, err := os.ReadFile(*devicesFile)
+	if err != nil {
+		return err
+	}
+	var devices []*model.Device
+	if err = json.Unmarshal(data, &devices); err != nil {
+		return fmt.Errorf("%s: %w", *devicesFile, err)
+	}
+
+	config := (&Module{}).DefaultConfig()
+	config.DefaultKey = *defaultKey
+	config.MasterKeyFile = *masterKeyFile
+	if err = config.resolveKeys(); err != nil {
+		return err
+	}
+	if *codecsDir != "" {
+		config.CodecsDir = *codecsDir
+		(&Module{config: config}).loadCodecFiles()
+	}
+
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	frames, err := replayCapture(file, devices, config, ReplayOptions{Network: *network, ReplayProtection: *replayProtection})
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(stdout)
+		for _, frame := range frames {
+			if err = enc.Encode(frame); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, frame := range frames {
+		_, err = fmt.Fprintln(stdout, formatReplayedFrame(frame))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// formatReplayedFrame renders a frame as one line:
+// time address model status name=value ...
+func formatReplayedFrame(frame ReplayedFrame) string {
+	var b strings.Builder
+	if frame.Time != nil {
+		b.WriteString(frame.Time.Format("2006-01-02T15:04:05.000Z07:00") + " ")
+	}
+	address := frame.Address
+	if address == "" {
+		address = "-"
+	}
+	b.WriteString(address)
+	if frame.Model != "" {
+		b.WriteString(" " + frame.Model)
+	}
+	switch {
+	case frame.OK:
+		b.WriteString(" ok")
+	case frame.Dropped != "":
+		b.WriteString(" dropped:" + frame.Dropped)
+	case frame.DeviceUUID == "":
+		b.WriteString(" no-device")
+	default:
+		b.WriteString(" failed")
+	}
+	writeSorted := func(prefix string, values map[string]string, quote bool) {
+		keys := make([]string, 0, len(values))
+		for key := range values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			value := values[key]
+			if quote {
+				value = fmt.Sprintf("%q", value)
+			}
+			b.WriteString(" " + prefix + key + "=" + value)
+		}
+	}
+	formatFloats := func(values map[string]float64) map[string]string {
+		out := make(map[string]string, len(values))
+		for key, value := range values {
+			out[key] = fmt.Sprintf("%g", value)
+		}
+		return out
+	}
+	writeSorted("", formatFloats(frame.Points), false)
+	writeSorted("written:", formatFloats(frame.Written), false)
+	writeSorted("error:", frame.Errors, true)
+	writeSorted("tag:", frame.MetaTags, true)
+	return b.String()
+}
@@ -0,0 +1,147 @@
+package pkg
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/NubeIO/module-core-loraraw/codec"
+	"github.com/NubeIO/module-core-loraraw/schema"
+	"github.com/NubeIO/nubeio-rubix-lib-models-go/model"
+)
+
+func TestReplayWindow_InOrderOutOfOrderAndReplay(t *testing.T) {
+	w := &replayWindow{}
+	steps := []struct {
+		nonce uint8
+		want  bool
+	}{
+		{10, true},  // first frame initialises the window
+		{11, true},  // ahead
+		{11, false}, // exact replay
+		{14, true},  // ahead with a gap (12, 13 lost or delayed)
+		{12, true},  // late but inside the window and unseen
+		{12, false}, // replay of the late frame
+		{10, false}, // replay of an old frame
+	}
+	for i, s := range steps {
+		if got := w.check(s.nonce, 32, 0); got != s.want {
+			t.Fatalf("step %d nonce %d: expected %v, got %v", i, s.nonce, s.want, got)
+		}
+	}
+	if w.Rejected != 3 {
+		t.Fatalf("expected 3 rejected frames, got %d", w.Rejected)
+	}
+}
+
+func TestReplayWindow_Wraparound(t *testing.T) {
+	w := &replayWindow{}
+	for _, n := range []uint8{250, 253, 255, 0, 2} {
+		if !w.check(n, 32, 0) {
+			t.Fatalf("nonce %d should be accepted across the 255→0 wrap", n)
+		}
+	}
+	if w.check(255, 32, 0) {
+		t.Fatalf("nonce 255 was already seen before the wrap and must be rejected")
+	}
+	if !w.check(254, 32, 0) {
+		t.Fatalf("nonce 254 is unseen and inside the window")
+	}
+}
+
+func TestReplayWindow_TooOldIsRejected(t *testing.T) {
+	w := &replayWindow{}
+	w.check(100, 8, 0)
+	w.check(120, 8, 0)
+	if w.check(105, 8, 0) {
+		t.Fatalf("nonce 105 is 15 behind an 8-frame window and must be rejected")
+	}
+}
+
+func TestReplayWindow_ResyncAfterReboot(t *testing.T) {
+	w := &replayWindow{}
+	w.check(200, 32, 3)
+	// Device reboots and counts from 100: behind, and outside the window.
+	if w.check(100, 32, 3) || w.check(101, 32, 3) {
+		t.Fatalf("the first frames after a reboot are behind the window")
+	}
+	if !w.check(102, 32, 3) {
+		t.Fatalf("third consecutive nonce should re-sync the window")
+	}
+	if !w.check(103, 32, 3) {
+		t.Fatalf("device should be accepted normally after re-sync")
+	}
+	// A scattered (non-consecutive) replay never builds a run.
+	if w.check(1, 32, 3) || w.check(5, 32, 3) || w.check(40, 32, 3) {
+		t.Fatalf("non-consecutive old nonces must not re-sync the window")
+	}
+	// Nor do consecutive replays inside the window.
+	if w.check(102, 32, 2) || w.check(103, 32, 2) {
+		t.Fatalf("replays inside the window must not re-sync it")
+	}
+	// With the default of 0 nothing re-syncs the window.
+	w = &replayWindow{}
+	w.check(200, 32, 0)
+	for n := uint8(100); n < 110; n++ {
+		if w.check(n, 32, 0) {
+			t.Fatalf("nonce %d re-synced the window with re-sync off", n)
+		}
+	}
+}
+
+func TestReplayGuard_PersistsAcrossRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), replayStateFile)
+
+	g := newReplayGuard(path, 32, 0)
+	if !g.Check("dev-1", 7) {
+		t.Fatalf("first frame should be accepted")
+	}
+	if w := newReplayGuard(path, 32, 0).Get("dev-1"); w != nil {
+		t.Fatalf("windows must not be saved on every uplink, got %+v", w)
+	}
+	g.Flush() // as Disable does
+
+	g = newReplayGuard(path, 32, 0)
+	if g.Check("dev-1", 7) {
+		t.Fatalf("replayed frame must be rejected after a restart")
+	}
+	if w := g.Get("dev-1"); w == nil || w.Rejected != 1 {
+		t.Fatalf("expected the rejection to be counted, got %+v", w)
+	}
+
+	g.Reset("dev-1")
+	if !g.Check("dev-1", 7) {
+		t.Fatalf("frame should be accepted after a reset")
+	}
+}
+
+func TestDispatchFrame_DropsReplayedEncryptedUplink(t *testing.T) {
+	addr := "65C0640D"
+	device := &model.Device{
+		CommonUUID: model.CommonUUID{UUID: "dev-optical"},
+		CommonDevice: model.CommonDevice{
+			Model:       schema.DeviceModelRubixEncrypted,
+			AddressUUID: &addr,
+		},
+	}
+	frame := "65C0640DA98521CC47B800BF4F2E90E4014F5279F207180C56A29EE9604CE987A1BA825351BDEF154126"
+
+	m := &Module{
+		config:      &Config{DefaultKey: testDefaultKey},
+		replayGuard: newReplayGuard("", 32, 0),
+	}
+	dispatch := func() DispatchResult {
+		return m.dispatchFrame(frame, newMockGetDevice(device, addr),
+			func(string, float64, *model.Device, *codec.LoRaDeviceDescription) error { return nil },
+			noopPointErr, noopMetaTags, noopWrittenOK, noopWrittenErr)
+	}
+
+	if !dispatch().OK {
+		t.Fatalf("first reception should decode")
+	}
+	if dispatch().OK {
+		t.Fatalf("re-transmitted frame must be dropped")
+	}
+	if w := m.replayGuard.Get(device.UUID); w == nil || w.Rejected != 1 {
+		t.Fatalf("expected one rejected frame, got %+v", w)
+	}
+}
@@ -2,6 +2,7 @@ package pkg
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 	"strconv"
 	"time"
@@ -9,9 +10,11 @@ import (
 	"github.com/NubeIO/lib-module-go/nhttp"
 	"github.com/NubeIO/lib-module-go/nmodule"
 	"github.com/NubeIO/lib-module-go/router"
+	"github.com/NubeIO/module-core-loraraw/codecs"
 	"github.com/NubeIO/module-core-loraraw/codecs/rubixDataEncoding"
 	"github.com/NubeIO/module-core-loraraw/schema"
 	"github.com/NubeIO/nubeio-rubix-lib-helpers-go/pkg/nils"
+	"github.com/NubeIO/nubeio-rubix-lib-models-go/datatype"
 	"github.com/NubeIO/nubeio-rubix-lib-models-go/dto"
 	"github.com/NubeIO/nubeio-rubix-lib-models-go/model"
 	"github.com/NubeIO/nubeio-rubix-lib-models-go/nargs"
@@ -36,14 +39,51 @@ func InitRouter() {
 	route.Handle(nhttp.POST, "/api/networks", CreateNetwork)
 	route.Handle(nhttp.PATCH, "/api/networks/:uuid", UpdateNetwork)
 	route.Handle(nhttp.DELETE, "/api/networks/:uuid", DeleteNetwork)
+	route.Handle(nhttp.GET, "/api/networks/:uuid/transport", GetNetworkTransport)
+	route.Handle(nhttp.GET, "/api/networks/:uuid/duty-cycle", GetNetworkDutyCycle)
 
 	route.Handle(nhttp.POST, "/api/devices", CreateDevice)
 	route.Handle(nhttp.PATCH, "/api/devices/:uuid", UpdateDevice)
 	route.Handle(nhttp.DELETE, "/api/devices/:uuid", DeleteDevice)
+	route.Handle(nhttp.GET, "/api/devices/:uuid/replay", GetDeviceReplayWindow)
+	route.Handle(nhttp.DELETE, "/api/devices/:uuid/replay", ResetDeviceReplayWindow)
+	route.Handle(nhttp.GET, "/api/devices/:uuid/link", GetDeviceLinkStats)
+	route.Handle(nhttp.DELETE, "/api/devices/:uuid/link", ResetDeviceLinkStats)
+	route.Handle(nhttp.GET, "/api/devices/:uuid/keys", GetDeviceKeys)
+	route.Handle(nhttp.PUT, "/api/devices/:uuid/keys/next", SetDeviceNextKey)
+	route.Handle(nhttp.DELETE, "/api/devices/:uuid/keys/next", ClearDeviceNextKey)
+	route.Handle(nhttp.GET, "/api/keys/audit", GetKeyAudit)
+	route.Handle(nhttp.GET, "/api/devices/:uuid/model", GetDeviceModelSuggestion)
+	route.Handle(nhttp.PUT, "/api/devices/:uuid/model/learning", StartDeviceModelLearning)
+	route.Handle(nhttp.DELETE, "/api/devices/:uuid/model/learning", StopDeviceModelLearning)
+
+	route.Handle(nhttp.GET, "/api/discovered", GetDiscoveredDevices)
+	route.Handle(nhttp.POST, "/api/discovered/:address", ProvisionDiscoveredDevice)
+	route.Handle(nhttp.DELETE, "/api/discovered/:address", DeleteDiscoveredDevice)
+
+	route.Handle(nhttp.GET, "/api/captures", GetCaptureFiles)
+	route.Handle(nhttp.POST, "/api/captures/replay", ReplayCapture)
+
+	route.Handle(nhttp.GET, "/api/mqtt/buffer", GetMQTTBuffer)
+
+	route.Handle(nhttp.GET, "/api/write-queue", GetWriteQueues)
+	route.Handle(nhttp.GET, "/api/write-queue/:uuid", GetDeviceWriteQueue)
+	route.Handle(nhttp.DELETE, "/api/write-queue/:uuid", FlushDeviceWriteQueue)
+	route.Handle(nhttp.POST, "/api/write-queue/:uuid/pause", PauseDeviceWriteQueue)
+	route.Handle(nhttp.POST, "/api/write-queue/:uuid/resume", ResumeDeviceWriteQueue)
+	route.Handle(nhttp.POST, "/api/write-queue/:uuid/retry", RetryDeviceWriteQueue)
+
+	route.Handle(nhttp.GET, "/api/schedules", GetSchedules)
+	route.Handle(nhttp.POST, "/api/schedules", CreateSchedule)
+	route.Handle(nhttp.GET, "/api/schedules/:uuid", GetSchedule)
+	route.Handle(nhttp.PATCH, "/api/schedules/:uuid", UpdateSchedule)
+	route.Handle(nhttp.DELETE, "/api/schedules/:uuid", DeleteSchedule)
+	route.Handle(nhttp.POST, "/api/schedules/:uuid/run", RunSchedule)
 
 	route.Handle(nhttp.POST, "/api/points", CreatePoint)
 	route.Handle(nhttp.PATCH, "/api/points/:uuid", UpdatePoint)
 	route.Handle(nhttp.PATCH, "/api/points/:uuid/write", PointWrite)
+	route.Handle(nhttp.DELETE, "/api/points/:uuid/write", CancelPointWrite)
 	route.Handle(nhttp.DELETE, "/api/points/:uuid", DeletePoint)
 }
 
@@ -57,7 +97,7 @@ func GetNetworkSchema(m *nmodule.Module, r *router.Request) ([]byte, error) {
 }
 
 func GetDeviceSchema(m *nmodule.Module, r *router.Request) ([]byte, error) {
-	return json.Marshal(schema.GetDeviceSchema())
+	return json.Marshal(schema.GetDeviceSchema(codecs.FileModels()...))
 }
 
 func GetPointSchema(m *nmodule.Module, r *router.Request) ([]byte, error) {
@@ -83,24 +123,58 @@ func UpdateNetwork(m *nmodule.Module, r *router.Request) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	if network.TransportType != "" && !validTransportType(network.TransportType) {
+		return nil, errors.New("unsupported transport type " + network.TransportType)
+	}
 	net, err := (*m).(*Module).grpcMarshaller.UpdateNetwork(r.PathParams["uuid"], network)
 	if err != nil {
 		return nil, err
 	}
+	if n := (*m).(*Module).getNetwork(net.UUID); n != nil {
+		// The run loop reconnects with the updated settings.
+		_ = n.closeTransport()
+	}
 	return json.Marshal(net)
 }
 
 func DeleteNetwork(m *nmodule.Module, r *router.Request) ([]byte, error) {
 	err := (*m).(*Module).grpcMarshaller.DeleteNetwork(r.PathParams["uuid"])
+	if err == nil {
+		(*m).(*Module).stopNetwork(r.PathParams["uuid"])
+		(*m).(*Module).removeWriteJournal(r.PathParams["uuid"])
+	}
 	return nil, err
 }
 
+func GetNetworkTransport(m *nmodule.Module, r *router.Request) ([]byte, error) {
+	n := (*m).(*Module).getNetwork(r.PathParams["uuid"])
+	if n == nil {
+		return nil, errors.New("network is not running")
+	}
+	transport := n.getTransport()
+	if transport == nil {
+		return json.Marshal(TransportHealth{Connected: false})
+	}
+	return json.Marshal(transport.Health())
+}
+
+func GetNetworkDutyCycle(m *nmodule.Module, r *router.Request) ([]byte, error) {
+	n := (*m).(*Module).getNetwork(r.PathParams["uuid"])
+	if n == nil {
+		return nil, errors.New("network is not running")
+	}
+	return json.Marshal(n.dutyCycleStats())
+}
+
 func CreateDevice(m *nmodule.Module, r *router.Request) ([]byte, error) {
 	var device *model.Device
 	err := json.Unmarshal(r.Body, &device)
 	if err != nil {
 		return nil, err
 	}
+	if err = (*m).(*Module).prepareDeviceKey("", device); err != nil {
+		return nil, err
+	}
 	v := r.QueryParams.Get(nargs.WithPoints)
 	dev, err := (*m).(*Module).addDevice(device, v == "true")
 	if err != nil {
@@ -110,7 +184,8 @@ func CreateDevice(m *nmodule.Module, r *router.Request) ([]byte, error) {
 	if device.Model == schema.DeviceModelUART { // Ping at address 4
 		enqueueUartPing(m, dev)
 	}
-	return json.Marshal(dev)
+	(*m).(*Module).refreshHADiscovery()
+	return json.Marshal((*m).(*Module).redactDevice(dev))
 }
 
 func UpdateDevice(m *nmodule.Module, r *router.Request) ([]byte, error) {
@@ -119,6 +194,9 @@ func UpdateDevice(m *nmodule.Module, r *router.Request) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err = (*m).(*Module).prepareDeviceKey(r.PathParams["uuid"], device); err != nil {
+		return nil, err
+	}
 	dev, err := (*m).(*Module).grpcMarshaller.UpdateDevice(r.PathParams["uuid"], device)
 	if err != nil {
 		return nil, err
@@ -129,15 +207,332 @@ func UpdateDevice(m *nmodule.Module, r *router.Request) ([]byte, error) {
 	if device.Model == schema.DeviceModelUART { // Ping at address 4
 		enqueueUartPing(m, dev)
 	}
+	(*m).(*Module).refreshHADiscovery()
 
-	return json.Marshal(dev)
+	return json.Marshal((*m).(*Module).redactDevice(dev))
 }
 
 func DeleteDevice(m *nmodule.Module, r *router.Request) ([]byte, error) {
 	err := (*m).(*Module).grpcMarshaller.DeleteDevice(r.PathParams["uuid"])
+	if err == nil && (*m).(*Module).replayGuard != nil {
+		(*m).(*Module).replayGuard.Reset(r.PathParams["uuid"])
+	}
+	if err == nil && (*m).(*Module).linkTracker != nil {
+		(*m).(*Module).linkTracker.Reset(r.PathParams["uuid"])
+	}
+	if err == nil && (*m).(*Module).keyRing != nil {
+		(*m).(*Module).keyRing.forget(r.PathParams["uuid"])
+	}
+	if err == nil && (*m).(*Module).offlineWatchdog != nil {
+		(*m).(*Module).offlineWatchdog.Forget(r.PathParams["uuid"])
+	}
+	if err == nil && (*m).(*Module).downlinkScheduler != nil {
+		(*m).(*Module).downlinkScheduler.Forget(r.PathParams["uuid"])
+	}
+	if err == nil && (*m).(*Module).modelDetector != nil {
+		(*m).(*Module).modelDetector.Forget(r.PathParams["uuid"])
+	}
+	if err == nil {
+		(*m).(*Module).refreshHADiscovery()
+	}
 	return nil, err
 }
 
+func GetDeviceReplayWindow(m *nmodule.Module, r *router.Request) ([]byte, error) {
+	guard := (*m).(*Module).replayGuard
+	if guard == nil {
+		return nil, errors.New("replay protection is disabled")
+	}
+	return json.Marshal(guard.Get(r.PathParams["uuid"]))
+}
+
+func ResetDeviceReplayWindow(m *nmodule.Module, r *router.Request) ([]byte, error) {
+	guard := (*m).(*Module).replayGuard
+	if guard == nil {
+		return nil, errors.New("replay protection is disabled")
+	}
+	guard.Reset(r.PathParams["uuid"])
+	return nil, nil
+}
+
+func GetDeviceLinkStats(m *nmodule.Module, r *router.Request) ([]byte, error) {
+	tracker := (*m).(*Module).linkTracker
+	if tracker == nil {
+		return nil, errors.New("module is not enabled")
+	}
+	return json.Marshal(tracker.Get(r.PathParams["uuid"]))
+}
+
+func ResetDeviceLinkStats(m *nmodule.Module, r *router.Request) ([]byte, error) {
+	tracker := (*m).(*Module).linkTracker
+	if tracker == nil {
+		return nil, errors.New("module is not enabled")
+	}
+	tracker.Reset(r.PathParams["uuid"])
+	return nil, nil
+}
+
+// NextKeyBody is the body of PUT /api/devices/:uuid/keys/next.
+type NextKeyBody struct {
+	Key string `json:"key"`
+}
+
+func GetDeviceKeys(m *nmodule.Module, r *router.Request) ([]byte, error) {
+	status, err := (*m).(*Module).keyStatus(r.PathParams["uuid"])
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(status)
+}
+
+func SetDeviceNextKey(m *nmodule.Module, r *router.Request) ([]byte, error) {
+	var body NextKeyBody
+	if err := json.Unmarshal(r.Body, &body); err != nil {
+		return nil, err
+	}
+	if err := (*m).(*Module).setNextKey(r.PathParams["uuid"], body.Key); err != nil {
+		return nil, err
+	}
+	return GetDeviceKeys(m, r)
+}
+
+func ClearDeviceNextKey(m *nmodule.Module, r *router.Request) ([]byte, error) {
+	ring := (*m).(*Module).keyRing
+	if ring == nil {
+		return nil, errors.New("module is not enabled")
+	}
+	ring.clearNext(r.PathParams["uuid"])
+	return nil, nil
+}
+
+func GetKeyAudit(m *nmodule.Module, r *router.Request) ([]byte, error) {
+	ring := (*m).(*Module).keyRing
+	if ring == nil {
+		return nil, errors.New("module is not enabled")
+	}
+	return json.Marshal(ring.audit.list(r.QueryParams.Get("device_uuid")))
+}
+
+func GetDeviceModelSuggestion(m *nmodule.Module, r *router.Request) ([]byte, error) {
+	device, err := (*m).(*Module).getDevice(r.PathParams["uuid"])
+	if err != nil {
+		return nil, err
+	}
+	suggestion, err := (*m).(*Module).suggestModel(device)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(suggestion)
+}
+
+func StartDeviceModelLearning(m *nmodule.Module, r *router.Request) ([]byte, error) {
+	detector := (*m).(*Module).modelDetector
+	if detector == nil {
+		return nil, errors.New("module is not enabled")
+	}
+	detector.SetLearning(r.PathParams["uuid"], true)
+	return GetDeviceModelSuggestion(m, r)
+}
+
+func StopDeviceModelLearning(m *nmodule.Module, r *router.Request) ([]byte, error) {
+	detector := (*m).(*Module).modelDetector
+	if detector == nil {
+		return nil, errors.New("module is not enabled")
+	}
+	detector.SetLearning(r.PathParams["uuid"], false)
+	return nil, nil
+}
+
+func GetDiscoveredDevices(m *nmodule.Module, r *router.Request) ([]byte, error) {
+	inbox := (*m).(*Module).discovery
+	if inbox == nil {
+		return nil, errors.New("module is not enabled")
+	}
+	return json.Marshal(inbox.List())
+}
+
+func ProvisionDiscoveredDevice(m *nmodule.Module, r *router.Request) ([]byte, error) {
+	body := &ProvisionBody{}
+	if len(r.Body) > 0 {
+		if err := json.Unmarshal(r.Body, body); err != nil {
+			return nil, err
+		}
+	}
+	dev, err := (*m).(*Module).provisionDevice(r.PathParams["address"], body)
+	if err != nil {
+		return nil, err
+	}
+
+	if dev.Model == schema.DeviceModelUART { // Ping at address 4
+		enqueueUartPing(m, dev)
+	}
+	(*m).(*Module).refreshHADiscovery()
+	return json.Marshal((*m).(*Module).redactDevice(dev))
+}
+
+func DeleteDiscoveredDevice(m *nmodule.Module, r *router.Request) ([]byte, error) {
+	inbox := (*m).(*Module).discovery
+	if inbox == nil {
+		return nil, errors.New("module is not enabled")
+	}
+	inbox.Forget(r.PathParams["address"])
+	return nil, nil
+}
+
+func GetCaptureFiles(m *nmodule.Module, r *router.Request) ([]byte, error) {
+	files, err := (*m).(*Module).listCaptureFiles()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(files)
+}
+
+func ReplayCapture(m *nmodule.Module, r *router.Request) ([]byte, error) {
+	req := &ReplayRequest{}
+	if len(r.Body) > 0 {
+		if err := json.Unmarshal(r.Body, req); err != nil {
+			return nil, err
+		}
+	}
+	frames, err := (*m).(*Module).replayCaptureRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(frames)
+}
+
+func GetMQTTBuffer(m *nmodule.Module, r *router.Request) ([]byte, error) {
+	return json.Marshal((*m).(*Module).mqttClient.BufferStats())
+}
+
+func GetWriteQueues(m *nmodule.Module, r *router.Request) ([]byte, error) {
+	return json.Marshal((*m).(*Module).writeQueues())
+}
+
+func GetDeviceWriteQueue(m *nmodule.Module, r *router.Request) ([]byte, error) {
+	manager, err := (*m).(*Module).deviceWriteQueue(r.PathParams["uuid"])
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(manager.QueueStatus(r.PathParams["uuid"]))
+}
+
+func FlushDeviceWriteQueue(m *nmodule.Module, r *router.Request) ([]byte, error) {
+	manager, err := (*m).(*Module).deviceWriteQueue(r.PathParams["uuid"])
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(map[string]int{"flushed": manager.Flush(r.PathParams["uuid"])})
+}
+
+func PauseDeviceWriteQueue(m *nmodule.Module, r *router.Request) ([]byte, error) {
+	return setDeviceWriteQueuePaused(m, r.PathParams["uuid"], true)
+}
+
+func ResumeDeviceWriteQueue(m *nmodule.Module, r *router.Request) ([]byte, error) {
+	return setDeviceWriteQueuePaused(m, r.PathParams["uuid"], false)
+}
+
+func setDeviceWriteQueuePaused(m *nmodule.Module, deviceUUID string, paused bool) ([]byte, error) {
+	manager, err := (*m).(*Module).deviceWriteQueue(deviceUUID)
+	if err != nil {
+		return nil, err
+	}
+	manager.Pause(deviceUUID, paused)
+	return json.Marshal(manager.QueueStatus(deviceUUID))
+}
+
+func RetryDeviceWriteQueue(m *nmodule.Module, r *router.Request) ([]byte, error) {
+	manager, err := (*m).(*Module).deviceWriteQueue(r.PathParams["uuid"])
+	if err != nil {
+		return nil, err
+	}
+	if err = manager.RetryNow(r.PathParams["uuid"]); err != nil {
+		return nil, err
+	}
+	return json.Marshal(manager.QueueStatus(r.PathParams["uuid"]))
+}
+
+func GetSchedules(m *nmodule.Module, r *router.Request) ([]byte, error) {
+	scheduler := (*m).(*Module).downlinkScheduler
+	if scheduler == nil {
+		return nil, errors.New("module is not enabled")
+	}
+	return json.Marshal(scheduler.List(r.QueryParams.Get("device_uuid")))
+}
+
+func GetSchedule(m *nmodule.Module, r *router.Request) ([]byte, error) {
+	scheduler := (*m).(*Module).downlinkScheduler
+	if scheduler == nil {
+		return nil, errors.New("module is not enabled")
+	}
+	s, ok := scheduler.Get(r.PathParams["uuid"])
+	if !ok {
+		return nil, errors.New("schedule not found")
+	}
+	return json.Marshal(s)
+}
+
+func CreateSchedule(m *nmodule.Module, r *router.Request) ([]byte, error) {
+	var body DownlinkSchedule
+	if err := json.Unmarshal(r.Body, &body); err != nil {
+		return nil, err
+	}
+	body.UUID = ""
+	s, err := (*m).(*Module).putSchedule(body)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(s)
+}
+
+// UpdateSchedule patches the fields given in the body.
+func UpdateSchedule(m *nmodule.Module, r *router.Request) ([]byte, error) {
+	scheduler := (*m).(*Module).downlinkScheduler
+	if scheduler == nil {
+		return nil, errors.New("module is not enabled")
+	}
+	body, ok := scheduler.Get(r.PathParams["uuid"])
+	if !ok {
+		return nil, errors.New("schedule not found")
+	}
+	if err := json.Unmarshal(r.Body, &body); err != nil {
+		return nil, err
+	}
+	body.UUID = r.PathParams["uuid"]
+	s, err := (*m).(*Module).putSchedule(body)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(s)
+}
+
+func DeleteSchedule(m *nmodule.Module, r *router.Request) ([]byte, error) {
+	scheduler := (*m).(*Module).downlinkScheduler
+	if scheduler == nil {
+		return nil, errors.New("module is not enabled")
+	}
+	if !scheduler.Delete(r.PathParams["uuid"]) {
+		return nil, errors.New("schedule not found")
+	}
+	return nil, nil
+}
+
+// RunSchedule queues a run of the schedule now, whether it is enabled or not.
+// Its next run stays as planned.
+func RunSchedule(m *nmodule.Module, r *router.Request) ([]byte, error) {
+	scheduler := (*m).(*Module).downlinkScheduler
+	if scheduler == nil {
+		return nil, errors.New("module is not enabled")
+	}
+	s, ok := scheduler.Get(r.PathParams["uuid"])
+	if !ok {
+		return nil, errors.New("schedule not found")
+	}
+	(*m).(*Module).runSchedule(scheduler, s, time.Now())
+	return GetSchedule(m, r)
+}
+
 func CreatePoint(m *nmodule.Module, r *router.Request) ([]byte, error) {
 	var point *model.Point
 	err := json.Unmarshal(r.Body, &point)
@@ -148,6 +543,7 @@ func CreatePoint(m *nmodule.Module, r *router.Request) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	(*m).(*Module).refreshHADiscovery()
 	return json.Marshal(pnt)
 }
 
@@ -161,6 +557,7 @@ func UpdatePoint(m *nmodule.Module, r *router.Request) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	(*m).(*Module).refreshHADiscovery()
 	return json.Marshal(pnt)
 }
 
@@ -171,18 +568,42 @@ func PointWrite(m *nmodule.Module, r *router.Request) ([]byte, error) {
 		return nil, err
 	}
 
+	priority := datatype.PollPriority(r.QueryParams.Get("priority"))
+	if err = priority.Validate(); err != nil {
+		return nil, err
+	}
+
 	point, err := (*m).(*Module).writePoint(r.PathParams["uuid"], pw)
 	if err != nil {
 		return nil, err
 	}
+	if priority != "" { // only for this write, the point keeps its own
+		point.PollPriority = priority
+	}
 
-	(*m).(*Module).pointWriteQueueManager.EnqueuePoint(point)
+	if err = (*m).(*Module).enqueuePoint(point); err != nil {
+		return nil, err
+	}
 
 	return json.Marshal(point)
 }
 
+func CancelPointWrite(m *nmodule.Module, r *router.Request) ([]byte, error) {
+	cancelled, err := (*m).(*Module).cancelPointWrite(r.PathParams["uuid"])
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(map[string]int{"cancelled": cancelled})
+}
+
 func DeletePoint(m *nmodule.Module, r *router.Request) ([]byte, error) {
 	err := (*m).(*Module).grpcMarshaller.DeletePoint(r.PathParams["uuid"])
+	if err == nil {
+		(*m).(*Module).refreshHADiscovery()
+	}
+	if err == nil && (*m).(*Module).downlinkScheduler != nil {
+		(*m).(*Module).downlinkScheduler.Forget(r.PathParams["uuid"])
+	}
 	return nil, err
 }
 
@@ -208,7 +629,9 @@ func enqueueUartPingWithRetry(m *nmodule.Module, device *model.Device) {
 			AddressUUID: device.AddressUUID,
 			WriteValue:  nils.NewFloat64(1),
 		}
-		module.pointWriteQueueManager.EnqueuePoint(point)
+		if err := module.enqueuePointOnNetwork(device.NetworkUUID, point, ""); err != nil {
+			log.Errorf("enqueueUartPing error on attempt %d: %s", attempt, err.Error())
+		}
 
 		// Wait for the poll interval before checking
 		time.Sleep(uartPingRetryInterval)
@@ -7,54 +7,69 @@ import (
 	"time"
 )
 
-// LoRa plugin loop
-func (m *Module) run() {
-	defer m.SerialClose()
+// LoRa network loop
+func (n *loRaNetwork) run() {
+	m := n.module
+	defer n.closeTransport()
 
 	for {
-		sc, err := m.SerialOpen()
+		transport, err := n.openTransport()
 		select {
-		case <-m.interruptChan:
-			log.Info("interrupt received on run")
+		case <-n.interruptChan:
+			log.Infof("interrupt received on run of network %s", n.uuid)
 			return
 		default:
 			if err != nil {
-				errMsg := fmt.Sprintf("error opening serial: %v", err.Error())
+				errMsg := fmt.Sprintf("error opening transport: %v", err.Error())
 				log.Error(errMsg)
-				_ = m.grpcMarshaller.UpdateNetworkFault(m.networkUUID, &model.CommonFault{
+				_ = m.grpcMarshaller.UpdateNetworkFault(n.uuid, &model.CommonFault{
 					InFault: true,
 					Message: errMsg,
 				})
-				time.Sleep(m.config.ReIterationTime)
+				n.sleep(m.config.ReIterationTime)
 				continue
 			} else {
-				_ = m.grpcMarshaller.UpdateNetworkFault(m.networkUUID, &model.CommonFault{
+				_ = m.grpcMarshaller.UpdateNetworkFault(n.uuid, &model.CommonFault{
 					InFault: false,
 					Message: "",
 				})
 			}
 		}
-		serialPayloadChan := make(chan string, 1)
-		serialCloseChan := make(chan error, 1)
-		go sc.Loop(serialPayloadChan, serialCloseChan)
+		payloadChan := make(chan string, 1)
+		closeChan := make(chan error, 1)
+		go func() { closeChan <- transport.ReadLines(payloadChan) }()
 
+	read:
 		for {
 			select {
-			case <-m.interruptChan:
-				log.Info("interrupt received on run")
+			case <-n.interruptChan:
+				log.Infof("interrupt received on run of network %s", n.uuid)
 				return
-			case err := <-serialCloseChan:
-				errMsg := fmt.Sprintf("serial connection error: %v", err.Error())
+			case err := <-closeChan:
+				errMsg := fmt.Sprintf("connection error: %v", err)
 				log.Error(errMsg)
-				_ = m.grpcMarshaller.UpdateNetworkFault(m.networkUUID, &model.CommonFault{
+				_ = m.grpcMarshaller.UpdateNetworkFault(n.uuid, &model.CommonFault{
 					InFault: true,
 					Message: errMsg,
 				})
-				log.Info("serial connection attempting to reconnect...")
-				continue
-			case data := <-serialPayloadChan:
-				m.handleSerialPayload(data)
+				log.Info("connection attempting to reconnect...")
+				n.sleep(m.config.ReIterationTime)
+				break read
+			case data, ok := <-payloadChan:
+				if !ok { // the reader is done, closeChan says why
+					payloadChan = nil
+					continue
+				}
+				m.handleSerialPayload(n.uuid, data)
 			}
 		}
 	}
 }
+
+// sleep waits for d or until the network is stopped.
+func (n *loRaNetwork) sleep(d time.Duration) {
+	select {
+	case <-n.interruptChan:
+	case <-time.After(d):
+	}
+}
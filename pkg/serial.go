@@ -1,12 +1,9 @@
 package pkg
 
 import (
-	"bufio"
 	"errors"
 	"fmt"
-	"time"
 
-	"github.com/NubeIO/nubeio-rubix-lib-models-go/model"
 	log "github.com/sirupsen/logrus"
 	"go.bug.st/serial"
 )
@@ -20,76 +17,64 @@ type SerialSetting struct {
 	DataBits       int
 	Timeout        int
 	ActivePortList []string
+	Port           serial.Port
 	Connected      bool
 	Error          bool
-}
-
-var Port serial.Port
 
-func (m *Module) SerialOpen() (*SerialSetting, error) {
-	s := &SerialSetting{}
-	networks, err := m.grpcMarshaller.GetNetworksByPluginName(m.moduleName)
-	if err != nil {
-		return nil, err
-	}
-	totalNetworks := len(networks)
-	if totalNetworks == 0 {
-		return nil, errors.New(fmt.Sprintf("we don't have network of module %s", m.moduleName))
-	} else if totalNetworks > 1 {
-		return nil, errors.New(fmt.Sprintf("we have %d networks of module %s", totalNetworks, m.moduleName))
-	}
-	net := networks[0]
-	m.networkUUID = net.UUID
-	if net.SerialPort == nil || net.SerialBaudRate == nil {
-		return s, errors.New("lora-serial: serial_port & serial_baud_rate required to open")
-	}
-	s.SerialPort = *net.SerialPort
-	s.BaudRate = int(*net.SerialBaudRate)
+	linkStats
+	closed chan struct{}
+}
 
-	_, err = s.open()
+func (s *SerialSetting) Open() error {
+	s.closed = make(chan struct{})
+	_, err := s.open()
 	if err != nil {
-		_ = m.grpcMarshaller.UpdateNetworkFault(net.UUID, &model.CommonFault{
-			InFault: true,
-			Message: fmt.Sprintf("port: %s, message: %s", s.SerialPort, err.Error()),
-		})
-	} else {
-		_ = m.grpcMarshaller.UpdateNetworkFault(net.UUID, &model.CommonFault{
-			InFault: false,
-			Message: "",
-		})
+		s.fail(err)
+		return fmt.Errorf("port: %s, message: %s", s.SerialPort, err.Error())
 	}
-	return s, err
+	return nil
 }
 
-func (m *Module) SerialClose() error {
-	return disconnect()
+func (s *SerialSetting) ReadLines(lines chan<- string) error {
+	if s.Port == nil {
+		return errors.New("serial port not connected")
+	}
+	err := readLines(s.Port, lines, s.closed, s.rx)
+	s.fail(err)
+	return err
 }
 
-func (m *Module) WriteToLoRaRaw(data []byte) error {
-	m.initWriteQueue() // Make sure the queue is initialized
-
-	if Port == nil {
+func (s *SerialSetting) Write(data []byte) error {
+	if s.Port == nil {
 		return errors.New("serial port not connected")
 	}
-	queue := m.getWriteQueue()
-	if queue == nil {
-		return errors.New("write queue stopped")
-	}
+	_, err := s.Port.Write(data)
+	s.tx(err)
+	return err
+}
 
-	select {
-	case queue <- data:
+func (s *SerialSetting) Close() error {
+	if s.closed != nil {
+		select {
+		case <-s.closed:
+		default:
+			close(s.closed)
+		}
+	}
+	if s.Port == nil || !s.Connected {
 		return nil
-	case <-time.After(1 * time.Second):
-		return errors.New("write queue full, timeout after 1 second")
 	}
+	s.Connected = false
+	err := s.Port.Close()
+	if err != nil {
+		log.Error("err on trying to close the port")
+		return err
+	}
+	return nil
 }
 
-func (s *SerialSetting) Loop(plChan chan<- string, errChan chan<- error) {
-	scanner := bufio.NewScanner(Port)
-	for scanner.Scan() {
-		plChan <- scanner.Text()
-	}
-	errChan <- scanner.Err()
+func (s *SerialSetting) Health() TransportHealth {
+	return s.health(TransportSerial, s.SerialPort, s.Connected)
 }
 
 func (s *SerialSetting) open() (connected bool, err error) {
@@ -100,7 +85,7 @@ func (s *SerialSetting) open() (connected bool, err error) {
 	dataBits := s.DataBits
 	if s.Connected {
 		log.Info("existing serial port connection by this app is open, so close the existing connection")
-		err := disconnect()
+		err := s.Port.Close()
 		if err != nil {
 			log.Info(err)
 			s.Error = true
@@ -123,19 +108,8 @@ func (s *SerialSetting) open() (connected bool, err error) {
 		s.Error = true
 		return false, err
 	}
-	Port = port
+	s.Port = port
 	s.Connected = true
 	log.Infof("connected to serial port: %s connected: %t", portName, s.Connected)
 	return s.Connected, nil
 }
-
-func disconnect() error {
-	if Port != nil {
-		err := Port.Close()
-		if err != nil {
-			log.Error("err on trying to close the port")
-			return err
-		}
-	}
-	return nil
-}
@@ -0,0 +1,70 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// resolveDataDir asks the host for this module's data directory. State files
+// (replay windows etc.) live there so they survive plugin restarts. An empty
+// result means state is kept in memory only.
+func (m *Module) resolveDataDir() string {
+	if m.grpcMarshaller == nil {
+		return ""
+	}
+	dir, err := m.grpcMarshaller.CreateModuleDir(m.moduleName)
+	if err != nil || dir == nil || *dir == "" {
+		log.Warnf("module data dir unavailable, state will not persist across restarts: %v", err)
+		return ""
+	}
+	return *dir
+}
+
+// statePath returns the path of a state file in the module data dir, or ""
+// when there is no data dir.
+func (m *Module) statePath(name string) string {
+	if m.dataDir == "" {
+		return ""
+	}
+	return filepath.Join(m.dataDir, name)
+}
+
+// loadState reads JSON from path into v. A missing file (or an empty path) is
+// not an error: v is left untouched.
+func loadState(path string, v interface{}) error {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// saveState writes v as JSON to path via a temp file and rename, so a crash
+// mid-write never leaves a truncated file behind. An empty path is a no-op.
+func saveState(path string, v interface{}) error {
+	if path == "" {
+		return nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,536 @@
+package pkg
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NubeIO/nubeio-rubix-lib-models-go/model"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	TransportSerial    = "serial"
+	TransportTCPClient = "tcp-client"
+	TransportTCPServer = "tcp-server"
+	TransportUDP       = "udp"
+)
+
+var transportTypes = []string{TransportSerial, TransportTCPClient, TransportTCPServer, TransportUDP}
+
+const transportDialTimeout = 10 * time.Second
+
+// Transport is where a network's frames come from and go to. The wire format
+// is the radio's serial protocol whatever the transport: uplinks arrive as
+// newline terminated hex lines, downlinks are written as raw frame bytes. A
+// remote radio bridge (ser2net, socat, a gateway app) forwards that stream
+// as-is over TCP or UDP.
+type Transport interface {
+	// Open connects (or starts listening). It is called again by the run
+	// loop after ReadLines returns.
+	Open() error
+	// ReadLines delivers every received line to lines and blocks until the
+	// connection is lost or closed, returning why. It may close lines when
+	// it returns.
+	ReadLines(lines chan<- string) error
+	Write(data []byte) error
+	Close() error
+	Health() TransportHealth
+}
+
+// TransportHealth is what a transport reports about its link.
+type TransportHealth struct {
+	Type      string    `json:"type"`
+	Address   string    `json:"address"`
+	Connected bool      `json:"connected"`
+	Peer      string    `json:"peer,omitempty"`
+	LastRx    time.Time `json:"last_rx,omitempty"`
+	LastTx    time.Time `json:"last_tx,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+func validTransportType(transportType string) bool {
+	for _, t := range transportTypes {
+		if t == transportType {
+			return true
+		}
+	}
+	return false
+}
+
+// newTransport builds the transport configured on the network. An empty
+// transport type is a serial radio, as networks created before TCP/UDP
+// support have no other.
+func newTransport(network *model.Network) (Transport, error) {
+	switch network.TransportType {
+	case "", TransportSerial:
+		if network.SerialPort == nil || network.SerialBaudRate == nil {
+			return nil, errors.New("lora-serial: serial_port & serial_baud_rate required to open")
+		}
+		return &SerialSetting{
+			SerialPort: *network.SerialPort,
+			BaudRate:   int(*network.SerialBaudRate),
+		}, nil
+	case TransportTCPClient, TransportTCPServer, TransportUDP:
+		if network.Port == nil || *network.Port <= 0 {
+			return nil, fmt.Errorf("lora-%s: port required to open", network.TransportType)
+		}
+		if network.TransportType == TransportTCPClient && network.IP == "" {
+			return nil, errors.New("lora-tcp-client: ip required to open")
+		}
+		address := net.JoinHostPort(network.IP, strconv.Itoa(*network.Port))
+		var bridge *bridgePeer
+		if network.Host != nil && *network.Host != "" && network.TransportType != TransportTCPClient {
+			var err error
+			if bridge, err = parseBridgePeer(*network.Host); err != nil {
+				return nil, fmt.Errorf("lora-%s: %s", network.TransportType, err)
+			}
+		}
+		if network.TransportType == TransportUDP {
+			return newUDPTransport(address, bridge), nil
+		}
+		return newTCPTransport(network.TransportType, address, bridge), nil
+	default:
+		return nil, fmt.Errorf("unsupported transport type %q, must be one of %s", network.TransportType, strings.Join(transportTypes, ", "))
+	}
+}
+
+// bridgePeer is the only radio bridge a tcp-server or udp transport takes
+// frames from and sends downlinks to: the network's host, an IP with an
+// optional port.
+type bridgePeer struct {
+	ip   net.IP
+	port int // 0: any
+}
+
+func parseBridgePeer(host string) (*bridgePeer, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return &bridgePeer{ip: ip}, nil
+	}
+	h, p, err := net.SplitHostPort(host)
+	if err != nil {
+		return nil, fmt.Errorf("invalid radio bridge host %q: want an IP or IP:port", host)
+	}
+	ip := net.ParseIP(h)
+	port, err := strconv.Atoi(p)
+	if ip == nil || err != nil || port <= 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid radio bridge host %q: want an IP or IP:port", host)
+	}
+	return &bridgePeer{ip: ip, port: port}, nil
+}
+
+func (b *bridgePeer) matches(ip net.IP, port int) bool {
+	return b.ip.Equal(ip) && (b.port == 0 || b.port == port)
+}
+
+// linkStats is the bookkeeping shared by the network transports.
+type linkStats struct {
+	mutex     sync.Mutex
+	peer      string
+	lastRx    time.Time
+	lastTx    time.Time
+	lastError string
+}
+
+func (l *linkStats) rx() {
+	l.mutex.Lock()
+	l.lastRx = time.Now()
+	l.mutex.Unlock()
+}
+
+func (l *linkStats) tx(err error) {
+	l.mutex.Lock()
+	if err != nil {
+		l.lastError = err.Error()
+	} else {
+		l.lastTx = time.Now()
+	}
+	l.mutex.Unlock()
+}
+
+func (l *linkStats) fail(err error) {
+	if err == nil {
+		return
+	}
+	l.mutex.Lock()
+	l.lastError = err.Error()
+	l.mutex.Unlock()
+}
+
+func (l *linkStats) health(transportType, address string, connected bool) TransportHealth {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return TransportHealth{
+		Type:      transportType,
+		Address:   address,
+		Connected: connected,
+		Peer:      l.peer,
+		LastRx:    l.lastRx,
+		LastTx:    l.lastTx,
+		LastError: l.lastError,
+	}
+}
+
+// readLines scans newline terminated lines from r until it fails or done is
+// closed. Blank lines and surrounding whitespace (\r from bridges that send
+// CRLF) are dropped.
+func readLines(r io.Reader, lines chan<- string, done <-chan struct{}, onLine func()) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if onLine != nil {
+			onLine()
+		}
+		select {
+		case lines <- line:
+		case <-done:
+			return errors.New("transport closed")
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+// tcpTransport is a TCP stream to a radio bridge: either dialled out to the
+// bridge (tcp-client) or accepted from it (tcp-server). As a server only one
+// bridge connection is served at a time. With a bridge host configured only
+// it may connect, and its new connection replaces the old, so it is not
+// locked out by its own half-open socket after a network blip. Without one
+// the first bridge keeps the link and others are turned away until it
+// disconnects (keep-alives end a half-open socket).
+type tcpTransport struct {
+	linkStats
+	transportType string
+	address       string
+	bridge        *bridgePeer
+
+	connMutex sync.Mutex
+	conn      net.Conn
+	listener  net.Listener
+	accepted  chan net.Conn
+	closed    chan struct{}
+}
+
+func newTCPTransport(transportType, address string, bridge *bridgePeer) *tcpTransport {
+	return &tcpTransport{transportType: transportType, address: address, bridge: bridge}
+}
+
+func (t *tcpTransport) Open() error {
+	t.connMutex.Lock()
+	defer t.connMutex.Unlock()
+
+	t.closed = make(chan struct{})
+	if t.transportType == TransportTCPClient {
+		conn, err := net.DialTimeout("tcp", t.address, transportDialTimeout)
+		if err != nil {
+			t.fail(err)
+			return err
+		}
+		t.setConn(conn)
+		log.Infof("connected to radio bridge %s", t.address)
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", t.address)
+	if err != nil {
+		t.fail(err)
+		return err
+	}
+	t.listener = listener
+	t.accepted = make(chan net.Conn)
+	go t.accept(listener, t.accepted, t.closed)
+	log.Infof("listening for radio bridge on %s", listener.Addr())
+	return nil
+}
+
+func (t *tcpTransport) accept(listener net.Listener, accepted chan<- net.Conn, closed <-chan struct{}) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		select {
+		case accepted <- conn:
+		case <-closed:
+			_ = conn.Close()
+			return
+		}
+	}
+}
+
+// admit reports whether an accepted connection may become the bridge
+// connection. It must be called with connMutex held.
+func (t *tcpTransport) admit(conn net.Conn) error {
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return errors.New("not a TCP peer")
+	}
+	if t.bridge != nil {
+		if !t.bridge.matches(addr.IP, addr.Port) {
+			return errors.New("not the configured radio bridge")
+		}
+		return nil
+	}
+	if t.conn != nil {
+		return fmt.Errorf("radio bridge %s is connected already", t.conn.RemoteAddr())
+	}
+	return nil
+}
+
+// setConn must be called with connMutex held.
+func (t *tcpTransport) setConn(conn net.Conn) {
+	if t.conn != nil {
+		_ = t.conn.Close()
+	}
+	t.conn = conn
+	t.mutex.Lock()
+	t.peer = conn.RemoteAddr().String()
+	t.mutex.Unlock()
+}
+
+func (t *tcpTransport) ReadLines(lines chan<- string) error {
+	if t.transportType == TransportTCPClient {
+		t.connMutex.Lock()
+		conn, closed := t.conn, t.closed
+		t.connMutex.Unlock()
+		if conn == nil {
+			return errors.New("not connected")
+		}
+		err := readLines(conn, lines, closed, t.rx)
+		t.fail(err)
+		return err
+	}
+
+	t.connMutex.Lock()
+	accepted, closed := t.accepted, t.closed
+	t.connMutex.Unlock()
+	if accepted == nil {
+		return errors.New("not listening")
+	}
+	// Serve one bridge at a time; a replaced connection's reader ends.
+	readErr := make(chan error, 1)
+	for {
+		select {
+		case conn := <-accepted:
+			t.connMutex.Lock()
+			err := t.admit(conn)
+			if err == nil {
+				t.setConn(conn)
+			}
+			t.connMutex.Unlock()
+			if err != nil {
+				log.Warnf("radio bridge on %s: refused connection from %s: %s", t.address, conn.RemoteAddr(), err)
+				_ = conn.Close()
+				continue
+			}
+			log.Infof("radio bridge connected from %s", conn.RemoteAddr())
+			go func() {
+				err := readLines(conn, lines, closed, t.rx)
+				t.connMutex.Lock()
+				current := t.conn == conn
+				if current {
+					t.conn = nil
+				}
+				t.connMutex.Unlock()
+				if current {
+					readErr <- err
+				}
+			}()
+		case err := <-readErr:
+			// The bridge went away; keep listening for it to come back.
+			log.Warnf("radio bridge on %s disconnected: %v", t.address, err)
+			t.fail(err)
+		case <-closed:
+			return errors.New("transport closed")
+		}
+	}
+}
+
+func (t *tcpTransport) Write(data []byte) error {
+	t.connMutex.Lock()
+	conn := t.conn
+	t.connMutex.Unlock()
+	if conn == nil {
+		return errors.New("no radio bridge connected")
+	}
+	_, err := conn.Write(data)
+	t.tx(err)
+	return err
+}
+
+func (t *tcpTransport) Close() error {
+	t.connMutex.Lock()
+	defer t.connMutex.Unlock()
+
+	if t.closed != nil {
+		select {
+		case <-t.closed:
+		default:
+			close(t.closed)
+		}
+	}
+	if t.listener != nil {
+		_ = t.listener.Close()
+		t.listener = nil
+	}
+	if t.conn != nil {
+		err := t.conn.Close()
+		t.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (t *tcpTransport) Health() TransportHealth {
+	t.connMutex.Lock()
+	connected := t.conn != nil
+	t.connMutex.Unlock()
+	return t.health(t.transportType, t.address, connected)
+}
+
+// udpTransport listens on a local UDP port. Every datagram holds one or more
+// hex lines; downlinks are sent back to the bridge's last datagram, so the
+// bridge needs no configuration of its own to be reachable. The bridge is the
+// configured bridge host or else the first sender since Open; datagrams from
+// other hosts are dropped. A bridge host with a port is sent downlinks before
+// it sent anything.
+type udpTransport struct {
+	linkStats
+	address string
+	bridge  *bridgePeer
+
+	connMutex sync.Mutex
+	conn      *net.UDPConn
+	peerAddr  *net.UDPAddr
+	closed    chan struct{}
+}
+
+func newUDPTransport(address string, bridge *bridgePeer) *udpTransport {
+	return &udpTransport{address: address, bridge: bridge}
+}
+
+func (u *udpTransport) Open() error {
+	addr, err := net.ResolveUDPAddr("udp", u.address)
+	if err != nil {
+		u.fail(err)
+		return err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		u.fail(err)
+		return err
+	}
+	u.connMutex.Lock()
+	u.conn = conn
+	u.peerAddr = nil
+	if u.bridge != nil && u.bridge.port != 0 {
+		u.peerAddr = &net.UDPAddr{IP: u.bridge.ip, Port: u.bridge.port}
+	}
+	u.closed = make(chan struct{})
+	u.connMutex.Unlock()
+	log.Infof("listening for radio bridge datagrams on %s", conn.LocalAddr())
+	return nil
+}
+
+func (u *udpTransport) ReadLines(lines chan<- string) error {
+	defer close(lines)
+	u.connMutex.Lock()
+	conn, closed := u.conn, u.closed
+	u.connMutex.Unlock()
+	if conn == nil {
+		return errors.New("not listening")
+	}
+	buf := make([]byte, 4096)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			u.fail(err)
+			return err
+		}
+		if !u.accept(from) {
+			log.Debugf("radio bridge on %s: dropped datagram from %s", u.address, from)
+			continue
+		}
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				u.rx()
+				select {
+				case lines <- line:
+				case <-closed:
+					return errors.New("transport closed")
+				}
+			}
+		}
+	}
+}
+
+// accept reports whether a datagram from is from the bridge, and makes from
+// the address downlinks go to when it is.
+func (u *udpTransport) accept(from *net.UDPAddr) bool {
+	u.connMutex.Lock()
+	defer u.connMutex.Unlock()
+
+	if u.bridge != nil && !u.bridge.matches(from.IP, from.Port) {
+		return false
+	}
+	if u.bridge == nil && u.peerAddr != nil && !u.peerAddr.IP.Equal(from.IP) {
+		return false
+	}
+	u.peerAddr = from
+	u.mutex.Lock()
+	u.peer = from.String()
+	u.mutex.Unlock()
+	return true
+}
+
+func (u *udpTransport) Write(data []byte) error {
+	u.connMutex.Lock()
+	conn, peer := u.conn, u.peerAddr
+	u.connMutex.Unlock()
+	if conn == nil {
+		return errors.New("not listening")
+	}
+	if peer == nil {
+		return errors.New("no datagram received from a radio bridge yet")
+	}
+	_, err := conn.WriteToUDP(data, peer)
+	u.tx(err)
+	return err
+}
+
+func (u *udpTransport) Close() error {
+	u.connMutex.Lock()
+	defer u.connMutex.Unlock()
+
+	if u.closed != nil {
+		select {
+		case <-u.closed:
+		default:
+			close(u.closed)
+		}
+	}
+	if u.conn == nil {
+		return nil
+	}
+	err := u.conn.Close()
+	u.conn = nil
+	return err
+}
+
+func (u *udpTransport) Health() TransportHealth {
+	u.connMutex.Lock()
+	connected := u.conn != nil && u.peerAddr != nil
+	u.connMutex.Unlock()
+	return u.health(TransportUDP, u.address, connected)
+}
@@ -0,0 +1,326 @@
+package pkg
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/NubeIO/nubeio-rubix-lib-models-go/model"
+)
+
+func recvLine(t *testing.T, lines <-chan string) string {
+	t.Helper()
+	select {
+	case line := <-lines:
+		return line
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no line received")
+		return ""
+	}
+}
+
+func freePort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestTransport_TCPClient(t *testing.T) {
+	bridge, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer bridge.Close()
+
+	port := bridge.Addr().(*net.TCPAddr).Port
+	transport, err := newTransport(&model.Network{TransportType: TransportTCPClient, IP: "127.0.0.1", Port: &port})
+	if err != nil {
+		t.Fatalf("newTransport: %s", err)
+	}
+	if err = transport.Open(); err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	defer transport.Close()
+
+	conn, err := bridge.Accept()
+	if err != nil {
+		t.Fatalf("accept: %s", err)
+	}
+	defer conn.Close()
+
+	lines := make(chan string, 4)
+	readErr := make(chan error, 1)
+	go func() { readErr <- transport.ReadLines(lines) }()
+
+	_, _ = conn.Write([]byte("AABBCCDD01\r\n\nEEFF\n"))
+	if got := recvLine(t, lines); got != "AABBCCDD01" {
+		t.Fatalf("expected first line, got %q", got)
+	}
+	if got := recvLine(t, lines); got != "EEFF" {
+		t.Fatalf("expected second line, got %q", got)
+	}
+
+	if err = transport.Write([]byte{0xAA, 0x01}); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	buf := make([]byte, 2)
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err = conn.Read(buf); err != nil || buf[0] != 0xAA || buf[1] != 0x01 {
+		t.Fatalf("bridge should receive the raw frame, got %x (%v)", buf, err)
+	}
+	if h := transport.Health(); !h.Connected || h.LastRx.IsZero() || h.LastTx.IsZero() {
+		t.Fatalf("unexpected health %+v", h)
+	}
+
+	_ = conn.Close()
+	select {
+	case <-readErr:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("ReadLines should return once the bridge hangs up")
+	}
+}
+
+func TestTransport_TCPServerServesOneBridge(t *testing.T) {
+	port := freePort(t)
+	transport, err := newTransport(&model.Network{TransportType: TransportTCPServer, IP: "127.0.0.1", Port: &port})
+	if err != nil {
+		t.Fatalf("newTransport: %s", err)
+	}
+	if err = transport.Open(); err != nil {
+		t.Fatalf("open: %s", err)
+	}
+
+	lines := make(chan string, 4)
+	readErr := make(chan error, 1)
+	go func() { readErr <- transport.ReadLines(lines) }()
+
+	address := "127.0.0.1:" + strconv.Itoa(port)
+	first, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	defer first.Close()
+	_, _ = first.Write([]byte("0101\n"))
+	if got := recvLine(t, lines); got != "0101" {
+		t.Fatalf("expected line from first bridge, got %q", got)
+	}
+
+	// Without a bridge host a second peer cannot take the link over.
+	second, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	defer second.Close()
+	_ = second.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err = second.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("a second bridge connection must be refused")
+	}
+
+	if err = transport.Write([]byte{0x42}); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	buf := make([]byte, 1)
+	_ = first.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err = first.Read(buf); err != nil || buf[0] != 0x42 {
+		t.Fatalf("downlink should go to the first bridge, got %x (%v)", buf, err)
+	}
+
+	_ = transport.Close()
+	select {
+	case <-readErr:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("ReadLines should return once the transport is closed")
+	}
+}
+
+func TestTransport_TCPServerPinnedBridge(t *testing.T) {
+	port := freePort(t)
+	address := "127.0.0.1:" + strconv.Itoa(port)
+	open := func(host string) Transport {
+		transport, err := newTransport(&model.Network{TransportType: TransportTCPServer, IP: "127.0.0.1", Port: &port, Host: &host})
+		if err != nil {
+			t.Fatalf("newTransport: %s", err)
+		}
+		if err = transport.Open(); err != nil {
+			t.Fatalf("open: %s", err)
+		}
+		go func() { _ = transport.ReadLines(make(chan string, 4)) }()
+		return transport
+	}
+
+	// The configured bridge reconnecting replaces its old connection.
+	transport := open("127.0.0.1")
+	first, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	defer first.Close()
+	second, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	defer second.Close()
+	waitFor(t, 2*time.Second, func() bool { return transport.Health().Peer == second.LocalAddr().String() })
+	if err = transport.Write([]byte{0x42}); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	buf := make([]byte, 1)
+	_ = second.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err = second.Read(buf); err != nil || buf[0] != 0x42 {
+		t.Fatalf("downlink should go to the reconnected bridge, got %x (%v)", buf, err)
+	}
+	_ = transport.Close()
+
+	// Any other host is refused.
+	transport = open("127.0.0.2")
+	defer transport.Close()
+	other, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	defer other.Close()
+	_ = other.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err = other.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("a connection from another host must be refused")
+	}
+	if transport.Health().Connected {
+		t.Fatalf("the refused host must not become the bridge")
+	}
+}
+
+func TestTransport_UDPRepliesToBridge(t *testing.T) {
+	port := freePort(t)
+	transport, err := newTransport(&model.Network{TransportType: TransportUDP, IP: "127.0.0.1", Port: &port})
+	if err != nil {
+		t.Fatalf("newTransport: %s", err)
+	}
+	if err = transport.Open(); err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	defer transport.Close()
+
+	if err = transport.Write([]byte{0x01}); err == nil {
+		t.Fatalf("write before any datagram has no peer and must fail")
+	}
+
+	lines := make(chan string, 4)
+	go func() { _ = transport.ReadLines(lines) }()
+
+	listen := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+	bridge, err := net.DialUDP("udp", nil, listen)
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	defer bridge.Close()
+	_, _ = bridge.Write([]byte("AAAA\nBBBB\n"))
+	if got := recvLine(t, lines); got != "AAAA" {
+		t.Fatalf("expected first line, got %q", got)
+	}
+	if got := recvLine(t, lines); got != "BBBB" {
+		t.Fatalf("expected second line, got %q", got)
+	}
+
+	// The bridge host is learned from the first datagram; another host
+	// cannot take the downlinks over.
+	other, err := net.DialUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2)}, listen)
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	defer other.Close()
+	_, _ = other.Write([]byte("EEEE\n"))
+	_, _ = bridge.Write([]byte("CCCC\n"))
+	if got := recvLine(t, lines); got != "CCCC" {
+		t.Fatalf("datagrams from another host must be dropped, got %q", got)
+	}
+
+	if err = transport.Write([]byte{0x07, 0x08}); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	buf := make([]byte, 16)
+	_ = bridge.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := bridge.Read(buf)
+	if err != nil || n != 2 || buf[0] != 0x07 {
+		t.Fatalf("bridge should receive the frame, got %x (%v)", buf[:n], err)
+	}
+}
+
+func TestTransport_UDPPinnedBridgeAndClose(t *testing.T) {
+	port, bridgePort := freePort(t), freePort(t)
+	host := "127.0.0.1:" + strconv.Itoa(bridgePort)
+	transport, err := newTransport(&model.Network{TransportType: TransportUDP, IP: "127.0.0.1", Port: &port, Host: &host})
+	if err != nil {
+		t.Fatalf("newTransport: %s", err)
+	}
+	if err = transport.Open(); err != nil {
+		t.Fatalf("open: %s", err)
+	}
+
+	bridge, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: bridgePort})
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer bridge.Close()
+	// A bridge host with a port gets downlinks before it sent anything.
+	if err = transport.Write([]byte{0x09}); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	buf := make([]byte, 16)
+	_ = bridge.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if n, _, err := bridge.ReadFromUDP(buf); err != nil || n != 1 || buf[0] != 0x09 {
+		t.Fatalf("bridge should receive the frame, got %x (%v)", buf[:n], err)
+	}
+
+	// Nobody reads lines: ReadLines must still return once closed, and
+	// close lines.
+	lines := make(chan string)
+	readErr := make(chan error, 1)
+	go func() { readErr <- transport.ReadLines(lines) }()
+	listen := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+	stranger, err := net.DialUDP("udp", nil, listen)
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	defer stranger.Close()
+	_, _ = stranger.Write([]byte("EEEE\n")) // wrong port: dropped
+	_, _ = bridge.WriteToUDP([]byte("AAAA\n"), listen)
+	time.Sleep(100 * time.Millisecond) // let the reader block on lines
+	_ = transport.Close()
+	select {
+	case <-readErr:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("ReadLines must not stay blocked on lines after Close")
+	}
+	if _, ok := <-lines; ok {
+		t.Fatalf("lines must be closed")
+	}
+}
+
+func TestTransport_Config(t *testing.T) {
+	port := 1700
+	baud := uint(38400)
+	serialPort := "/dev/ttyUSB0"
+	badHost, bridgeHost := "bridge.local:x", "10.0.0.5:4001"
+	cases := []struct {
+		network *model.Network
+		ok      bool
+	}{
+		{&model.Network{SerialPort: &serialPort, SerialBaudRate: &baud}, true}, // pre-transport networks are serial
+		{&model.Network{TransportType: TransportSerial}, false},
+		{&model.Network{TransportType: TransportTCPClient, Port: &port}, false}, // no ip
+		{&model.Network{TransportType: TransportTCPServer, Port: &port}, true},
+		{&model.Network{TransportType: TransportUDP}, false}, // no port
+		{&model.Network{TransportType: TransportUDP, Port: &port, Host: &badHost}, false},
+		{&model.Network{TransportType: TransportTCPServer, Port: &port, Host: &bridgeHost}, true},
+		{&model.Network{TransportType: "ip"}, false},
+	}
+	for i, c := range cases {
+		if _, err := newTransport(c.network); (err == nil) != c.ok {
+			t.Fatalf("case %d: expected ok=%v, got %v", i, c.ok, err)
+		}
+	}
+}
@@ -1,7 +1,9 @@
 package pkg
 
 import (
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/NubeIO/nubeio-rubix-lib-models-go/model"
 	log "github.com/sirupsen/logrus"
@@ -13,6 +15,25 @@ type PendingPointWrite struct {
 	MessageType bool
 	Point       *model.Point
 	RetryCount  int
+	// CorrelationID is the ID of the MQTT write command that queued the
+	// write, empty for other writes. It is saved with the write, so the
+	// outcome is published with it after a restart too.
+	CorrelationID string
+
+	// notBefore holds the item back after a failed attempt (retry backoff) or
+	// while the duty-cycle budget is spent.
+	notBefore time.Time
+	// priority is the item's writePriority class; the queue keeps the more
+	// urgent classes ahead.
+	priority int
+
+	// Batch is every point encoded into Message, Point first. Writes merged
+	// into the batch leave the queue; the device RESPONSE is fanned back out
+	// to them by IoNumber. batchAcked tracks which ones have been answered,
+	// batchCorrelation holds their CorrelationIDs.
+	Batch            []*model.Point
+	batchAcked       []bool
+	batchCorrelation []string
 
 	// done is closed exactly once when the item leaves the queue (acked,
 	// exhausted or dropped). The scheduler waits on it after transmitting.
@@ -28,6 +49,24 @@ func (p *PendingPointWrite) markDone(acked bool) {
 	})
 }
 
+// batchWrite is a point of a batch with the CorrelationID of its write.
+type batchWrite struct {
+	point         *model.Point
+	correlationID string
+}
+
+// pending returns the batch points that never got a RESPONSE. The caller
+// holds the queue lock.
+func (p *PendingPointWrite) pending() []batchWrite {
+	var writes []batchWrite
+	for i, point := range p.Batch {
+		if !p.batchAcked[i] {
+			writes = append(writes, batchWrite{point: point, correlationID: p.batchCorrelation[i]})
+		}
+	}
+	return writes
+}
+
 // --------------------------------------------
 // SINGLE QUEUE — holds one device's pending writes in order.
 // Transmission is driven by PointWriteQueueManager's scheduler.
@@ -35,7 +74,9 @@ func (p *PendingPointWrite) markDone(acked bool) {
 
 type PointWriteQueue struct {
 	writeQueue []*PendingPointWrite
-	mutex      sync.Mutex
+	// paused keeps the queue off air; writes still queue up.
+	paused bool
+	mutex  sync.Mutex
 }
 
 func NewPointWriteQueue() *PointWriteQueue {
@@ -45,12 +86,82 @@ func NewPointWriteQueue() *PointWriteQueue {
 }
 
 func (pwq *PointWriteQueue) EnqueueWriteQueue(point *model.Point) *PendingPointWrite {
+	item, _ := pwq.enqueue(point, "")
+	return item
+}
+
+// enqueue queues a write behind the writes of its priority class or a more
+// urgent one. A queued write to the same point that is not on air yet is
+// superseded: it leaves the queue and is returned. The head stays in place
+// once it has gone on air, and a write never overtakes an earlier write to
+// the same IoNumber.
+func (pwq *PointWriteQueue) enqueue(point *model.Point, correlationID string) (*PendingPointWrite, []*PendingPointWrite) {
+	pwq.mutex.Lock()
+	defer pwq.mutex.Unlock()
+
+	var superseded []*PendingPointWrite
+	if point.UUID != "" {
+		kept := pwq.writeQueue[:0]
+		for _, item := range pwq.writeQueue {
+			if item.Message == nil && item.Point.UUID == point.UUID {
+				item.markDone(false)
+				superseded = append(superseded, item)
+				continue
+			}
+			kept = append(kept, item)
+		}
+		pwq.writeQueue = kept
+	}
+
+	ppWrite := &PendingPointWrite{
+		Point:            point,
+		CorrelationID:    correlationID,
+		Batch:            []*model.Point{point},
+		batchAcked:       []bool{false},
+		batchCorrelation: []string{correlationID},
+		done:             make(chan struct{}),
+		priority:         writePriority(point),
+	}
+	start := 0
+	if len(pwq.writeQueue) > 0 && pwq.writeQueue[0].Message != nil {
+		start = 1
+	}
+	pos := len(pwq.writeQueue)
+	for i := len(pwq.writeQueue) - 1; i >= start; i-- {
+		item := pwq.writeQueue[i]
+		if item.priority <= ppWrite.priority || strings.EqualFold(item.Point.IoNumber, point.IoNumber) {
+			break
+		}
+		pos = i
+	}
+	pwq.writeQueue = append(pwq.writeQueue, nil)
+	copy(pwq.writeQueue[pos+1:], pwq.writeQueue[pos:])
+	pwq.writeQueue[pos] = ppWrite
+	return ppWrite, superseded
+}
+
+// cancel removes the queued writes to a point that are not on air yet and
+// returns them. onAir is set when a write to the point is on air: it can no
+// longer be taken back.
+func (pwq *PointWriteQueue) cancel(pointUUID string) (cancelled []*PendingPointWrite, onAir bool) {
 	pwq.mutex.Lock()
 	defer pwq.mutex.Unlock()
 
-	ppWrite := &PendingPointWrite{Point: point, done: make(chan struct{})}
-	pwq.writeQueue = append(pwq.writeQueue, ppWrite)
-	return ppWrite
+	kept := pwq.writeQueue[:0]
+	for _, item := range pwq.writeQueue {
+		if item.Message != nil {
+			for _, p := range item.Batch {
+				onAir = onAir || p.UUID == pointUUID
+			}
+		} else if item.Point.UUID == pointUUID {
+			item.markDone(false)
+			cancelled = append(cancelled, item)
+			continue
+		}
+		kept = append(kept, item)
+	}
+	pwq.writeQueue = kept
+	return cancelled, onAir
 }
 
 // Peek returns the head item without removing it, or nil when empty.
@@ -64,6 +175,99 @@ func (pwq *PointWriteQueue) Peek() *PendingPointWrite {
 	return pwq.writeQueue[0]
 }
 
+// PeekReady returns the head item when it may go on air at now. Otherwise it
+// returns nil and when the head is held back until (zero when empty).
+func (pwq *PointWriteQueue) PeekReady(now time.Time) (*PendingPointWrite, time.Time) {
+	pwq.mutex.Lock()
+	defer pwq.mutex.Unlock()
+
+	if len(pwq.writeQueue) == 0 {
+		return nil, time.Time{}
+	}
+	head := pwq.writeQueue[0]
+	if pwq.paused {
+		return nil, time.Time{}
+	}
+	if head.notBefore.After(now) {
+		return nil, head.notBefore
+	}
+	return head, time.Time{}
+}
+
+func (pwq *PointWriteQueue) setPaused(paused bool) {
+	pwq.mutex.Lock()
+	defer pwq.mutex.Unlock()
+
+	pwq.paused = paused
+}
+
+// release lifts the hold on the head (retry backoff), so it goes on the next
+// pick. It returns false when the queue is empty or paused.
+func (pwq *PointWriteQueue) release() bool {
+	pwq.mutex.Lock()
+	defer pwq.mutex.Unlock()
+
+	if len(pwq.writeQueue) == 0 || pwq.paused {
+		return false
+	}
+	pwq.writeQueue[0].notBefore = time.Time{}
+	return true
+}
+
+// flush empties the queue, the head included even when it is on air, and
+// returns the points that never got a RESPONSE.
+func (pwq *PointWriteQueue) flush() []batchWrite {
+	pwq.mutex.Lock()
+	defer pwq.mutex.Unlock()
+
+	var writes []batchWrite
+	for _, item := range pwq.writeQueue {
+		writes = append(writes, item.pending()...)
+		item.markDone(false)
+	}
+	pwq.writeQueue = nil
+	return writes
+}
+
+// snapshot returns the queue as the write-queue API shows it.
+func (pwq *PointWriteQueue) snapshot() (bool, []WriteQueueItem) {
+	pwq.mutex.Lock()
+	defer pwq.mutex.Unlock()
+
+	items := make([]WriteQueueItem, 0, len(pwq.writeQueue))
+	for _, item := range pwq.writeQueue {
+		entry := WriteQueueItem{
+			PointUUID: item.Point.UUID,
+			IoNumber:  item.Point.IoNumber,
+			Value:     item.Point.WriteValue,
+			Priority:  writePriorityNames[item.priority],
+			Retries:   item.RetryCount,
+			OnAir:     item.Message != nil,
+		}
+		if item.Message != nil {
+			messageId := item.MessageId
+			entry.MessageId = &messageId
+			for _, p := range item.Batch[1:] {
+				entry.Batch = append(entry.Batch, p.UUID)
+			}
+		}
+		if !item.notBefore.IsZero() {
+			notBefore := item.notBefore
+			entry.NotBefore = &notBefore
+		}
+		items = append(items, entry)
+	}
+	return pwq.paused, items
+}
+
+// holdBack keeps the item off air until the given time.
+func (pwq *PointWriteQueue) holdBack(item *PendingPointWrite, until time.Time) {
+	pwq.mutex.Lock()
+	defer pwq.mutex.Unlock()
+
+	item.notBefore = until
+}
+
 // SetMessage stores the encoded frame on the item under the queue lock so the
 // RX side never observes a half-initialised MessageId.
 func (pwq *PointWriteQueue) SetMessage(item *PendingPointWrite, messageId uint8, message []byte) {
@@ -74,6 +278,118 @@ func (pwq *PointWriteQueue) SetMessage(item *PendingPointWrite, messageId uint8,
 	item.Message = message
 }
 
+// batchCandidates returns the queued writes behind head that can still be
+// merged into its frame: not on air yet, and not for a point that is already
+// in the batch (two writes to one point must stay in order).
+func (pwq *PointWriteQueue) batchCandidates(head *PendingPointWrite) []*PendingPointWrite {
+	pwq.mutex.Lock()
+	defer pwq.mutex.Unlock()
+
+	if len(pwq.writeQueue) == 0 || pwq.writeQueue[0] != head {
+		return nil
+	}
+	inBatch := map[string]bool{}
+	for _, p := range head.Batch {
+		inBatch[strings.ToUpper(p.IoNumber)] = true
+	}
+	var candidates []*PendingPointWrite
+	for _, item := range pwq.writeQueue[1:] {
+		ioNumber := strings.ToUpper(item.Point.IoNumber)
+		if item.Message != nil || inBatch[ioNumber] {
+			continue
+		}
+		inBatch[ioNumber] = true
+		candidates = append(candidates, item)
+	}
+	return candidates
+}
+
+// absorb moves items out of the queue into head's batch and stores the
+// encoded frame. It is all or nothing: when any item is no longer queued
+// (e.g. dropped meanwhile) nothing changes and it returns false.
+func (pwq *PointWriteQueue) absorb(head *PendingPointWrite, items []*PendingPointWrite, messageId uint8, message []byte) bool {
+	pwq.mutex.Lock()
+	defer pwq.mutex.Unlock()
+
+	if len(pwq.writeQueue) == 0 || pwq.writeQueue[0] != head {
+		return false
+	}
+	remove := map[*PendingPointWrite]bool{}
+	for _, item := range items {
+		remove[item] = true
+	}
+	found := 0
+	for _, item := range pwq.writeQueue {
+		if remove[item] {
+			found++
+		}
+	}
+	if found != len(items) {
+		return false
+	}
+
+	kept := pwq.writeQueue[:0]
+	for _, item := range pwq.writeQueue {
+		if remove[item] {
+			head.Batch = append(head.Batch, item.Point)
+			head.batchAcked = append(head.batchAcked, false)
+			head.batchCorrelation = append(head.batchCorrelation, item.CorrelationID)
+			item.markDone(false)
+			continue
+		}
+		kept = append(kept, item)
+	}
+	pwq.writeQueue = kept
+	head.MessageId = messageId
+	head.Message = message
+	return true
+}
+
+// ackPoint resolves the point of the in-flight batch that a RESPONSE field
+// refers to: the unanswered one with a matching IoNumber, and the
+// CorrelationID of its write. A field no point of the batch matches answers
+// nothing; the batch's points are retried or time out. The head leaves the
+// queue once every point is answered.
+func (pwq *PointWriteQueue) ackPoint(messageId uint8, ioNumber string) (*model.Point, string) {
+	pwq.mutex.Lock()
+	defer pwq.mutex.Unlock()
+
+	if len(pwq.writeQueue) == 0 {
+		return nil, ""
+	}
+	head := pwq.writeQueue[0]
+	if head.Message == nil || head.MessageId != messageId {
+		return nil, ""
+	}
+	idx := -1
+	for i, p := range head.Batch {
+		if !head.batchAcked[i] && strings.EqualFold(p.IoNumber, ioNumber) {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		return nil, ""
+	}
+	head.batchAcked[idx] = true
+	for _, acked := range head.batchAcked {
+		if !acked {
+			return head.Batch[idx], head.batchCorrelation[idx]
+		}
+	}
+	pwq.writeQueue = pwq.writeQueue[1:]
+	head.markDone(true)
+	return head.Batch[idx], head.batchCorrelation[idx]
+}
+
+// unacked returns the batch points that never got a RESPONSE.
+func (pwq *PointWriteQueue) unacked(item *PendingPointWrite) []batchWrite {
+	pwq.mutex.Lock()
+	defer pwq.mutex.Unlock()
+
+	return item.pending()
+}
+
 // IncRetry bumps the attempt counter and returns the new value.
 func (pwq *PointWriteQueue) IncRetry(item *PendingPointWrite) int {
 	pwq.mutex.Lock()
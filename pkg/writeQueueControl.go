@@ -0,0 +1,193 @@
+package pkg
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// WriteQueueItem is a pending write as GET /api/write-queue shows it. OnAir is
+// set once the write has been encoded and sent at least once; MessageId and
+// Batch (the other points merged into its frame) are known from then on.
+// NotBefore is when a held-back write (retry backoff, duty cycle) may go.
+type WriteQueueItem struct {
+	PointUUID string     `json:"point_uuid"`
+	IoNumber  string     `json:"io_number"`
+	Value     *float64   `json:"value,omitempty"`
+	Priority  string     `json:"priority"`
+	Retries   int        `json:"retries"`
+	OnAir     bool       `json:"on_air"`
+	MessageId *uint8     `json:"message_id,omitempty"`
+	Batch     []string   `json:"batch,omitempty"`
+	NotBefore *time.Time `json:"not_before,omitempty"`
+}
+
+// WriteQueueStatus is one device's write queue.
+type WriteQueueStatus struct {
+	DeviceUUID string           `json:"device_uuid"`
+	Paused     bool             `json:"paused"`
+	Items      []WriteQueueItem `json:"items"`
+}
+
+// WriteQueueInFlight is the write the radio is held for: it waits for the
+// device's RESPONSE until Deadline.
+type WriteQueueInFlight struct {
+	DeviceUUID string    `json:"device_uuid"`
+	PointUUID  string    `json:"point_uuid"`
+	MessageId  uint8     `json:"message_id"`
+	Attempt    int       `json:"attempt"`
+	Deadline   time.Time `json:"deadline"`
+}
+
+// NetworkWriteQueues is the write scheduler of one network.
+type NetworkWriteQueues struct {
+	NetworkUUID string              `json:"network_uuid"`
+	InFlight    *WriteQueueInFlight `json:"in_flight,omitempty"`
+	Queues      []WriteQueueStatus  `json:"queues"`
+}
+
+// Status returns every device queue, in round-robin order, and the write in
+// flight.
+func (m *PointWriteQueueManager) Status() ([]WriteQueueStatus, *WriteQueueInFlight) {
+	m.mutex.Lock()
+	order := append([]string(nil), m.order...)
+	queues := make([]*PointWriteQueue, len(order))
+	for i, deviceUUID := range order {
+		queues[i] = m.queues[deviceUUID]
+	}
+	var inFlight *WriteQueueInFlight
+	if m.inFlight != nil {
+		inFlight = &WriteQueueInFlight{
+			DeviceUUID: m.inFlightDevice,
+			PointUUID:  m.inFlight.Point.UUID,
+			Deadline:   m.inFlightDeadline,
+		}
+	}
+	item := m.inFlight
+	m.mutex.Unlock()
+
+	statuses := make([]WriteQueueStatus, len(order))
+	for i, deviceUUID := range order {
+		statuses[i] = m.queueStatus(deviceUUID, queues[i])
+	}
+	if inFlight != nil {
+		if idx := indexOf(order, inFlight.DeviceUUID); idx >= 0 {
+			queues[idx].mutex.Lock()
+			inFlight.MessageId = item.MessageId
+			inFlight.Attempt = item.RetryCount + 1
+			queues[idx].mutex.Unlock()
+		}
+	}
+	return statuses, inFlight
+}
+
+func indexOf(list []string, s string) int {
+	for i, v := range list {
+		if v == s {
+			return i
+		}
+	}
+	return -1
+}
+
+// QueueStatus returns a device's queue; a device without writes has an
+// empty one.
+func (m *PointWriteQueueManager) QueueStatus(deviceUUID string) WriteQueueStatus {
+	m.mutex.Lock()
+	queue := m.queues[deviceUUID]
+	m.mutex.Unlock()
+	return m.queueStatus(deviceUUID, queue)
+}
+
+func (m *PointWriteQueueManager) queueStatus(deviceUUID string, queue *PointWriteQueue) WriteQueueStatus {
+	status := WriteQueueStatus{DeviceUUID: deviceUUID, Items: []WriteQueueItem{}}
+	if queue != nil {
+		status.Paused, status.Items = queue.snapshot()
+	}
+	return status
+}
+
+// Pause keeps a device's writes off air, e.g. while it is offline, so it
+// does not take the radio in every round; Resume lets them go again. A write
+// on air is still waited for.
+func (m *PointWriteQueueManager) Pause(deviceUUID string, paused bool) {
+	m.getOrCreateQueue(deviceUUID).setPaused(paused)
+	m.persist()
+	m.wake()
+}
+
+// Flush drops every write of a device, the one on air included, and reports
+// them dropped with errWriteFlushed.
+func (m *PointWriteQueueManager) Flush(deviceUUID string) int {
+	m.mutex.Lock()
+	queue, exists := m.queues[deviceUUID]
+	m.mutex.Unlock()
+	if !exists {
+		return 0
+	}
+
+	writes := queue.flush()
+	m.persist()
+	log.Infof("[%s] write queue flushed, %d writes dropped", deviceUUID, len(writes))
+	if m.onWriteDropped != nil {
+		for _, write := range writes {
+			m.onWriteDropped(write.point, write.correlationID, errWriteFlushed)
+		}
+	}
+	m.wake()
+	return len(writes)
+}
+
+// RetryNow sends a device's next write on the scheduler's next pick: it lifts
+// the retry backoff and puts the device first in the round-robin. A write on
+// air is still waited for, and the duty-cycle budget still applies.
+func (m *PointWriteQueueManager) RetryNow(deviceUUID string) error {
+	m.mutex.Lock()
+	queue, exists := m.queues[deviceUUID]
+	m.mutex.Unlock()
+	if !exists || !queue.release() {
+		return errors.New("no write to retry for device " + deviceUUID + " (empty or paused queue)")
+	}
+
+	m.mutex.Lock()
+	if idx := indexOf(m.order, deviceUUID); idx >= 0 {
+		m.rrIndex = idx
+	}
+	m.mutex.Unlock()
+	m.persist()
+	m.wake()
+	return nil
+}
+
+// writeQueues returns the write schedulers of every running network.
+func (m *Module) writeQueues() []NetworkWriteQueues {
+	m.networksMutex.Lock()
+	networks := make([]*loRaNetwork, 0, len(m.networks))
+	for _, n := range m.networks {
+		networks = append(networks, n)
+	}
+	m.networksMutex.Unlock()
+	sort.Slice(networks, func(i, j int) bool { return networks[i].uuid < networks[j].uuid })
+
+	list := make([]NetworkWriteQueues, 0, len(networks))
+	for _, n := range networks {
+		queues, inFlight := n.pointWriteQueueManager.Status()
+		list = append(list, NetworkWriteQueues{NetworkUUID: n.uuid, InFlight: inFlight, Queues: queues})
+	}
+	return list
+}
+
+// deviceWriteQueue returns the write scheduler of a device's network.
+func (m *Module) deviceWriteQueue(deviceUUID string) (*PointWriteQueueManager, error) {
+	device, err := m.getDevice(deviceUUID)
+	if err != nil {
+		return nil, err
+	}
+	manager := m.getWriteQueueManager(device)
+	if manager == nil {
+		return nil, errors.New("network " + device.NetworkUUID + " is not running")
+	}
+	return manager, nil
+}
@@ -0,0 +1,101 @@
+package pkg
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/NubeIO/nubeio-rubix-lib-models-go/model"
+)
+
+func TestWriteQueueStatus_InFlight(t *testing.T) {
+	const timeout = time.Second
+	f := newSchedFixture(t, 5, timeout, "AAAAAAA1")
+	f.setAck("AAAAAAA1", false)
+
+	f.mgr.EnqueuePoint(f.point("AAAAAAA1", "pA", 2))
+	if !waitFor(t, time.Second, func() bool { return f.rec.count() == 1 }) {
+		t.Fatalf("expected a transmission")
+	}
+	var inFlight *WriteQueueInFlight
+	var queues []WriteQueueStatus
+	waitFor(t, time.Second, func() bool {
+		queues, inFlight = f.mgr.Status()
+		return inFlight != nil
+	})
+	if inFlight == nil || inFlight.DeviceUUID != "dev-AAAAAAA1" || inFlight.PointUUID != "pA" || inFlight.Attempt != 1 {
+		t.Fatalf("unexpected in-flight write %+v", inFlight)
+	}
+	if left := time.Until(inFlight.Deadline); left <= 0 || left > timeout {
+		t.Fatalf("deadline should be within the response timeout, is %s away", left)
+	}
+	if len(queues) != 1 || len(queues[0].Items) != 1 {
+		t.Fatalf("unexpected queues %+v", queues)
+	}
+	item := queues[0].Items[0]
+	if !item.OnAir || item.MessageId == nil || *item.MessageId != inFlight.MessageId || item.Priority != "normal" {
+		t.Fatalf("unexpected queue item %+v", item)
+	}
+}
+
+func TestWriteQueue_PauseAndResume(t *testing.T) {
+	f := newSchedFixture(t, 5, time.Second, "AAAAAAA1", "BBBBBBB2")
+	f.setAck("AAAAAAA1", true)
+	f.setAck("BBBBBBB2", true)
+
+	f.mgr.Pause("dev-AAAAAAA1", true)
+	f.mgr.EnqueuePoint(f.point("AAAAAAA1", "pA", 1))
+	f.mgr.EnqueuePoint(f.point("BBBBBBB2", "pB", 2))
+
+	if !waitFor(t, time.Second, func() bool { return f.rec.count() == 1 }) {
+		t.Fatalf("the other device's write should go")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if f.rec.count() != 1 || !f.mgr.QueueStatus("dev-AAAAAAA1").Paused {
+		t.Fatalf("a paused queue must stay off air")
+	}
+
+	f.mgr.Pause("dev-AAAAAAA1", false)
+	if !waitFor(t, time.Second, func() bool { return f.rec.count() == 2 }) {
+		t.Fatalf("write should go once the queue is resumed")
+	}
+}
+
+func TestWriteQueue_FlushAndRetryNow(t *testing.T) {
+	f := newSchedFixture(t, 5, time.Second, "AAAAAAA1")
+	f.mgr.Stop()
+	f.mgr.backoffBase = time.Minute
+	var dropped []error
+	f.mgr.onWriteDropped = func(p *model.Point, _ string, err error) { dropped = append(dropped, err) }
+
+	queue := f.mgr.getOrCreateQueue("dev-AAAAAAA1")
+	head := queue.EnqueueWriteQueue(f.point("AAAAAAA1", "pA", 1))
+	queue.EnqueueWriteQueue(f.point("AAAAAAA1", "pB", 2))
+
+	f.mgr.finishAttempt("dev-AAAAAAA1", queue, head)
+	if item, _ := queue.PeekReady(time.Now()); item != nil {
+		t.Fatalf("head should be backing off")
+	}
+	if err := f.mgr.RetryNow("dev-AAAAAAA1"); err != nil {
+		t.Fatal(err)
+	}
+	if item, _ := queue.PeekReady(time.Now()); item != head {
+		t.Fatalf("RetryNow should lift the backoff")
+	}
+	f.mgr.Pause("dev-AAAAAAA1", true)
+	if err := f.mgr.RetryNow("dev-AAAAAAA1"); err == nil {
+		t.Fatalf("a paused queue cannot be retried")
+	}
+
+	if n := f.mgr.Flush("dev-AAAAAAA1"); n != 2 || queue.Size() != 0 {
+		t.Fatalf("Flush = %d, %d left", n, queue.Size())
+	}
+	if len(dropped) != 2 || !errors.Is(dropped[0], errWriteCancelled) {
+		t.Fatalf("flushed writes should be reported cancelled, got %v", dropped)
+	}
+	select {
+	case <-head.done:
+	default:
+		t.Fatalf("a flushed write on air must release the scheduler")
+	}
+}
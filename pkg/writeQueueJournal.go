@@ -0,0 +1,217 @@
+package pkg
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"github.com/NubeIO/nubeio-rubix-lib-models-go/model"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// writeJournalVersion is the version of the write queue file format.
+	writeJournalVersion = 1
+
+	// writeJournalSaveDelay coalesces the changes of a burst of writes,
+	// acks and retries into one save of the file, to spare the flash.
+	writeJournalSaveDelay = 2 * time.Second
+)
+
+// writeJournalFile is the write queue file of a network in the module data
+// dir.
+func writeJournalFile(networkUUID string) string {
+	return "write-queue-" + networkUUID + ".json"
+}
+
+// writeJournal is a network's write queues as saved shortly after every
+// change, so a restart resumes them where they were: same order, retries, backoff and
+// paused devices, synthetic writes (the UART ping) included.
+type writeJournal struct {
+	Version int            `json:"version"`
+	Queues  []journalQueue `json:"queues"`
+}
+
+type journalQueue struct {
+	DeviceUUID string         `json:"device_uuid"`
+	Paused     bool           `json:"paused,omitempty"`
+	Writes     []journalWrite `json:"writes"`
+}
+
+// journalWrite is a pending write. Batch holds the unanswered points merged
+// into its frame; they are queued again on their own behind it, and the
+// frame is encoded anew (with a new messageId) on restore. The correlation
+// IDs are the MQTT write commands' (BatchCorrelationIDs one per Batch point).
+type journalWrite struct {
+	Point               *model.Point   `json:"point"`
+	CorrelationID       string         `json:"correlation_id,omitempty"`
+	Batch               []*model.Point `json:"batch,omitempty"`
+	BatchCorrelationIDs []string       `json:"batch_correlation_ids,omitempty"`
+	Retries             int            `json:"retries,omitempty"`
+	NotBefore           time.Time      `json:"not_before,omitempty"`
+}
+
+// journal returns the queue as it is saved.
+func (pwq *PointWriteQueue) journal(deviceUUID string) journalQueue {
+	pwq.mutex.Lock()
+	defer pwq.mutex.Unlock()
+
+	queue := journalQueue{DeviceUUID: deviceUUID, Paused: pwq.paused, Writes: []journalWrite{}}
+	for _, item := range pwq.writeQueue {
+		write := journalWrite{Point: item.Point, CorrelationID: item.CorrelationID, Retries: item.RetryCount, NotBefore: item.notBefore}
+		for i, p := range item.Batch[1:] {
+			if !item.batchAcked[i+1] {
+				write.Batch = append(write.Batch, p)
+				write.BatchCorrelationIDs = append(write.BatchCorrelationIDs, item.batchCorrelation[i+1])
+			}
+		}
+		queue.Writes = append(queue.Writes, write)
+	}
+	return queue
+}
+
+// restore appends the saved writes as they were, without reordering.
+func (pwq *PointWriteQueue) restore(saved journalQueue) {
+	pwq.mutex.Lock()
+	defer pwq.mutex.Unlock()
+
+	pwq.paused = saved.Paused
+	add := func(point *model.Point, correlationID string, retries int, notBefore time.Time) {
+		pwq.writeQueue = append(pwq.writeQueue, &PendingPointWrite{
+			Point:            point,
+			CorrelationID:    correlationID,
+			RetryCount:       retries,
+			Batch:            []*model.Point{point},
+			batchAcked:       []bool{false},
+			batchCorrelation: []string{correlationID},
+			done:             make(chan struct{}),
+			priority:         writePriority(point),
+			notBefore:        notBefore,
+		})
+	}
+	for _, write := range saved.Writes {
+		if write.Point == nil {
+			continue
+		}
+		add(write.Point, write.CorrelationID, write.Retries, write.NotBefore)
+		for i, point := range write.Batch {
+			var correlationID string
+			if i < len(write.BatchCorrelationIDs) {
+				correlationID = write.BatchCorrelationIDs[i]
+			}
+			add(point, correlationID, 0, time.Time{})
+		}
+	}
+}
+
+// Restore loads the write queues saved at path and keeps saving them there
+// after every change. An empty path keeps the queues in memory only. It
+// returns the number of writes restored.
+func (m *PointWriteQueueManager) Restore(path string) int {
+	var journal writeJournal
+	if err := loadState(path, &journal); err != nil {
+		log.Errorf("write queue: failed to read %s, starting empty: %s", path, err)
+	}
+	restored := 0
+	for _, saved := range journal.Queues {
+		m.getOrCreateQueue(saved.DeviceUUID).restore(saved)
+		for _, write := range saved.Writes {
+			restored += 1 + len(write.Batch)
+		}
+	}
+
+	m.mutex.Lock()
+	m.journalPath = path
+	m.mutex.Unlock()
+	m.saveJournal()
+	m.wake()
+	return restored
+}
+
+// persist schedules a save of the write queues, when Restore gave them a
+// file. Changes within writeJournalSaveDelay are saved together.
+func (m *PointWriteQueueManager) persist() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.journalPath == "" || m.journalTimer != nil {
+		return
+	}
+	m.journalTimer = time.AfterFunc(writeJournalSaveDelay, m.flushJournal)
+}
+
+// flushJournal saves the write queues now if a save is pending.
+func (m *PointWriteQueueManager) flushJournal() {
+	m.mutex.Lock()
+	pending := m.journalTimer != nil
+	if pending {
+		m.journalTimer.Stop()
+		m.journalTimer = nil
+	}
+	m.mutex.Unlock()
+	if pending {
+		m.saveJournal()
+	}
+}
+
+// saveJournal saves the write queues to their file.
+func (m *PointWriteQueueManager) saveJournal() {
+	m.journalMutex.Lock()
+	defer m.journalMutex.Unlock()
+
+	m.mutex.Lock()
+	path := m.journalPath
+	order := append([]string(nil), m.order...)
+	queues := make([]*PointWriteQueue, len(order))
+	for i, deviceUUID := range order {
+		queues[i] = m.queues[deviceUUID]
+	}
+	m.mutex.Unlock()
+	if path == "" {
+		return
+	}
+
+	journal := writeJournal{Version: writeJournalVersion, Queues: []journalQueue{}}
+	for i, deviceUUID := range order {
+		saved := queues[i].journal(deviceUUID)
+		if len(saved.Writes) > 0 || saved.Paused {
+			journal.Queues = append(journal.Queues, saved)
+		}
+	}
+	if err := saveState(path, journal); err != nil {
+		log.Errorf("write queue: failed to save %s: %s", path, err)
+	}
+}
+
+// removeWriteJournal deletes the write queue file of a deleted network.
+func (m *Module) removeWriteJournal(networkUUID string) {
+	path := m.statePath(writeJournalFile(networkUUID))
+	if path == "" {
+		return
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Errorf("write queue: failed to remove %s: %s", path, err)
+	}
+}
+
+// QueuedPoints returns the UUIDs of the points with a queued write.
+func (m *PointWriteQueueManager) QueuedPoints() map[string]bool {
+	m.mutex.Lock()
+	queues := make([]*PointWriteQueue, 0, len(m.queues))
+	for _, queue := range m.queues {
+		queues = append(queues, queue)
+	}
+	m.mutex.Unlock()
+
+	points := map[string]bool{}
+	for _, queue := range queues {
+		queue.mutex.Lock()
+		for _, item := range queue.writeQueue {
+			for _, p := range item.Batch {
+				points[p.UUID] = true
+			}
+		}
+		queue.mutex.Unlock()
+	}
+	return points
+}
@@ -0,0 +1,122 @@
+package pkg
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWriteJournal_RestoresQueues(t *testing.T) {
+	path := filepath.Join(t.TempDir(), writeJournalFile("net-1"))
+	f := newSchedFixture(t, 5, time.Second, "AAAAAAA1", "BBBBBBB2")
+	f.mgr.Stop()
+	f.mgr.backoffBase = time.Minute
+	if n := f.mgr.Restore(path); n != 0 {
+		t.Fatalf("nothing to restore from a missing file, got %d", n)
+	}
+	f.mgr.mutex.Lock()
+	f.mgr.journalPath = path // Stop turned saving off
+	f.mgr.mutex.Unlock()
+
+	ping := f.point("AAAAAAA1", "", 1) // synthetic, like the UART ping
+	ping.IoNumber = "UVP-4"
+	f.mgr.EnqueuePoint(ping)
+	f.mgr.EnqueuePoint(f.point("AAAAAAA1", "pA", 2))
+	f.mgr.EnqueuePoint(f.point("BBBBBBB2", "pB", 3))
+	f.mgr.Pause("dev-BBBBBBB2", true)
+	queueA := f.mgr.getOrCreateQueue("dev-AAAAAAA1")
+	f.mgr.finishAttempt("dev-AAAAAAA1", queueA, queueA.Peek())
+	f.mgr.persist()
+	f.mgr.flushJournal()
+
+	g := newSchedFixture(t, 5, time.Second, "AAAAAAA1", "BBBBBBB2")
+	g.mgr.Stop()
+	if n := g.mgr.Restore(path); n != 3 {
+		t.Fatalf("expected 3 writes restored, got %d", n)
+	}
+	_, items := g.mgr.getOrCreateQueue("dev-AAAAAAA1").snapshot()
+	if len(items) != 2 || items[0].IoNumber != "UVP-4" || items[0].PointUUID != "" || items[1].PointUUID != "pA" {
+		t.Fatalf("queue A not restored in order: %+v", items)
+	}
+	if items[0].Retries != 1 || items[0].NotBefore == nil {
+		t.Fatalf("retries and backoff should survive a restart: %+v", items[0])
+	}
+	if status := g.mgr.QueueStatus("dev-BBBBBBB2"); !status.Paused || len(status.Items) != 1 {
+		t.Fatalf("queue B not restored paused: %+v", status)
+	}
+	if queued := g.mgr.QueuedPoints(); !queued["pA"] || !queued["pB"] {
+		t.Fatalf("unexpected queued points %v", queued)
+	}
+}
+
+func TestWriteJournal_BatchIsRequeuedUnanswered(t *testing.T) {
+	path := filepath.Join(t.TempDir(), writeJournalFile("net-1"))
+	f := newSchedFixture(t, 5, time.Second, "AAAAAAA1")
+	f.mgr.Stop()
+	f.mgr.mutex.Lock()
+	f.mgr.journalPath = path
+	f.mgr.mutex.Unlock()
+
+	queue := f.mgr.getOrCreateQueue("dev-AAAAAAA1")
+	for i := 0; i < 3; i++ {
+		p := f.point("AAAAAAA1", fmt.Sprintf("p%d", i), float64(i))
+		p.IoNumber = fmt.Sprintf("UVP-%d", 40+i)
+		f.mgr.EnqueueCommand(p, fmt.Sprintf("cmd-%d", i))
+	}
+	head := queue.Peek()
+	if err := f.mgr.prepareMessage(queue, head); err != nil || len(head.Batch) != 3 {
+		t.Fatalf("expected one batch of 3, got %d: %v", len(head.Batch), err)
+	}
+	if _, correlationID := f.mgr.AckPoint("dev-AAAAAAA1", head.MessageId, "UVP-41"); correlationID != "cmd-1" {
+		t.Fatalf("ack of a batched command write returned correlation %q", correlationID)
+	}
+	f.mgr.flushJournal()
+
+	g := newSchedFixture(t, 5, time.Second, "AAAAAAA1")
+	g.mgr.Stop()
+	if n := g.mgr.Restore(path); n != 2 {
+		t.Fatalf("the answered point must not be restored, got %d writes", n)
+	}
+	_, items := g.mgr.getOrCreateQueue("dev-AAAAAAA1").snapshot()
+	if len(items) != 2 || items[0].PointUUID != "p0" || items[1].PointUUID != "p2" || items[0].OnAir {
+		t.Fatalf("unexpected restored queue %+v", items)
+	}
+
+	// The restored writes keep their commands' correlation IDs, the batched
+	// one included.
+	queue = g.mgr.getOrCreateQueue("dev-AAAAAAA1")
+	head = queue.Peek()
+	if err := g.mgr.prepareMessage(queue, head); err != nil || len(head.Batch) != 2 {
+		t.Fatalf("expected the restored writes batched again: %v", err)
+	}
+	for i, ioNumber := range []string{"UVP-40", "UVP-42"} {
+		if _, correlationID := g.mgr.AckPoint("dev-AAAAAAA1", head.MessageId, ioNumber); correlationID != fmt.Sprintf("cmd-%d", i*2) {
+			t.Fatalf("%s acked with correlation %q after a restart", ioNumber, correlationID)
+		}
+	}
+}
+
+func TestWriteJournal_SavesAreCoalesced(t *testing.T) {
+	path := filepath.Join(t.TempDir(), writeJournalFile("net-1"))
+	f := newSchedFixture(t, 5, time.Second, "AAAAAAA1")
+	f.mgr.Stop()
+	f.mgr = NewPointWriteQueueManager(5, time.Second, 0, 0, f.mgr.getDevice, f.mgr.getEncryptionKey,
+		f.mgr.writeToLoRaRaw, nil, nil)
+	f.mgr.Restore(path)
+	f.mgr.Pause("dev-AAAAAAA1", true) // keep the writes off air
+
+	for i := 0; i < 10; i++ {
+		f.mgr.EnqueuePoint(f.point("AAAAAAA1", fmt.Sprintf("p%d", i), float64(i)))
+	}
+	var saved writeJournal
+	if err := loadState(path, &saved); err != nil || len(saved.Queues) != 0 {
+		t.Fatalf("writes must not be saved one by one, got %+v (%v)", saved, err)
+	}
+
+	// Stop saves the last changes.
+	f.mgr.Stop()
+	if err := loadState(path, &saved); err != nil || len(saved.Queues) != 1 || len(saved.Queues[0].Writes) != 10 {
+		t.Fatalf("Stop must save the pending changes, got %+v (%v)", saved, err)
+	}
+}
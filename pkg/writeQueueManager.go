@@ -1,7 +1,9 @@
 package pkg
 
 import (
+	"crypto/aes"
 	"errors"
+	"fmt"
 	"sync"
 	"time"
 
@@ -10,6 +12,7 @@ import (
 	"github.com/NubeIO/module-core-loraraw/codec"
 	"github.com/NubeIO/module-core-loraraw/codecs"
 	"github.com/NubeIO/module-core-loraraw/utils"
+	"github.com/NubeIO/nubeio-rubix-lib-models-go/datatype"
 	"github.com/NubeIO/nubeio-rubix-lib-models-go/model"
 	log "github.com/sirupsen/logrus"
 )
@@ -18,6 +21,57 @@ import (
 // port rejects a frame before it tries the next one.
 const serialWriteErrorBackoff = 2 * time.Second
 
+// maxRequestFrameLen is the largest encrypted REQUEST frame the radio can put
+// on air (the LoRa PHY payload limit). Batches are cut to fit it.
+const maxRequestFrameLen = 255
+
+// Write priority classes, most urgent first. A point's class comes from its
+// poll priority: asap for safety and commands, low for configuration.
+const (
+	writePriorityASAP = iota
+	writePriorityHigh
+	writePriorityNormal
+	writePriorityLow
+)
+
+var (
+	errWriteSuperseded = errors.New("superseded by a newer write to the point")
+	errWriteCancelled  = errors.New("write cancelled")
+	errWriteFlushed    = fmt.Errorf("%w: write queue flushed", errWriteCancelled)
+	// errWriteQueueChanged is returned by prepareMessage when a supersede,
+	// cancel or flush changed the queue while the batch was being encoded.
+	errWriteQueueChanged = errors.New("write queue changed while encoding the batch")
+)
+
+var writePriorityNames = []string{
+	writePriorityASAP:   string(datatype.PriorityASAP),
+	writePriorityHigh:   string(datatype.PriorityHigh),
+	writePriorityNormal: string(datatype.PriorityNormal),
+	writePriorityLow:    string(datatype.PriorityLow),
+}
+
+func writePriority(point *model.Point) int {
+	switch point.PollPriority {
+	case datatype.PriorityASAP:
+		return writePriorityASAP
+	case datatype.PriorityHigh:
+		return writePriorityHigh
+	case datatype.PriorityLow:
+		return writePriorityLow
+	}
+	return writePriorityNormal
+}
+
+// encryptedFrameLen is the on-air length of a REQUEST carrying payloadLen
+// bytes: address, AES-padded opts/nonce/length/payload, CMAC.
+func encryptedFrameLen(payloadLen int) int {
+	inner := 3 + payloadLen
+	if inner%aes.BlockSize != 0 {
+		inner += aes.BlockSize - inner%aes.BlockSize
+	}
+	return aesutils.LoraRawHeaderLen + inner + aesutils.LoraRawCmacLen
+}
+
 // ---------------------------------------------------
 // MANAGER — one queue per DeviceUUID, one scheduler for the radio.
 //
@@ -25,6 +79,11 @@ const serialWriteErrorBackoff = 2 * time.Second
 // RESPONSE. So exactly one frame is on air at a time, and after each
 // transmission the scheduler waits for that frame's RESPONSE (or the response
 // timeout) before it moves on to the next device's frame, round-robin.
+//
+// A write that got no RESPONSE is held back before its next attempt
+// (exponential backoff with jitter), and one the duty-cycle budget does not
+// allow yet (see dutyCycle) is held back until it fits; other devices' writes
+// go meanwhile.
 // ---------------------------------------------------
 
 type PointWriteQueueManager struct {
@@ -34,43 +93,72 @@ type PointWriteQueueManager struct {
 	mutex           sync.Mutex
 	maxRetry        int
 	responseTimeout time.Duration
+	backoffBase     time.Duration
+	backoffMax      time.Duration
+
+	// inFlight is the item the radio is held for, waiting for its RESPONSE
+	// until inFlightDeadline.
+	inFlight         *PendingPointWrite
+	inFlightDevice   string
+	inFlightDeadline time.Time
+
+	// journalPath is the file the queues are saved to (see Restore), by
+	// journalTimer once changed.
+	journalPath  string
+	journalTimer *time.Timer
+	journalMutex sync.Mutex
 
-	notify chan struct{}
-	stop   chan struct{}
-	once   sync.Once
+	notify  chan struct{}
+	stop    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
 
 	getDevice        func(string) (*model.Device, error)
 	getEncryptionKey func(*model.Device) ([]byte, error)
 	writeToLoRaRaw   func([]byte) error
-	onWriteExhausted func(*model.Point)
+	onWriteExhausted func(point *model.Point, correlationID string)
+	onWriteDropped   func(point *model.Point, correlationID string, err error)
 }
 
 func NewPointWriteQueueManager(
 	maxRetry int,
 	responseTimeout time.Duration,
+	backoffBase, backoffMax time.Duration,
 	getDevice func(string) (*model.Device, error),
 	getEncryptionKey func(*model.Device) ([]byte, error),
 	writeToLoRaRaw func([]byte) error,
-	onWriteExhausted func(*model.Point),
+	onWriteExhausted func(point *model.Point, correlationID string),
+	onWriteDropped func(point *model.Point, correlationID string, err error),
 ) *PointWriteQueueManager {
 	m := &PointWriteQueueManager{
 		queues:           make(map[string]*PointWriteQueue),
 		maxRetry:         maxRetry,
 		responseTimeout:  responseTimeout,
+		backoffBase:      backoffBase,
+		backoffMax:       backoffMax,
 		notify:           make(chan struct{}, 1),
 		stop:             make(chan struct{}),
+		stopped:          make(chan struct{}),
 		getDevice:        getDevice,
 		getEncryptionKey: getEncryptionKey,
 		writeToLoRaRaw:   writeToLoRaRaw,
 		onWriteExhausted: onWriteExhausted,
+		onWriteDropped:   onWriteDropped,
 	}
 	go m.schedule()
 	return m
 }
 
-// Stop ends the scheduler goroutine. Safe to call more than once.
+// Stop ends the scheduler goroutine, waits for it to return and saves the
+// queues' last changes. Safe to call more than once. The queues are no
+// longer saved after it: a restarted network has restored them.
 func (m *PointWriteQueueManager) Stop() {
 	m.once.Do(func() { close(m.stop) })
+	<-m.stopped
+	m.flushJournal()
+	m.mutex.Lock()
+	m.journalPath = ""
+	m.mutex.Unlock()
 }
 
 func (m *PointWriteQueueManager) getOrCreateQueue(deviceUUID string) *PointWriteQueue {
@@ -87,10 +175,52 @@ func (m *PointWriteQueueManager) getOrCreateQueue(deviceUUID string) *PointWrite
 	return queue
 }
 
+// EnqueuePoint queues a write. A queued write to the same point that has not
+// gone on air yet is superseded and reported dropped with errWriteSuperseded.
 func (m *PointWriteQueueManager) EnqueuePoint(point *model.Point) {
+	m.EnqueueCommand(point, "")
+}
+
+// EnqueueCommand queues the write of an MQTT write command; its outcome is
+// reported with correlationID.
+func (m *PointWriteQueueManager) EnqueueCommand(point *model.Point, correlationID string) {
 	queue := m.getOrCreateQueue(point.DeviceUUID)
-	queue.EnqueueWriteQueue(point)
+	_, superseded := queue.enqueue(point, correlationID)
+	m.persist()
 	m.wake()
+	for _, item := range superseded {
+		log.Infof("[%s] write to point %s superseded by a newer one", point.DeviceUUID, point.UUID)
+		if m.onWriteDropped != nil {
+			m.onWriteDropped(item.Point, item.CorrelationID, errWriteSuperseded)
+		}
+	}
+}
+
+// CancelPoint takes the queued writes to a point back and reports them
+// dropped with errWriteCancelled. A write already on air cannot be cancelled.
+func (m *PointWriteQueueManager) CancelPoint(deviceUUID, pointUUID string) (int, error) {
+	m.mutex.Lock()
+	queue, exists := m.queues[deviceUUID]
+	m.mutex.Unlock()
+	if !exists {
+		return 0, errors.New("no pending write for point " + pointUUID)
+	}
+
+	cancelled, onAir := queue.cancel(pointUUID)
+	m.persist()
+	for _, item := range cancelled {
+		log.Infof("[%s] write to point %s cancelled", deviceUUID, pointUUID)
+		if m.onWriteDropped != nil {
+			m.onWriteDropped(item.Point, item.CorrelationID, errWriteCancelled)
+		}
+	}
+	if len(cancelled) == 0 {
+		if onAir {
+			return 0, errors.New("write to point " + pointUUID + " is already on air")
+		}
+		return 0, errors.New("no pending write for point " + pointUUID)
+	}
+	return len(cancelled), nil
 }
 
 func (m *PointWriteQueueManager) wake() {
@@ -109,45 +239,75 @@ func (m *PointWriteQueueManager) DequeueUsingMessageId(deviceUUID string, messag
 	}
 
 	queue.mutex.Lock()
-	defer queue.mutex.Unlock()
-
 	item := queue.dequeue(&messageId)
+	queue.mutex.Unlock()
 	if item == nil {
 		log.Warnf("[%s] no pending point write found for messageId %v", deviceUUID, messageId)
 		return nil
 	}
+	m.persist()
 	return item.Point
 }
 
-// nextPending picks the next non-empty queue round-robin. Returns nil when
-// nothing is pending anywhere.
-func (m *PointWriteQueueManager) nextPending() (string, *PointWriteQueue, *PendingPointWrite) {
+// AckPoint resolves one field of a device RESPONSE against the in-flight
+// batch with that messageId and returns the point it answers, with the
+// CorrelationID of its write. The batch is done once every point in it has
+// been answered.
+func (m *PointWriteQueueManager) AckPoint(deviceUUID string, messageId uint8, ioNumber string) (*model.Point, string) {
+	m.mutex.Lock()
+	queue, exists := m.queues[deviceUUID]
+	m.mutex.Unlock()
+	if !exists {
+		return nil, ""
+	}
+
+	point, correlationID := queue.ackPoint(messageId, ioNumber)
+	if point == nil {
+		log.Warnf("[%s] no pending point write found for messageId %v (%s)", deviceUUID, messageId, ioNumber)
+		return nil, ""
+	}
+	m.persist()
+	return point, correlationID
+}
+
+// nextPending picks the next queue whose head may go on air, round-robin.
+// When none may, it returns how long until the first held-back head may (0
+// when nothing is pending anywhere).
+func (m *PointWriteQueueManager) nextPending() (string, *PointWriteQueue, *PendingPointWrite, time.Duration) {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
+	now := time.Now()
+	var first time.Time
 	n := len(m.order)
 	for i := 0; i < n; i++ {
 		idx := (m.rrIndex + i) % n
 		deviceUUID := m.order[idx]
 		queue := m.queues[deviceUUID]
-		if item := queue.Peek(); item != nil {
+		item, until := queue.PeekReady(now)
+		if item != nil {
 			m.rrIndex = idx + 1 // not modded: order may grow before the next pick
-			return deviceUUID, queue, item
+			return deviceUUID, queue, item, 0
+		}
+		if !until.IsZero() && (first.IsZero() || until.Before(first)) {
+			first = until
 		}
 	}
-	return "", nil, nil
+	if first.IsZero() {
+		return "", nil, nil, 0
+	}
+	return "", nil, nil, first.Sub(now)
 }
 
 func (m *PointWriteQueueManager) schedule() {
+	defer close(m.stopped)
 	for {
-		deviceUUID, queue, item := m.nextPending()
+		deviceUUID, queue, item, wait := m.nextPending()
 		if item == nil {
-			select {
-			case <-m.notify:
-				continue
-			case <-m.stop:
+			if !m.idle(wait) {
 				return
 			}
+			continue
 		}
 
 		select {
@@ -160,25 +320,65 @@ func (m *PointWriteQueueManager) schedule() {
 	}
 }
 
+// idle waits for a new write, or wait when it is not 0. It returns false once
+// the manager is stopped.
+func (m *PointWriteQueueManager) idle(wait time.Duration) bool {
+	var timeout <-chan time.Time
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-m.notify:
+	case <-timeout:
+	case <-m.stop:
+		return false
+	}
+	return true
+}
+
 // transmit sends one attempt of the item and blocks until it is acked or the
 // response timeout elapses.
 func (m *PointWriteQueueManager) transmit(deviceUUID string, queue *PointWriteQueue, item *PendingPointWrite) {
+	defer m.persist()
+
 	if item.Message == nil {
-		if err := m.prepareMessage(queue, item); err != nil {
+		err := m.prepareMessage(queue, item)
+		if errors.Is(err, errWriteQueueChanged) {
+			// Nothing is wrong with the head: it stays queued, and if it is
+			// still the head the batch is built again from the queue as it is
+			// now on its next pick. Whoever took it out has reported it.
+			log.Debugf("[%s] write queue changed while encoding point %s, re-batching", deviceUUID, item.Point.UUID)
+			return
+		}
+		if err != nil {
 			// Device gone, bad key or unencodable point: nothing to retry.
 			log.Errorf("[%s] dropping write for point %s: %s", deviceUUID, item.Point.UUID, err.Error())
-			queue.RemoveItem(item)
+			if queue.RemoveItem(item) && m.onWriteDropped != nil {
+				m.onWriteDropped(item.Point, item.CorrelationID, err)
+			}
 			return
 		}
 	}
 
 	if err := m.writeToLoRaRaw(item.Message); err != nil {
+		var dutyCycleErr *DutyCycleError
+		if errors.As(err, &dutyCycleErr) {
+			m.holdForDutyCycle(deviceUUID, queue, item, dutyCycleErr)
+			return
+		}
 		log.Errorf("[%s] error writing to LoRa serial port: %v", deviceUUID, err)
 		m.finishAttempt(deviceUUID, queue, item)
-		time.Sleep(serialWriteErrorBackoff)
+		select {
+		case <-m.stop:
+		case <-time.After(serialWriteErrorBackoff):
+		}
 		return
 	}
 
+	m.setInFlight(deviceUUID, item, time.Now().Add(m.responseTimeout))
+	defer m.setInFlight("", nil, time.Time{})
 	timer := time.NewTimer(m.responseTimeout)
 	defer timer.Stop()
 	select {
@@ -195,21 +395,56 @@ func (m *PointWriteQueueManager) transmit(deviceUUID string, queue *PointWriteQu
 	}
 }
 
+func (m *PointWriteQueueManager) setInFlight(deviceUUID string, item *PendingPointWrite, deadline time.Time) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.inFlight, m.inFlightDevice, m.inFlightDeadline = item, deviceUUID, deadline
+}
+
+// holdForDutyCycle holds the item back until the duty-cycle budget allows
+// it, without counting an attempt, or drops it when it can never fit.
+func (m *PointWriteQueueManager) holdForDutyCycle(deviceUUID string, queue *PointWriteQueue, item *PendingPointWrite, err *DutyCycleError) {
+	if !err.Never {
+		log.Warnf("[%s] write for point %s deferred %s: %s", deviceUUID, item.Point.UUID, err.Wait.Round(time.Millisecond), err)
+		queue.holdBack(item, time.Now().Add(err.Wait))
+		return
+	}
+	log.Errorf("[%s] dropping write for point %s: %s", deviceUUID, item.Point.UUID, err)
+	writes := queue.unacked(item)
+	if !queue.RemoveItem(item) || m.onWriteDropped == nil {
+		return
+	}
+	for _, write := range writes {
+		m.onWriteDropped(write.point, write.correlationID, err)
+	}
+}
+
 // finishAttempt records a failed attempt and gives up on the item once
-// maxRetry attempts have been made.
+// maxRetry attempts have been made. Otherwise the item is held back for the
+// retry backoff.
 func (m *PointWriteQueueManager) finishAttempt(deviceUUID string, queue *PointWriteQueue, item *PendingPointWrite) {
-	if queue.IncRetry(item) < m.maxRetry {
+	if retry := queue.IncRetry(item); retry < m.maxRetry {
+		if backoff := retryBackoff(retry, m.backoffBase, m.backoffMax); backoff > 0 {
+			queue.holdBack(item, time.Now().Add(backoff))
+		}
 		return
 	}
+	writes := queue.unacked(item)
 	if !queue.RemoveItem(item) {
 		return
 	}
-	log.Warnf("[%s] write to point %s exhausted after %d attempts", deviceUUID, item.Point.UUID, m.maxRetry)
-	if m.onWriteExhausted != nil {
-		m.onWriteExhausted(item.Point)
+	for _, write := range writes {
+		log.Warnf("[%s] write to point %s exhausted after %d attempts", deviceUUID, write.point.UUID, m.maxRetry)
+		if m.onWriteExhausted != nil {
+			m.onWriteExhausted(write.point, write.correlationID)
+		}
 	}
 }
 
+// prepareMessage encodes the head write, merging in as many of the device's
+// other queued writes as fit in one frame, and stores the encrypted frame on
+// the head item.
 func (m *PointWriteQueueManager) prepareMessage(queue *PointWriteQueue, item *PendingPointWrite) error {
 	device, err := m.getDevice(item.Point.DeviceUUID)
 	if err != nil {
@@ -221,15 +456,32 @@ func (m *PointWriteQueueManager) prepareMessage(queue *PointWriteQueue, item *Pe
 		return errors.New("error extracting encryption key: " + err.Error())
 	}
 
-	// TEMPORARY ARRAY UNTIL WE HANDLE MULTI POINT WRITE
-	points := []*model.Point{item.Point}
 	deviceDescription := codec.GetDeviceDescription(device, codecs.LoRaDeviceDescriptions)
+	if deviceDescription.EncodeRequestMessage == nil {
+		return errors.New("device model " + device.Model + " does not support writes")
+	}
 
+	points := []*model.Point{item.Point}
 	payload, err := deviceDescription.EncodeRequestMessage(points)
 	if err != nil {
 		return errors.New("error encoding request: " + err.Error())
 	}
 
+	var merged []*PendingPointWrite
+	for _, candidate := range queue.batchCandidates(item) {
+		batchPayload, err := deviceDescription.EncodeRequestMessage(append(points, candidate.Point))
+		if err != nil {
+			// Leave it queued; it fails on its own once it reaches the head.
+			continue
+		}
+		if encryptedFrameLen(len(batchPayload)) > maxRequestFrameLen {
+			break
+		}
+		points = append(points, candidate.Point)
+		merged = append(merged, candidate)
+		payload = batchPayload
+	}
+
 	messageID := utils.GenerateRandomId()
 	completePacket, err := aesutils.Encrypt(
 		nstring.DerefString(item.Point.AddressUUID), // Note this is the device loraraw unique address
@@ -242,6 +494,11 @@ func (m *PointWriteQueueManager) prepareMessage(queue *PointWriteQueue, item *Pe
 		return errors.New("error encrypting data: " + err.Error())
 	}
 
-	queue.SetMessage(item, messageID, completePacket)
+	if !queue.absorb(item, merged, messageID, completePacket) {
+		return errWriteQueueChanged
+	}
+	if len(merged) > 0 {
+		log.Infof("[%s] batched %d point writes into messageId %d", item.Point.DeviceUUID, len(points), messageID)
+	}
 	return nil
 }
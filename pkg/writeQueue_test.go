@@ -2,12 +2,17 @@ package pkg
 
 import (
 	"errors"
+	"fmt"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/NubeIO/module-core-loraraw/codec"
+	"github.com/NubeIO/module-core-loraraw/codecs"
+	"github.com/NubeIO/module-core-loraraw/codecs/rubixDataEncoding"
 	"github.com/NubeIO/module-core-loraraw/schema"
 	"github.com/NubeIO/module-core-loraraw/utils"
+	"github.com/NubeIO/nubeio-rubix-lib-models-go/datatype"
 	"github.com/NubeIO/nubeio-rubix-lib-models-go/model"
 )
 
@@ -21,6 +26,8 @@ type txRecorder struct {
 	mgr    *PointWriteQueueManager
 	uuidBy map[string]string // address hex -> device uuid
 	failN  int               // first N writes fail with a serial error
+	holdN  int               // then N writes are deferred by the duty cycle
+	hold   time.Duration
 	notify chan txFrame
 }
 
@@ -37,6 +44,11 @@ func (r *txRecorder) write(data []byte) error {
 		r.mu.Unlock()
 		return errors.New("serial down")
 	}
+	if r.holdN > 0 {
+		r.holdN--
+		r.mu.Unlock()
+		return &DutyCycleError{Airtime: 50 * time.Millisecond, Wait: r.hold}
+	}
 	// The nonce/messageId sits inside the encrypted body, so read it off the
 	// queue head (SetMessage runs before writeToLoRaRaw) instead of the wire.
 	address := string(data[:utils.LORARAW_HEADER_LEN])
@@ -109,11 +121,11 @@ func newSchedFixture(t *testing.T, maxRetry int, responseTimeout time.Duration,
 	getKey := func(*model.Device) ([]byte, error) {
 		return []byte("0123456789abcdef"), nil
 	}
-	f.mgr = NewPointWriteQueueManager(maxRetry, responseTimeout, getDevice, getKey, f.rec.write, func(p *model.Point) {
+	f.mgr = NewPointWriteQueueManager(maxRetry, responseTimeout, 0, 0, getDevice, getKey, f.rec.write, func(p *model.Point, _ string) {
 		f.exMu.Lock()
 		f.exhausted = append(f.exhausted, p)
 		f.exMu.Unlock()
-	})
+	}, nil)
 	f.rec.mgr = f.mgr
 	t.Cleanup(f.mgr.Stop)
 	return f
@@ -282,6 +294,27 @@ func TestScheduler_SerialWriteErrorCountsAsAttempt(t *testing.T) {
 	}
 }
 
+func TestScheduler_StopDoesNotWaitOutSerialErrorBackoff(t *testing.T) {
+	f := newSchedFixture(t, 5, 100*time.Millisecond, "AAAAAAA1")
+	f.rec.mu.Lock()
+	f.rec.failN = 1
+	f.rec.mu.Unlock()
+
+	f.mgr.EnqueuePoint(f.point("AAAAAAA1", "pA", 2))
+	if !waitFor(t, time.Second, func() bool {
+		_, items := f.mgr.getOrCreateQueue("dev-AAAAAAA1").snapshot()
+		return len(items) == 1 && items[0].Retries == 1
+	}) {
+		t.Fatal("the serial error should count as an attempt")
+	}
+
+	start := time.Now()
+	f.mgr.Stop()
+	if elapsed := time.Since(start); elapsed >= serialWriteErrorBackoff/2 {
+		t.Fatalf("Stop waited %s for the serial error backoff", elapsed)
+	}
+}
+
 func TestScheduler_UnknownDeviceIsDropped(t *testing.T) {
 	f := newSchedFixture(t, 5, time.Second, "AAAAAAA1")
 	p := f.point("AAAAAAA1", "ghost", 1)
@@ -303,27 +336,338 @@ func TestScheduler_UnknownDeviceIsDropped(t *testing.T) {
 }
 
 func TestSerialWriteQueue_RestartsAfterStop(t *testing.T) {
-	m := &Module{}
+	n := &loRaNetwork{}
 
-	m.initWriteQueue()
-	first := m.getWriteQueue()
+	n.initWriteQueue()
+	first := n.getWriteQueue()
 	if first == nil {
 		t.Fatalf("initWriteQueue should create the send channel")
 	}
-	if m.getWriteQueue() != first {
+	if n.getWriteQueue() != first {
 		t.Fatalf("second init must reuse the running queue")
 	}
 
-	m.stopWriteQueue()
-	if m.getWriteQueue() != nil {
+	n.stopWriteQueue()
+	if n.getWriteQueue() != nil {
 		t.Fatalf("stopWriteQueue should drop the send channel")
 	}
-	m.stopWriteQueue() // idempotent
+	n.stopWriteQueue() // idempotent
 
-	m.initWriteQueue()
-	second := m.getWriteQueue()
+	n.initWriteQueue()
+	second := n.getWriteQueue()
 	if second == nil || second == first {
 		t.Fatalf("init after stop must create a fresh queue")
 	}
-	m.stopWriteQueue()
+	n.stopWriteQueue()
+}
+
+func TestScheduler_BatchesPendingWritesForOneDevice(t *testing.T) {
+	f := newSchedFixture(t, 5, time.Second, "AAAAAAA1")
+	f.mgr.Stop() // drive prepareMessage by hand
+
+	queue := f.mgr.getOrCreateQueue("dev-AAAAAAA1")
+	var points []*model.Point
+	for i, io := range []string{"UVP-40", "UVP-41", "UVP-40", "UVP-42"} {
+		p := f.point("AAAAAAA1", fmt.Sprintf("p%d", i), float64(i))
+		p.IoNumber = io
+		points = append(points, p)
+		queue.EnqueueWriteQueue(p)
+	}
+
+	head := queue.Peek()
+	if err := f.mgr.prepareMessage(queue, head); err != nil {
+		t.Fatalf("prepareMessage: %s", err)
+	}
+	// The second UVP-40 write must wait for the first one to be answered.
+	if len(head.Batch) != 3 || queue.Size() != 2 {
+		t.Fatalf("expected 3 points in the batch and 2 queued items, got %d and %d", len(head.Batch), queue.Size())
+	}
+
+	if p, _ := f.mgr.AckPoint("dev-AAAAAAA1", head.MessageId, "UVP-43"); p != nil {
+		t.Fatalf("a field that is not in the batch must not ack a write, got %+v", p)
+	}
+	if p, _ := f.mgr.AckPoint("dev-AAAAAAA1", head.MessageId, "UVP-42"); p != points[3] {
+		t.Fatalf("UVP-42 field should resolve to its own point, got %+v", p)
+	}
+	if p, _ := f.mgr.AckPoint("dev-AAAAAAA1", head.MessageId, "UVP-40"); p != points[0] {
+		t.Fatalf("UVP-40 field should resolve to the first UVP-40 write, got %+v", p)
+	}
+	if queue.Peek() != head {
+		t.Fatalf("batch must stay in flight until every point is answered")
+	}
+	if p, _ := f.mgr.AckPoint("dev-AAAAAAA1", head.MessageId, "UVP-40"); p != nil {
+		t.Fatalf("the batch's UVP-40 write is answered already, got %+v", p)
+	}
+	if queue.Peek() != head || len(queue.unacked(head)) != 1 {
+		t.Fatalf("UVP-41 must stay unanswered")
+	}
+	if p, _ := f.mgr.AckPoint("dev-AAAAAAA1", head.MessageId, "UVP-41"); p != points[1] {
+		t.Fatalf("UVP-41 field should resolve to its own point, got %+v", p)
+	}
+	if next := queue.Peek(); next == nil || next.Point != points[2] {
+		t.Fatalf("the held-back UVP-40 write should be next once the batch is acked")
+	}
+}
+
+func TestScheduler_SupersedeWhileEncodingKeepsTheHead(t *testing.T) {
+	f := newSchedFixture(t, 5, time.Second, "AAAAAAA1")
+	f.mgr.Stop()
+	var dropped []*model.Point
+	var errs []error
+	f.mgr.onWriteDropped = func(p *model.Point, _ string, err error) {
+		dropped = append(dropped, p)
+		errs = append(errs, err)
+	}
+
+	// An operator moves the UVP-41 setpoint while the batch is being encoded.
+	newer := f.point("AAAAAAA1", "setpoint", 22)
+	newer.IoNumber = "UVP-41"
+	superseded := false
+	codecs.SetFileDeviceDescriptions([]codec.LoRaDeviceDescription{{
+		Model: "RaceModel",
+		EncodeRequestMessage: func(points []*model.Point) ([]byte, error) {
+			if len(points) > 1 && !superseded {
+				superseded = true
+				f.mgr.EnqueuePoint(newer)
+			}
+			return rubixDataEncoding.EncodeRequestMessage(points)
+		},
+	}})
+	t.Cleanup(func() { codecs.SetFileDeviceDescriptions(nil) })
+	f.devices["dev-AAAAAAA1"].Model = "RaceModel"
+
+	queue := f.mgr.getOrCreateQueue("dev-AAAAAAA1")
+	head := f.point("AAAAAAA1", "other", 1)
+	head.IoNumber = "UVP-40"
+	f.mgr.EnqueuePoint(head)
+	old := f.point("AAAAAAA1", "setpoint", 21)
+	old.IoNumber = "UVP-41"
+	f.mgr.EnqueuePoint(old)
+
+	f.mgr.transmit("dev-AAAAAAA1", queue, queue.Peek())
+	if len(dropped) != 1 || dropped[0] != old || !errors.Is(errs[0], errWriteSuperseded) {
+		t.Fatalf("only the superseded write may be reported, got %v", errs)
+	}
+	if queue.Peek() == nil || queue.Peek().Point != head || queue.Peek().Message != nil {
+		t.Fatal("the head must stay queued, unsent, when the queue changes under its batch")
+	}
+	if f.rec.count() != 0 {
+		t.Fatalf("nothing may go on air from a stale batch, got %d frames", f.rec.count())
+	}
+
+	// The next pick batches the head with the newer write.
+	if err := f.mgr.prepareMessage(queue, queue.Peek()); err != nil {
+		t.Fatal(err)
+	}
+	if batch := queue.Peek().Batch; len(batch) != 2 || batch[0] != head || batch[1] != newer {
+		t.Fatalf("expected the head batched with the newer write, got %v", batch)
+	}
+}
+
+func TestScheduler_BatchIsCutAtFrameLimit(t *testing.T) {
+	f := newSchedFixture(t, 5, time.Second, "AAAAAAA1")
+	f.mgr.Stop()
+
+	queue := f.mgr.getOrCreateQueue("dev-AAAAAAA1")
+	for i := 1; i <= 64; i++ {
+		p := f.point("AAAAAAA1", fmt.Sprintf("p%d", i), float64(i))
+		p.IoNumber = fmt.Sprintf("UVP-%d", i)
+		p.DataType = "41" // MDK_DOUBLE: 64 of them cannot fit in one frame
+		queue.EnqueueWriteQueue(p)
+	}
+
+	head := queue.Peek()
+	if err := f.mgr.prepareMessage(queue, head); err != nil {
+		t.Fatalf("prepareMessage: %s", err)
+	}
+	if len(head.Message) > maxRequestFrameLen {
+		t.Fatalf("frame of %d bytes exceeds the %d byte limit", len(head.Message), maxRequestFrameLen)
+	}
+	if len(head.Batch) < 2 || len(head.Batch) == 64 {
+		t.Fatalf("expected the batch to be cut short of all 64 writes, got %d", len(head.Batch))
+	}
+	if len(head.Batch)+queue.Size()-1 != 64 {
+		t.Fatalf("no write may be lost: %d batched, %d still queued", len(head.Batch), queue.Size()-1)
+	}
+}
+
+func TestScheduler_ExhaustedBatchReportsEveryPoint(t *testing.T) {
+	f := newSchedFixture(t, 1, 50*time.Millisecond, "AAAAAAA1")
+	f.mgr.Stop()
+
+	queue := f.mgr.getOrCreateQueue("dev-AAAAAAA1")
+	for _, io := range []string{"UVP-1", "UVP-2"} {
+		p := f.point("AAAAAAA1", io, 1)
+		p.IoNumber = io
+		queue.EnqueueWriteQueue(p)
+	}
+
+	head := queue.Peek()
+	if err := f.mgr.prepareMessage(queue, head); err != nil {
+		t.Fatalf("prepareMessage: %s", err)
+	}
+	f.mgr.finishAttempt("dev-AAAAAAA1", queue, head)
+
+	f.exMu.Lock()
+	defer f.exMu.Unlock()
+	if len(f.exhausted) != 2 {
+		t.Fatalf("both batched points should be reported exhausted, got %d", len(f.exhausted))
+	}
+}
+
+func TestNetworks_WritesRouteToTheirOwnScheduler(t *testing.T) {
+	m := &Module{config: &Config{WriteQueueMaxRetries: 1, WriteResponseTimeout: time.Second}}
+	netA, netB := newLoRaNetwork(m, "net-a"), newLoRaNetwork(m, "net-b")
+	netA.pointWriteQueueManager.Stop()
+	netB.pointWriteQueueManager.Stop()
+	m.networks = map[string]*loRaNetwork{"net-a": netA, "net-b": netB}
+
+	point := &model.Point{DeviceUUID: "dev-1", IoNumber: "UVP-1"}
+	if err := m.enqueuePointOnNetwork("net-b", point, ""); err != nil {
+		t.Fatalf("enqueue on a running network: %s", err)
+	}
+	if netB.pointWriteQueueManager.getOrCreateQueue("dev-1").Size() != 1 {
+		t.Fatalf("write should be queued on network B")
+	}
+	if netA.pointWriteQueueManager.getOrCreateQueue("dev-1").Size() != 0 {
+		t.Fatalf("network A must not see network B's writes")
+	}
+	if err := m.enqueuePointOnNetwork("net-c", point, ""); err == nil {
+		t.Fatalf("enqueue on an unknown network must fail")
+	}
+	if err := m.WriteToLoRaRaw("net-c", []byte{1}); err == nil {
+		t.Fatalf("raw write on an unknown network must fail")
+	}
+}
+
+func TestScheduler_DutyCycleHoldsWriteWithoutAttempt(t *testing.T) {
+	const hold = 200 * time.Millisecond
+	f := newSchedFixture(t, 1, time.Second, "AAAAAAA1")
+	f.setAck("AAAAAAA1", true)
+	f.rec.mu.Lock()
+	f.rec.holdN = 1
+	f.rec.hold = hold
+	f.rec.mu.Unlock()
+
+	start := time.Now()
+	f.mgr.EnqueuePoint(f.point("AAAAAAA1", "pA", 2))
+
+	if !waitFor(t, 2*time.Second, func() bool { return f.rec.count() == 1 }) {
+		t.Fatalf("write should go once the budget allows it")
+	}
+	if gap := f.rec.snapshot()[0].at.Sub(start); gap < hold {
+		t.Fatalf("write went %s after it was queued; must wait the %s the budget asked", gap, hold)
+	}
+	f.exMu.Lock()
+	defer f.exMu.Unlock()
+	if len(f.exhausted) != 0 {
+		t.Fatalf("a deferred write is not a failed attempt")
+	}
+}
+
+func TestScheduler_RetryBackoffHoldsHead(t *testing.T) {
+	f := newSchedFixture(t, 5, time.Second, "AAAAAAA1", "BBBBBBB2")
+	f.mgr.Stop()
+	f.mgr.backoffBase = 400 * time.Millisecond
+	f.mgr.backoffMax = time.Second
+
+	queueA := f.mgr.getOrCreateQueue("dev-AAAAAAA1")
+	queueB := f.mgr.getOrCreateQueue("dev-BBBBBBB2")
+	itemA := queueA.EnqueueWriteQueue(f.point("AAAAAAA1", "pA", 1))
+	queueB.EnqueueWriteQueue(f.point("BBBBBBB2", "pB", 2))
+
+	f.mgr.finishAttempt("dev-AAAAAAA1", queueA, itemA)
+	now := time.Now()
+	if item, until := queueA.PeekReady(now); item != nil || until.Sub(now) < 200*time.Millisecond || until.Sub(now) > 400*time.Millisecond {
+		t.Fatalf("first retry should be held 200-400ms, got item %v until +%s", item, until.Sub(now))
+	}
+	uuid, _, itemB, _ := f.mgr.nextPending()
+	if itemB == nil || uuid != "dev-BBBBBBB2" {
+		t.Fatalf("another device's write should go while A backs off, got %q", uuid)
+	}
+	queueB.RemoveItem(itemB)
+	if _, _, item, wait := f.mgr.nextPending(); item != nil || wait <= 0 {
+		t.Fatalf("with A held back nothing is ready, expected a wait, got %v %s", item, wait)
+	}
+}
+
+func TestWriteQueue_CoalescesWritesToOnePoint(t *testing.T) {
+	f := newSchedFixture(t, 5, time.Second, "AAAAAAA1")
+	f.mgr.Stop()
+	var dropped []error
+	f.mgr.onWriteDropped = func(p *model.Point, _ string, err error) { dropped = append(dropped, err) }
+
+	queue := f.mgr.getOrCreateQueue("dev-AAAAAAA1")
+	f.mgr.EnqueuePoint(f.point("AAAAAAA1", "setpoint", 20))
+	f.mgr.EnqueuePoint(f.point("AAAAAAA1", "setpoint", 21))
+	last := f.point("AAAAAAA1", "setpoint", 22)
+	f.mgr.EnqueuePoint(last)
+
+	if queue.Size() != 1 || queue.Peek().Point != last {
+		t.Fatalf("expected only the latest write queued, got %d items", queue.Size())
+	}
+	if len(dropped) != 2 || !errors.Is(dropped[0], errWriteSuperseded) {
+		t.Fatalf("superseded writes should be reported, got %v", dropped)
+	}
+
+	// Once on air the write stays; a newer one queues behind it.
+	if err := f.mgr.prepareMessage(queue, queue.Peek()); err != nil {
+		t.Fatal(err)
+	}
+	f.mgr.EnqueuePoint(f.point("AAAAAAA1", "setpoint", 23))
+	if queue.Size() != 2 || queue.Peek().Point != last {
+		t.Fatalf("a write on air must not be superseded")
+	}
+}
+
+func TestWriteQueue_PriorityClasses(t *testing.T) {
+	f := newSchedFixture(t, 5, time.Second, "AAAAAAA1")
+	f.mgr.Stop()
+
+	queue := f.mgr.getOrCreateQueue("dev-AAAAAAA1")
+	enqueue := func(uuid, io string, priority datatype.PollPriority) {
+		p := f.point("AAAAAAA1", uuid, 1)
+		p.IoNumber = io
+		p.PollPriority = priority
+		f.mgr.EnqueuePoint(p)
+	}
+	enqueue("config", "UVP-40", datatype.PriorityLow)
+	enqueue("normal", "UVP-41", "")
+	enqueue("command", "UVP-42", datatype.PriorityASAP)
+	enqueue("urgent", "UVP-40", datatype.PriorityASAP) // must not overtake the UVP-40 config write
+
+	var order []string
+	for _, item := range queue.writeQueue {
+		order = append(order, item.Point.UUID)
+	}
+	if fmt.Sprint(order) != "[command normal config urgent]" {
+		t.Fatalf("unexpected queue order %v", order)
+	}
+}
+
+func TestWriteQueue_CancelPoint(t *testing.T) {
+	f := newSchedFixture(t, 5, time.Second, "AAAAAAA1")
+	f.mgr.Stop()
+	var dropped []error
+	f.mgr.onWriteDropped = func(p *model.Point, _ string, err error) { dropped = append(dropped, err) }
+
+	queue := f.mgr.getOrCreateQueue("dev-AAAAAAA1")
+	f.mgr.EnqueuePoint(f.point("AAAAAAA1", "pA", 1))
+	if err := f.mgr.prepareMessage(queue, queue.Peek()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.mgr.CancelPoint("dev-AAAAAAA1", "pA"); err == nil {
+		t.Fatalf("a write on air cannot be cancelled")
+	}
+
+	f.mgr.EnqueuePoint(f.point("AAAAAAA1", "pB", 2))
+	if n, err := f.mgr.CancelPoint("dev-AAAAAAA1", "pB"); err != nil || n != 1 {
+		t.Fatalf("CancelPoint = %d, %v", n, err)
+	}
+	if queue.Size() != 1 || len(dropped) != 1 || !errors.Is(dropped[0], errWriteCancelled) {
+		t.Fatalf("cancelled write should leave the queue and be reported, got %d queued, %v", queue.Size(), dropped)
+	}
+	if _, err := f.mgr.CancelPoint("dev-AAAAAAA1", "pB"); err == nil {
+		t.Fatalf("nothing left to cancel")
+	}
 }
@@ -32,8 +32,11 @@ type DeviceSchema struct {
 	DeviceKey     DeviceKey                       `json:"manufacture" type:"secret"`
 }
 
-func GetDeviceSchema() *DeviceSchema {
+// GetDeviceSchema lists the built-in models followed by extraModels (models
+// loaded from codec files).
+func GetDeviceSchema(extraModels ...string) *DeviceSchema {
 	models := []string{DeviceModelTHLM, DeviceModelTHL, DeviceModelTH, DeviceModelMicroEdgeV1, DeviceModelMicroEdgeV2, DeviceModelZiptHydroTap, DeviceModelRubix, DeviceModelUART, DeviceModelRubixEncrypted}
+	models = append(models, extraModels...)
 	m := &DeviceSchema{}
 	m.AddressUUID.Min = 8
 	m.AddressUUID.Max = 8
@@ -10,8 +10,12 @@ type NetworkSchema struct {
 	Description    schema.Description    `json:"description"`
 	Enable         schema.Enable         `json:"enable"`
 	PluginName     schema.PluginName     `json:"plugin_name"`
+	TransportType  TransportTypeLora     `json:"transport_type"`
 	SerialPort     SerialPortLora        `json:"serial_port"`
 	SerialBaudRate schema.SerialBaudRate `json:"serial_baud_rate"`
+	IP             IPLora                `json:"ip"`
+	Port           PortLora              `json:"port"`
+	Host           HostLora              `json:"host"`
 	HistoryEnable  schema.HistoryEnable  `json:"history_enable"`
 }
 
@@ -29,3 +33,36 @@ type SerialPortLora struct {
 	Default  string   `json:"default" default:"/data/socat/LoRa1"`
 	ReadOnly bool     `json:"readOnly" default:"false"`
 }
+
+type TransportTypeLora struct {
+	Type     string   `json:"type" default:"string"`
+	Title    string   `json:"title" default:"Transport Type"`
+	Options  []string `json:"enum" default:"[\"serial\",\"tcp-client\",\"tcp-server\",\"udp\"]"`
+	EnumName []string `json:"enumNames" default:"[\"Serial radio\",\"TCP client (connect to radio bridge)\",\"TCP server (radio bridge connects in)\",\"UDP\"]"`
+	Default  string   `json:"default" default:"serial"`
+	ReadOnly bool     `json:"readOnly" default:"false"`
+}
+
+type IPLora struct {
+	Type     string `json:"type" default:"string"`
+	Title    string `json:"title" default:"IP Address"`
+	Default  string `json:"default" default:""`
+	Help     string `json:"help" default:"tcp-client: the radio bridge to connect to; tcp-server/udp: local address to listen on (empty for all)"`
+	ReadOnly bool   `json:"readOnly" default:"false"`
+}
+
+type HostLora struct {
+	Type     string `json:"type" default:"string"`
+	Title    string `json:"title" default:"Radio Bridge"`
+	Default  string `json:"default" default:""`
+	Help     string `json:"help" default:"tcp-server/udp: IP (or IP:port) of the only radio bridge accepted; empty accepts the first one"`
+	ReadOnly bool   `json:"readOnly" default:"false"`
+}
+
+type PortLora struct {
+	Type     string `json:"type" default:"number"`
+	Title    string `json:"title" default:"Port"`
+	Default  int    `json:"default" default:"1700"`
+	Help     string `json:"help" default:"tcp/udp port, not used for serial"`
+	ReadOnly bool   `json:"readOnly" default:"false"`
+}